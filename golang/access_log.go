@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Locals keys handlers use to annotate a request for the access log
+const (
+	localRequestID    = "requestid"
+	localCacheOutcome = "cacheOutcome"
+	localUserSegment  = "userSegment"
+	// localError is the error writeError answered the request with
+	localError = "error"
+)
+
+// Header load scripts set to tag requests with the benchmark phase
+// (warmup, steady, spike, ...)
+const headerRunPhase = "X-Run-Phase"
+
+// accessLogStdout is the ACCESS_LOG_PATH value that sends records to
+// stdout through the structured logger instead of a rotated file
+const accessLogStdout = "stdout"
+
+var accessLogDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "access_log_dropped_total",
+	Help: "Access log records dropped because the write buffer was full.",
+})
+
+type AccessLogConfig struct {
+	Path string
+	// SampleRate is the fraction of fast 2xx responses logged (0..1).
+	// Non-2xx responses and those slower than SlowThreshold always are.
+	SampleRate    float64
+	SlowThreshold time.Duration
+	// Format is "json" or "text"; files are always JSON so logstats can
+	// read them
+	Format        string
+	MaxSizeBytes  int64
+	MaxAge        time.Duration
+	BufferRecords int
+}
+
+type AccessLogRecord struct {
+	Time      time.Time
+	RequestID string
+	Method    string
+	Route     string
+	Status    int
+	Duration  time.Duration
+	Bytes     int
+	Cache     string
+	Segment   string
+	Phase     string
+}
+
+func (r AccessLogRecord) attrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, 10)
+	if r.RequestID != "" {
+		attrs = append(attrs, slog.String("request_id", r.RequestID))
+	}
+	attrs = append(attrs,
+		slog.String("method", r.Method),
+		slog.String("route", r.Route),
+		slog.Int("status", r.Status),
+		slog.Float64("duration_ms", float64(r.Duration.Microseconds())/1000),
+		slog.Int("bytes", r.Bytes),
+	)
+	if r.Cache != "" {
+		attrs = append(attrs, slog.String("cache", r.Cache))
+	}
+	if r.Segment != "" {
+		attrs = append(attrs, slog.String("segment", r.Segment))
+	}
+	if r.Phase != "" {
+		attrs = append(attrs, slog.String("phase", r.Phase))
+	}
+	return attrs
+}
+
+// AccessLogger emits sampled records through a slog.Logger from a single
+// background goroutine. Requests never block on output: when the buffer is
+// full the record is dropped and counted.
+type AccessLogger struct {
+	cfg     AccessLogConfig
+	records chan AccessLogRecord
+	done    chan struct{}
+	closeMu sync.Once
+
+	out    *rotatingWriter
+	logger *slog.Logger
+}
+
+func NewAccessLogger(cfg AccessLogConfig) (*AccessLogger, error) {
+	if cfg.BufferRecords < 1 {
+		cfg.BufferRecords = 8192
+	}
+	out, err := newRotatingWriter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	format := cfg.Format
+	if cfg.Path != accessLogStdout {
+		format = "json"
+	}
+	l := &AccessLogger{
+		cfg:     cfg,
+		records: make(chan AccessLogRecord, cfg.BufferRecords),
+		done:    make(chan struct{}),
+		out:     out,
+		logger:  newAccessSlog(out, format),
+	}
+	go l.run()
+	return l, nil
+}
+
+// newAccessSlog keeps the JSON keys logstats expects: the record time is
+// "ts" and the level is dropped
+func newAccessSlog(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "ts"
+			case slog.LevelKey:
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+func (l *AccessLogger) sampled(status int, elapsed time.Duration) bool {
+	if status < 200 || status >= 300 {
+		return true
+	}
+	if l.cfg.SlowThreshold > 0 && elapsed >= l.cfg.SlowThreshold {
+		return true
+	}
+	return l.cfg.SampleRate > 0 && rand.Float64() < l.cfg.SampleRate
+}
+
+func (l *AccessLogger) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		elapsed := time.Since(start)
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fe, ok := err.(*fiber.Error); ok {
+				status = fe.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		if !l.sampled(status, elapsed) {
+			return err
+		}
+
+		rec := AccessLogRecord{
+			Time:     start,
+			Method:   c.Method(),
+			Route:    c.Route().Path,
+			Status:   status,
+			Duration: elapsed,
+			Bytes:    len(c.Response().Body()),
+			Phase:    c.Get(headerRunPhase),
+		}
+		if v, ok := c.Locals(localRequestID).(string); ok {
+			rec.RequestID = v
+		}
+		if v, ok := c.Locals(localCacheOutcome).(string); ok {
+			rec.Cache = v
+		}
+		if v, ok := c.Locals(localUserSegment).(string); ok {
+			rec.Segment = v
+		}
+
+		select {
+		case l.records <- rec:
+		default:
+			accessLogDropped.Inc()
+		}
+		return err
+	}
+}
+
+// Close drains buffered records and closes the current file
+func (l *AccessLogger) Close() {
+	l.closeMu.Do(func() {
+		close(l.records)
+		<-l.done
+	})
+}
+
+func (l *AccessLogger) run() {
+	defer close(l.done)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case rec, ok := <-l.records:
+			if !ok {
+				l.out.Close()
+				return
+			}
+			r := slog.NewRecord(rec.Time, slog.LevelInfo, "access", 0)
+			r.AddAttrs(rec.attrs()...)
+			_ = l.logger.Handler().Handle(context.Background(), r)
+		case <-flush.C:
+			l.out.Flush()
+			l.out.rotateIfOld()
+		}
+	}
+}
+
+// rotatingWriter buffers writes to the access log file and rotates it by
+// size and age. slog handlers write one whole line per call, so a rotation
+// never splits a record. It is only used from the logger goroutine.
+type rotatingWriter struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingWriter(cfg AccessLogConfig) (*rotatingWriter, error) {
+	rw := &rotatingWriter{
+		path:    cfg.Path,
+		maxSize: cfg.MaxSizeBytes,
+		maxAge:  cfg.MaxAge,
+	}
+	if cfg.Path == accessLogStdout {
+		rw.w = bufio.NewWriterSize(os.Stdout, 64*1024)
+		return rw, nil
+	}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	if rw.file != nil && rw.maxSize > 0 && rw.size+int64(len(p)) > rw.maxSize {
+		rw.rotate()
+	}
+	n, err := rw.w.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingWriter) Flush() {
+	rw.w.Flush()
+}
+
+func (rw *rotatingWriter) Close() {
+	rw.w.Flush()
+	if rw.file != nil {
+		rw.file.Close()
+	}
+}
+
+func (rw *rotatingWriter) rotateIfOld() {
+	if rw.file != nil && rw.maxAge > 0 && time.Since(rw.openedAt) >= rw.maxAge {
+		rw.rotate()
+	}
+}
+
+func (rw *rotatingWriter) open() error {
+	f, err := os.OpenFile(rw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat access log: %w", err)
+	}
+	rw.file = f
+	rw.w = bufio.NewWriterSize(f, 64*1024)
+	rw.size = info.Size()
+	rw.openedAt = time.Now()
+	return nil
+}
+
+func (rw *rotatingWriter) rotate() {
+	rw.w.Flush()
+	rw.file.Close()
+	rotated := rw.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(rw.path, rotated); err != nil {
+		log.Printf("access log rotate: %v", err)
+	}
+	if err := rw.open(); err != nil {
+		// Keep writing somewhere rather than crash the writer goroutine
+		log.Printf("access log reopen: %v", err)
+		rw.file, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		rw.w = bufio.NewWriter(rw.file)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		status  int
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "errors always", rate: 0, status: 500, want: 1},
+		{name: "client errors always", rate: 0, status: 429, want: 1},
+		{name: "slow always", rate: 0, status: 200, elapsed: time.Second, want: 1},
+		{name: "rate 0 never", rate: 0, status: 200, want: 0},
+		{name: "rate 1 always", rate: 1, status: 204, want: 1},
+		{name: "1 in 10", rate: 0.1, status: 200, want: 0.1},
+		{name: "1 in 100", rate: 0.01, status: 200, want: 0.01},
+	}
+	const n = 200_000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &AccessLogger{cfg: AccessLogConfig{SampleRate: tt.rate, SlowThreshold: 500 * time.Millisecond}}
+			logged := 0
+			for i := 0; i < n; i++ {
+				if l.sampled(tt.status, tt.elapsed) {
+					logged++
+				}
+			}
+			got := float64(logged) / n
+			// Five standard deviations of a binomial proportion
+			tolerance := 5 * math.Sqrt(tt.want*(1-tt.want)/n)
+			if math.Abs(got-tt.want) > tolerance {
+				t.Errorf("logged %.4f of requests, want %.4f ± %.4f", got, tt.want, tolerance)
+			}
+		})
+	}
+}
+
+func TestRotatingWriterRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rw, err := newRotatingWriter(AccessLogConfig{Path: path, MaxSizeBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(`{"route":"/v1/checkout","status":200,"duration_ms":1.5}` + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := rw.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated names carry milliseconds; keep them distinct
+		time.Sleep(2 * time.Millisecond)
+	}
+	rw.Close()
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 56-byte lines in 100-byte files: one line per file
+	if len(files) != 10 {
+		t.Fatalf("got %d files, want 10: %v", len(files), files)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) > 100 {
+			t.Errorf("%s is %d bytes, over the 100-byte limit", f, len(data))
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			if !json.Valid([]byte(l)) {
+				t.Errorf("%s has a split record %q", f, l)
+			}
+		}
+	}
+}
+
+func TestRotatingWriterRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rw, err := newRotatingWriter(AccessLogConfig{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Write([]byte("{}\n"))
+	rw.rotateIfOld()
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Fatalf("rotated a fresh file: %v", files)
+	}
+	rw.openedAt = time.Now().Add(-2 * time.Hour)
+	rw.rotateIfOld()
+	rw.Write([]byte("{}\n"))
+	rw.Close()
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) != 1 {
+		t.Fatalf("got rotated files %v, want one", files)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{}\n" {
+		t.Errorf("new file holds %q, want only the record written after rotating", data)
+	}
+}
+
+func TestAccessLogMiddlewareRecordsRequestContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := NewAccessLogger(AccessLogConfig{Path: path, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Use(logger.Middleware())
+	app.Get("/users/:userId", func(c *fiber.Ctx) error {
+		c.Locals(localRequestID, "req-1")
+		c.Locals(localCacheOutcome, "HIT")
+		c.Locals(localUserSegment, "vip")
+		return c.SendString("ok")
+	})
+	req := newRequest(http.MethodGet, "/users/42", nil)
+	req.Header.Set(headerRunPhase, "steady")
+	send(t, app, req)
+	logger.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		t.Fatal("no record written")
+	}
+	rec := decode(t, sc.Bytes())
+	want := map[string]any{
+		"route":      "/users/:userId",
+		"method":     "GET",
+		"status":     float64(200),
+		"bytes":      float64(2),
+		"request_id": "req-1",
+		"cache":      "HIT",
+		"segment":    "vip",
+		"phase":      "steady",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	if _, ok := rec["ts"]; !ok {
+		t.Error("record has no ts")
+	}
+	if _, ok := rec["level"]; ok {
+		t.Error("record has a level; logstats records don't")
+	}
+}
+
+func TestAccessLogDropsWhenTheBufferIsFull(t *testing.T) {
+	// No writer goroutine drains this buffer
+	l := &AccessLogger{
+		cfg:     AccessLogConfig{SampleRate: 1},
+		records: make(chan AccessLogRecord, 1),
+	}
+	app := fiber.New()
+	app.Use(l.Middleware())
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+	before := testutil.ToFloat64(accessLogDropped)
+	for i := 0; i < 3; i++ {
+		resp, _ := send(t, app, newRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("status = %d; a full buffer must not fail the request", resp.StatusCode)
+		}
+	}
+	if got := testutil.ToFloat64(accessLogDropped) - before; got != 2 {
+		t.Errorf("dropped %v records, want 2", got)
+	}
+}
+
+func TestAccessLogSkippedRequestsDoNotAllocate(t *testing.T) {
+	allocs := func(mw fiber.Handler) float64 {
+		app := fiber.New()
+		if mw != nil {
+			app.Use(mw)
+		}
+		app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+		h := app.Handler()
+		return testing.AllocsPerRun(200, func() { h(benchCtx(http.MethodGet, "/")) })
+	}
+	l := &AccessLogger{cfg: AccessLogConfig{SampleRate: 0}, records: make(chan AccessLogRecord, 1)}
+	if without, with := allocs(nil), allocs(l.Middleware()); with > without {
+		t.Errorf("unsampled request allocates %v times, %v without the access log", with, without)
+	}
+}
+
+// The access log is only registered when ACCESS_LOG_PATH is set, so
+// disabled costs nothing; these compare that baseline with the sampled
+// middleware at both ends of LOG_SAMPLE_RATE.
+func BenchmarkAccessLog(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		rate float64
+		on   bool
+	}{
+		{name: "disabled"},
+		{name: "rate=0", on: true},
+		{name: "rate=1", on: true, rate: 1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			app := fiber.New()
+			if bc.on {
+				logger, err := NewAccessLogger(AccessLogConfig{
+					Path:          filepath.Join(b.TempDir(), "access.log"),
+					SampleRate:    bc.rate,
+					BufferRecords: 1 << 16,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer logger.Close()
+				app.Use(logger.Middleware())
+			}
+			app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+			h := app.Handler()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h(benchCtx(http.MethodGet, "/"))
+			}
+		})
+	}
+}
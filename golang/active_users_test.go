@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"loastest-go/config"
+)
+
+func TestActiveUsersCountsDistinctUsersPerDay(t *testing.T) {
+	for _, mode := range []string{"hll", "set"} {
+		t.Run(mode, func(t *testing.T) {
+			mr, rdb := testRedis(t)
+			a := NewActiveUsers(rdb, config.ActiveUsersConfig{Mode: mode, RetentionDays: 7})
+			ctx := context.Background()
+			today := time.Date(2024, 3, 3, 15, 0, 0, 0, time.UTC)
+			mr.SetTime(today)
+			visits := map[int][]string{
+				-2: {"a", "b"},
+				-1: {"b", "c", "c"},
+				0:  {"a", "d"},
+			}
+			for offset, users := range visits {
+				for _, u := range users {
+					pipe := rdb.Pipeline()
+					a.Track(ctx, pipe, u, today.AddDate(0, 0, offset))
+					if _, err := pipe.Exec(ctx); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			total, daily, err := a.Count(ctx, 3, today)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// miniredis sums a multi-key PFCOUNT instead of counting the
+			// union as Redis does, so only the exact sets can check it here
+			if mode == "set" && total != 4 {
+				t.Errorf("total = %d, want 4 distinct users", total)
+			}
+			want := []DailyActiveUsers{{"2024-03-01", 2}, {"2024-03-02", 2}, {"2024-03-03", 2}}
+			for i := range want {
+				if daily[i] != want[i] {
+					t.Errorf("daily[%d] = %+v, want %+v", i, daily[i], want[i])
+				}
+			}
+
+			// Today's key lives until the retention after the day ends
+			key := a.key(today)
+			if ttl := mr.TTL(key); ttl != 8*24*time.Hour-15*time.Hour {
+				t.Errorf("TTL of %s = %s, want to midnight plus 7 days", key, ttl)
+			}
+		})
+	}
+}
+
+func TestActiveUsersHandler(t *testing.T) {
+	_, rdb := testRedis(t)
+	a := NewActiveUsers(rdb, config.ActiveUsersConfig{Mode: "hll", RetentionDays: 7})
+	pipe := rdb.Pipeline()
+	a.Track(context.Background(), pipe, testUserID, time.Now())
+	pipe.Exec(context.Background())
+
+	app := fiber.New()
+	app.Get("/active-users", a.Handler)
+	resp, body := send(t, app, newRequest(http.MethodGet, "/active-users?days=2", nil))
+	got := decode(t, body)
+	if resp.StatusCode != 200 || got["activeUsers"] != 1.0 || got["days"] != 2.0 || got["mode"] != "hll" {
+		t.Errorf("got %d %s", resp.StatusCode, body)
+	}
+	if daily, _ := got["daily"].([]any); len(daily) != 2 {
+		t.Errorf("daily = %v, want two days", got["daily"])
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/active-users?days=8", nil)); resp.StatusCode != 400 {
+		t.Errorf("days past the retention: status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// LimitsAdmin lets operators inspect and clear the Redis state that can
+// lock a user out during a long run: their rate-limit windows and
+// checkout locks. It builds keys with the helpers the limiters and
+// checkout use, so the formats can't drift apart.
+type LimitsAdmin struct {
+	db  *DBRouter
+	rdb *redis.Client
+	// limits are the per-user rate limits in force
+	limits      []RateLimit
+	lockBackend string
+}
+
+func NewLimitsAdmin(db *DBRouter, rdb *redis.Client, limits []RateLimit, checkout config.CheckoutConfig) *LimitsAdmin {
+	return &LimitsAdmin{db: db, rdb: rdb, limits: limits, lockBackend: checkout.LockBackend}
+}
+
+// RateLimitState is one limiter's window for a user
+type RateLimitState struct {
+	Limiter string `json:"limiter"`
+	Key     string `json:"key"`
+	Plan    string `json:"plan"`
+	Limit   int    `json:"limit"`
+	// Used is the sliding-window count the limiter checks against Limit
+	Used float64 `json:"used"`
+	// TTLMs is how long until the window's key expires; 0 when absent
+	TTLMs int64 `json:"ttlMs"`
+}
+
+// LockState is one checkout lock that can be held for a user
+type LockState struct {
+	Lock string `json:"lock"`
+	Key  string `json:"key"`
+	// CartID is set on cart locks
+	CartID string `json:"cartId,omitempty"`
+	Held   bool   `json:"held"`
+	TTLMs  int64  `json:"ttlMs,omitempty"`
+}
+
+// lockKeys returns the checkout locks a checkout by userID can take: the
+// user's and one per cart of theirs. The postgres backend's advisory locks
+// go with their transaction, so there are none that could be stuck.
+func (a *LimitsAdmin) lockKeys(ctx context.Context, userID string) ([]LockState, error) {
+	if a.lockBackend == "postgres" {
+		return []LockState{}, nil
+	}
+	locks := []LockState{{Lock: "user", Key: userLockKey(userID)}}
+	rows, err := a.db.Primary().Query(ctx, `SELECT id::text FROM carts WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, dbError("load carts", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cartID string
+		if err := rows.Scan(&cartID); err != nil {
+			return nil, err
+		}
+		locks = append(locks, LockState{Lock: "cart", Key: cartLockKey(cartID), CartID: cartID})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load carts", err)
+	}
+	return locks, nil
+}
+
+// State reads userID's rate-limit windows and checkout locks. The windows
+// are weighed at Redis's clock, as the limiter does.
+func (a *LimitsAdmin) State(ctx context.Context, userID string) ([]RateLimitState, []LockState, error) {
+	locks, err := a.lockKeys(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now, err := a.rdb.Time(ctx).Result()
+	if err != nil {
+		return nil, nil, ErrRedisUnavailable.With(err)
+	}
+
+	pipe := a.rdb.Pipeline()
+	limits := make([]RateLimitState, len(a.limits))
+	buckets := make([]*redis.MapStringStringCmd, len(a.limits))
+	limitTTLs := make([]*redis.DurationCmd, len(a.limits))
+	for i, rl := range a.limits {
+		key := rateLimitKey(rl.Name, userID)
+		plan, limit := rl.limitFor(ctx, userID)
+		limits[i] = RateLimitState{Limiter: rl.Name, Key: key, Plan: plan, Limit: limit}
+		buckets[i] = pipe.HGetAll(ctx, key)
+		limitTTLs[i] = pipe.PTTL(ctx, key)
+	}
+	lockTTLs := make([]*redis.DurationCmd, len(locks))
+	for i, l := range locks {
+		lockTTLs[i] = pipe.PTTL(ctx, l.Key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, nil, ErrRedisUnavailable.With(err)
+	}
+
+	for i, rl := range a.limits {
+		limits[i].Used = slidingWindowUsed(buckets[i].Val(), rl.Window, now)
+		limits[i].TTLMs = max(limitTTLs[i].Val().Milliseconds(), 0)
+	}
+	for i := range locks {
+		// PTTL is -2 for a missing key and -1 for one without expiry
+		if ttl := lockTTLs[i].Val(); ttl != -2 {
+			locks[i].Held = true
+			locks[i].TTLMs = max(ttl.Milliseconds(), 0)
+		}
+	}
+	return limits, locks, nil
+}
+
+// slidingWindowUsed weighs a rateLimitScript hash at now the way the
+// script does: the current bucket plus the overlapping share of the last
+func slidingWindowUsed(buckets map[string]string, window time.Duration, now time.Time) float64 {
+	w := max(window.Milliseconds(), 1)
+	ms := now.UnixMilli()
+	cur := ms / w
+	elapsed := ms - cur*w
+	count, _ := strconv.ParseFloat(buckets[strconv.FormatInt(cur, 10)], 64)
+	prev, _ := strconv.ParseFloat(buckets[strconv.FormatInt(cur-1, 10)], 64)
+	return prev*float64(w-elapsed)/float64(w) + count
+}
+
+// Clear deletes userID's rate-limit windows and checkout locks and returns
+// the keys that existed. A lock is deleted even if a checkout still holds
+// it, which lets a concurrent checkout in alongside that one.
+func (a *LimitsAdmin) Clear(ctx context.Context, userID string) ([]string, error) {
+	locks, err := a.lockKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, rl := range a.limits {
+		keys = append(keys, rateLimitKey(rl.Name, userID))
+	}
+	for _, l := range locks {
+		keys = append(keys, l.Key)
+	}
+
+	pipe := a.rdb.Pipeline()
+	dels := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		dels[i] = pipe.Del(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, ErrRedisUnavailable.With(err)
+	}
+	cleared := []string{}
+	for i, del := range dels {
+		if del.Val() > 0 {
+			cleared = append(cleared, keys[i])
+		}
+	}
+	return cleared, nil
+}
+
+// GetLimits serves GET /v1/admin/users/:userId/limits
+func (a *LimitsAdmin) GetLimits(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	userID := p.PathUUID("userId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	limits, locks, err := a.State(c.UserContext(), userID)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"userId":      userID,
+		"rateLimits":  limits,
+		"lockBackend": a.lockBackend,
+		"locks":       locks,
+	})
+}
+
+// ClearLimits serves DELETE /v1/admin/users/:userId/limits
+func (a *LimitsAdmin) ClearLimits(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	userID := p.PathUUID("userId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	cleared, err := a.Clear(c.UserContext(), userID)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(fiber.Map{"userId": userID, "cleared": cleared})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// limitsApp serves the limits admin routes behind the admin key "secret",
+// and a checkout route limited by limit
+func limitsApp(db *DBRouter, rdb *redis.Client, limit RateLimit, lockBackend string) *fiber.App {
+	admin := NewLimitsAdmin(db, rdb, []RateLimit{limit}, config.CheckoutConfig{LockBackend: lockBackend})
+	routes := NewRouteRegistry("", requireAdmin(false, "secret"))
+	routes.Add(Route{Version: "v1", Method: fiber.MethodGet, Path: "/admin/users/:userId/limits", Admin: true, Handler: admin.GetLimits})
+	routes.Add(Route{Version: "v1", Method: fiber.MethodDelete, Path: "/admin/users/:userId/limits", Admin: true, Handler: admin.ClearLimits})
+	app := fiber.New()
+	routes.Mount(app)
+	app.Post("/checkout", rateLimitMiddleware(rdb, limit, false), okHandler)
+	return app
+}
+
+// adminRequest is a request to the limits admin carrying the admin key
+func adminRequest(method, userID string) *http.Request {
+	req := newRequest(method, "/v1/admin/users/"+userID+"/limits", nil)
+	req.Header.Set(headerAdminKey, "secret")
+	return req
+}
+
+func TestLimitsAdminRequiresTheKey(t *testing.T) {
+	_, rdb := testRedis(t)
+	app := limitsApp(nil, rdb, checkoutLimit(1), "postgres")
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		for _, key := range []string{"", "wrong"} {
+			req := newRequest(method, "/v1/admin/users/"+testUserID+"/limits", nil)
+			if key != "" {
+				req.Header.Set(headerAdminKey, key)
+			}
+			resp, body := send(t, app, req)
+			e, _ := decode(t, body)["error"].(map[string]any)
+			if resp.StatusCode != fiber.StatusUnauthorized || e["code"] != ErrUnauthorized.Code {
+				t.Errorf("%s with key %q: got %d %s, want 401 %s", method, key, resp.StatusCode, body, ErrUnauthorized.Code)
+			}
+		}
+	}
+	resp, body := send(t, app, adminRequest(http.MethodGet, "not-a-uuid"))
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusBadRequest || e["code"] != "INVALID_QUERY" {
+		t.Errorf("bad user id: got %d %s, want 400 INVALID_QUERY", resp.StatusCode, body)
+	}
+}
+
+func TestClearedRateLimitAllowsCheckoutAgain(t *testing.T) {
+	_, rdb := testRedis(t)
+	app := limitsApp(nil, rdb, checkoutLimit(1), "postgres")
+	checkout := func() int {
+		resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID}))
+		return resp.StatusCode
+	}
+	if got := checkout(); got != fiber.StatusOK {
+		t.Fatalf("first checkout: status = %d", got)
+	}
+	if got := checkout(); got != fiber.StatusTooManyRequests {
+		t.Fatalf("second checkout: status = %d, want 429", got)
+	}
+
+	resp, body := send(t, app, adminRequest(http.MethodGet, testUserID))
+	limits, _ := decode(t, body)["rateLimits"].([]any)
+	if resp.StatusCode != fiber.StatusOK || len(limits) != 1 {
+		t.Fatalf("state: got %d %s", resp.StatusCode, body)
+	}
+	if l := limits[0].(map[string]any); l["key"] != rateLimitKey("checkout", testUserID) ||
+		l["used"] != 1.0 || l["limit"] != 1.0 || l["ttlMs"].(float64) <= 0 {
+		t.Errorf("checkout window = %v, want the one request used", l)
+	}
+
+	resp, body = send(t, app, adminRequest(http.MethodDelete, testUserID))
+	cleared, _ := decode(t, body)["cleared"].([]any)
+	if resp.StatusCode != fiber.StatusOK || !slices.Contains(cleared, any(rateLimitKey("checkout", testUserID))) {
+		t.Fatalf("clear: got %d %s, want the window cleared", resp.StatusCode, body)
+	}
+	if got := checkout(); got != fiber.StatusOK {
+		t.Errorf("checkout after the clear: status = %d, want 200", got)
+	}
+}
+
+func TestSlidingWindowUsed(t *testing.T) {
+	window := 10 * time.Second
+	// 2.5s into bucket 170001, so three quarters of bucket 170000 overlap
+	now := time.UnixMilli(1_700_012_500)
+	buckets := map[string]string{"170000": "4", "170001": "2", "169999": "9"}
+	if got := slidingWindowUsed(buckets, window, now); got != 5 {
+		t.Errorf("used = %v, want 4*0.75 + 2", got)
+	}
+	if got := slidingWindowUsed(nil, window, now); got != 0 {
+		t.Errorf("used = %v with no buckets, want 0", got)
+	}
+}
+
+func TestLimitsShowAndClearCheckoutLocks(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	app := limitsApp(db, rdb, checkoutLimit(1), "redis")
+	user := seedUser(t, db, "pro", "active")
+	cart := seedCart(t, db, user, "open", 5)
+	mr.Set(cartLockKey(cart), "stuck-token")
+	mr.SetTTL(cartLockKey(cart), time.Minute)
+
+	_, body := send(t, app, adminRequest(http.MethodGet, user))
+	held := map[string]bool{}
+	locks, _ := decode(t, body)["locks"].([]any)
+	for _, l := range locks {
+		l := l.(map[string]any)
+		held[l["key"].(string)] = l["held"] == true
+	}
+	if len(held) != 2 || !held[cartLockKey(cart)] || held[userLockKey(user)] {
+		t.Errorf("locks = %v, want the cart's held and the user's free", locks)
+	}
+
+	_, body = send(t, app, adminRequest(http.MethodDelete, user))
+	if cleared, _ := decode(t, body)["cleared"].([]any); len(cleared) != 1 || cleared[0] != cartLockKey(cart) {
+		t.Errorf("cleared = %v, want the cart lock", cleared)
+	}
+	if mr.Exists(cartLockKey(cart)) {
+		t.Error("the cart lock survived the clear")
+	}
+}
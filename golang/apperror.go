@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// AppError is an error with the HTTP status and machine-readable code it
+// should be reported as. Handlers map errors with errors.As, so wrapping
+// (fmt.Errorf("...: %w", err)) keeps the mapping intact.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	// Details is optional extra context such as field errors
+	Details any
+	// Err is the underlying cause, if any; it is not sent to clients
+	Err error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error { return e.Err }
+
+// Is matches AppErrors by code, so a copy carrying details or a cause still
+// satisfies errors.Is against the sentinel
+func (e *AppError) Is(target error) bool {
+	t, ok := target.(*AppError)
+	return ok && t.Code == e.Code
+}
+
+// With returns a copy of e wrapping cause
+func (e *AppError) With(cause error) *AppError {
+	c := *e
+	c.Err = cause
+	return &c
+}
+
+// WithDetails returns a copy of e carrying details
+func (e *AppError) WithDetails(details any) *AppError {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+var (
+	ErrInvalidJSON       = &AppError{Status: fiber.StatusBadRequest, Code: "INVALID_JSON", Message: "Invalid JSON body"}
+	ErrValidation        = &AppError{Status: fiber.StatusBadRequest, Code: "VALIDATION_FAILED", Message: "Invalid checkout request"}
+	ErrInvalidQuery      = &AppError{Status: fiber.StatusBadRequest, Code: "INVALID_QUERY", Message: "Invalid query parameters"}
+	ErrBodyTooLarge      = &AppError{Status: fiber.StatusRequestEntityTooLarge, Code: "BODY_TOO_LARGE", Message: "Request body too large"}
+	ErrCartNotFound      = &AppError{Status: fiber.StatusBadRequest, Code: "CART_NOT_FOUND", Message: "Cart not found or not open"}
+	ErrNoOpenCart        = &AppError{Status: fiber.StatusNotFound, Code: "NO_OPEN_CART", Message: "User has no open cart"}
+	ErrCartEmpty         = &AppError{Status: fiber.StatusBadRequest, Code: "CART_EMPTY", Message: "Cart is empty"}
+	ErrInvalidCoupon     = &AppError{Status: fiber.StatusBadRequest, Code: "INVALID_COUPON", Message: "Unknown coupon code"}
+	ErrCouponNotActive   = &AppError{Status: fiber.StatusBadRequest, Code: "COUPON_NOT_ACTIVE", Message: "Coupon is not yet valid or has expired"}
+	ErrCouponExhausted   = &AppError{Status: fiber.StatusBadRequest, Code: "COUPON_EXHAUSTED", Message: "Coupon has reached its maximum uses"}
+	ErrCouponMinNotMet   = &AppError{Status: fiber.StatusBadRequest, Code: "COUPON_MIN_NOT_MET", Message: "Order subtotal is below the coupon's minimum"}
+	ErrCouponNotEligible = &AppError{Status: fiber.StatusBadRequest, Code: "COUPON_NOT_APPLICABLE", Message: "Coupon does not apply to any item in the order"}
+	ErrInvalidShipping   = &AppError{Status: fiber.StatusBadRequest, Code: "INVALID_SHIPPING_METHOD", Message: "Unknown shipping method"}
+	ErrCouponUsed        = &AppError{Status: fiber.StatusBadRequest, Code: "COUPON_ALREADY_USED", Message: "Coupon already used"}
+	ErrInsufficientStock = &AppError{Status: fiber.StatusConflict, Code: "INSUFFICIENT_INVENTORY", Message: "Insufficient inventory"}
+	ErrNotStocked        = &AppError{Status: fiber.StatusConflict, Code: "NOT_STOCKED", Message: "Product not stocked in the fulfillment warehouse"}
+	ErrCartMismatch      = &AppError{Status: fiber.StatusConflict, Code: "CART_MISMATCH", Message: "Requested items do not match the cart"}
+	ErrCheckoutPending   = &AppError{Status: fiber.StatusConflict, Code: "PROCESSING", Message: "A checkout with this paymentRef is still processing"}
+	ErrIdempotencyReuse  = &AppError{Status: fiber.StatusUnprocessableEntity, Code: "IDEMPOTENCY_KEY_REUSED", Message: "Idempotency key was already used for a different request"}
+	ErrCartLocked        = &AppError{Status: fiber.StatusConflict, Code: "CART_CHECKOUT_IN_PROGRESS", Message: "A checkout of this cart is in progress"}
+	ErrUserLocked        = &AppError{Status: fiber.StatusConflict, Code: "USER_CHECKOUT_IN_PROGRESS", Message: "A checkout for this user is in progress"}
+	ErrAsyncDisabled     = &AppError{Status: fiber.StatusServiceUnavailable, Code: "ASYNC_DISABLED", Message: "Async checkout is disabled on this server"}
+	ErrCheckoutNotFound  = &AppError{Status: fiber.StatusNotFound, Code: "CHECKOUT_NOT_FOUND", Message: "Async checkout not found or expired"}
+	ErrOrderNotFound     = &AppError{Status: fiber.StatusNotFound, Code: "ORDER_NOT_FOUND", Message: "Order not found"}
+	ErrOrderNotPending   = &AppError{Status: fiber.StatusConflict, Code: "ORDER_NOT_CANCELLABLE", Message: "Only pending orders can be cancelled"}
+	ErrOpenCartExists    = &AppError{Status: fiber.StatusConflict, Code: "OPEN_CART_EXISTS", Message: "User already has an open cart; reorder with ?mode=merge to add to it"}
+	ErrNothingToReorder  = &AppError{Status: fiber.StatusConflict, Code: "NOTHING_TO_REORDER", Message: "No item of the order is available to reorder"}
+	ErrPaymentNotFound   = &AppError{Status: fiber.StatusNotFound, Code: "PAYMENT_NOT_FOUND", Message: "No order has this paymentRef"}
+	ErrPaymentAmbiguous  = &AppError{Status: fiber.StatusConflict, Code: "PAYMENT_AMBIGUOUS", Message: "More than one order has this paymentRef"}
+	ErrBadSignature      = &AppError{Status: fiber.StatusUnauthorized, Code: "INVALID_SIGNATURE", Message: "Webhook signature does not match"}
+	ErrSignatureExpired  = &AppError{Status: fiber.StatusUnauthorized, Code: "SIGNATURE_EXPIRED", Message: "Webhook timestamp is outside the allowed window"}
+	ErrWebhookDisabled   = &AppError{Status: fiber.StatusServiceUnavailable, Code: "WEBHOOK_DISABLED", Message: "Payment webhook is not configured on this server"}
+	ErrWebhookNotFound   = &AppError{Status: fiber.StatusNotFound, Code: "WEBHOOK_NOT_FOUND", Message: "Webhook subscription not found"}
+	ErrOrderTransition   = &AppError{Status: fiber.StatusConflict, Code: "INVALID_TRANSITION", Message: "Order cannot move to the requested status"}
+	ErrUserNotFound      = &AppError{Status: fiber.StatusNotFound, Code: "USER_NOT_FOUND", Message: "User not found"}
+	ErrUnauthorized      = &AppError{Status: fiber.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "Admin credentials required"}
+	ErrUserInactive      = &AppError{Status: fiber.StatusForbidden, Code: "USER_INACTIVE", Message: "User is inactive"}
+	ErrProductNotFound   = &AppError{Status: fiber.StatusNotFound, Code: "PRODUCT_NOT_FOUND", Message: "Product not found"}
+	ErrRateLimited       = &AppError{Status: fiber.StatusTooManyRequests, Code: "RATE_LIMITED", Message: "Rate limit exceeded"}
+	ErrServerBusy        = &AppError{Status: fiber.StatusServiceUnavailable, Code: "SERVER_BUSY", Message: "Server busy"}
+	ErrRedisUnavailable  = &AppError{Status: fiber.StatusServiceUnavailable, Code: "REDIS_UNAVAILABLE", Message: "Redis unavailable"}
+	ErrDBUnavailable     = &AppError{Status: fiber.StatusServiceUnavailable, Code: "DATABASE_UNAVAILABLE", Message: "Database unavailable"}
+	ErrTimeout           = &AppError{Status: fiber.StatusGatewayTimeout, Code: "TIMEOUT", Message: "Request timed out"}
+	ErrInternal          = &AppError{Status: fiber.StatusInternalServerError, Code: "INTERNAL", Message: "Internal error"}
+)
+
+// dbError wraps a query failure with op. Connection-level failures that
+// never reached Postgres become ErrDBUnavailable (503) so clients retry;
+// anything else stays a plain error and is reported as a 500. pgconn's
+// SafeToRetry doesn't unwrap and a failed connect isn't SafeToRetry at all,
+// so the chain is searched for either, or for the network error beneath.
+func dbError(op string, err error) error {
+	wrapped := fmt.Errorf("%s: %w", op, err)
+	var retryable interface{ SafeToRetry() bool }
+	var netErr net.Error
+	if (errors.As(err, &retryable) && retryable.SafeToRetry()) ||
+		pgconn.Timeout(err) || errors.As(err, &netErr) {
+		return ErrDBUnavailable.With(wrapped)
+	}
+	return wrapped
+}
+
+// writeError renders err as {"error": {"code", "message", "details"?}}.
+// Anything that isn't an AppError is a 500. Only the AppError's Message
+// goes to the client; a 5xx's underlying cause is logged here with the
+// request id instead, since it can carry SQL, hosts or other internals.
+func writeError(c *fiber.Ctx, err error) error {
+	c.Locals(localError, err)
+	status, body := errorBody(err)
+	if status >= fiber.StatusInternalServerError {
+		requestID, _ := c.Locals(localRequestID).(string)
+		log.Printf("error: %v\nrequestId=%s route=%s %s status=%d",
+			err, requestID, c.Method(), c.Path(), status)
+	}
+	return c.Status(status).JSON(fiber.Map{"error": body})
+}
+
+// errorBody is the status and "error" object writeError sends for err
+func errorBody(err error) (int, fiber.Map) {
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		appErr = ErrInternal.With(err)
+	}
+	body := fiber.Map{
+		"code":    appErr.Code,
+		"message": appErr.Message,
+	}
+	if appErr.Details != nil {
+		body["details"] = appErr.Details
+	}
+	return appErr.Status, body
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+func TestErrorBody(t *testing.T) {
+	cause := errors.New(`dial tcp 10.0.4.2:5432: connect: connection refused`)
+	details := []FieldError{{Field: "userId", Message: "must be a UUID"}}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   fiber.Map
+	}{
+		{
+			name:   "sentinel",
+			err:    ErrOrderNotFound,
+			status: 404,
+			want:   fiber.Map{"code": "ORDER_NOT_FOUND", "message": "Order not found"},
+		},
+		{
+			name:   "cause is not sent",
+			err:    ErrDBUnavailable.With(cause),
+			status: 503,
+			want:   fiber.Map{"code": "DATABASE_UNAVAILABLE", "message": "Database unavailable"},
+		},
+		{
+			name:   "wrapped",
+			err:    fmt.Errorf("load cart: %w", ErrCartEmpty.With(cause)),
+			status: 400,
+			want:   fiber.Map{"code": "CART_EMPTY", "message": "Cart is empty"},
+		},
+		{
+			name:   "details",
+			err:    ErrValidation.WithDetails(details),
+			status: 400,
+			want:   fiber.Map{"code": "VALIDATION_FAILED", "message": "Invalid checkout request", "details": details},
+		},
+		{
+			name:   "plain error",
+			err:    fmt.Errorf("scan orders: %w", cause),
+			status: 500,
+			want:   fiber.Map{"code": "INTERNAL", "message": "Internal error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := errorBody(tt.err)
+			if status != tt.status || !reflect.DeepEqual(body, tt.want) {
+				t.Errorf("errorBody = %d %v, want %d %v", status, body, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteErrorLogsTheCauseOfServerErrors(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	secret := errors.New(`relation "orders_v2" does not exist`)
+	app := fiber.New()
+	app.Use(requestid.New())
+	app.Get("/internal", func(c *fiber.Ctx) error { return writeError(c, secret) })
+	app.Get("/missing", func(c *fiber.Ctx) error { return writeError(c, ErrOrderNotFound.With(secret)) })
+
+	req := newRequest(http.MethodGet, "/internal", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "req-42")
+	resp, body := send(t, app, req)
+	if resp.StatusCode != 500 || strings.Contains(string(body), "orders_v2") {
+		t.Errorf("got %d %s, want a 500 without the cause", resp.StatusCode, body)
+	}
+	if line := logged.String(); !strings.Contains(line, "orders_v2") || !strings.Contains(line, "requestId=req-42") {
+		t.Errorf("log = %q, want the cause and request id", line)
+	}
+
+	logged.Reset()
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/missing", nil)); resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("a client error was logged: %q", logged.String())
+	}
+}
+
+func TestDecodeStrictExplainsItself(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"productID":"x"}`: `unknown field "productID"`,
+		`{"userId":1}`:      "cannot unmarshal number",
+		`{} {}`:             "unexpected data after the object",
+	} {
+		var req CheckoutRequest
+		err := decodeStrict([]byte(body), &req)
+		_, got := errorBody(err)
+		fields, _ := got["details"].([]FieldError)
+		if got["code"] != "INVALID_JSON" || len(fields) != 1 || !strings.Contains(fields[0].Message, want) {
+			t.Errorf("%s: body = %v, want INVALID_JSON detailing %q", body, got, want)
+		}
+	}
+}
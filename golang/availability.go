@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+var (
+	availabilityRefreshAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "product_availability_refresh_age_seconds",
+		Help: "Seconds since any instance last refreshed the product_availability view; -1 before the first refresh.",
+	})
+	availabilityRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "product_availability_refreshes_total",
+		Help: "product_availability refresh attempts by this instance, by outcome (refreshed, failed, skipped when another instance held the lock).",
+	}, []string{"outcome"})
+)
+
+const (
+	availabilityLockKey      = "lock:availability_refresh"
+	availabilityRefreshedKey = "availability:refreshed_at"
+)
+
+// AvailabilityView maintains the product_availability materialized view,
+// which holds each product's availability summed over every warehouse.
+// With AVAILABILITY_SOURCE=materialized every instance runs a refresher,
+// but a Redis lock held for one interval lets only one of them refresh per
+// tick; the others pick up the refresh time from Redis. Reads use the view
+// only while it is within AVAILABILITY_MAX_STALENESS and aggregate
+// inventory live otherwise.
+type AvailabilityView struct {
+	db  *DBRouter
+	rdb *redis.Client
+	cfg config.AvailabilityConfig
+	// refreshedAt is the unix millis of the last refresh by any instance
+	refreshedAt atomic.Int64
+}
+
+func NewAvailabilityView(
+	db *DBRouter,
+	rdb *redis.Client,
+	cfg config.AvailabilityConfig,
+) *AvailabilityView {
+	return &AvailabilityView{db: db, rdb: rdb, cfg: cfg}
+}
+
+// Enabled reports whether the view is in use at all
+func (v *AvailabilityView) Enabled() bool {
+	return v.cfg.Source == "materialized"
+}
+
+// Age is the time since the last refresh; false before the first one
+func (v *AvailabilityView) Age() (time.Duration, bool) {
+	ms := v.refreshedAt.Load()
+	if ms == 0 {
+		return 0, false
+	}
+	return time.Since(time.UnixMilli(ms)), true
+}
+
+// Fresh reports whether reads should come from the view
+func (v *AvailabilityView) Fresh() bool {
+	if !v.Enabled() {
+		return false
+	}
+	age, ok := v.Age()
+	return ok && age <= v.cfg.MaxStaleness
+}
+
+// Run refreshes the view every interval until ctx is done
+func (v *AvailabilityView) Run(ctx context.Context) {
+	v.tick(ctx)
+	ticker := time.NewTicker(v.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			v.tick(ctx)
+		}
+	}
+}
+
+func (v *AvailabilityView) tick(ctx context.Context) {
+	// The lock is never released: it expires after one interval, which is
+	// what limits the cluster to one refresh per tick
+	claimed, err := v.rdb.SetNX(ctx, availabilityLockKey, uuid.NewString(), v.cfg.RefreshInterval).Result()
+	switch {
+	case err != nil:
+		log.Printf("⚠️  Availability refresh lock failed: %v", err)
+	case claimed:
+		v.refresh(ctx)
+	default:
+		availabilityRefreshes.WithLabelValues("skipped").Inc()
+	}
+
+	if ms, err := v.rdb.Get(ctx, availabilityRefreshedKey).Int64(); err == nil && ms > v.refreshedAt.Load() {
+		v.refreshedAt.Store(ms)
+	}
+	if age, ok := v.Age(); ok {
+		availabilityRefreshAge.Set(age.Seconds())
+	} else {
+		availabilityRefreshAge.Set(-1)
+	}
+}
+
+func (v *AvailabilityView) refresh(ctx context.Context) {
+	refreshCtx, cancel := context.WithTimeout(ctx, v.cfg.MaxStaleness)
+	defer cancel()
+	// CONCURRENTLY keeps the view readable during the refresh; it needs
+	// the unique index on product_id
+	_, err := v.db.Primary().Exec(refreshCtx,
+		`REFRESH MATERIALIZED VIEW CONCURRENTLY product_availability`)
+	if err != nil {
+		availabilityRefreshes.WithLabelValues("failed").Inc()
+		log.Printf("⚠️  Availability refresh failed: %v", err)
+		return
+	}
+	availabilityRefreshes.WithLabelValues("refreshed").Inc()
+
+	now := time.Now().UnixMilli()
+	v.refreshedAt.Store(now)
+	// Outlives a few missed ticks so the others still see the last refresh
+	err = v.rdb.Set(ctx, availabilityRefreshedKey, strconv.FormatInt(now, 10), 0).Err()
+	if err != nil {
+		log.Printf("⚠️  Availability refresh time not published: %v", err)
+	}
+}
+
+// health reports the view's freshness for the readiness probe. A stale view
+// only means reads fall back to live aggregation, so it is never critical.
+func (v *AvailabilityView) health() ComponentHealth {
+	result := ComponentHealth{Status: "up"}
+	age, ok := v.Age()
+	if !ok {
+		result.Status, result.Error = "down", "never refreshed"
+		return result
+	}
+	seconds := age.Seconds()
+	result.AgeSeconds = &seconds
+	if age > v.cfg.MaxStaleness {
+		result.Status, result.Error = "down", "older than AVAILABILITY_MAX_STALENESS"
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+func materializedView(db *DBRouter, rdb *redis.Client) *AvailabilityView {
+	return NewAvailabilityView(db, rdb, config.AvailabilityConfig{
+		Source:          "materialized",
+		RefreshInterval: time.Minute,
+		MaxStaleness:    30 * time.Second,
+	})
+}
+
+func TestAvailabilityPicksUpAnotherInstancesRefresh(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	// Another instance holds this interval's lock, so no refresh (and no
+	// Postgres) is attempted here
+	mr.Set(availabilityLockKey, "other")
+
+	v := materializedView(nil, rdb)
+	v.tick(ctx)
+	if v.Fresh() {
+		t.Fatal("fresh before any instance refreshed")
+	}
+	if h := v.health(); h.Status != "down" || h.Error != "never refreshed" {
+		t.Errorf("health = %+v, want down, never refreshed", h)
+	}
+
+	mr.Set(availabilityRefreshedKey, strconv.FormatInt(time.Now().Add(-10*time.Second).UnixMilli(), 10))
+	v.tick(ctx)
+	if !v.Fresh() {
+		t.Error("a refresh 10s ago isn't fresh")
+	}
+	h := v.health()
+	if h.Status != "up" || h.AgeSeconds == nil || *h.AgeSeconds < 10 || *h.AgeSeconds > 11 {
+		t.Errorf("health = %+v, want up about 10s old", h)
+	}
+
+	// An older time in Redis never moves the view's age backwards
+	mr.Set(availabilityRefreshedKey, strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10))
+	v.tick(ctx)
+	if !v.Fresh() {
+		t.Error("an older refresh time in Redis replaced a newer one")
+	}
+}
+
+func TestAvailabilityGoesStale(t *testing.T) {
+	mr, rdb := testRedis(t)
+	mr.Set(availabilityLockKey, "other")
+	mr.Set(availabilityRefreshedKey, strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10))
+
+	v := materializedView(nil, rdb)
+	v.tick(context.Background())
+	if v.Fresh() {
+		t.Error("a view a minute old is fresh with 30s max staleness")
+	}
+	if h := v.health(); h.Status != "down" || h.Critical {
+		t.Errorf("health = %+v, want down and not critical", h)
+	}
+
+	live := NewAvailabilityView(nil, rdb, config.AvailabilityConfig{Source: "live"})
+	live.refreshedAt.Store(time.Now().UnixMilli())
+	if live.Enabled() || live.Fresh() {
+		t.Error("the live source reads from the view")
+	}
+}
+
+func TestAvailabilityRefreshOncePerInterval(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	first, second := materializedView(db, rdb), materializedView(db, rdb)
+
+	first.tick(ctx)
+	if !first.Fresh() {
+		t.Fatal("the instance that took the lock didn't refresh")
+	}
+	if ttl := mr.TTL(availabilityLockKey); ttl != time.Minute {
+		t.Errorf("lock TTL = %s, want one interval", ttl)
+	}
+	published, _ := rdb.Get(ctx, availabilityRefreshedKey).Int64()
+	second.tick(ctx)
+	if !second.Fresh() || second.refreshedAt.Load() != published {
+		t.Errorf("second instance: refreshedAt = %d, want the published %d", second.refreshedAt.Load(), published)
+	}
+	if again, _ := rdb.Get(ctx, availabilityRefreshedKey).Int64(); again != published {
+		t.Error("the second instance refreshed within the same interval")
+	}
+}
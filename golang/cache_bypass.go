@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The overview data all lives in Postgres, so a Redis failure on that path
+// is never worth a 500: reads become misses, writes are skipped, and the
+// response is flagged so clients and load reports can tell.
+
+var cacheBypasses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "overview_cache_bypass_total",
+	Help: "Overview cache operations skipped because Redis failed, by operation.",
+}, []string{"op"})
+
+// headerCache is set to "BYPASS" on responses served without Redis
+const headerCache = "X-Cache"
+
+type cacheBypassKey struct{}
+
+// withCacheBypass returns a context the service can flag Redis failures on
+func withCacheBypass(ctx context.Context) (context.Context, *atomic.Bool) {
+	flag := new(atomic.Bool)
+	return context.WithValue(ctx, cacheBypassKey{}, flag), flag
+}
+
+func isCacheBypassed(ctx context.Context) bool {
+	flag, _ := ctx.Value(cacheBypassKey{}).(*atomic.Bool)
+	return flag != nil && flag.Load()
+}
+
+// lastBypassLog throttles the log line to one per second; at load-test
+// rates an outage would otherwise flood stdout
+var lastBypassLog atomic.Int64
+
+// cacheBypassed records a Redis failure for op on the request in ctx
+func cacheBypassed(ctx context.Context, op string, err error) {
+	if flag, _ := ctx.Value(cacheBypassKey{}).(*atomic.Bool); flag != nil {
+		flag.Store(true)
+	}
+	cacheBypasses.WithLabelValues(op).Inc()
+
+	now := time.Now().Unix()
+	if last := lastBypassLog.Load(); now > last && lastBypassLog.CompareAndSwap(last, now) {
+		log.Printf("⚠️  Redis %s failed, serving from Postgres: %v", op, err)
+	}
+}
+
+// markBypass annotates the response when the request ran without Redis
+func markBypass(c *fiber.Ctx, bypassed *atomic.Bool) {
+	if bypassed.Load() {
+		c.Set(headerCache, "BYPASS")
+		c.Locals(localCacheOutcome, "bypass")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOverviewWithRedisClosed(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	product := seedProduct(t, db, "BYPASS", 12.5, 30)
+	user := seedUser(t, db, "pro", "active")
+	seedOrder(t, db, user, "completed", 2, 12.5, product)
+
+	target := "/v1/users/" + user + "/overview"
+	resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerCache) != "MISS" {
+		t.Fatalf("with Redis: got %d X-Cache %q", resp.StatusCode, resp.Header.Get(headerCache))
+	}
+	want := decode(t, body)
+
+	rdb.Close()
+	resp, body = send(t, app, newRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("without Redis: status = %d: %s", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get(headerCache); got != "BYPASS" {
+		t.Errorf("X-Cache = %q, want BYPASS", got)
+	}
+	got := decode(t, body)
+	for _, section := range []string{"user", "orders", "products", "derived"} {
+		if !reflect.DeepEqual(got[section], want[section]) {
+			t.Errorf("%s differs without Redis:\n got: %v\nwant: %v", section, got[section], want[section])
+		}
+	}
+	if orders, _ := got["orders"].([]any); len(orders) != 1 {
+		t.Errorf("orders = %v, want the seeded order", got["orders"])
+	}
+
+	// v2 says so in the body too
+	resp, body = send(t, app, newRequest(http.MethodGet, "/v2/users/"+user+"/overview", nil))
+	if resp.StatusCode != fiber.StatusOK || decode(t, body)["degraded"] != true {
+		t.Errorf("v2 without Redis: got %d %s, want 200 with degraded true", resp.StatusCode, body)
+	}
+}
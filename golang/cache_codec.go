@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheCompressionSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cache_compression_saved_bytes_total",
+		Help: "Bytes kept out of Redis by compressing large cached payloads.",
+	})
+	cacheCorrupt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_corrupt_entries_total",
+		Help: "Cached payloads that failed validation and were deleted, by cache (summary, idempotency).",
+	}, []string{"cache"})
+)
+
+// Cached payloads start with a format byte. Neither value can begin a JSON
+// document, so entries written before compression existed (plain JSON) are
+// still read as they are. Every cached payload is a JSON object.
+const (
+	codecRaw  byte = 0x00
+	codecGzip byte = 0x01
+)
+
+var errCorruptCacheEntry = errors.New("corrupt cache entry")
+
+// cacheCodec gzips payloads of at least threshold bytes; 0 disables it
+type cacheCodec struct {
+	threshold int
+}
+
+func newCacheCodec(threshold int) cacheCodec {
+	return cacheCodec{threshold: threshold}
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// Encode returns the value to store for payload
+func (cc cacheCodec) Encode(payload []byte) []byte {
+	if cc.threshold <= 0 || len(payload) < cc.threshold {
+		return append([]byte{codecRaw}, payload...)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(payload) / 4)
+	buf.WriteByte(codecGzip)
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil || w.Close() != nil {
+		return append([]byte{codecRaw}, payload...)
+	}
+	// Not worth it for payloads that don't shrink
+	if buf.Len() >= len(payload)+1 {
+		return append([]byte{codecRaw}, payload...)
+	}
+	cacheCompressionSaved.Add(float64(len(payload) + 1 - buf.Len()))
+	return buf.Bytes()
+}
+
+// decodeCached undoes Encode; unprefixed values are legacy plain entries.
+// Payloads go to clients as they are, so anything that isn't plausibly a
+// JSON object is rejected: gzip checks its own CRC, and raw payloads must
+// at least start with '{' and end with '}', which catches truncation and
+// stray writes without parsing.
+func decodeCached(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errCorruptCacheEntry
+	}
+	payload := stored
+	switch stored[0] {
+	case codecRaw:
+		payload = stored[1:]
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, errCorruptCacheEntry
+		}
+		defer r.Close()
+		if payload, err = io.ReadAll(r); err != nil {
+			return nil, errCorruptCacheEntry
+		}
+	}
+	if len(payload) < 2 || payload[0] != '{' || payload[len(payload)-1] != '}' {
+		return nil, errCorruptCacheEntry
+	}
+	return payload, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheCodecRoundTrip(t *testing.T) {
+	small := []byte(`{"user":{"id":"u"}}`)
+	large := []byte(`{"products":[` + strings.Repeat(`{"sku":"SKU-000001","price":9.99},`, 200) + `{}]}`)
+	cc := newCacheCodec(1024)
+	for name, tt := range map[string]struct {
+		payload []byte
+		format  byte
+	}{
+		"below threshold": {small, codecRaw},
+		"compressed":      {large, codecGzip},
+	} {
+		stored := cc.Encode(tt.payload)
+		if stored[0] != tt.format {
+			t.Errorf("%s: format byte = %#x, want %#x", name, stored[0], tt.format)
+		}
+		got, err := decodeCached(stored)
+		if err != nil || !bytes.Equal(got, tt.payload) {
+			t.Errorf("%s: decodeCached = %.40q, %v", name, got, err)
+		}
+	}
+	if stored := cc.Encode(large); len(stored) >= len(large)/4 {
+		t.Errorf("compressed %d bytes to %d", len(large), len(stored))
+	}
+	// Entries from before the format byte are plain JSON
+	if got, err := decodeCached(small); err != nil || !bytes.Equal(got, small) {
+		t.Errorf("legacy entry: %q, %v", got, err)
+	}
+}
+
+func TestDecodeCachedRejectsCorruptEntries(t *testing.T) {
+	gz := newCacheCodec(1).Encode([]byte(`{"products":[` + strings.Repeat(`1,`, 500) + `1]}`))
+	flipped := bytes.Clone(gz)
+	flipped[len(flipped)-6] ^= 0xff // inside the CRC trailer
+	for name, stored := range map[string][]byte{
+		"empty":          {},
+		"format only":    {codecRaw},
+		"truncated raw":  append([]byte{codecRaw}, `{"user":{"id":`...),
+		"not an object":  append([]byte{codecRaw}, `"OK"`...),
+		"truncated gzip": gz[:len(gz)/2],
+		"bad crc":        flipped,
+		"not gzip":       append([]byte{codecGzip}, `{}`...),
+	} {
+		if got, err := decodeCached(stored); !errors.Is(err, errCorruptCacheEntry) {
+			t.Errorf("%s: decodeCached = %q, %v, want errCorruptCacheEntry", name, got, err)
+		}
+	}
+}
+
+func TestCorruptSummaryIsAMiss(t *testing.T) {
+	mr, rdb := testRedis(t)
+	svc := summaryService(t, rdb)
+	key := summaryKeyPrefix(testUserID) + "v1:corrupt"
+	mr.Set(key, string([]byte{codecRaw})+`{"user":{"id":`)
+
+	built := 0
+	res, err := svc.Summary(context.Background(), key, testUserID, func(context.Context) (BuiltSummary, error) {
+		built++
+		return BuiltSummary{Payload: []byte(`{"user":{"id":"u"}}`)}, nil
+	})
+	if err != nil || built != 1 || res.Outcome != "miss" {
+		t.Fatalf("got %q (%s), %v after %d builds, want one rebuild", res.Payload, res.Outcome, err, built)
+	}
+	// The corrupt entry was dropped and the rebuild stored in its place
+	waitDeferredWrites()
+	stored, _ := mr.Get(key)
+	if got, err := decodeCached([]byte(stored)); err != nil || string(got) != `{"user":{"id":"u"}}` {
+		t.Errorf("cached after rebuild: %q, %v", got, err)
+	}
+}
+
+func TestCorruptIdempotencyEntryIsProcessedAgain(t *testing.T) {
+	_, rdb := testRedis(t)
+	checkouts := 0
+	app, _ := replayApp(t, rdb, &checkouts)
+	rdb.Set(context.Background(), idempotencyRedisKey("pay-1"), strings.Repeat("ab", 32)+string([]byte{codecRaw})+`{"orderId":`, 0)
+
+	resp, body := send(t, app, newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID, PaymentRef: "pay-1"}))
+	if resp.Header.Get(headerIdempotentReplay) != "" || checkouts != 1 || string(body) != `{"orderId":"new"}` {
+		t.Errorf("got %s (replay %q, %d checkouts), want a fresh checkout", body, resp.Header.Get(headerIdempotentReplay), checkouts)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The overview reads the user cache and then the summary cache before it
+// touches Postgres. Both keys are known up front, so PrefetchOverview
+// fetches them in one pipelined round trip and the lookups pick the
+// results up from the context instead of going back to Redis.
+
+type prefetchKey struct{}
+
+type prefetched struct {
+	mu   sync.Mutex
+	cmds map[string]*redis.StringCmd
+}
+
+// PrefetchOverview reads the user and summary entries for an overview
+// request (plus the stale copy in swr mode) in one round trip
+func (s *UserOverviewService) PrefetchOverview(
+	ctx context.Context,
+	userID, summaryKey string,
+) context.Context {
+	keys := []string{userCacheKey(userID), summaryKey}
+	if s.cache.Strategy == "swr" {
+		keys = append(keys, summaryKey+staleSuffix)
+	}
+	return s.prefetch(ctx, keys...)
+}
+
+// prefetch GETs keys in one pipeline and returns a context carrying the
+// results. Each result is handed out once, so a later read of the same key
+// goes back to Redis. A failed pipeline leaves every command holding the
+// error, so each lookup bypasses the cache exactly as its own GET would.
+func (s *UserOverviewService) prefetch(ctx context.Context, keys ...string) context.Context {
+	spanCtx, span := startSpan(ctx, "overview.prefetch")
+	pipe := s.rdb.Pipeline()
+	p := &prefetched{cmds: make(map[string]*redis.StringCmd, len(keys))}
+	for _, key := range keys {
+		p.cmds[key] = pipe.Get(spanCtx, key)
+	}
+	// Misses come back as redis.Nil; every error is read off its command
+	_, err := pipe.Exec(spanCtx)
+	if err == redis.Nil {
+		err = nil
+	}
+	endSpan(span, err)
+	return context.WithValue(ctx, prefetchKey{}, p)
+}
+
+// cachedGet returns the prefetched GET for key, or runs it now
+func (s *UserOverviewService) cachedGet(ctx context.Context, key string) *redis.StringCmd {
+	if p, _ := ctx.Value(prefetchKey{}).(*prefetched); p != nil {
+		p.mu.Lock()
+		cmd, ok := p.cmds[key]
+		delete(p.cmds, key)
+		p.mu.Unlock()
+		if ok {
+			return cmd
+		}
+	}
+	return s.rdb.Get(ctx, key)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "overview_cache_lookups_total",
+	Help: "Overview cache lookups, by cache (user, summary, reco, segment, cart, order) and outcome (hit, stale, miss, bypass).",
+}, []string{"cache", "outcome"})
+
+// cacheCounters are the in-process totals behind /v1/internal/cache-stats
+type cacheCounters struct {
+	hits, stale, misses, bypasses atomic.Uint64
+}
+
+var (
+	cacheStats = map[string]*cacheCounters{
+		"user":    {},
+		"summary": {},
+		"reco":    {},
+		"segment": {},
+		"cart":    {},
+		"order":   {},
+	}
+	cacheStatsSince = time.Now()
+)
+
+// recordCache counts one lookup in Prometheus, in process and in Redis
+// (metrics:cache:{cache}:{outcome}), the last so both benchmark services
+// can be compared from the same place. Bypasses mean Redis is failing, so
+// they skip the Redis counter.
+func (s *UserOverviewService) recordCache(ctx context.Context, cache, outcome string) {
+	cacheLookups.WithLabelValues(cache, outcome).Inc()
+
+	counters := cacheStats[cache]
+	switch outcome {
+	case "hit":
+		counters.hits.Add(1)
+	case "stale":
+		counters.stale.Add(1)
+	case "miss":
+		counters.misses.Add(1)
+	case "bypass":
+		counters.bypasses.Add(1)
+		return
+	}
+	if isCacheBypassed(ctx) {
+		return
+	}
+	if err := s.rdb.Incr(ctx, "metrics:cache:"+cache+":"+outcome).Err(); err != nil {
+		cacheBypassed(ctx, "incr_cache_stats", err)
+	}
+}
+
+// CacheStats is one cache's counts since process start. HitRatio counts
+// stale serves as hits; it is 0 before the first lookup.
+type CacheStats struct {
+	Hits     uint64  `json:"hits"`
+	Stale    uint64  `json:"stale"`
+	Misses   uint64  `json:"misses"`
+	Bypasses uint64  `json:"bypasses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+func (c *cacheCounters) snapshot() CacheStats {
+	st := CacheStats{
+		Hits:     c.hits.Load(),
+		Stale:    c.stale.Load(),
+		Misses:   c.misses.Load(),
+		Bypasses: c.bypasses.Load(),
+	}
+	if total := st.Hits + st.Stale + st.Misses + st.Bypasses; total > 0 {
+		st.HitRatio = float64(st.Hits+st.Stale) / float64(total)
+	}
+	return st
+}
+
+func cacheStatsHandler(c *fiber.Ctx) error {
+	body := fiber.Map{"since": cacheStatsSince.UTC().Format(time.RFC3339)}
+	for name, counters := range cacheStats {
+		body[name] = counters.snapshot()
+	}
+	return c.JSON(body)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// ttlPolicy decides how long cache entries live. Every TTL is scaled by a
+// random factor in [1-jitter, 1+jitter], so a cohort of users whose
+// entries were written together doesn't hit Postgres in the same second
+// when they expire.
+type ttlPolicy struct {
+	jitter float64
+}
+
+func newTTLPolicy(jitter float64) ttlPolicy {
+	return ttlPolicy{jitter: jitter}
+}
+
+// TTL returns base with jitter applied
+func (p ttlPolicy) TTL(base time.Duration) time.Duration {
+	return p.scale(base, p.factor())
+}
+
+// Pair jitters base and a longer companion TTL by the same factor, keeping
+// the companion the longer of the two (the swr stale copy must outlive the
+// fresh entry)
+func (p ttlPolicy) Pair(base, longer time.Duration) (time.Duration, time.Duration) {
+	f := p.factor()
+	return p.scale(base, f), p.scale(longer, f)
+}
+
+func (p ttlPolicy) factor() float64 {
+	if p.jitter == 0 {
+		return 1
+	}
+	return 1 + p.jitter*(2*rand.Float64()-1)
+}
+
+func (p ttlPolicy) scale(d time.Duration, f float64) time.Duration {
+	return max(time.Duration(float64(d)*f), time.Second)
+}
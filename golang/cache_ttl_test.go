@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLJitterStaysInBounds(t *testing.T) {
+	const base = 30 * time.Second
+	p := newTTLPolicy(0.2)
+	lo, hi := base, base
+	for range 10_000 {
+		ttl := p.TTL(base)
+		if ttl < 24*time.Second || ttl > 36*time.Second {
+			t.Fatalf("TTL = %s, want within 30s ± 20%%", ttl)
+		}
+		lo, hi = min(lo, ttl), max(hi, ttl)
+	}
+	// Spread across the range rather than stuck near the base
+	if lo > 25*time.Second || hi < 35*time.Second {
+		t.Errorf("TTLs spanned %s-%s, want most of 24s-36s", lo, hi)
+	}
+}
+
+func TestTTLPairKeepsTheCompanionLonger(t *testing.T) {
+	p := newTTLPolicy(0.5)
+	for range 1000 {
+		fresh, stale := p.Pair(30*time.Second, 10*time.Minute)
+		if r := float64(stale) / float64(fresh); r < 19.99 || r > 20.01 {
+			t.Fatalf("Pair = %s, %s, want both scaled by the same factor", fresh, stale)
+		}
+	}
+}
+
+func TestTTLWithoutJitter(t *testing.T) {
+	p := newTTLPolicy(0)
+	if got := p.TTL(30 * time.Second); got != 30*time.Second {
+		t.Errorf("TTL = %s, want 30s unchanged", got)
+	}
+	// Never rounds a short TTL down to "no expiry"
+	if got := newTTLPolicy(0.9).TTL(time.Second); got < time.Second {
+		t.Errorf("TTL = %s, want at least 1s", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	catA = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+	catB = "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb"
+)
+
+// summaryKeyApp answers with the v1 summary key of the parsed query
+func summaryKeyApp(t *testing.T, maxCategories int) *fiber.App {
+	_, rdb := testRedis(t)
+	cfg := testConfig(t)
+	cfg.Overview.MaxCategories = maxCategories
+	svc := summaryService(t, rdb)
+	h := NewUserOverviewHandler(svc, cfg.Overview)
+	app := fiber.New()
+	app.Get("/users/:userId/overview", func(c *fiber.Ctx) error {
+		q, err := h.parseOverviewQuery(c)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.SendString(svc.SummaryKey("v1", q))
+	})
+	return app
+}
+
+func TestCategoryListsShareOneSummaryKey(t *testing.T) {
+	app := summaryKeyApp(t, 3)
+	keys := map[string]bool{}
+	for _, query := range []string{
+		"categoryId=" + catA + "," + catB,
+		"categoryId=" + catB + "," + catA,
+		"categoryId=" + catB + "&categoryId=" + strings.ToUpper(catA),
+		"categoryId=" + catA + ",%20" + catB + "," + catA + ",",
+	} {
+		resp, body := send(t, app, newRequest(http.MethodGet, "/users/"+testUserID+"/overview?"+query, nil))
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s: status = %d: %s", query, resp.StatusCode, body)
+		}
+		keys[string(body)] = true
+	}
+	if len(keys) != 1 {
+		t.Errorf("equivalent category lists made %d summary keys: %v", len(keys), keys)
+	}
+	for key := range keys {
+		if !strings.Contains(key, catA+","+catB) {
+			t.Errorf("key %s doesn't list the categories in order", key)
+		}
+	}
+}
+
+func TestCategoryListValidation(t *testing.T) {
+	app := summaryKeyApp(t, 2)
+	for _, query := range []string{
+		"categoryId=" + catA + ",not-a-uuid",
+		"categoryId=" + catA + "," + catB + ",cccccccc-cccc-cccc-cccc-cccccccccccc",
+	} {
+		resp, body := send(t, app, newRequest(http.MethodGet, "/users/"+testUserID+"/overview?"+query, nil))
+		e, _ := decode(t, body)["error"].(map[string]any)
+		if resp.StatusCode != 400 || e["code"] != "INVALID_QUERY" || !strings.Contains(string(body), "categoryId") {
+			t.Errorf("%s: got %d %s, want 400 INVALID_QUERY on categoryId", query, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestOverviewFiltersByEveryListedCategory(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	first, second, third := seedCategory(t, db), seedCategory(t, db), seedCategory(t, db)
+	want := []string{
+		seedProductIn(t, db, first, "CAT-1", 5, 5),
+		seedProductIn(t, db, second, "CAT-2", 5, 5),
+	}
+	seedProductIn(t, db, third, "CAT-3", 5, 5)
+	slices.Sort(want)
+
+	for _, v := range []string{"v1", "v2"} {
+		target := fmt.Sprintf("/%s/users/%s/overview?categoryId=%s,%s", v, user, first, second)
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", v, resp.StatusCode, body)
+		}
+		got := productIDs(t, body)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: products = %v, want %v", v, got, want)
+		}
+	}
+}
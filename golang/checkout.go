@@ -2,30 +2,49 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+	"loastest-go/events"
 )
 
 type CheckoutHandler struct {
-	db                *pgxpool.Pool
-	rdb               *redis.Client
-	warehouseByRegion map[string]string
+	db       *pgxpool.Pool
+	rdb      *redis.Client
+	cfg      config.CheckoutConfig
+	failOpen config.RedisFailOpenConfig
+	codec    cacheCodec
+	segments *segmentStore
+	taxes    *taxRates
+	// summaries drops the summaries an order changes
+	summaries *summaryInvalidator
+	stats     *CheckoutStats
+	// now is the clock coupon validity and payment webhook timestamps are
+	// judged by; time.Now outside of tests
+	now func() time.Time
 }
 
 type CheckoutRequest struct {
-	UserID     string         `json:"userId"`
+	UserID string `json:"userId"`
+	// CartID is optional: without it checkout runs in direct mode and
+	// charges Items at the products' current prices
 	CartID     string         `json:"cartId"`
 	Items      []CheckoutItem `json:"items"`
 	Coupon     string         `json:"coupon"`
 	PaymentRef string         `json:"paymentRef"`
+	// ShippingMethod is standard (the default), express or overnight
+	ShippingMethod string `json:"shippingMethod"`
 }
 
 type CheckoutItem struct {
@@ -34,187 +53,271 @@ type CheckoutItem struct {
 }
 
 type CheckoutResponse struct {
-	OrderID string  `json:"orderId"`
-	Status  string  `json:"status"`
-	Total   float64 `json:"total"`
+	OrderID string `json:"orderId"`
+	// OrderNumber is the human-readable ORD-yyyy-nnnnnnnnn form
+	OrderNumber string  `json:"orderNumber"`
+	Status      string  `json:"status"`
+	Total       float64 `json:"total"`
+	// Mode is cart or direct
+	Mode string `json:"mode"`
+	// items is how many products the order has, for CheckoutStats
+	items int
+	// total is Total in cents, for the leaderboard
+	total Cents
 }
 
 type CartItemDB struct {
 	ProductID string
 	Qty       int
-	UnitPrice float64
+	UnitPrice Cents
 	Status    string
+	// CategoryID is the product's category, nil when it has none
+	CategoryID *string
 }
 
 type CouponDB struct {
-	Code      string
-	Type      string
-	Value     float64
+	Code string
+	Type string
+	// Value is the fixed amount, or for a percentage coupon the percent
+	// in hundredths (1500 is 15%), as both are stored with two decimals
+	Value     Cents
 	MaxUses   *int
 	UsedCount int
 	StartsAt  time.Time
 	EndsAt    time.Time
+	// MinOrderAmount is the subtotal the order must reach, if set
+	MinOrderAmount *Cents
+	// ApplicableCategoryID restricts the coupon to products in one
+	// category, if set
+	ApplicableCategoryID *string
 }
 
-func NewCheckoutHandler(db *pgxpool.Pool, rdb *redis.Client) *CheckoutHandler {
+func NewCheckoutHandler(
+	db *pgxpool.Pool,
+	rdb *redis.Client,
+	cfg config.CheckoutConfig,
+	failOpen config.RedisFailOpenConfig,
+	codec cacheCodec,
+	segments *segmentStore,
+	taxes *taxRates,
+	summaries *summaryInvalidator,
+	stats *CheckoutStats,
+) *CheckoutHandler {
 	return &CheckoutHandler{
-		db:  db,
-		rdb: rdb,
-		warehouseByRegion: map[string]string{
-			"us-east":      "11111111-1111-1111-1111-111111111111",
-			"us-west":      "22222222-2222-2222-2222-222222222222",
-			"eu-west":      "33333333-3333-3333-3333-333333333333",
-			"ap-southeast": "44444444-4444-4444-4444-444444444444",
-		},
+		db:       db,
+		rdb:      rdb,
+		cfg:      cfg,
+		failOpen: failOpen,
+		codec:    codec,
+		segments: segments,
+		taxes:    taxes,
+
+		summaries: summaries,
+		stats:     stats,
+		now:       time.Now,
 	}
 }
 
 func (h *CheckoutHandler) Checkout(c *fiber.Ctx) error {
-	ctx := c.Context()
+	ctx := c.UserContext()
 
-	var req CheckoutRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).
-			JSON(fiber.Map{"error": err.Error()})
+	req, err := h.parseRequest(c)
+	if err != nil {
+		return writeError(c, err)
 	}
 
-	// Validate required fields
-	if req.UserID == "" || req.CartID == "" || req.PaymentRef == "" {
-		return c.Status(fiber.StatusBadRequest).
-			JSON(fiber.Map{"error": "userId, cartId, and paymentRef are required"})
-	}
-	if len(req.Items) == 0 {
-		return c.Status(fiber.StatusBadRequest).
-			JSON(fiber.Map{"error": "items are required"})
+	key := checkoutIdempotencyKey(c.Get(headerIdempotencyKey), req)
+	payload, replayed, err := h.processCheckout(ctx, req, key)
+	if err != nil {
+		return writeError(c, err)
 	}
 
-	result, err := h.processCheckout(ctx, req)
-	if err != nil {
-		status := fiber.StatusInternalServerError
-		switch err.Error() {
-		case "Rate limit exceeded":
-			status = fiber.StatusTooManyRequests
-		case "Checkout in progress":
-			status = fiber.StatusConflict
-		case "Cart not found or not open",
-			"Cart is empty",
-			"Invalid or expired coupon",
-			"Coupon already used":
-			status = fiber.StatusBadRequest
-		case "Insufficient inventory":
-			status = fiber.StatusConflict
-		}
-		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	if replayed {
+		c.Set(headerIdempotentReplay, "true")
 	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(payload)
+}
 
-	return c.JSON(result)
+// parseRequest decodes and validates the checkout body, defaulting the
+// shipping method
+func (h *CheckoutHandler) parseRequest(c *fiber.Ctx) (CheckoutRequest, error) {
+	return h.decodeRequest(c, true)
+}
+
+// decodeRequest decodes and validates a checkout body; a quote doesn't
+// need its paymentRef
+func (h *CheckoutHandler) decodeRequest(c *fiber.Ctx, requirePaymentRef bool) (CheckoutRequest, error) {
+	var req CheckoutRequest
+	if len(c.Body()) > h.cfg.MaxBodyBytes {
+		return req, ErrBodyTooLarge
+	}
+	if err := decodeStrict(c.Body(), &req); err != nil {
+		return req, err
+	}
+	if details := h.validate(req, requirePaymentRef); len(details) > 0 {
+		return req, ErrValidation.WithDetails(details)
+	}
+	req.ShippingMethod = shippingMethodOrDefault(req.ShippingMethod)
+	if _, ok := shippingTiers[req.ShippingMethod]; !ok {
+		return req, ErrInvalidShipping.WithDetails(fiber.Map{
+			"shippingMethod": req.ShippingMethod, "allowed": shippingMethods,
+		})
+	}
+	return req, nil
 }
 
+// processCheckout returns the encoded CheckoutResponse, which a replay
+// sends back byte for byte from the idempotency entry or record. replayed
+// reports that it is such a replay.
 func (h *CheckoutHandler) processCheckout(
 	ctx context.Context,
 	req CheckoutRequest,
-) (*CheckoutResponse, error) {
-	idempotencyKey := "idem:checkout:" + req.PaymentRef
-
-	// 0) Idempotency check (Redis)
-	existing, err := h.rdb.Get(ctx, idempotencyKey).Result()
-	if err == nil && existing != "" {
-		var resp CheckoutResponse
-		json.Unmarshal([]byte(existing), &resp)
-		return &resp, nil
+	key string,
+) (payload []byte, replayed bool, err error) {
+	idempotencyKey := idempotencyRedisKey(key)
+	fingerprint := requestFingerprint(req)
+
+	// 0) Idempotency reservation (Redis), backed by idempotency_keys for
+	// a key whose Redis entry has expired or been flushed. Without Redis
+	// locks idempotency_keys is all there is.
+	redisLocks := h.cfg.LockBackend == "redis"
+	spanCtx, span := startSpan(ctx, "checkout.idempotency_check")
+	var replay []byte
+	release := func() {}
+	if redisLocks {
+		replay, release, err = h.reserveIdempotency(spanCtx, idempotencyKey, fingerprint)
+	}
+	if err == nil && replay == nil {
+		replay, err = h.loadIdempotencyRecord(spanCtx, key, fingerprint)
+		if replay != nil && redisLocks {
+			// Ours now, so the placeholder can become the entry again
+			h.rdb.SetEx(spanCtx, idempotencyKey, h.idempotencyEntry(fingerprint, replay), idempotencyCacheTTL)
+		} else if err != nil {
+			release()
+		}
 	}
-
-	// 1) Rate limit (Redis)
-	currentMinute := time.Now().Unix() / 60
-	rlKey := fmt.Sprintf("rl:user:%s:checkout:%d", req.UserID, currentMinute)
-	count, err := h.rdb.Incr(ctx, rlKey).Result()
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	if count == 1 {
-		h.rdb.Expire(ctx, rlKey, 90*time.Second)
+	if replay != nil {
+		return replay, true, nil
 	}
-	if count > 10 {
-		return nil, errors.New("Rate limit exceeded")
+	// A failed checkout frees the key for a retry; once the order has
+	// committed the placeholder stays until the response replaces it
+	committed := false
+	defer func() {
+		if !committed {
+			release()
+		}
+	}()
+
+	// 2) Distributed locks (Redis); the postgres backend takes them in
+	// the transaction instead
+	if redisLocks {
+		spanCtx, span = startSpan(ctx, "checkout.lock")
+		releaseLocks, err := h.acquireCheckoutLocks(spanCtx, req)
+		endSpan(span, err)
+		if err != nil {
+			return nil, false, err
+		}
+		defer releaseLocks()
 	}
 
-	// 2) Distributed lock (Redis)
-	lockKey := "lock:checkout:" + req.UserID
-	locked, err := h.rdb.SetNX(ctx, lockKey, "1", 5*time.Second).Result()
-	if err != nil {
-		return nil, err
-	}
-	if !locked {
-		return nil, errors.New("Checkout in progress")
-	}
-	defer h.rdb.Del(ctx, lockKey)
+	// Past this point a disconnect or request timeout must not leave
+	// half-finished state (an order committed without its idempotency
+	// record, so a retry charges twice). The rest runs detached from the
+	// request, bounded by CHECKOUT_TX_TIMEOUT, which is shorter than the
+	// lock TTL.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.cfg.TxTimeout)
+	defer cancel()
 
 	// Execute transaction
-	result, err := h.executeCheckoutTransaction(ctx, req)
+	spanCtx, span = startSpan(ctx, "checkout.transaction")
+	txStart := time.Now()
+	result, responseJSON, err := h.executeCheckoutTransaction(spanCtx, req, key, fingerprint)
+	h.stats.observeTransaction(txStart, err)
+	endSpan(span, err)
+	if isIdempotencyKeyTaken(err) {
+		// A concurrent checkout with this key won, which only happens
+		// when Redis wasn't guarding it; replay what that one stored
+		replay, err := h.loadIdempotencyRecord(ctx, key, fingerprint)
+		if err == nil && replay == nil {
+			err = ErrCheckoutPending
+		}
+		return replay, replay != nil, err
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	committed = true
+	h.stats.orderItems.Observe(float64(result.items))
+
+	// 4) Post-commit Redis work, after the response
+	afterResponse(ctx, "post_commit", func(ctx context.Context) error {
+		spanCtx, span := startSpan(ctx, "checkout.post_commit")
+		err := h.postCommitRedisOps(spanCtx, req.UserID, result.OrderID, result.total)
+		endSpan(span, err)
+		return err
+	})
 
-	// 5) Store idempotency response
-	responseJSON, _ := json.Marshal(result)
-	h.rdb.SetEx(ctx, idempotencyKey, string(responseJSON), 10*time.Minute)
+	// 5) Cache the idempotency response; idempotency_keys already has it
+	if redisLocks {
+		h.rdb.SetEx(ctx, idempotencyKey, h.idempotencyEntry(fingerprint, responseJSON), idempotencyCacheTTL)
+	}
 
-	return result, nil
+	return responseJSON, false, nil
 }
 
+// executeCheckoutTransaction places the order and returns it with its
+// encoded response, which is recorded under key in idempotency_keys in
+// the same transaction
 func (h *CheckoutHandler) executeCheckoutTransaction(
 	ctx context.Context,
 	req CheckoutRequest,
-) (*CheckoutResponse, error) {
+	key, fingerprint string,
+) (*CheckoutResponse, []byte, error) {
 	tx, err := h.db.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer tx.Rollback(ctx)
+	// Roll back even when ctx has expired, so the locks are released now
+	// rather than when the server notices the cancelled connection
+	defer tx.Rollback(context.WithoutCancel(ctx))
 
-	// 3.1) Validate cart ownership & open status (row lock)
-	var cartID, cartStatus string
-	err = tx.QueryRow(
-		ctx,
-		`SELECT id, status FROM carts WHERE id = $1 AND user_id = $2 FOR UPDATE`,
-		req.CartID,
-		req.UserID,
-	).Scan(&cartID, &cartStatus)
-	if err != nil || cartStatus != "open" {
-		return nil, errors.New("Cart not found or not open")
+	// 3.0) Reject inactive users before taking any locks. The region
+	// picks both the warehouse and the tax rate.
+	region, err := h.getUserRegion(ctx, tx, req.UserID)
+	if err != nil {
+		return nil, nil, err
 	}
+	warehouseID := warehouseForRegion(region)
 
-	// 3.2) Load items from DB
-	rows, err := tx.Query(ctx, `
-		SELECT ci.product_id, ci.qty, ci.unit_price, p.status
-		FROM cart_items ci
-		JOIN products p ON p.id = ci.product_id
-		WHERE ci.cart_id = $1`, req.CartID)
-	if err != nil {
-		return nil, err
+	if h.cfg.LockBackend == "postgres" {
+		if err := h.lockCheckoutTx(ctx, tx, req); err != nil {
+			return nil, nil, err
+		}
 	}
-	defer rows.Close()
 
+	// 3.1) The items to charge: the cart's, or in direct mode the
+	// requested ones at current product prices
 	var cartItems []CartItemDB
-	for rows.Next() {
-		var item CartItemDB
-		err := rows.Scan(
-			&item.ProductID,
-			&item.Qty,
-			&item.UnitPrice,
-			&item.Status,
-		)
-		if err != nil {
-			return nil, err
+	if req.CartID == "" {
+		cartItems, err = loadDirectItems(ctx, tx, req.Items, true)
+	} else {
+		cartItems, err = loadCartItems(ctx, tx, req.UserID, req.CartID, true)
+		// Charge only for what the client agreed to
+		if mismatches := matchCart(req.Items, cartItems); err == nil && len(mismatches) > 0 {
+			err = ErrCartMismatch.WithDetails(mismatches)
 		}
-		cartItems = append(cartItems, item)
 	}
-	if len(cartItems) == 0 {
-		return nil, errors.New("Cart is empty")
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// 3.3) Coupon validation + usage lock
-	var discount float64
+	var discount Cents
 	if req.Coupon != "" {
 		discount, err = h.processCoupon(
 			ctx,
@@ -224,127 +327,271 @@ func (h *CheckoutHandler) executeCheckoutTransaction(
 			cartItems,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	// 3.4) Inventory reservation (lock rows)
-	warehouseID, err := h.getWarehouseForUser(ctx, tx, req.UserID)
+	// 3.4) Inventory reservation
+	err = h.reserveInventory(ctx, tx, cartItems, warehouseID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	err = h.reserveInventory(ctx, tx, cartItems, warehouseID)
+
+	// 3.5) Compute totals, exactly as a quote does
+	price := priceOrder(cartItems, discount, h.taxes.Rate(region), req.ShippingMethod)
+	subtotal, discount, tax, shipping, total := price.Subtotal, price.Discount, price.Tax, price.Shipping, price.Total
+	taxRate := price.TaxRate
+
+	// 3.6) Create order + items, close the cart and log the event
+	orderID := uuid.New().String()
+	orderNumber, err := nextOrderNumber(ctx, tx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// The items' columns go over as parallel arrays (text[] for the ids,
+	// as pgx has no binary uuid[] encoding for []string)
+	itemIDs := make([]string, len(cartItems))
+	productIDs := make([]string, len(cartItems))
+	qtys := make([]int, len(cartItems))
+	prices := make([]Cents, len(cartItems))
+	for i, item := range cartItems {
+		itemIDs[i] = uuid.New().String()
+		productIDs[i], qtys[i], prices[i] = item.ProductID, item.Qty, item.UnitPrice
+	}
+	payload, err := events.Marshal(&events.OrderCreatedPayload{
+		OrderID:     orderID,
+		OrderNumber: orderNumber,
+		Total:       total.Dollars(),
+		CartID:      req.CartID,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	stmts := []batchStmt{
+		{"create order", `
+			INSERT INTO orders(id, order_number, user_id, status, subtotal, discount, tax, tax_rate,
+				shipping, shipping_method, total, coupon_code, payment_ref, created_at)
+			VALUES($1, $2, $3, 'pending', $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), $12, NOW())`,
+			[]any{orderID, orderNumber, req.UserID, subtotal, discount, tax, taxRate, shipping,
+				req.ShippingMethod, total, req.Coupon, req.PaymentRef}},
+		{"create order items", `
+			INSERT INTO order_items(id, order_id, product_id, qty, unit_price)
+			SELECT t.id::uuid, $1, t.product_id::uuid, t.qty, t.unit_price
+			FROM unnest($2::text[], $3::text[], $4::int[], $5::numeric[])
+				AS t(id, product_id, qty, unit_price)`,
+			[]any{orderID, itemIDs, productIDs, qtys, prices}},
+		// What the reservation sweeper gives back if the order is still
+		// pending once they expire
+		{"record reservations", `
+			INSERT INTO inventory_reservations(order_id, product_id, warehouse_id, qty, created_at, expires_at)
+			SELECT $1, t.product_id::uuid, $2, t.qty, NOW(), NOW() + make_interval(secs => $5)
+			FROM unnest($3::text[], $4::int[]) AS t(product_id, qty)`,
+			[]any{orderID, warehouseID, productIDs, qtys, h.cfg.ReservationTTL.Seconds()}},
+		{"log order event", `
+			INSERT INTO events(id, user_id, type, payload_json, created_at)
+			VALUES($1, $2, $3, $4, NOW())`,
+			[]any{uuid.New().String(), req.UserID, events.OrderCreated, payload}},
+		// Published to the stream by the outbox relay once this commits
+		outboxEntry(orderEventsStream, map[string]string{
+			"type":    events.OrderCreated,
+			"userId":  req.UserID,
+			"orderId": orderID,
+			"total":   strconv.FormatFloat(total.Dollars(), 'f', -1, 64),
+		}),
+	}
+	mode := "direct"
+	if req.CartID != "" {
+		mode = "cart"
+		stmts = append(stmts, batchStmt{"close cart",
+			`UPDATE carts SET status = 'closed', updated_at = NOW() WHERE id = $1`,
+			[]any{req.CartID}})
+	}
+	resp := &CheckoutResponse{
+		OrderID:     orderID,
+		OrderNumber: orderNumber,
+		Status:      "pending",
+		Total:       total.Dollars(),
+		Mode:        mode,
+		items:       len(cartItems),
+		total:       total,
+	}
+	responseJSON, err := jsonMarshal(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The key's primary key makes a concurrent checkout with the same key
+	// wait for this one and then fail, rather than order twice
+	stmts = append(stmts, batchStmt{"record idempotency key", `
+		INSERT INTO idempotency_keys(key, user_id, request_hash, response_json, created_at)
+		VALUES($1, $2, $3, $4, NOW())`,
+		[]any{key, req.UserID, fingerprint, string(responseJSON)}})
+	if err := execBatch(ctx, tx, stmts...); err != nil {
+		return nil, nil, err
 	}
 
-	// 3.5) Compute totals
-	var subtotal float64
-	for _, item := range cartItems {
-		subtotal += float64(item.Qty) * item.UnitPrice
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	tax := computeTax(subtotal - discount)
-	shipping := computeShipping(subtotal, len(cartItems))
-	total := maxFloat(0, subtotal-discount+tax+shipping)
+	return resp, responseJSON, nil
+}
 
-	// 3.6) Create order + items
-	orderID := uuid.New().String()
-	_, err = tx.Exec(ctx, `
-		INSERT INTO orders(id, user_id, status, subtotal, discount, tax, shipping, total, created_at)
-		VALUES($1, $2, 'pending', $3, $4, $5, $6, $7, NOW())`,
-		orderID, req.UserID, subtotal, discount, tax, shipping, total)
+// loadCartItems returns the items of the user's open cart, locking the
+// cart unless lock is false (a read-only transaction can't lock rows)
+func loadCartItems(ctx context.Context, tx pgx.Tx, userID, cartID string, lock bool) ([]CartItemDB, error) {
+	// Validate cart ownership & open status (row lock)
+	var cartStatus string
+	err := tx.QueryRow(
+		ctx,
+		`SELECT status FROM carts WHERE id = $1 AND user_id = $2`+lockClause(lock, "FOR UPDATE"),
+		cartID,
+		userID,
+	).Scan(&cartStatus)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && cartStatus != "open") {
+		return nil, ErrCartNotFound
+	}
+	if err != nil {
+		return nil, dbError("load cart", err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT ci.product_id, ci.qty, ci.unit_price, p.status, p.category_id::text
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1`, cartID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	// Insert order items
-	for _, item := range cartItems {
-		_, err = tx.Exec(
-			ctx,
-			`
-			INSERT INTO order_items(id, order_id, product_id, qty, unit_price)
-			VALUES($1, $2, $3, $4, $5)`,
-			uuid.New().
-				String(),
-			orderID,
-			item.ProductID,
-			item.Qty,
-			item.UnitPrice,
+	var cartItems []CartItemDB
+	for rows.Next() {
+		var item CartItemDB
+		err := rows.Scan(
+			&item.ProductID,
+			&item.Qty,
+			&item.UnitPrice,
+			&item.Status,
+			&item.CategoryID,
 		)
 		if err != nil {
 			return nil, err
 		}
+		cartItems = append(cartItems, item)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load cart items", err)
+	}
+	if len(cartItems) == 0 {
+		return nil, ErrCartEmpty
+	}
+	return cartItems, nil
+}
 
-	// 3.7) Mark cart closed
-	_, err = tx.Exec(
-		ctx,
-		`UPDATE carts SET status = 'closed', updated_at = NOW() WHERE id = $1`,
-		req.CartID,
-	)
-	if err != nil {
-		return nil, err
+// lockClause returns clause, a row-locking clause, or "" when lock is
+// false
+func lockClause(lock bool, clause string) string {
+	if !lock {
+		return ""
 	}
+	return " " + clause
+}
 
-	// 3.8) Event log
-	payload, _ := json.Marshal(map[string]interface{}{
-		"orderId": orderID,
-		"total":   total,
-		"cartId":  req.CartID,
-	})
-	_, err = tx.Exec(ctx, `
-		INSERT INTO events(user_id, type, payload_json, created_at)
-		VALUES($1, 'ORDER_CREATED', $2, NOW())`,
-		req.UserID, string(payload))
+// loadDirectItems prices the requested items from the products table.
+// With lock, FOR SHARE keeps the prices from changing before the order
+// commits; an unknown product is a PRODUCT_NOT_FOUND listing every
+// missing id.
+func loadDirectItems(ctx context.Context, tx pgx.Tx, requested []CheckoutItem, lock bool) ([]CartItemDB, error) {
+	// Canonical ids, since validation accepts any UUID spelling
+	ids := make([]string, len(requested))
+	for i, it := range requested {
+		ids[i] = uuid.MustParse(it.ProductID).String()
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT id::text, price, status, category_id::text
+		FROM products
+		WHERE id = ANY($1::text[]::uuid[])`+lockClause(lock, "FOR SHARE"), ids)
 	if err != nil {
-		return nil, err
+		return nil, dbError("load products", err)
 	}
+	defer rows.Close()
 
-	err = tx.Commit(ctx)
-	if err != nil {
-		return nil, err
+	found := make(map[string]CartItemDB, len(requested))
+	for rows.Next() {
+		var item CartItemDB
+		if err := rows.Scan(&item.ProductID, &item.UnitPrice, &item.Status, &item.CategoryID); err != nil {
+			return nil, err
+		}
+		found[item.ProductID] = item
 	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load products", err)
+	}
+
+	items := make([]CartItemDB, 0, len(requested))
+	var missing []string
+	for i, it := range requested {
+		item, ok := found[ids[i]]
+		if !ok {
+			missing = append(missing, it.ProductID)
+			continue
+		}
+		item.Qty = it.Qty
+		items = append(items, item)
+	}
+	if len(missing) > 0 {
+		return nil, ErrProductNotFound.WithDetails(fiber.Map{"productIds": missing})
+	}
+	return items, nil
+}
 
-	// 4) Post-commit Redis work
-	h.postCommitRedisOps(ctx, req.UserID, orderID, total)
+// batchStmt is one statement for execBatch; name labels its failure
+type batchStmt struct {
+	name string
+	sql  string
+	args []any
+}
 
-	return &CheckoutResponse{
-		OrderID: orderID,
-		Status:  "pending",
-		Total:   total,
-	}, nil
+// execBatch sends stmts in one round trip, so writes queued at the end of
+// the transaction don't each hold its row locks for another round trip.
+// Results are checked in order; the first failure is returned wrapped
+// with its statement's name, and the caller's rollback undoes the rest.
+func execBatch(ctx context.Context, tx pgx.Tx, stmts ...batchStmt) error {
+	_, err := execBatchTags(ctx, tx, stmts...)
+	return err
 }
 
+// execBatchTags is execBatch for callers that need each statement's
+// command tag, e.g. to count the rows a conditional UPDATE matched
+func execBatchTags(ctx context.Context, tx pgx.Tx, stmts ...batchStmt) ([]pgconn.CommandTag, error) {
+	batch := &pgx.Batch{}
+	for _, st := range stmts {
+		batch.Queue(st.sql, st.args...)
+	}
+	results := tx.SendBatch(ctx, batch)
+	tags := make([]pgconn.CommandTag, 0, len(stmts))
+	for _, st := range stmts {
+		tag, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return nil, dbError(st.name, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, results.Close()
+}
+
+// processCoupon applies couponCode to the order and records its use
+// against the coupon and the user
 func (h *CheckoutHandler) processCoupon(
 	ctx context.Context,
 	tx pgx.Tx,
 	userID, couponCode string,
 	cartItems []CartItemDB,
-) (float64, error) {
-	var coupon CouponDB
-	err := tx.QueryRow(ctx, `
-		SELECT code, type, value, max_uses, used_count, starts_at, ends_at
-		FROM coupons WHERE code = $1 FOR UPDATE`, couponCode).
-		Scan(&coupon.Code, &coupon.Type, &coupon.Value, &coupon.MaxUses, &coupon.UsedCount, &coupon.StartsAt, &coupon.EndsAt)
+) (Cents, error) {
+	discount, err := h.evaluateCoupon(ctx, tx, userID, couponCode, cartItems, true)
 	if err != nil {
-		return 0, errors.New("Invalid or expired coupon")
-	}
-
-	now := time.Now()
-	if now.Before(coupon.StartsAt) || now.After(coupon.EndsAt) {
-		return 0, errors.New("Invalid or expired coupon")
-	}
-	if coupon.MaxUses != nil && coupon.UsedCount >= *coupon.MaxUses {
-		return 0, errors.New("Invalid or expired coupon")
-	}
-
-	// Check user usage
-	var usedCount int
-	err = tx.QueryRow(ctx, `
-		SELECT used_count FROM user_coupon_usage
-		WHERE user_id = $1 AND coupon_code = $2 FOR UPDATE`, userID, couponCode).Scan(&usedCount)
-	if err == nil && usedCount >= 1 {
-		return 0, errors.New("Coupon already used")
+		return 0, err
 	}
 
 	// Mark usage
@@ -365,54 +612,245 @@ func (h *CheckoutHandler) processCoupon(
 	if err != nil {
 		return 0, err
 	}
+	return discount, nil
+}
 
-	// Compute discount
-	var subtotal float64
+// evaluateCoupon checks that couponCode applies to cartItems for userID
+// and returns the discount, without recording any use. Checkout passes
+// lock so the coupon and the user's usage row stay put until it has
+// recorded the use; the coupon preview reads them unlocked.
+func (h *CheckoutHandler) evaluateCoupon(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID, couponCode string,
+	cartItems []CartItemDB,
+	lock bool,
+) (Cents, error) {
+	var coupon CouponDB
+	err := tx.QueryRow(ctx, `
+		SELECT code, type, value, max_uses, used_count, starts_at, ends_at,
+			min_order_amount, applicable_category_id::text
+		FROM coupons WHERE code = $1`+lockClause(lock, "FOR UPDATE"), couponCode).
+		Scan(&coupon.Code, &coupon.Type, &coupon.Value, &coupon.MaxUses, &coupon.UsedCount, &coupon.StartsAt, &coupon.EndsAt,
+			&coupon.MinOrderAmount, &coupon.ApplicableCategoryID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrInvalidCoupon
+	}
+	if err != nil {
+		return 0, dbError("load coupon", err)
+	}
+
+	now := h.now().UTC()
+	if bound := couponBoundFailed(coupon, now, h.cfg.CouponGrace); bound != "" {
+		return 0, ErrCouponNotActive.WithDetails(fiber.Map{
+			"bound":    bound,
+			"startsAt": coupon.StartsAt.UTC(),
+			"endsAt":   coupon.EndsAt.UTC(),
+			"now":      now,
+		})
+	}
+	if coupon.MaxUses != nil && coupon.UsedCount >= *coupon.MaxUses {
+		return 0, ErrCouponExhausted
+	}
+
+	// Eligibility: the whole subtotal must reach the minimum, and a
+	// category-restricted coupon needs at least one product in it
+	var subtotal, eligible Cents
 	for _, item := range cartItems {
-		subtotal += float64(item.Qty) * item.UnitPrice
+		line := Cents(item.Qty) * item.UnitPrice
+		subtotal += line
+		if coupon.ApplicableCategoryID == nil ||
+			(item.CategoryID != nil && *item.CategoryID == *coupon.ApplicableCategoryID) {
+			eligible += line
+		}
+	}
+	if coupon.MinOrderAmount != nil && subtotal < *coupon.MinOrderAmount {
+		return 0, ErrCouponMinNotMet.WithDetails(fiber.Map{
+			"minOrderAmount": coupon.MinOrderAmount.Dollars(), "subtotal": subtotal.Dollars(),
+		})
+	}
+	if coupon.ApplicableCategoryID != nil && eligible == 0 {
+		return 0, ErrCouponNotEligible.WithDetails(fiber.Map{
+			"categoryId": *coupon.ApplicableCategoryID,
+		})
 	}
 
+	// Check user usage
+	var usedCount int
+	err = tx.QueryRow(ctx, `
+		SELECT used_count FROM user_coupon_usage
+		WHERE user_id = $1 AND coupon_code = $2`+lockClause(lock, "FOR UPDATE"), userID, couponCode).
+		Scan(&usedCount)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, dbError("load coupon usage", err)
+	}
+	if err == nil && usedCount >= 1 {
+		return 0, ErrCouponUsed
+	}
+
+	// A percentage only discounts the eligible items; a fixed amount comes
+	// off the order as a whole, but never takes it below zero
 	if coupon.Type == "percentage" {
-		return subtotal * (coupon.Value / 100), nil
+		return eligible.MulDiv(int64(coupon.Value), 100*100), nil
 	}
-	return coupon.Value, nil
+	return min(coupon.Value, subtotal), nil
 }
 
-func (h *CheckoutHandler) getWarehouseForUser(
+// couponBoundFailed returns the validity bound coupon fails at now:
+// "starts_at" before it starts, "ends_at" once its final second is over,
+// or "" while it is valid. Both bounds are widened by grace, so a clock a
+// little off from whoever set them doesn't turn a coupon away. The bounds
+// are timestamptz and compared as instants, whatever the session's zone.
+func couponBoundFailed(coupon CouponDB, now time.Time, grace time.Duration) string {
+	if now.Before(coupon.StartsAt.Add(-grace)) {
+		return "starts_at"
+	}
+	if !now.Before(coupon.EndsAt.Truncate(time.Second).Add(time.Second + grace)) {
+		return "ends_at"
+	}
+	return ""
+}
+
+// getUserRegion resolves the user's region, defaultRegion for an unknown
+// user, and fails with ErrUserInactive for inactive users
+func (h *CheckoutHandler) getUserRegion(
 	ctx context.Context,
 	tx pgx.Tx,
 	userID string,
 ) (string, error) {
-	var region string
-	err := tx.QueryRow(ctx, `SELECT region FROM users WHERE id = $1`, userID).
-		Scan(&region)
+	var region, status string
+	err := tx.QueryRow(ctx, `SELECT region, status FROM users WHERE id = $1`, userID).
+		Scan(&region, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return defaultRegion, nil
+	}
 	if err != nil {
-		return h.warehouseByRegion["us-east"], nil
+		return "", dbError("load user region", err)
 	}
-	if wh, ok := h.warehouseByRegion[region]; ok {
-		return wh, nil
+	if status != "active" {
+		return "", ErrUserInactive
 	}
-	return h.warehouseByRegion["us-east"], nil
+	return region, nil
 }
 
+// reserveInventory holds each item's quantity in the warehouse, or fails
+// with ErrInsufficientStock, by CHECKOUT_RESERVATION_STRATEGY
 func (h *CheckoutHandler) reserveInventory(
 	ctx context.Context,
 	tx pgx.Tx,
 	cartItems []CartItemDB,
 	warehouseID string,
 ) error {
+	if h.cfg.ReservationStrategy == "locking" {
+		return reserveInventoryLocking(ctx, tx, cartItems, warehouseID)
+	}
+	return reserveInventoryConditional(ctx, tx, cartItems, warehouseID)
+}
+
+// reserveInventoryConditional reserves every item with one conditional
+// UPDATE each, all in a single round trip. The stock check is part of the
+// UPDATE, so no row is locked before it is written, and an item that
+// matches no row was short (or not stocked in the warehouse). Items go
+// in product order so concurrent checkouts lock shared rows in the same
+// order instead of deadlocking.
+func reserveInventoryConditional(
+	ctx context.Context,
+	tx pgx.Tx,
+	cartItems []CartItemDB,
+	warehouseID string,
+) error {
+	sorted := slices.Clone(cartItems)
+	slices.SortFunc(sorted, func(a, b CartItemDB) int {
+		return strings.Compare(a.ProductID, b.ProductID)
+	})
+	stmts := make([]batchStmt, len(sorted))
+	for i, item := range sorted {
+		stmts[i] = batchStmt{"reserve inventory", `
+			UPDATE inventory
+			SET reserved_qty = reserved_qty + $1, updated_at = NOW()
+			WHERE product_id = $2 AND warehouse_id = $3
+				AND available_qty - reserved_qty >= $1`,
+			[]any{item.Qty, item.ProductID, warehouseID}}
+	}
+	tags, err := execBatchTags(ctx, tx, stmts...)
+	if err != nil {
+		return err
+	}
+	var short []CartItemDB
+	for i, tag := range tags {
+		if tag.RowsAffected() == 0 {
+			short = append(short, sorted[i])
+		}
+	}
+	if len(short) == 0 {
+		return nil
+	}
+
+	// Only on failure: look up what the short items actually have, for
+	// the error. The transaction is rolled back either way.
+	ids := make([]string, len(short))
+	for i, item := range short {
+		ids[i] = item.ProductID
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT product_id::text, available_qty - reserved_qty
+		FROM inventory
+		WHERE warehouse_id = $1 AND product_id = ANY($2::text[]::uuid[])`, warehouseID, ids)
+	if err != nil {
+		return dbError("load inventory", err)
+	}
+	defer rows.Close()
+	available := make(map[string]int, len(short))
+	for rows.Next() {
+		var id string
+		var qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			return err
+		}
+		available[id] = qty
+	}
+	if err := rows.Err(); err != nil {
+		return dbError("load inventory", err)
+	}
+
+	shortfalls := make([]InventoryShortfall, len(short))
+	for i, item := range short {
+		qty, stocked := available[strings.ToLower(item.ProductID)]
+		shortfalls[i] = newShortfall(item, qty, stocked)
+	}
+	return shortfallError(shortfalls)
+}
+
+// reserveInventoryLocking is the original strategy: lock each row, check
+// it, then update it, two round trips per item. Once an item is short the
+// rest are only checked, so the error can list every shortfall.
+func reserveInventoryLocking(
+	ctx context.Context,
+	tx pgx.Tx,
+	cartItems []CartItemDB,
+	warehouseID string,
+) error {
+	var shortfalls []InventoryShortfall
 	for _, item := range cartItems {
 		var availableQty, reservedQty int
 		err := tx.QueryRow(ctx, `
 			SELECT available_qty, reserved_qty FROM inventory
 			WHERE product_id = $1 AND warehouse_id = $2
 			FOR UPDATE`, item.ProductID, warehouseID).Scan(&availableQty, &reservedQty)
+		if errors.Is(err, pgx.ErrNoRows) {
+			shortfalls = append(shortfalls, newShortfall(item, 0, false))
+			continue
+		}
 		if err != nil {
-			return errors.New("Insufficient inventory")
+			return dbError("load inventory", err)
 		}
 
 		if availableQty-reservedQty < item.Qty {
-			return errors.New("Insufficient inventory")
+			shortfalls = append(shortfalls, newShortfall(item, availableQty-reservedQty, true))
+			continue
+		}
+		if len(shortfalls) > 0 {
+			continue
 		}
 
 		_, err = tx.Exec(ctx, `
@@ -423,45 +861,92 @@ func (h *CheckoutHandler) reserveInventory(
 			return err
 		}
 	}
+	if len(shortfalls) > 0 {
+		return shortfallError(shortfalls)
+	}
 	return nil
 }
 
-func (h *CheckoutHandler) postCommitRedisOps(
-	ctx context.Context,
-	userID, orderID string,
-	total float64,
-) {
-	// Delete user summary cache keys
-	keys, _ := h.rdb.Keys(ctx, "cache:user:"+userID+":summary:*").Result()
-	if len(keys) > 0 {
-		h.rdb.Del(ctx, keys...)
-	}
-
-	h.rdb.ZIncrBy(ctx, "leaderboard:top_buyers", total, userID)
-	h.rdb.XAdd(ctx, &redis.XAddArgs{
-		Stream: "stream:order_events",
-		Values: map[string]interface{}{
-			"userId":  userID,
-			"orderId": orderID,
-			"total":   total,
-		},
-	})
+// InventoryShortfall is one entry in an INSUFFICIENT_INVENTORY or
+// NOT_STOCKED error's details list
+type InventoryShortfall struct {
+	ProductID string `json:"productId"`
+	// Code is NOT_STOCKED when the warehouse has no inventory row for the
+	// product at all, INSUFFICIENT_INVENTORY when it has too few
+	Code         string `json:"code"`
+	RequestedQty int    `json:"requestedQty"`
+	AvailableQty int    `json:"availableQty"`
 }
 
-func computeTax(amount float64) float64 {
-	return float64(int(amount*0.08*100)) / 100
+func newShortfall(item CartItemDB, available int, stocked bool) InventoryShortfall {
+	s := InventoryShortfall{
+		ProductID:    strings.ToLower(item.ProductID),
+		Code:         ErrInsufficientStock.Code,
+		RequestedQty: item.Qty,
+		AvailableQty: max(available, 0),
+	}
+	if !stocked {
+		s.Code = ErrNotStocked.Code
+	}
+	return s
 }
 
-func computeShipping(subtotal float64, itemCount int) float64 {
-	if subtotal > 100 {
-		return 0
+// shortfallError lists every short item. It is NOT_STOCKED only when none
+// of them is stocked in the warehouse at all.
+func shortfallError(shortfalls []InventoryShortfall) error {
+	base := ErrNotStocked
+	for _, s := range shortfalls {
+		if s.Code != ErrNotStocked.Code {
+			base = ErrInsufficientStock
+			break
+		}
 	}
-	return 5.99 + float64(itemCount-1)*0.99
+	return base.WithDetails(shortfalls)
 }
 
-func maxFloat(a, b float64) float64 {
-	if a > b {
-		return a
+// postCommitRedisOps sends the cache invalidation and leaderboard update
+// in one pipeline, then updates the segment, which needs the script's
+// reply. Nothing here is rolled back on failure; the caches expire on
+// their own. The order event goes through the outbox instead, so it is
+// never lost to a Redis failure here.
+func (h *CheckoutHandler) postCommitRedisOps(
+	ctx context.Context,
+	userID, orderID string,
+	total Cents,
+) error {
+	_, err := h.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// Delete user summary cache keys, the purchase-derived top products
+		// and the cart page, since the cart is now closed
+		if err := h.summaries.Queue(ctx, pipe, userID, topProductsKey(userID), cartCacheKey(userID)); err != nil {
+			return err
+		}
+
+		// Dated by the handler's clock, as the order's coupon checks were
+		now := h.now()
+		queueTopBuyer(ctx, pipe, userID, total, now, now)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return b
+
+	// The new total may move the user into a higher segment
+	return h.segments.AddOrder(ctx, userID, total.Dollars())
+}
+
+// orderTotals composes the order's amounts, so the stored row satisfies
+// subtotal - discount + tax + shipping = total (the
+// orders_total_composition constraint). The discount is capped at the
+// subtotal and tax is charged at the region's rate on what remains;
+// shipping is priced by method on the undiscounted subtotal.
+func orderTotals(
+	subtotal, discount Cents,
+	taxRate TaxRate,
+	shippingMethod string,
+	units int,
+) (Cents, Cents, Cents, Cents, Cents) {
+	discount = min(max(discount, 0), subtotal)
+	tax := taxRate.Apply(subtotal - discount)
+	shipping := computeShipping(shippingMethod, subtotal, units)
+	return subtotal, discount, tax, shipping, subtotal - discount + tax + shipping
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+var asyncCheckouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "checkout_async_jobs_total",
+	Help: "Queued checkouts run by this instance's workers, by outcome (succeeded, failed).",
+}, []string{"outcome"})
+
+const (
+	// checkoutQueueStream holds queued checkouts until a worker runs them
+	checkoutQueueStream = "stream:checkout_queue"
+	checkoutQueueGroup  = "checkout-workers"
+)
+
+// Async checkout states, in order
+const (
+	asyncQueued     = "queued"
+	asyncProcessing = "processing"
+	asyncSucceeded  = "succeeded"
+	asyncFailed     = "failed"
+)
+
+func asyncStatusKey(checkoutID string) string { return "checkout:async:" + checkoutID }
+
+// asyncIdempotencyKey maps an idempotency key to the checkout it queued
+func asyncIdempotencyKey(key string) string { return "checkout:async:key:" + key }
+
+// AsyncCheckoutStatus is what GET /v1/checkout/:checkoutId/status returns.
+// Result is the checkout response once it succeeded, Error the error
+// object a synchronous checkout would have sent once it failed.
+type AsyncCheckoutStatus struct {
+	CheckoutID string          `json:"checkoutId"`
+	Status     string          `json:"status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      fiber.Map       `json:"error,omitempty"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
+
+// CheckoutQueue is the async checkout mode, for benchmarking a queued
+// write path against the synchronous one. The request is validated,
+// rate limited and deduplicated on its idempotency key when it is
+// queued; the worker then runs the same processCheckout, so a job run
+// twice replays the first run's order.
+type CheckoutQueue struct {
+	h        *CheckoutHandler
+	rdb      *redis.Client
+	cfg      config.CheckoutAsyncConfig
+	timeout  time.Duration
+	consumer string
+	workers  sync.WaitGroup
+}
+
+// NewCheckoutQueue runs each job under timeout, the synchronous route's
+// budget
+func NewCheckoutQueue(h *CheckoutHandler, rdb *redis.Client, timeout time.Duration) *CheckoutQueue {
+	host, _ := os.Hostname()
+	return &CheckoutQueue{
+		h:        h,
+		rdb:      rdb,
+		cfg:      h.cfg.Async,
+		timeout:  timeout,
+		consumer: fmt.Sprintf("%s-%d", host, os.Getpid()),
+	}
+}
+
+// Enabled reports whether CHECKOUT_ASYNC_WORKERS turns the mode on
+func (q *CheckoutQueue) Enabled() bool {
+	return q.cfg.Workers > 0
+}
+
+// Checkout serves POST /v1/checkout: with ?async=true or a
+// "Prefer: respond-async" header it queues the checkout and answers 202,
+// otherwise it checks out synchronously
+func (q *CheckoutQueue) Checkout(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	async := p.Bool("async", preferAsync(c))
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	if !async {
+		return q.h.Checkout(c)
+	}
+	if !q.Enabled() {
+		return writeError(c, ErrAsyncDisabled)
+	}
+
+	req, err := q.h.parseRequest(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	key := checkoutIdempotencyKey(c.Get(headerIdempotencyKey), req)
+	checkoutID, replayed, err := q.enqueue(c.UserContext(), req, key)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if replayed {
+		c.Set(headerIdempotentReplay, "true")
+	}
+	statusURL := "/v1/checkout/" + checkoutID + "/status"
+	c.Set(fiber.HeaderLocation, statusURL)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"checkoutId": checkoutID,
+		"statusUrl":  statusURL,
+	})
+}
+
+// preferAsync reports whether the request asks for an async checkout with
+// Prefer: respond-async; ?async= overrides it
+func preferAsync(c *fiber.Ctx) bool {
+	return strings.Contains(c.Get("Prefer"), "respond-async")
+}
+
+// wantsAsync reports whether Checkout would queue the request rather than
+// run it. An invalid ?async= counts too, as Checkout rejects it.
+func wantsAsync(c *fiber.Ctx) bool {
+	p := newQueryParams(c)
+	return p.Bool("async", preferAsync(c)) || p.Err() != nil
+}
+
+// enqueue queues req under a new checkout id, unless key already queued
+// one, whose id it returns with replayed set. Reusing key for a different
+// request is ErrIdempotencyReuse, as in a synchronous checkout.
+func (q *CheckoutQueue) enqueue(ctx context.Context, req CheckoutRequest, key string) (string, bool, error) {
+	fingerprint := requestFingerprint(req)
+	claimKey := asyncIdempotencyKey(key)
+	checkoutID := uuid.NewString()
+
+	// A second pass covers a claim that expired in between
+	for range 2 {
+		ok, err := q.rdb.SetNX(ctx, claimKey, fingerprint+checkoutID, q.cfg.StatusTTL).Result()
+		if err != nil {
+			return "", false, ErrRedisUnavailable.With(err)
+		}
+		if !ok {
+			existing, err := q.rdb.Get(ctx, claimKey).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return "", false, ErrRedisUnavailable.With(err)
+			}
+			id, same := strings.CutPrefix(existing, fingerprint)
+			if !same {
+				return "", false, ErrIdempotencyReuse
+			}
+			return id, true, nil
+		}
+
+		body, _ := json.Marshal(req)
+		status, _ := json.Marshal(AsyncCheckoutStatus{
+			CheckoutID: checkoutID, Status: asyncQueued, UpdatedAt: time.Now().UTC(),
+		})
+		_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, asyncStatusKey(checkoutID), status, q.cfg.StatusTTL)
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: checkoutQueueStream,
+				Values: map[string]any{"checkoutId": checkoutID, "key": key, "request": body},
+			})
+			return nil
+		})
+		if err != nil {
+			q.rdb.Del(context.WithoutCancel(ctx), claimKey)
+			return "", false, ErrRedisUnavailable.With(err)
+		}
+		return checkoutID, false, nil
+	}
+	return "", false, ErrCheckoutPending
+}
+
+// Status serves GET /v1/checkout/:checkoutId/status
+func (q *CheckoutQueue) Status(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	checkoutID := p.PathUUID("checkoutId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	raw, err := q.rdb.Get(c.UserContext(), asyncStatusKey(checkoutID)).Bytes()
+	if err == redis.Nil {
+		return writeError(c, ErrCheckoutNotFound)
+	}
+	if err != nil {
+		return writeError(c, ErrRedisUnavailable.With(err))
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(raw)
+}
+
+// Start creates the queue's group and starts the workers, plus one
+// goroutine that reclaims jobs from crashed workers, all of which stop
+// when ctx is done; Wait waits for them
+func (q *CheckoutQueue) Start(ctx context.Context) {
+	err := q.rdb.XGroupCreateMkStream(ctx, checkoutQueueStream, checkoutQueueGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		// The workers retry it, as they would after a FLUSHALL
+		log.Printf("⚠️  Checkout queue group not created: %v", err)
+	}
+	log.Printf("📥 %d async checkout worker(s) as %s", q.cfg.Workers, q.consumer)
+	for range q.cfg.Workers {
+		q.workers.Add(1)
+		go q.work(ctx)
+	}
+	q.workers.Add(1)
+	go q.reclaim(ctx)
+}
+
+// Wait blocks until the goroutines Start started have returned
+func (q *CheckoutQueue) Wait() {
+	q.workers.Wait()
+}
+
+// work runs queued checkouts one at a time until ctx is done
+func (q *CheckoutQueue) work(ctx context.Context) {
+	defer q.workers.Done()
+	for ctx.Err() == nil {
+		streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    checkoutQueueGroup,
+			Consumer: q.consumer,
+			Streams:  []string{checkoutQueueStream, ">"},
+			Count:    1,
+			Block:    q.cfg.Block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			q.failed(ctx, err)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				q.run(ctx, msg)
+			}
+		}
+	}
+}
+
+// reclaim runs, every ClaimIdle, the jobs a worker took and never
+// acknowledged for that long
+func (q *CheckoutQueue) reclaim(ctx context.Context) {
+	defer q.workers.Done()
+	ticker := time.NewTicker(q.cfg.ClaimIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := "0-0"
+		for ctx.Err() == nil {
+			msgs, next, err := q.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   checkoutQueueStream,
+				Group:    checkoutQueueGroup,
+				Consumer: q.consumer,
+				MinIdle:  q.cfg.ClaimIdle,
+				Start:    start,
+				Count:    int64(q.cfg.Workers),
+			}).Result()
+			if err != nil {
+				q.failed(ctx, err)
+				break
+			}
+			for _, msg := range msgs {
+				q.run(ctx, msg)
+			}
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// failed logs a queue read failure and pauses the caller for a second,
+// recreating the group if Redis lost it
+func (q *CheckoutQueue) failed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("⚠️  Checkout queue read failed: %v", err)
+	if strings.HasPrefix(err.Error(), "NOGROUP") {
+		q.rdb.XGroupCreateMkStream(ctx, checkoutQueueStream, checkoutQueueGroup, "0")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// run checks out one job and records the outcome, then removes the job.
+// It runs to the end even if ctx is done, so shutdown doesn't leave a
+// committed order without its status. If the outcome can't be recorded
+// the job stays pending and is run again, replaying the order.
+func (q *CheckoutQueue) run(ctx context.Context, msg redis.XMessage) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), q.timeout)
+	defer cancel()
+
+	checkoutID, _ := msg.Values["checkoutId"].(string)
+	key, _ := msg.Values["key"].(string)
+	body, _ := msg.Values["request"].(string)
+	var req CheckoutRequest
+	if checkoutID == "" || json.Unmarshal([]byte(body), &req) != nil {
+		log.Printf("⚠️  Dropping malformed checkout job %s", msg.ID)
+		q.ack(ctx, msg.ID, nil)
+		return
+	}
+
+	q.setStatus(ctx, q.rdb, AsyncCheckoutStatus{CheckoutID: checkoutID, Status: asyncProcessing})
+
+	status := AsyncCheckoutStatus{CheckoutID: checkoutID, Status: asyncSucceeded}
+	spanCtx, span := startSpan(ctx, "checkout.async_job")
+	payload, replayed, err := q.h.processCheckout(spanCtx, req, key)
+	endSpan(span, err)
+	if replayed {
+		q.h.stats.Record("replayed")
+	} else {
+		q.h.stats.Record(checkoutOutcome(err))
+	}
+	if err != nil {
+		status.Status = asyncFailed
+		_, status.Error = errorBody(err)
+	} else {
+		status.Result = payload
+	}
+	asyncCheckouts.WithLabelValues(status.Status).Inc()
+
+	if err := q.ack(ctx, msg.ID, &status); err != nil {
+		log.Printf("⚠️  Checkout job %s not recorded, to be run again: %v", msg.ID, err)
+	}
+}
+
+// ack records status, if any, and removes job id from the queue in one
+// transaction
+func (q *CheckoutQueue) ack(ctx context.Context, id string, status *AsyncCheckoutStatus) error {
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if status != nil {
+			q.setStatus(ctx, pipe, *status)
+		}
+		pipe.XAck(ctx, checkoutQueueStream, checkoutQueueGroup, id)
+		pipe.XDel(ctx, checkoutQueueStream, id)
+		return nil
+	})
+	return err
+}
+
+// setStatus writes status with the current time, keeping it StatusTTL
+func (q *CheckoutQueue) setStatus(ctx context.Context, rdb redis.Cmdable, status AsyncCheckoutStatus) {
+	status.UpdatedAt = time.Now().UTC()
+	raw, _ := json.Marshal(status)
+	rdb.Set(ctx, asyncStatusKey(status.CheckoutID), raw, q.cfg.StatusTTL)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// asyncApp mounts a CheckoutQueue over checkoutApp's handler. Its workers
+// run once start is called and stop with the test.
+func asyncApp(t *testing.T, db *DBRouter, rdb *redis.Client, workers int) (app *fiber.App, start func()) {
+	t.Helper()
+	_, h := checkoutApp(t, db, rdb)
+	q := NewCheckoutQueue(h, rdb, 5*time.Second)
+	q.cfg = config.CheckoutAsyncConfig{Workers: workers, StatusTTL: time.Minute, ClaimIdle: time.Minute, Block: 10 * time.Millisecond}
+	app = fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/checkout", q.Checkout)
+	app.Get("/v1/checkout/:checkoutId/status", q.Status)
+	return app, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(func() {
+			cancel()
+			q.Wait()
+		})
+		q.Start(ctx)
+	}
+}
+
+// enqueueCheckout posts req with ?async=true under idempotency key key
+func enqueueCheckout(t *testing.T, app *fiber.App, key string, req CheckoutRequest) (*http.Response, map[string]any) {
+	t.Helper()
+	r := newRequest(http.MethodPost, "/v1/checkout?async=true", req)
+	r.Header.Set(headerIdempotencyKey, key)
+	resp, body := send(t, app, r)
+	return resp, decode(t, body)
+}
+
+// awaitCheckout polls statusURL until the checkout has an outcome
+func awaitCheckout(t *testing.T, app *fiber.App, statusURL string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, body := send(t, app, newRequest(http.MethodGet, statusURL, nil))
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("status: got %d %s", resp.StatusCode, body)
+		}
+		status := decode(t, body)
+		if s := status["status"]; s == asyncSucceeded || s == asyncFailed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still %s after 5s", status["status"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func asyncRequest(user, product string) CheckoutRequest {
+	return CheckoutRequest{UserID: user, PaymentRef: "pay-async", Items: []CheckoutItem{{ProductID: product, Qty: 1}}}
+}
+
+func TestAsyncCheckoutValidatesBeforeQueueing(t *testing.T) {
+	mr, rdb := testRedis(t)
+	app, _ := asyncApp(t, unreachableRouter(t), rdb, 1)
+
+	resp, body := enqueueCheckout(t, app, "k-1", CheckoutRequest{UserID: "me", PaymentRef: "pay-async"})
+	e, _ := body["error"].(map[string]any)
+	if resp.StatusCode != fiber.StatusBadRequest || e["code"] != "VALIDATION_FAILED" {
+		t.Errorf("invalid body: got %d %v, want 400 VALIDATION_FAILED", resp.StatusCode, body)
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodPost, "/v1/checkout?async=maybe", asyncRequest(testUserID, testUserID))); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("?async=maybe: status = %d, want 400", resp.StatusCode)
+	}
+	if mr.Exists(checkoutQueueStream) {
+		t.Error("an invalid checkout was queued")
+	}
+
+	off, _ := asyncApp(t, unreachableRouter(t), rdb, 0)
+	resp, body = enqueueCheckout(t, off, "k-1", asyncRequest(testUserID, testUserID))
+	if e, _ := body["error"].(map[string]any); resp.StatusCode != fiber.StatusServiceUnavailable || e["code"] != "ASYNC_DISABLED" {
+		t.Errorf("without workers: got %d %v, want 503 ASYNC_DISABLED", resp.StatusCode, body)
+	}
+}
+
+func TestAsyncCheckoutQueuesOncePerKey(t *testing.T) {
+	mr, rdb := testRedis(t)
+	app, _ := asyncApp(t, unreachableRouter(t), rdb, 1)
+	req := asyncRequest(testUserID, testUserID)
+
+	resp, first := enqueueCheckout(t, app, "k-1", req)
+	if resp.StatusCode != fiber.StatusAccepted || resp.Header.Get(fiber.HeaderLocation) != first["statusUrl"] {
+		t.Fatalf("got %d %v, want 202 with the status URL", resp.StatusCode, first)
+	}
+	req.PaymentRef = "pay-retried"
+	resp, again := enqueueCheckout(t, app, "k-1", req)
+	if resp.StatusCode != fiber.StatusAccepted || again["checkoutId"] != first["checkoutId"] ||
+		resp.Header.Get(headerIdempotentReplay) != "true" {
+		t.Errorf("retry: got %d %v, want the first checkout replayed", resp.StatusCode, again)
+	}
+	req.Items[0].Qty = 2
+	resp, body := enqueueCheckout(t, app, "k-1", req)
+	if e, _ := body["error"].(map[string]any); resp.StatusCode != fiber.StatusUnprocessableEntity || e["code"] != "IDEMPOTENCY_KEY_REUSED" {
+		t.Errorf("another body: got %d %v, want 422", resp.StatusCode, body)
+	}
+	if n, _ := rdb.XLen(context.Background(), checkoutQueueStream).Result(); n != 1 {
+		t.Errorf("queue holds %d jobs, want 1", n)
+	}
+
+	resp, raw := send(t, app, newRequest(http.MethodGet, first["statusUrl"].(string), nil))
+	if resp.StatusCode != fiber.StatusOK || decode(t, raw)["status"] != asyncQueued {
+		t.Errorf("status: got %d %s, want queued", resp.StatusCode, raw)
+	}
+	if ttl := mr.TTL(asyncStatusKey(first["checkoutId"].(string))); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("status TTL = %s, want StatusTTL", ttl)
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/v1/checkout/"+testUserID+"/status", nil)); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("unknown checkout: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAsyncCheckoutReportsAWorkerFailure(t *testing.T) {
+	mr, rdb := testRedis(t)
+	app, start := asyncApp(t, unreachableRouter(t), rdb, 2)
+	start()
+
+	_, queued := enqueueCheckout(t, app, "k-1", asyncRequest(testUserID, testUserID))
+	status := awaitCheckout(t, app, queued["statusUrl"].(string))
+	e, _ := status["error"].(map[string]any)
+	if status["status"] != asyncFailed || e["code"] != "DATABASE_UNAVAILABLE" || status["result"] != nil {
+		t.Errorf("status = %v, want failed with the checkout's DATABASE_UNAVAILABLE", status)
+	}
+	if n, _ := rdb.XLen(context.Background(), checkoutQueueStream).Result(); n != 0 {
+		t.Errorf("queue holds %d jobs after the run, want none", n)
+	}
+	if !mr.Exists(asyncIdempotencyKey("k-1")) {
+		t.Error("the key was released, so a retry would queue a second job")
+	}
+}
+
+func TestAsyncCheckout(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, start := asyncApp(t, db, rdb, 2)
+	start()
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "ASYNC", 3, 10)
+
+	_, queued := enqueueCheckout(t, app, "async-"+user, asyncRequest(user, product))
+	status := awaitCheckout(t, app, queued["statusUrl"].(string))
+	result, _ := status["result"].(map[string]any)
+	if status["status"] != asyncSucceeded || result["orderId"] == nil || result["total"] == nil {
+		t.Fatalf("status = %v, want the checkout response", status)
+	}
+	var owner string
+	err := db.Primary().QueryRow(context.Background(), `SELECT user_id::text FROM orders WHERE id = $1`, result["orderId"]).Scan(&owner)
+	if err != nil || owner != user {
+		t.Errorf("order owner = %q, %v, want %s", owner, err, user)
+	}
+}
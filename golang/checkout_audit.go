@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"loastest-go/config"
+)
+
+var checkoutAuditRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "checkout_audit_records_total",
+	Help: "Failed checkouts offered to the audit table, by outcome (written, dropped when the buffer was full, failed to insert).",
+}, []string{"outcome"})
+
+// checkoutAuditBatch is how many records the writer inserts at once
+const checkoutAuditBatch = 100
+
+// checkoutAuditRecord is a failed checkout as the middleware saw it. The
+// body is sanitized by the writer, off the request path.
+type checkoutAuditRecord struct {
+	at        time.Time
+	requestID string
+	status    int
+	code      string
+	message   string
+	body      []byte
+	duration  time.Duration
+}
+
+// CheckoutAudit records checkouts answered with an error in checkout_audit,
+// with the request body, so a burst of failures can be replayed. Requests
+// only hand a record to a buffered channel; a single goroutine sanitizes
+// and inserts them in batches, and a full buffer drops the record rather
+// than hold up the response.
+type CheckoutAudit struct {
+	db  *DBRouter
+	cfg config.AuditConfig
+
+	records chan checkoutAuditRecord
+	done    chan struct{}
+	closeMu sync.Once
+}
+
+func NewCheckoutAudit(db *DBRouter, cfg config.AuditConfig) *CheckoutAudit {
+	return &CheckoutAudit{db: db, cfg: cfg}
+}
+
+// Enabled reports whether AUDIT_FAILED_CHECKOUTS turns auditing on
+func (a *CheckoutAudit) Enabled() bool {
+	return a.cfg.FailedCheckouts
+}
+
+// Start runs the writer and, until ctx is done, the cleanup
+func (a *CheckoutAudit) Start(ctx context.Context) {
+	a.records = make(chan checkoutAuditRecord, a.cfg.Buffer)
+	a.done = make(chan struct{})
+	go a.write()
+	go a.cleanup(ctx)
+}
+
+// Close writes what is still buffered
+func (a *CheckoutAudit) Close() {
+	a.closeMu.Do(func() {
+		close(a.records)
+		<-a.done
+	})
+}
+
+// Middleware offers every checkout answered with an error to the writer,
+// including rejections by the limits it wraps. An accepted async checkout
+// is a 202 and isn't recorded, whatever the worker makes of it.
+func (a *CheckoutAudit) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		failure := err
+		if failure == nil {
+			failure, _ = c.Locals(localError).(error)
+		}
+		if failure != nil && errors.Is(c.UserContext().Err(), context.DeadlineExceeded) {
+			failure = ErrTimeout
+		}
+		status := c.Response().StatusCode()
+		if failure == nil && status < fiber.StatusMultipleChoices {
+			return err
+		}
+
+		rec := checkoutAuditRecord{
+			at:       start,
+			status:   status,
+			code:     "HTTP_" + strconv.Itoa(status),
+			body:     bytes.Clone(c.Body()),
+			duration: time.Since(start),
+		}
+		if failure != nil {
+			var body fiber.Map
+			rec.status, body = errorBody(failure)
+			rec.code, _ = body["code"].(string)
+			// The audit table is internal, so it keeps the cause the
+			// client isn't shown
+			rec.message = failure.Error()
+		}
+		rec.requestID, _ = c.Locals(localRequestID).(string)
+
+		select {
+		case a.records <- rec:
+		default:
+			checkoutAuditRecords.WithLabelValues("dropped").Inc()
+		}
+		return err
+	}
+}
+
+// write inserts records in batches of up to checkoutAuditBatch, or
+// whatever has arrived each second, until Close
+func (a *CheckoutAudit) write() {
+	defer close(a.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]checkoutAuditRecord, 0, checkoutAuditBatch)
+	for {
+		select {
+		case rec, ok := <-a.records:
+			if !ok {
+				a.insert(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) == checkoutAuditBatch {
+				a.insert(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			a.insert(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (a *CheckoutAudit) insert(batch []checkoutAuditRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	rows := make([][]any, len(batch))
+	for i, rec := range batch {
+		userID, refHash, body, truncated := a.sanitize(rec.body)
+		rows[i] = []any{
+			rec.requestID, userID, rec.status, rec.code, rec.message, refHash,
+			body, len(rec.body), truncated,
+			float64(rec.duration.Microseconds()) / 1000, rec.at,
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.db.Primary().CopyFrom(ctx, pgx.Identifier{"checkout_audit"},
+		[]string{"request_id", "user_id", "status", "code", "message", "payment_ref_hash",
+			"body", "body_bytes", "body_truncated", "duration_ms", "created_at"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		checkoutAuditRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		log.Printf("⚠️  %d checkout audit records not written: %v", len(batch), err)
+		return
+	}
+	checkoutAuditRecords.WithLabelValues("written").Add(float64(len(batch)))
+}
+
+// sanitize replaces the body's paymentRef with its SHA-256, returned as
+// refHash too, and cuts the result at AUDIT_MAX_BODY_BYTES. userID is the
+// body's userId when it is a UUID. A body that isn't a JSON object isn't
+// kept at all, since the paymentRef in it can't be found to hash.
+func (a *CheckoutAudit) sanitize(raw []byte) (userID, refHash, body *string, truncated bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return nil, nil, nil, false
+	}
+	var s string
+	if json.Unmarshal(fields["userId"], &s) == nil {
+		if id, err := uuid.Parse(s); err == nil {
+			canonical := id.String()
+			userID = &canonical
+		}
+	}
+	if ref, ok := fields["paymentRef"]; ok {
+		// A paymentRef that isn't a string is hashed as it was sent
+		value := []byte(ref)
+		var str string
+		if json.Unmarshal(ref, &str) == nil {
+			value = []byte(str)
+		}
+		sum := sha256.Sum256(value)
+		hash := hex.EncodeToString(sum[:])
+		refHash = &hash
+		fields["paymentRef"], _ = json.Marshal("sha256:" + hash)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return userID, refHash, nil, false
+	}
+	if len(data) > a.cfg.MaxBodyBytes {
+		data, truncated = data[:a.cfg.MaxBodyBytes], true
+	}
+	sanitized := string(data)
+	return userID, refHash, &sanitized, truncated
+}
+
+// cleanup deletes records past AUDIT_RETENTION, then all but the newest
+// AUDIT_MAX_ROWS, every interval. Every instance runs it; the deletes are
+// the same whichever gets there first.
+func (a *CheckoutAudit) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := a.db.Primary().Exec(ctx, `
+				DELETE FROM checkout_audit
+				WHERE created_at < NOW() - make_interval(secs => $1)
+					OR id <= (SELECT id FROM checkout_audit ORDER BY id DESC OFFSET $2 LIMIT 1)`,
+				a.cfg.Retention.Seconds(), a.cfg.MaxRows)
+			if err != nil {
+				log.Printf("⚠️  Checkout audit cleanup failed: %v", err)
+			}
+		}
+	}
+}
+
+// CheckoutAuditEntry is one failed checkout. Body is the sanitized request
+// as JSON, or as a string when it was cut short.
+type CheckoutAuditEntry struct {
+	ID             int64     `json:"id"`
+	RequestID      *string   `json:"requestId"`
+	UserID         *string   `json:"userId"`
+	Status         int       `json:"status"`
+	Code           string    `json:"code"`
+	Message        *string   `json:"message"`
+	PaymentRefHash *string   `json:"paymentRefHash"`
+	Body           any       `json:"body"`
+	BodyBytes      int       `json:"bodyBytes"`
+	BodyTruncated  bool      `json:"bodyTruncated"`
+	DurationMs     float64   `json:"durationMs"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// Handler serves GET /v1/admin/checkout-audit: the newest failures first,
+// optionally only those with ?code=
+func (a *CheckoutAudit) Handler(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	limit := p.Int("limit", 50, 500)
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	code := strings.ToUpper(c.Query("code"))
+
+	rows, err := a.db.Read().Query(c.UserContext(), `
+		SELECT id, request_id, user_id::text, status, code, message, payment_ref_hash,
+			body, body_bytes, body_truncated, duration_ms, created_at
+		FROM checkout_audit
+		WHERE $1 = '' OR code = $1
+		ORDER BY id DESC
+		LIMIT $2`, code, limit)
+	if err != nil {
+		return writeError(c, dbError("load checkout audit", err))
+	}
+	defer rows.Close()
+	entries := []CheckoutAuditEntry{}
+	for rows.Next() {
+		var e CheckoutAuditEntry
+		var body *string
+		if err := rows.Scan(&e.ID, &e.RequestID, &e.UserID, &e.Status, &e.Code, &e.Message,
+			&e.PaymentRefHash, &body, &e.BodyBytes, &e.BodyTruncated, &e.DurationMs, &e.CreatedAt); err != nil {
+			return writeError(c, err)
+		}
+		switch {
+		case body == nil:
+		case e.BodyTruncated:
+			e.Body = *body
+		default:
+			e.Body = json.RawMessage(*body)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return writeError(c, dbError("load checkout audit", err))
+	}
+	return c.JSON(fiber.Map{"entries": entries, "enabled": a.Enabled()})
+}
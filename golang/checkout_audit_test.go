@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"loastest-go/config"
+)
+
+// sha256Hex is the hex SHA-256 of s
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSanitizeAuditBody(t *testing.T) {
+	a := NewCheckoutAudit(nil, config.AuditConfig{MaxBodyBytes: 1 << 10})
+	upper := strings.ToUpper(testUserID)
+
+	userID, refHash, body, truncated := a.sanitize([]byte(`{"userId":"` + upper + `","paymentRef":"pay-secret","items":[]}`))
+	if userID == nil || *userID != testUserID {
+		t.Errorf("userID = %v, want the canonical %s", userID, testUserID)
+	}
+	if refHash == nil || *refHash != sha256Hex("pay-secret") {
+		t.Errorf("refHash = %v, want the SHA-256 of the paymentRef", refHash)
+	}
+	if body == nil || strings.Contains(*body, "pay-secret") || !strings.Contains(*body, `"sha256:`+sha256Hex("pay-secret")+`"`) || truncated {
+		t.Errorf("body = %v (truncated %t), want the paymentRef replaced by its hash", body, truncated)
+	}
+
+	// A paymentRef that isn't a string is hashed as sent
+	if _, refHash, _, _ := a.sanitize([]byte(`{"paymentRef":12345}`)); refHash == nil || *refHash != sha256Hex("12345") {
+		t.Errorf("numeric paymentRef: refHash = %v", refHash)
+	}
+	// A userId that isn't a UUID isn't kept as one
+	if userID, _, body, _ := a.sanitize([]byte(`{"userId":"alice"}`)); userID != nil || body == nil {
+		t.Errorf("bad userId: userID = %v, body = %v", userID, body)
+	}
+	// Anything but an object could hide a paymentRef, so none of it is kept
+	for _, raw := range []string{`not json`, `["pay-secret"]`, `null`} {
+		if userID, refHash, body, _ := a.sanitize([]byte(raw)); userID != nil || refHash != nil || body != nil {
+			t.Errorf("%s: kept %v %v %v, want nothing", raw, userID, refHash, body)
+		}
+	}
+
+	a.cfg.MaxBodyBytes = 16
+	if _, _, body, truncated := a.sanitize([]byte(`{"items":[{"productId":"p1","qty":1}]}`)); body == nil || len(*body) != 16 || !truncated {
+		t.Errorf("long body = %v (truncated %t), want it cut at 16 bytes", body, truncated)
+	}
+}
+
+// auditApp serves routes behind a's middleware, with a's buffer in place
+// but no writer, so the test reads what the middleware offered
+func auditApp(a *CheckoutAudit, buffer int) *fiber.App {
+	a.records = make(chan checkoutAuditRecord, buffer)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(localRequestID, "req-7")
+		return c.Next()
+	})
+	app.Use(a.Middleware())
+	app.Post("/ok", okHandler)
+	app.Post("/empty", func(c *fiber.Ctx) error { return writeError(c, ErrCartEmpty) })
+	app.Post("/teapot", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusTeapot) })
+	return app
+}
+
+func TestAuditMiddlewareOffersFailures(t *testing.T) {
+	a := NewCheckoutAudit(nil, config.AuditConfig{})
+	app := auditApp(a, 10)
+	body := CheckoutRequest{UserID: testUserID, PaymentRef: "pay-1"}
+
+	send(t, app, newRequest(http.MethodPost, "/ok", body))
+	if len(a.records) != 0 {
+		t.Fatalf("a successful checkout was offered")
+	}
+	send(t, app, newRequest(http.MethodPost, "/empty", body))
+	send(t, app, newRequest(http.MethodPost, "/teapot", body))
+	if len(a.records) != 2 {
+		t.Fatalf("%d records offered, want 2", len(a.records))
+	}
+	rec := <-a.records
+	if rec.status != 400 || rec.code != ErrCartEmpty.Code || rec.requestID != "req-7" ||
+		!strings.Contains(string(rec.body), "pay-1") || rec.at.IsZero() {
+		t.Errorf("error record = %+v", rec)
+	}
+	// The writer sanitizes, off the request path
+	if rec = <-a.records; rec.status != fiber.StatusTeapot || rec.code != "HTTP_418" {
+		t.Errorf("status record = %+v, want HTTP_418", rec)
+	}
+}
+
+func TestAuditMiddlewareDropsWhenFull(t *testing.T) {
+	a := NewCheckoutAudit(nil, config.AuditConfig{})
+	app := auditApp(a, 1)
+	dropped := testutil.ToFloat64(checkoutAuditRecords.WithLabelValues("dropped"))
+	for range 3 {
+		if resp, _ := send(t, app, newRequest(http.MethodPost, "/empty", nil)); resp.StatusCode != 400 {
+			t.Fatalf("status = %d, want the failure answered as usual", resp.StatusCode)
+		}
+	}
+	if got := testutil.ToFloat64(checkoutAuditRecords.WithLabelValues("dropped")) - dropped; got != 2 {
+		t.Errorf("dropped %v records, want 2", got)
+	}
+}
+
+func TestCheckoutAuditWritesAndLists(t *testing.T) {
+	db := testRouter(t)
+	mustExec(t, db, `DELETE FROM checkout_audit`)
+	a := NewCheckoutAudit(db, config.AuditConfig{
+		FailedCheckouts: true, Buffer: 10, MaxBodyBytes: 1 << 10,
+		Retention: time.Hour, MaxRows: 100, CleanupInterval: time.Hour,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+	app := fiber.New()
+	app.Use(a.Middleware())
+	app.Post("/v1/checkout", func(c *fiber.Ctx) error {
+		if strings.Contains(string(c.Body()), "empty") {
+			return writeError(c, ErrCartEmpty)
+		}
+		return writeError(c, ErrValidation)
+	})
+	app.Get("/v1/admin/checkout-audit", a.Handler)
+
+	send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{UserID: testUserID, PaymentRef: "pay-empty"}))
+	send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{UserID: testUserID, PaymentRef: "pay-bad"}))
+	a.Close()
+
+	resp, body := send(t, app, newRequest(http.MethodGet, "/v1/admin/checkout-audit?code=cart_empty", nil))
+	entries, _ := decode(t, body)["entries"].([]any)
+	if resp.StatusCode != fiber.StatusOK || len(entries) != 1 {
+		t.Fatalf("got %d %s, want the one CART_EMPTY entry", resp.StatusCode, body)
+	}
+	e := entries[0].(map[string]any)
+	stored, _ := e["body"].(map[string]any)
+	if e["userId"] != testUserID || e["paymentRefHash"] != sha256Hex("pay-empty") ||
+		stored["paymentRef"] != "sha256:"+sha256Hex("pay-empty") {
+		t.Errorf("entry = %v, want the user and the hashed paymentRef", e)
+	}
+
+	_, body = send(t, app, newRequest(http.MethodGet, "/v1/admin/checkout-audit?limit=5", nil))
+	if entries, _ := decode(t, body)["entries"].([]any); len(entries) != 2 ||
+		entries[0].(map[string]any)["code"] != ErrValidation.Code {
+		t.Errorf("entries = %v, want both, newest first", entries)
+	}
+}
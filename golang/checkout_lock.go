@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	checkoutLockContention = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "checkout_lock_contention_total",
+		Help: "Checkouts rejected because another checkout held the lock, by lock (cart, user).",
+	}, []string{"lock"})
+	checkoutLockLost = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "checkout_lock_lost_total",
+		Help: "Checkout locks that expired or changed hands while their checkout was still running.",
+	})
+)
+
+// extendLockScript pushes the lock's expiry out only if it still holds our
+// token
+var extendLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// cartLockKey serializes checkouts of one cart, whoever submits them
+func cartLockKey(cartID string) string {
+	return "lock:checkout:cart:" + cartID
+}
+
+// userLockKey serializes a user's checkouts. The NestJS service takes the
+// same key.
+func userLockKey(userID string) string {
+	return "lock:checkout:" + userID
+}
+
+// checkoutLock is a Redis lock whose value is a token unique to the
+// holder, so releasing or extending it can't touch a lock that expired and
+// was taken by another request
+type checkoutLock struct {
+	rdb   *redis.Client
+	key   string
+	token string
+	ttl   time.Duration
+	lost  atomic.Bool
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+// acquireCheckoutLock tries once to take key, the name lock, for ttl. It
+// returns nil, nil when someone else holds it. With watchdog set the lock
+// is extended every third of its TTL until release.
+func acquireCheckoutLock(
+	ctx context.Context,
+	rdb *redis.Client,
+	name, key string,
+	ttl time.Duration,
+	watchdog bool,
+) (*checkoutLock, error) {
+	token := uuid.NewString()
+	ok, err := rdb.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		checkoutLockContention.WithLabelValues(name).Inc()
+		return nil, nil
+	}
+	l := &checkoutLock{rdb: rdb, key: key, token: token, ttl: ttl, stop: make(chan struct{})}
+	if watchdog {
+		l.done.Add(1)
+		go l.watch(context.WithoutCancel(ctx))
+	}
+	return l, nil
+}
+
+// watch extends the lock until release, or until it finds the lock gone
+func (l *checkoutLock) watch(ctx context.Context) {
+	defer l.done.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			extendCtx, cancel := context.WithTimeout(ctx, l.ttl/3)
+			n, err := extendLockScript.Run(extendCtx, l.rdb, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+			cancel()
+			if err != nil {
+				// Keep trying; the lock may still outlive a Redis blip
+				continue
+			}
+			if n == 0 {
+				l.markLost()
+				return
+			}
+		}
+	}
+}
+
+// release stops the watchdog and deletes the lock if it is still ours
+func (l *checkoutLock) release(ctx context.Context) {
+	close(l.stop)
+	l.done.Wait()
+	n, err := releaseMarkerScript.Run(context.WithoutCancel(ctx), l.rdb, []string{l.key}, l.token).Int()
+	if err == nil && n == 0 {
+		l.markLost()
+	}
+}
+
+// markLost counts a lock that expired under its holder, once
+func (l *checkoutLock) markLost() {
+	if l.lost.CompareAndSwap(false, true) {
+		checkoutLockLost.Inc()
+		log.Printf("⚠️  Checkout lock %s expired while held", l.key)
+	}
+}
+
+// checkoutLockWant is one lock a checkout runs under, and the error for
+// finding it taken
+type checkoutLockWant struct {
+	name, key string
+	busy      *AppError
+}
+
+// checkoutLockWants lists the locks req's checkout runs under: the
+// cart's, and the user's in direct mode (there is no cart to key on) or
+// with CHECKOUT_LOCK_PER_USER. They only keep concurrent checkouts from
+// queueing on each other; the carts row lock taken in the transaction is
+// what guarantees a cart is ordered once.
+func (h *CheckoutHandler) checkoutLockWants(req CheckoutRequest) []checkoutLockWant {
+	var wants []checkoutLockWant
+	if req.CartID != "" {
+		wants = append(wants, checkoutLockWant{"cart", cartLockKey(req.CartID), ErrCartLocked})
+	}
+	if req.CartID == "" || h.cfg.LockPerUser {
+		wants = append(wants, checkoutLockWant{"user", userLockKey(req.UserID), ErrUserLocked})
+	}
+	return wants
+}
+
+// acquireCheckoutLocks takes req's checkout locks in Redis. Contention is
+// ErrCartLocked or ErrUserLocked, after giving back any lock already
+// taken. A Redis failure skips the lock if locks fail open.
+func (h *CheckoutHandler) acquireCheckoutLocks(ctx context.Context, req CheckoutRequest) (release func(), err error) {
+	var held []*checkoutLock
+	release = func() {
+		for _, l := range held {
+			l.release(ctx)
+		}
+	}
+	for _, w := range h.checkoutLockWants(req) {
+		lock, err := acquireCheckoutLock(ctx, h.rdb, w.name, w.key, h.cfg.LockTTL, h.cfg.LockWatchdog)
+		switch {
+		case err != nil && !h.failOpen.Lock:
+			release()
+			return nil, ErrRedisUnavailable
+		case err != nil:
+			// Fail open: row locks in the transaction still guard inventory
+		case lock == nil:
+			release()
+			return nil, w.busy
+		default:
+			held = append(held, lock)
+		}
+	}
+	return release, nil
+}
+
+// lockCheckoutTx takes req's checkout locks with LOCK_BACKEND=postgres, as
+// transaction-level advisory locks on the hash of their Redis keys, and
+// fails the same way on contention. Unlike the Redis locks they are taken
+// only once the transaction has begun and go with its commit or rollback,
+// so they don't cover the idempotency check or the post-commit work, and
+// two keys whose hashes collide contend with each other.
+func (h *CheckoutHandler) lockCheckoutTx(ctx context.Context, tx pgx.Tx, req CheckoutRequest) error {
+	for _, w := range h.checkoutLockWants(req) {
+		var locked bool
+		err := tx.QueryRow(ctx,
+			`SELECT pg_try_advisory_xact_lock(hashtextextended($1, 0))`, w.key).Scan(&locked)
+		if err != nil {
+			return dbError("take checkout lock", err)
+		}
+		if !locked {
+			checkoutLockContention.WithLabelValues(w.name).Inc()
+			return w.busy
+		}
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCheckoutLockIsHeldByOneRequest(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	key := cartLockKey(testUserID)
+	contended := testutil.ToFloat64(checkoutLockContention.WithLabelValues("cart"))
+
+	first, err := acquireCheckoutLock(ctx, rdb, "cart", key, time.Minute, false)
+	if err != nil || first == nil {
+		t.Fatalf("acquire = %v, %v", first, err)
+	}
+	if second, err := acquireCheckoutLock(ctx, rdb, "cart", key, time.Minute, false); second != nil || err != nil {
+		t.Fatalf("second acquire = %v, %v, want the lock refused", second, err)
+	}
+	if got := testutil.ToFloat64(checkoutLockContention.WithLabelValues("cart")) - contended; got != 1 {
+		t.Errorf("contention counted %v times, want 1", got)
+	}
+
+	first.release(ctx)
+	if mr.Exists(key) {
+		t.Error("release left the lock")
+	}
+}
+
+func TestReleaseLeavesAnotherRequestsLock(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	key := cartLockKey(testUserID)
+	lost := testutil.ToFloat64(checkoutLockLost)
+
+	lock, err := acquireCheckoutLock(ctx, rdb, "cart", key, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ours expired and another checkout took the cart
+	mr.Set(key, "their-token")
+	lock.release(ctx)
+	if got, _ := mr.Get(key); got != "their-token" {
+		t.Errorf("lock = %q, want the other request's kept", got)
+	}
+	if got := testutil.ToFloat64(checkoutLockLost) - lost; got != 1 {
+		t.Errorf("lost locks counted %v times, want 1", got)
+	}
+}
+
+func TestLockWatchdog(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	key := cartLockKey(testUserID)
+	ttl := 90 * time.Millisecond
+
+	lock, err := acquireCheckoutLock(ctx, rdb, "cart", key, ttl, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// miniredis's clock doesn't run, so age the lock by hand and let the
+	// watchdog push it back out
+	mr.SetTTL(key, time.Millisecond)
+	time.Sleep(2 * ttl / 3)
+	if got := mr.TTL(key); got != ttl {
+		t.Errorf("TTL = %s after the watchdog ran, want %s", got, ttl)
+	}
+
+	// A watchdog that finds the lock gone stops and counts it lost
+	lost := testutil.ToFloat64(checkoutLockLost)
+	mr.Del(key)
+	time.Sleep(2 * ttl / 3)
+	if !lock.lost.Load() || testutil.ToFloat64(checkoutLockLost)-lost != 1 {
+		t.Errorf("lost = %v, want the missing lock noticed once", lock.lost.Load())
+	}
+	lock.release(ctx)
+	if testutil.ToFloat64(checkoutLockLost)-lost != 1 {
+		t.Error("release counted the lost lock again")
+	}
+}
+
+func TestCheckoutLockWants(t *testing.T) {
+	h := &CheckoutHandler{}
+	names := func(req CheckoutRequest) []string {
+		var out []string
+		for _, w := range h.checkoutLockWants(req) {
+			out = append(out, w.name)
+		}
+		return out
+	}
+	cart := CheckoutRequest{UserID: testUserID, CartID: testUserID}
+	if got := names(cart); len(got) != 1 || got[0] != "cart" {
+		t.Errorf("cart checkout locks %v, want cart", got)
+	}
+	if got := names(CheckoutRequest{UserID: testUserID}); len(got) != 1 || got[0] != "user" {
+		t.Errorf("direct checkout locks %v, want user", got)
+	}
+	h.cfg.LockPerUser = true
+	if got := names(cart); len(got) != 2 {
+		t.Errorf("CHECKOUT_LOCK_PER_USER locks %v, want cart and user", got)
+	}
+}
+
+// lockHandler is a CheckoutHandler that takes its checkout locks in rdb
+func lockHandler(rdb *redis.Client, perUser bool) *CheckoutHandler {
+	h := &CheckoutHandler{rdb: rdb}
+	h.cfg.LockBackend = "redis"
+	h.cfg.LockTTL = time.Minute
+	h.cfg.LockPerUser = perUser
+	return h
+}
+
+// acquireConcurrently takes the checkout locks of every req at once and
+// returns how many got them, leaving those held
+func acquireConcurrently(t *testing.T, h *CheckoutHandler, reqs ...CheckoutRequest) (won int, errs []error) {
+	t.Helper()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := h.acquireCheckoutLocks(context.Background(), req)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			won++
+			t.Cleanup(release)
+		}()
+	}
+	wg.Wait()
+	return won, errs
+}
+
+func TestOneCartIsCheckedOutOnceWhoeverSubmitsIt(t *testing.T) {
+	_, rdb := testRedis(t)
+	h := lockHandler(rdb, false)
+	cart := uuid.NewString()
+	var reqs []CheckoutRequest
+	for range 8 {
+		reqs = append(reqs, CheckoutRequest{UserID: uuid.NewString(), CartID: cart})
+	}
+	won, errs := acquireConcurrently(t, h, reqs...)
+	if won != 1 {
+		t.Fatalf("%d checkouts of one cart took its lock, want 1", won)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrCartLocked) {
+			t.Errorf("err = %v, want ErrCartLocked", err)
+		}
+	}
+}
+
+func TestOneUsersCartsAreCheckedOutTogether(t *testing.T) {
+	_, rdb := testRedis(t)
+	user := uuid.NewString()
+	reqs := []CheckoutRequest{{UserID: user, CartID: uuid.NewString()}, {UserID: user, CartID: uuid.NewString()}}
+	if won, errs := acquireConcurrently(t, lockHandler(rdb, false), reqs...); won != 2 {
+		t.Errorf("%d of two carts took their locks: %v", won, errs)
+	}
+}
+
+func TestPerUserLockSerializesAUsersCarts(t *testing.T) {
+	mr, rdb := testRedis(t)
+	h := lockHandler(rdb, true)
+	user := uuid.NewString()
+	first := CheckoutRequest{UserID: user, CartID: uuid.NewString()}
+	second := CheckoutRequest{UserID: user, CartID: uuid.NewString()}
+
+	release, err := h.acquireCheckoutLocks(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.acquireCheckoutLocks(context.Background(), second); !errors.Is(err, ErrUserLocked) {
+		t.Fatalf("second cart: err = %v, want ErrUserLocked", err)
+	}
+	// The second cart's lock was given back with the refusal
+	if mr.Exists(cartLockKey(second.CartID)) {
+		t.Error("a refused checkout kept its cart lock")
+	}
+	release()
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("release left %v", keys)
+	}
+}
+
+func TestCheckoutLocksWithRedisDown(t *testing.T) {
+	mr, rdb := testRedis(t)
+	mr.Close()
+	req := CheckoutRequest{UserID: uuid.NewString(), CartID: uuid.NewString()}
+
+	h := lockHandler(rdb, false)
+	if _, err := h.acquireCheckoutLocks(context.Background(), req); !errors.Is(err, ErrRedisUnavailable) {
+		t.Errorf("failing closed: err = %v, want ErrRedisUnavailable", err)
+	}
+	h.failOpen.Lock = true
+	release, err := h.acquireCheckoutLocks(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failing open: err = %v", err)
+	}
+	release()
+}
+
+// advisoryTx answers lockCheckoutTx's advisory lock queries, refusing the
+// keys in held
+type advisoryTx struct {
+	pgx.Tx
+	held  map[string]bool
+	taken []string
+	err   error
+}
+
+func (tx *advisoryTx) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	return rowFunc(func(dest ...any) error {
+		if tx.err != nil {
+			return tx.err
+		}
+		if !strings.Contains(sql, "pg_try_advisory_xact_lock") {
+			return errors.New("unexpected query: " + sql)
+		}
+		key := args[0].(string)
+		*dest[0].(*bool) = !tx.held[key]
+		if !tx.held[key] {
+			tx.taken = append(tx.taken, key)
+		}
+		return nil
+	})
+}
+
+func TestAdvisoryCheckoutLocks(t *testing.T) {
+	h := &CheckoutHandler{}
+	h.cfg.LockBackend = "postgres"
+	h.cfg.LockPerUser = true
+	req := CheckoutRequest{UserID: uuid.NewString(), CartID: uuid.NewString()}
+	ctx := context.Background()
+
+	tx := &advisoryTx{}
+	if err := h.lockCheckoutTx(ctx, tx, req); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{cartLockKey(req.CartID), userLockKey(req.UserID)}; !slices.Equal(tx.taken, want) {
+		t.Errorf("took %v, want %v", tx.taken, want)
+	}
+
+	contended := testutil.ToFloat64(checkoutLockContention.WithLabelValues("user"))
+	tx = &advisoryTx{held: map[string]bool{userLockKey(req.UserID): true}}
+	if err := h.lockCheckoutTx(ctx, tx, req); !errors.Is(err, ErrUserLocked) {
+		t.Errorf("held user: err = %v, want ErrUserLocked", err)
+	}
+	if got := testutil.ToFloat64(checkoutLockContention.WithLabelValues("user")) - contended; got != 1 {
+		t.Errorf("contention counted %v times, want 1", got)
+	}
+
+	broken := errors.New("conn busy")
+	if err := h.lockCheckoutTx(ctx, &advisoryTx{err: broken}, req); !errors.Is(err, broken) {
+		t.Errorf("failed query: err = %v, want it passed on", err)
+	}
+}
+
+// holdCheckoutLock holds key as a concurrent checkout would with backend
+// until the returned function is called
+func holdCheckoutLock(t *testing.T, db *DBRouter, mr *miniredis.Miniredis, backend, key string) func() {
+	t.Helper()
+	if backend == "redis" {
+		mr.Set(key, "their-token")
+		return func() { mr.Del(key) }
+	}
+	ctx := context.Background()
+	tx, err := db.Primary().Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback(ctx) })
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, key); err != nil {
+		t.Fatal(err)
+	}
+	return func() { tx.Rollback(ctx) }
+}
+
+func TestCheckoutReportsWhichLockIsHeld(t *testing.T) {
+	db := testRouter(t)
+	for _, backend := range []string{"redis", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			mr, rdb := testRedis(t)
+			app, h := checkoutApp(t, db, rdb)
+			h.cfg.LockBackend = backend
+			product := seedProduct(t, db, "LOCKS-"+backend, 5, 10)
+			owner := seedUser(t, db, "pro", "active")
+			other := seedUser(t, db, "pro", "active")
+			items := []CheckoutItem{{ProductID: product, Qty: 1}}
+			cart := seedCart(t, db, owner, "open", 5, product)
+
+			// Another user's checkout holds the cart
+			release := holdCheckoutLock(t, db, mr, backend, cartLockKey(cart))
+			resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout",
+				CheckoutRequest{UserID: other, CartID: cart, PaymentRef: "pay-locks", Items: items}))
+			if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusConflict || e["code"] != ErrCartLocked.Code {
+				t.Errorf("held cart: got %d %s, want 409 %s", resp.StatusCode, body, ErrCartLocked.Code)
+			}
+			release()
+
+			// The owner's checkout of another cart waits only with the
+			// per-user lock
+			h.cfg.LockPerUser = true
+			release = holdCheckoutLock(t, db, mr, backend, userLockKey(owner))
+			second := seedCart(t, db, owner, "open", 5, product)
+			resp, body = send(t, app, newRequest(http.MethodPost, "/v1/checkout",
+				CheckoutRequest{UserID: owner, CartID: second, PaymentRef: "pay-locks", Items: items}))
+			if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusConflict || e["code"] != ErrUserLocked.Code {
+				t.Errorf("held user: got %d %s, want 409 %s", resp.StatusCode, body, ErrUserLocked.Code)
+			}
+			h.cfg.LockPerUser = false
+			postCheckout(t, app, CheckoutRequest{UserID: owner, CartID: second, PaymentRef: "pay-locks", Items: items})
+			release()
+
+			// The advisory locks went with the transaction and left nothing
+			// in Redis
+			if backend == "postgres" {
+				for _, key := range mr.Keys() {
+					if strings.HasPrefix(key, "lock:") || strings.HasPrefix(key, "idem:") {
+						t.Errorf("the postgres backend left %s in Redis", key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAdvisoryBackendRejectsInactiveUsersFirst(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	h.cfg.LockBackend = "postgres"
+	h.cfg.LockPerUser = true
+	user := seedUser(t, db, "pro", "inactive")
+	product := seedProduct(t, db, "ADVISORY-INACTIVE", 5, 10)
+
+	// Were the lock taken first, the held one would answer 409
+	release := holdCheckoutLock(t, db, mr, "postgres", userLockKey(user))
+	defer release()
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+		UserID: user, PaymentRef: "pay-inactive", Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+	}))
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusForbidden || e["code"] != ErrUserInactive.Code {
+		t.Errorf("got %d %s, want 403 %s", resp.StatusCode, body, ErrUserInactive.Code)
+	}
+}
+
+func TestAdvisoryBackendReplaysFromIdempotencyKeys(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	h.cfg.LockBackend = "postgres"
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "ADVISORY", 5, 10)
+	checkout := func(paymentRef string) (*http.Response, []byte) {
+		req := newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+			UserID: user, PaymentRef: paymentRef,
+			Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+		})
+		req.Header.Set(headerIdempotencyKey, "advisory-"+user)
+		return send(t, app, req)
+	}
+
+	resp, first := checkout("pay-1")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("first: got %d %s", resp.StatusCode, first)
+	}
+	resp, body := checkout("pay-2")
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerIdempotentReplay) != "true" || string(body) != string(first) {
+		t.Errorf("retry: got %d replay %q %s, want the first response", resp.StatusCode, resp.Header.Get(headerIdempotentReplay), body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// OrderPrice is what an order charges: its lines and the totals
+// orderTotals composes from them. Checkout stores it and a quote returns
+// it, both from priceOrder, so a quote can't differ from the charge.
+type OrderPrice struct {
+	Lines    []QuoteLine
+	Subtotal Cents
+	Discount Cents
+	Tax      Cents
+	Shipping Cents
+	Total    Cents
+	TaxRate  TaxRate
+}
+
+// QuoteLine is one product of an order
+type QuoteLine struct {
+	ProductID string  `json:"productId"`
+	Qty       int     `json:"qty"`
+	UnitPrice float64 `json:"unitPrice"`
+	LineTotal float64 `json:"lineTotal"`
+}
+
+// priceOrder prices items with the coupon discount already worked out
+func priceOrder(items []CartItemDB, discount Cents, taxRate TaxRate, shippingMethod string) OrderPrice {
+	price := OrderPrice{Lines: make([]QuoteLine, len(items)), TaxRate: taxRate}
+	var subtotal Cents
+	units := 0
+	for i, item := range items {
+		line := Cents(item.Qty) * item.UnitPrice
+		subtotal += line
+		units += item.Qty
+		price.Lines[i] = QuoteLine{
+			ProductID: strings.ToLower(item.ProductID),
+			Qty:       item.Qty,
+			UnitPrice: item.UnitPrice.Dollars(),
+			LineTotal: line.Dollars(),
+		}
+	}
+	price.Subtotal, price.Discount, price.Tax, price.Shipping, price.Total = orderTotals(
+		subtotal, discount, taxRate, shippingMethod, units)
+	return price
+}
+
+// CheckoutQuote is the response of POST /v1/checkout/quote
+type CheckoutQuote struct {
+	UserID string `json:"userId"`
+	// Mode is cart or direct, as in CheckoutResponse
+	Mode           string      `json:"mode"`
+	Region         string      `json:"region"`
+	ShippingMethod string      `json:"shippingMethod"`
+	Coupon         string      `json:"coupon,omitempty"`
+	Items          []QuoteLine `json:"items"`
+	Subtotal       float64     `json:"subtotal"`
+	Discount       float64     `json:"discount"`
+	// TaxRate is fractional, 0.0825 for 8.25%
+	TaxRate  float64 `json:"taxRate"`
+	Tax      float64 `json:"tax"`
+	Shipping float64 `json:"shipping"`
+	Total    float64 `json:"total"`
+}
+
+// Quote serves POST /v1/checkout/quote: it takes a checkout request
+// (paymentRef optional) and runs checkout's steps in a read-only
+// transaction. The coupon is evaluated without recording a use and stock
+// is checked without being reserved. It fails as that checkout would
+// have. Nothing is locked, so a checkout right after can still fail.
+func (h *CheckoutHandler) Quote(c *fiber.Ctx) error {
+	req, err := h.decodeRequest(c, false)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	ctx, span := startSpan(c.UserContext(), "checkout.quote")
+	quote, err := h.quote(ctx, req)
+	endSpan(span, err)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(quote)
+}
+
+func (h *CheckoutHandler) quote(ctx context.Context, req CheckoutRequest) (*CheckoutQuote, error) {
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, dbError("begin quote", err)
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	region, err := h.getUserRegion(ctx, tx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mode := "direct"
+	var items []CartItemDB
+	if req.CartID == "" {
+		items, err = loadDirectItems(ctx, tx, req.Items, false)
+	} else {
+		mode = "cart"
+		items, err = loadCartItems(ctx, tx, req.UserID, req.CartID, false)
+		if mismatches := matchCart(req.Items, items); err == nil && len(mismatches) > 0 {
+			err = ErrCartMismatch.WithDetails(mismatches)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var discount Cents
+	if req.Coupon != "" {
+		discount, err = h.evaluateCoupon(ctx, tx, req.UserID, req.Coupon, items, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkInventory(ctx, tx, items, warehouseForRegion(region)); err != nil {
+		return nil, err
+	}
+
+	price := priceOrder(items, discount, h.taxes.Rate(region), req.ShippingMethod)
+	return &CheckoutQuote{
+		UserID:         req.UserID,
+		Mode:           mode,
+		Region:         region,
+		ShippingMethod: req.ShippingMethod,
+		Coupon:         req.Coupon,
+		Items:          price.Lines,
+		Subtotal:       price.Subtotal.Dollars(),
+		Discount:       price.Discount.Dollars(),
+		TaxRate:        float64(price.TaxRate) / 10000,
+		Tax:            price.Tax.Dollars(),
+		Shipping:       price.Shipping.Dollars(),
+		Total:          price.Total.Dollars(),
+	}, nil
+}
+
+// checkInventory fails with the shortfall error reserveInventory would,
+// reserving nothing
+func checkInventory(ctx context.Context, tx pgx.Tx, items []CartItemDB, warehouseID string) error {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.ProductID
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT product_id::text, available_qty - reserved_qty
+		FROM inventory
+		WHERE warehouse_id = $1 AND product_id = ANY($2::text[]::uuid[])`, warehouseID, ids)
+	if err != nil {
+		return dbError("load inventory", err)
+	}
+	defer rows.Close()
+	available := make(map[string]int, len(items))
+	for rows.Next() {
+		var id string
+		var qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			return err
+		}
+		available[id] = qty
+	}
+	if err := rows.Err(); err != nil {
+		return dbError("load inventory", err)
+	}
+
+	var shortfalls []InventoryShortfall
+	for _, item := range items {
+		qty, stocked := available[strings.ToLower(item.ProductID)]
+		if !stocked || qty < item.Qty {
+			shortfalls = append(shortfalls, newShortfall(item, qty, stocked))
+		}
+	}
+	if len(shortfalls) > 0 {
+		return shortfallError(shortfalls)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestOrderTotals(t *testing.T) {
+	for _, tt := range []struct {
+		name                                 string
+		subtotal, discount                   Cents
+		items                                int
+		wantDiscount, wantTax, wantShip, sum Cents
+	}{
+		{"no discount", 50_00, 0, 1, 0, 4_00, 5_99, 59_99},
+		{"discounted", 50_00, 10_00, 2, 10_00, 3_20, 6_98, 50_18},
+		{"a coupon bigger than the cart", 30_00, 50_00, 1, 30_00, 0, 5_99, 5_99},
+		{"a negative discount", 30_00, -5_00, 1, 0, 2_40, 5_99, 38_39},
+		{"free shipping on the undiscounted subtotal", 120_00, 40_00, 3, 40_00, 6_40, 0, 86_40},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			subtotal, discount, tax, shipping, total := orderTotals(tt.subtotal, tt.discount, 800, "standard", tt.items)
+			if subtotal != tt.subtotal || discount != tt.wantDiscount || tax != tt.wantTax ||
+				shipping != tt.wantShip || total != tt.sum {
+				t.Errorf("totals = %d %d %d %d %d, want %d %d %d %d %d",
+					subtotal, discount, tax, shipping, total,
+					tt.subtotal, tt.wantDiscount, tt.wantTax, tt.wantShip, tt.sum)
+			}
+			if total != subtotal-discount+tax+shipping || tax < 0 {
+				t.Errorf("the parts don't compose: %d - %d + %d + %d != %d", subtotal, discount, tax, shipping, total)
+			}
+		})
+	}
+}
+
+func TestPriceOrderWithAFixedCouponOverTheCart(t *testing.T) {
+	coupon := testCoupon("fixed", 50_00)
+	items := []CartItemDB{{ProductID: "P1", Qty: 2, UnitPrice: 15_00}}
+	discount, err := evaluate(couponTx{coupon: coupon}, items...)
+	if err != nil || discount != 30_00 {
+		t.Fatalf("discount = %d, %v, want the 30.00 subtotal", discount, err)
+	}
+	price := priceOrder(items, discount, 800, "standard")
+	if price.Subtotal != 30_00 || price.Discount != 30_00 || price.Tax != 0 || price.Total != price.Shipping {
+		t.Errorf("price = %+v, want only shipping charged", price)
+	}
+	if line := price.Lines[0]; line.ProductID != "p1" || line.LineTotal != 30 {
+		t.Errorf("line = %+v", line)
+	}
+}
+
+func TestOrdersRejectTotalsThatDontCompose(t *testing.T) {
+	db := testRouter(t)
+	user := seedUser(t, db, "pro", "active")
+	for name, row := range map[string][5]float64{
+		"discount over the subtotal": {30, 50, 0, 5.99, 5.99},
+		"negative tax":               {30, 50, -1.6, 5.99, -15.61},
+		"total off by a cent":        {30, 0, 2.4, 5.99, 38.38},
+	} {
+		var id string
+		err := db.Primary().QueryRow(context.Background(), `
+			INSERT INTO orders (user_id, status, subtotal, discount, tax, shipping, total)
+			VALUES ($1, 'pending', $2, $3, $4, $5, $6) RETURNING id`,
+			user, row[0], row[1], row[2], row[3], row[4]).Scan(&id)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.ConstraintName != "orders_total_composition" {
+			t.Errorf("%s: err = %v, want the orders_total_composition check", name, err)
+		}
+	}
+}
+
+func TestQuoteRejectsAsCheckoutDoes(t *testing.T) {
+	h := &CheckoutHandler{}
+	h.cfg.MaxBodyBytes, h.cfg.MaxItems, h.cfg.MaxQty = 1<<16, 10, 5
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/checkout/quote", h.Quote)
+	for name, tt := range map[string]struct {
+		body any
+		code string
+	}{
+		"no user":         {CheckoutRequest{Items: []CheckoutItem{{ProductID: testUserID, Qty: 1}}}, "VALIDATION_FAILED"},
+		"too many units":  {CheckoutRequest{UserID: testUserID, Items: []CheckoutItem{{ProductID: testUserID, Qty: 6}}}, "VALIDATION_FAILED"},
+		"unknown field":   {`{"customer":"x"}`, "INVALID_JSON"},
+		"unknown shipper": {CheckoutRequest{UserID: testUserID, ShippingMethod: "drone", Items: []CheckoutItem{{ProductID: testUserID, Qty: 1}}}, "INVALID_SHIPPING_METHOD"},
+	} {
+		resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout/quote", tt.body))
+		if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusBadRequest || e["code"] != tt.code {
+			t.Errorf("%s: got %d %s, want 400 %s", name, resp.StatusCode, body, tt.code)
+		}
+	}
+}
+
+// postQuote sends req to app's quote route and decodes a 200
+func postQuote(t *testing.T, app *fiber.App, req CheckoutRequest) CheckoutQuote {
+	t.Helper()
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout/quote", req))
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("quote: status = %d: %s", resp.StatusCode, body)
+	}
+	var quote CheckoutQuote
+	if err := jsonUnmarshal(body, &quote); err != nil {
+		t.Fatal(err)
+	}
+	return quote
+}
+
+func TestQuoteMatchesTheCheckout(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	app, h := checkoutApp(t, db, rdb)
+	app.Post("/v1/checkout/quote", h.Quote)
+	mustExec(t, db, `
+		INSERT INTO tax_rates (region, rate) VALUES ('test-tax-quote', 0.0725)
+		ON CONFLICT (region) DO UPDATE SET rate = EXCLUDED.rate`)
+	t.Cleanup(func() {
+		db.Primary().Exec(ctx, `DELETE FROM tax_rates WHERE region = 'test-tax-quote'`)
+	})
+	if err := h.taxes.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		region, shipping string
+		cart             bool
+	}{
+		{"us-east", "standard", false},
+		{"test-tax-quote", "express", false},
+		{"test-tax-quote", "overnight", true},
+	} {
+		t.Run(tt.region+"/"+tt.shipping, func(t *testing.T) {
+			user := seedUser(t, db, "pro", "active")
+			mustExec(t, db, `UPDATE users SET region = $2 WHERE id = $1`, user, tt.region)
+			cheap := seedProduct(t, db, "QUOTE-CHEAP", 3.35, 10)
+			dear := seedProduct(t, db, "QUOTE-DEAR", 41.99, 10)
+			req := CheckoutRequest{UserID: user, PaymentRef: "pay-quote", ShippingMethod: tt.shipping,
+				Items: []CheckoutItem{{ProductID: cheap, Qty: 1}, {ProductID: dear, Qty: 1}}}
+			if tt.cart {
+				req.CartID = seedCart(t, db, user, "open", 7.5, cheap, dear)
+			}
+
+			quote := postQuote(t, app, req)
+			// Quoting reserved nothing
+			if _, reserved := stock(t, db, dear); reserved != 0 {
+				t.Errorf("the quote reserved %d units", reserved)
+			}
+			out := postCheckout(t, app, req)
+			var got [5]float64
+			err := db.Primary().QueryRow(ctx, `
+				SELECT subtotal::float8, discount::float8, tax::float8, shipping::float8, total::float8
+				FROM orders WHERE id = $1`, out.OrderID).Scan(&got[0], &got[1], &got[2], &got[3], &got[4])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := [5]float64{quote.Subtotal, quote.Discount, quote.Tax, quote.Shipping, quote.Total}
+			if got != want || out.Total != quote.Total {
+				t.Errorf("order charged %v (total %v), quoted %v", got, out.Total, want)
+			}
+			items := orderItems(t, db, out.OrderID)
+			for _, line := range quote.Items {
+				if items[line.ProductID] != [2]float64{float64(line.Qty), line.UnitPrice} {
+					t.Errorf("line %s: ordered %v, quoted %+v", line.ProductID, items[line.ProductID], line)
+				}
+			}
+		})
+	}
+}
+
+func TestQuoteRecordsNoCouponUse(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	app.Post("/v1/checkout/quote", h.Quote)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "QUOTE-COUPON", 40, 10)
+	code := func(name string) string { return "Q" + strings.ToUpper(uuid.NewString()[:8]) + name }
+
+	for _, tt := range []struct {
+		typ      string
+		value    float64
+		discount float64
+	}{
+		{"percentage", 15, 12},
+		{"fixed", 5, 5},
+	} {
+		coupon := code(tt.typ[:1])
+		seedCoupon(t, db, coupon, tt.typ, tt.value, 100, "NOW() - INTERVAL '1 day'", "NOW() + INTERVAL '1 day'", nil, nil)
+		quote := postQuote(t, app, CheckoutRequest{
+			UserID: user, Coupon: coupon, Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+		})
+		if quote.Discount != tt.discount || quote.Total != quote.Subtotal-quote.Discount+quote.Tax+quote.Shipping {
+			t.Errorf("%s: quote = %+v, want a %v discount", tt.typ, quote, tt.discount)
+		}
+		var used int
+		if err := db.Primary().QueryRow(context.Background(),
+			`SELECT used_count FROM coupons WHERE code = $1`, coupon).Scan(&used); err != nil || used != 0 {
+			t.Errorf("%s: used_count = %d, %v after a quote, want 0", tt.typ, used, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// checkoutStatsKey is a hash of checkout outcome counts across every
+// instance, for runs without Prometheus
+const checkoutStatsKey = "metrics:checkout:outcomes"
+
+var checkoutOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "checkout_outcomes_total",
+	Help: "Checkouts by outcome: success, replayed, or the lowercased error code (rate_limited, cart_lock_contention, user_lock_contention, cart_not_found, coupon_invalid, db_error, ...).",
+}, []string{"outcome"})
+
+// checkoutOutcomeNames renames the error codes whose outcome label reads
+// better as the cause than as the response. Every other code is counted
+// lowercased, so new error types need no entry here.
+var checkoutOutcomeNames = map[string]string{
+	ErrCartLocked.Code:    "cart_lock_contention",
+	ErrUserLocked.Code:    "user_lock_contention",
+	ErrInvalidCoupon.Code: "coupon_invalid",
+	ErrCouponUsed.Code:    "coupon_used",
+	ErrDBUnavailable.Code: "db_error",
+}
+
+// checkoutOutcome labels a checkout that ended with err. Errors that
+// aren't AppErrors are counted as db_error: past validation, checkout's
+// unclassified failures are all Postgres's.
+func checkoutOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		return "db_error"
+	}
+	if name, ok := checkoutOutcomeNames[appErr.Code]; ok {
+		return name
+	}
+	return strings.ToLower(appErr.Code)
+}
+
+// CheckoutStats counts checkout outcomes in Prometheus, in memory since
+// the process started, and, every flush interval, in the checkoutStatsKey
+// hash. It also times the checkout transaction and sizes the orders it
+// places.
+type CheckoutStats struct {
+	rdb      *redis.Client
+	interval time.Duration
+	started  time.Time
+
+	txDuration *prometheus.HistogramVec
+	orderItems prometheus.Histogram
+
+	mu      sync.Mutex
+	counts  map[string]int64
+	pending map[string]int64
+}
+
+// NewCheckoutStats times transactions in the checkout latency buckets. A
+// zero interval keeps the counts out of Redis.
+func NewCheckoutStats(rdb *redis.Client, interval time.Duration, buckets []float64) *CheckoutStats {
+	return &CheckoutStats{
+		rdb:      rdb,
+		interval: interval,
+		started:  time.Now(),
+		txDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "checkout_transaction_duration_seconds",
+			Help:    "Time spent in the checkout transaction, by result (committed, failed).",
+			Buckets: buckets,
+		}, []string{"result"}),
+		orderItems: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "checkout_order_items",
+			Help:    "Distinct products per order placed.",
+			Buckets: []float64{1, 2, 3, 4, 5, 7, 10, 15, 20, 30, 50, 100},
+		}),
+		counts:  map[string]int64{},
+		pending: map[string]int64{},
+	}
+}
+
+// Record counts one checkout that ended in outcome
+func (s *CheckoutStats) Record(outcome string) {
+	checkoutOutcomes.WithLabelValues(outcome).Inc()
+	s.mu.Lock()
+	s.counts[outcome]++
+	if s.interval > 0 {
+		s.pending[outcome]++
+	}
+	s.mu.Unlock()
+}
+
+// observeTransaction records how long a checkout transaction took
+func (s *CheckoutStats) observeTransaction(start time.Time, err error) {
+	result := "committed"
+	if err != nil {
+		result = "failed"
+	}
+	s.txDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// Middleware counts the outcome of each synchronous checkout from the
+// error the request was answered with, so rejections by the rate and
+// concurrency limits and by validation are counted alongside the
+// checkout's own. A failure past the deadline is counted as the timeout
+// the timeout middleware turns it into. An accepted async checkout is
+// left to the worker that runs it.
+func (s *CheckoutStats) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		if err == nil {
+			err, _ = c.Locals(localError).(error)
+		}
+		switch {
+		case err != nil && errors.Is(c.UserContext().Err(), context.DeadlineExceeded):
+			s.Record(checkoutOutcome(ErrTimeout))
+		case err != nil:
+			s.Record(checkoutOutcome(err))
+		case c.Response().StatusCode() == fiber.StatusAccepted:
+		case string(c.Response().Header.Peek(headerIdempotentReplay)) == "true":
+			s.Record("replayed")
+		default:
+			s.Record("success")
+		}
+		return err
+	}
+}
+
+// Enabled reports whether the counts are flushed to Redis
+func (s *CheckoutStats) Enabled() bool {
+	return s.interval > 0
+}
+
+// Run flushes the counts to Redis every interval until ctx is done, and
+// once more on the way out
+func (s *CheckoutStats) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+			defer cancel()
+			if err := s.flush(flushCtx); err != nil {
+				log.Printf("⚠️  Checkout stats not flushed on shutdown: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.flush(ctx); err != nil {
+				log.Printf("⚠️  Checkout stats flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// flush adds the counts recorded since the last flush to the hash. On
+// failure they are kept for the next one.
+func (s *CheckoutStats) flush(ctx context.Context) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = map[string]int64{}
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	pipe := s.rdb.Pipeline()
+	for outcome, n := range pending {
+		pipe.HIncrBy(ctx, checkoutStatsKey, outcome, n)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.mu.Lock()
+		for outcome, n := range pending {
+			s.pending[outcome] += n
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Handler serves GET /v1/internal/checkout-stats: this process's counts
+// since it started and, when they are flushed, every instance's from Redis
+func (s *CheckoutStats) Handler(c *fiber.Ctx) error {
+	s.mu.Lock()
+	counts := maps.Clone(s.counts)
+	s.mu.Unlock()
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	body := fiber.Map{
+		"since":         s.started.UTC(),
+		"uptimeSeconds": int64(time.Since(s.started).Seconds()),
+		"total":         total,
+		"outcomes":      counts,
+	}
+	if s.Enabled() {
+		all, err := s.rdb.HGetAll(c.UserContext(), checkoutStatsKey).Result()
+		if err != nil {
+			return writeError(c, ErrRedisUnavailable.With(err))
+		}
+		allCounts := make(map[string]int64, len(all))
+		for outcome, raw := range all {
+			allCounts[outcome], _ = strconv.ParseInt(raw, 10, 64)
+		}
+		body["allInstances"] = allCounts
+	}
+	return c.JSON(body)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// outcomeStats is a CheckoutStats without its histograms, which can only
+// be registered once; counting doesn't touch them
+func outcomeStats(rdb *redis.Client, interval time.Duration) *CheckoutStats {
+	return &CheckoutStats{
+		rdb: rdb, interval: interval, started: time.Now(),
+		counts: map[string]int64{}, pending: map[string]int64{},
+	}
+}
+
+func TestCheckoutOutcome(t *testing.T) {
+	for err, want := range map[error]string{
+		nil:                                   "success",
+		ErrRateLimited:                        "rate_limited",
+		ErrCartLocked:                         "cart_lock_contention",
+		ErrUserLocked:                         "user_lock_contention",
+		ErrCartNotFound:                       "cart_not_found",
+		ErrCartEmpty:                          "cart_empty",
+		ErrInvalidCoupon:                      "coupon_invalid",
+		ErrCouponUsed:                         "coupon_used",
+		ErrDBUnavailable.With(errors.New("")): "db_error",
+		fmt.Errorf("wrapped: %w", ErrInsufficientStock): "insufficient_inventory",
+		// Codes without a name are counted as they are
+		ErrCouponMinNotMet:            "coupon_min_not_met",
+		errors.New("scan order: eof"): "db_error",
+	} {
+		if got := checkoutOutcome(err); got != want {
+			t.Errorf("%v: outcome = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestCheckoutStatsMiddleware(t *testing.T) {
+	s := outcomeStats(nil, 0)
+	app := fiber.New()
+	app.Use(s.Middleware())
+	app.Post("/ok", okHandler)
+	app.Post("/empty", func(c *fiber.Ctx) error { return writeError(c, ErrCartEmpty) })
+	app.Post("/returned", func(*fiber.Ctx) error { return ErrCartLocked })
+	app.Post("/queued", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusAccepted) })
+	app.Post("/replay", func(c *fiber.Ctx) error {
+		c.Set(headerIdempotentReplay, "true")
+		return c.SendString("{}")
+	})
+	app.Post("/late", func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), 0)
+		defer cancel()
+		c.SetUserContext(ctx)
+		return writeError(c, ErrDBUnavailable)
+	})
+	for _, path := range []string{"/ok", "/ok", "/empty", "/returned", "/queued", "/replay", "/late"} {
+		send(t, app, newRequest(http.MethodPost, path, nil))
+	}
+	want := map[string]int64{"success": 2, "cart_empty": 1, "cart_lock_contention": 1, "replayed": 1, "timeout": 1}
+	if !reflect.DeepEqual(s.counts, want) {
+		t.Errorf("counts = %v, want %v", s.counts, want)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %v without a flush interval", s.pending)
+	}
+}
+
+func TestCheckoutStatsFlushAndServe(t *testing.T) {
+	mr, rdb := testRedis(t)
+	s := outcomeStats(rdb, time.Minute)
+	mr.HSet(checkoutStatsKey, "success", "10") // another instance's
+	for _, outcome := range []string{"success", "success", "rate_limited"} {
+		s.Record(outcome)
+	}
+
+	// A failed flush keeps the counts for the next one
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { down.Close() })
+	s.rdb = down
+	if err := s.flush(context.Background()); err == nil {
+		t.Fatal("flushed to an unreachable Redis")
+	}
+	s.rdb = rdb
+	s.Record("success")
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(checkoutStatsKey, "success"); got != "13" {
+		t.Errorf("success in Redis = %s, want 13", got)
+	}
+	if got := mr.HGet(checkoutStatsKey, "rate_limited"); got != "1" {
+		t.Errorf("rate_limited in Redis = %s, want 1", got)
+	}
+
+	app := fiber.New()
+	app.Get("/v1/internal/checkout-stats", s.Handler)
+	resp, body := send(t, app, newRequest(http.MethodGet, "/v1/internal/checkout-stats", nil))
+	got := decode(t, body)
+	outcomes, _ := got["outcomes"].(map[string]any)
+	all, _ := got["allInstances"].(map[string]any)
+	if resp.StatusCode != fiber.StatusOK || got["total"] != 4.0 || outcomes["success"] != 3.0 || all["success"] != 13.0 {
+		t.Errorf("got %d %s, want this process's 4 and every instance's 13 successes", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// postCheckout sends req to app's POST /v1/checkout and decodes a 200
+func postCheckout(t *testing.T, app *fiber.App, req CheckoutRequest) CheckoutResponse {
+	t.Helper()
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", req))
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("checkout: status = %d: %s", resp.StatusCode, body)
+	}
+	var out CheckoutResponse
+	if err := jsonUnmarshal(body, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// orderItems returns the order's lines as product id -> {qty, unit price}
+func orderItems(t *testing.T, db *DBRouter, orderID string) map[string][2]float64 {
+	t.Helper()
+	rows, err := db.Primary().Query(context.Background(), `
+		SELECT product_id::text, qty, unit_price::float8 FROM order_items WHERE order_id = $1`, orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	items := map[string][2]float64{}
+	for rows.Next() {
+		var id string
+		var qty int
+		var price float64
+		if err := rows.Scan(&id, &qty, &price); err != nil {
+			t.Fatal(err)
+		}
+		items[id] = [2]float64{float64(qty), price}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestCheckoutWritesEveryOrderItem(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	var products []string
+	var items []CheckoutItem
+	for _, sku := range []string{"ITEMS-1", "ITEMS-2", "ITEMS-3"} {
+		p := seedProduct(t, db, sku, 4.25, 10)
+		products = append(products, p)
+		items = append(items, CheckoutItem{ProductID: p, Qty: 1})
+	}
+	cart := seedCart(t, db, user, "open", 4.25, products...)
+
+	out := postCheckout(t, app, CheckoutRequest{UserID: user, CartID: cart, PaymentRef: "pay-items", Items: items})
+	got := orderItems(t, db, out.OrderID)
+	if len(got) != len(products) {
+		t.Fatalf("order has %d items, want %d: %v", len(got), len(products), got)
+	}
+	for _, p := range products {
+		if got[p] != [2]float64{1, 4.25} {
+			t.Errorf("item %s = %v, want 1 at 4.25", p, got[p])
+		}
+	}
+}
+
+func TestExecBatchNamesTheFailingStatement(t *testing.T) {
+	db := testRouter(t)
+	ctx := context.Background()
+	user := seedUser(t, db, "pro", "active")
+	tx, err := db.Primary().Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = execBatch(ctx, tx,
+		batchStmt{"log event", `
+			INSERT INTO events(id, user_id, type, payload_json, created_at)
+			VALUES($1, $2, 'TEST', '{}', NOW())`, []any{uuid.NewString(), user}},
+		// No such user, so the foreign key rejects it
+		batchStmt{"bad insert", `INSERT INTO orders(user_id) VALUES($1)`, []any{testUserID}},
+		batchStmt{"never checked", `SELECT 1`, nil},
+	)
+	if err == nil || !strings.Contains(err.Error(), "bad insert") {
+		t.Fatalf("err = %v, want the failing statement named", err)
+	}
+	if status, _ := errorBody(err); status != 500 {
+		t.Errorf("a rejected statement is a %d, want 500", status)
+	}
+	tx.Rollback(ctx)
+
+	// The rollback undid the statement that succeeded
+	var n int
+	if err := db.Primary().QueryRow(ctx, `SELECT count(*) FROM events WHERE user_id = $1`, user).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d events survived the rollback", n)
+	}
+
+	// A good batch reports every tag
+	tx, err = db.Primary().Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	tags, err := execBatchTags(ctx, tx,
+		batchStmt{"touch user", `UPDATE users SET status = status WHERE id = $1`, []any{user}},
+		batchStmt{"touch nobody", `UPDATE users SET status = status WHERE id = $1`, []any{testUserID}},
+	)
+	if err != nil || len(tags) != 2 || tags[0].RowsAffected() != 1 || tags[1].RowsAffected() != 0 {
+		t.Errorf("tags = %v, %v, want one row then none", tags, err)
+	}
+}
+
+func TestDirectCheckoutChargesCurrentPrices(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "DIRECT", 7.5, 10)
+	// An open cart priced differently is left alone
+	cart := seedCart(t, db, user, "open", 2, product)
+
+	out := postCheckout(t, app, CheckoutRequest{
+		UserID: user, PaymentRef: "pay-direct",
+		Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+	})
+	if out.Mode != "direct" {
+		t.Errorf("mode = %q, want direct", out.Mode)
+	}
+	if got := orderItems(t, db, out.OrderID)[product]; got != [2]float64{2, 7.5} {
+		t.Errorf("item = %v, want 2 at the product's 7.5", got)
+	}
+	var status string
+	if err := db.Primary().QueryRow(context.Background(), `SELECT status FROM carts WHERE id = $1`, cart).Scan(&status); err != nil || status != "open" {
+		t.Errorf("cart status = %q, %v, want it left open", status, err)
+	}
+}
+
+func TestDirectCheckoutOfUnknownProducts(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "KNOWN", 1, 10)
+	missing := uuid.NewString()
+
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+		UserID: user, PaymentRef: "pay-unknown",
+		Items: []CheckoutItem{{ProductID: product, Qty: 1}, {ProductID: missing, Qty: 1}},
+	}))
+	e, _ := decode(t, body)["error"].(map[string]any)
+	if resp.StatusCode != http.StatusNotFound || e["code"] != "PRODUCT_NOT_FOUND" || !strings.Contains(string(body), missing) {
+		t.Errorf("got %d %s, want 404 PRODUCT_NOT_FOUND listing %s", resp.StatusCode, body, missing)
+	}
+}
+
+// cancelAfterLock cancels the request once its checkout lock is taken
+type cancelAfterLock struct {
+	cancel context.CancelFunc
+}
+
+func (h cancelAfterLock) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h cancelAfterLock) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if args := cmd.Args(); cmd.Name() == "set" && len(args) > 1 {
+			if key, _ := args[1].(string); strings.HasPrefix(key, "lock:checkout:") {
+				h.cancel()
+			}
+		}
+		return err
+	}
+}
+
+func (h cancelAfterLock) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestCheckoutOutlivesItsRequest(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	_, h := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "DETACHED", 2, 10)
+	cart := seedCart(t, db, user, "open", 2, product)
+	req := CheckoutRequest{
+		UserID: user, CartID: cart, PaymentRef: "pay-" + uuid.NewString(),
+		Items: []CheckoutItem{{ProductID: product, Qty: 1}}, ShippingMethod: "standard",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdb.AddHook(cancelAfterLock{cancel})
+	payload, _, err := h.processCheckout(ctx, req, req.PaymentRef)
+	if err != nil {
+		t.Fatalf("checkout failed once its request was gone: %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("the request was never cancelled")
+	}
+
+	// The order, its idempotency record and the closed cart all committed
+	var out CheckoutResponse
+	if err := jsonUnmarshal(payload, &out); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := db.Primary().QueryRow(context.Background(), `SELECT status FROM carts WHERE id = $1`, cart).Scan(&status); err != nil || status != "closed" {
+		t.Errorf("cart status = %q, %v, want closed", status, err)
+	}
+	replay, err := h.loadIdempotencyRecord(context.Background(), req.PaymentRef, requestFingerprint(req))
+	if err != nil || !strings.Contains(string(replay), out.OrderID) {
+		t.Errorf("idempotency record = %s, %v, want the order", replay, err)
+	}
+	if mr.Exists(cartLockKey(cart)) {
+		t.Error("the cart lock outlived the checkout")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// FieldError is one entry in a 400's details list
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// decodeStrict rejects unknown fields and trailing data, so a typo such as
+// "productID" fails loudly instead of decoding to an empty id. The decoder's
+// complaint is about the client's own body, so it goes back in details.
+func decodeStrict(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the object")
+	}
+	if err != nil {
+		return ErrInvalidJSON.With(err).WithDetails([]FieldError{{Field: "body", Message: err.Error()}})
+	}
+	return nil
+}
+
+// CartMismatch is one entry in a CART_MISMATCH's details list
+type CartMismatch struct {
+	ProductID string `json:"productId"`
+	// Reason is not_in_cart, missing_from_request or qty_mismatch
+	Reason       string `json:"reason"`
+	RequestedQty int    `json:"requestedQty"`
+	CartQty      int    `json:"cartQty"`
+}
+
+// matchCart checks the requested items against what the cart actually
+// holds, which is what checkout charges for. They must agree exactly:
+// the same products at the same quantities. Anything else means the
+// client's view of the cart is out of date, and it is listed, requested
+// items first, then cart items the request left out.
+func matchCart(requested []CheckoutItem, cart []CartItemDB) []CartMismatch {
+	inCart := make(map[string]int, len(cart))
+	for _, item := range cart {
+		inCart[strings.ToLower(item.ProductID)] = item.Qty
+	}
+	var mismatches []CartMismatch
+	asked := make(map[string]bool, len(requested))
+	for _, it := range requested {
+		id := strings.ToLower(it.ProductID)
+		asked[id] = true
+		qty, ok := inCart[id]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, CartMismatch{
+				ProductID: id, Reason: "not_in_cart", RequestedQty: it.Qty,
+			})
+		case qty != it.Qty:
+			mismatches = append(mismatches, CartMismatch{
+				ProductID: id, Reason: "qty_mismatch", RequestedQty: it.Qty, CartQty: qty,
+			})
+		}
+	}
+	for _, item := range cart {
+		if id := strings.ToLower(item.ProductID); !asked[id] {
+			mismatches = append(mismatches, CartMismatch{
+				ProductID: id, Reason: "missing_from_request", CartQty: item.Qty,
+			})
+		}
+	}
+	return mismatches
+}
+
+// fieldErrors collects a request's FieldErrors
+type fieldErrors []FieldError
+
+func (e *fieldErrors) add(field, msg string) {
+	*e = append(*e, FieldError{Field: field, Message: msg})
+}
+
+func (e *fieldErrors) requireUUID(field, v string) {
+	if v == "" {
+		e.add(field, "is required")
+	} else if uuid.Validate(v) != nil {
+		e.add(field, "must be a UUID")
+	}
+}
+
+func (h *CheckoutHandler) validate(req CheckoutRequest, requirePaymentRef bool) []FieldError {
+	var errs fieldErrors
+	errs.requireUUID("userId", req.UserID)
+	// cartId is optional; without it the items are checked out directly
+	if req.CartID != "" && uuid.Validate(req.CartID) != nil {
+		errs.add("cartId", "must be a UUID")
+	}
+	if requirePaymentRef && req.PaymentRef == "" {
+		errs.add("paymentRef", "is required")
+	}
+	if len(req.Items) == 0 {
+		errs.add("items", "is required")
+	}
+	h.validateItems(&errs, req.Items)
+	return errs
+}
+
+// validateItems checks the items' count, ids and quantities
+func (h *CheckoutHandler) validateItems(errs *fieldErrors, items []CheckoutItem) {
+	if len(items) > h.cfg.MaxItems {
+		errs.add("items", fmt.Sprintf("must have at most %d entries", h.cfg.MaxItems))
+	}
+	seen := make(map[string]int, len(items))
+	for i, it := range items {
+		if len(*errs) >= 20 {
+			// Enough to diagnose; don't echo back a huge list
+			break
+		}
+		errs.requireUUID(fmt.Sprintf("items[%d].productId", i), it.ProductID)
+		id := strings.ToLower(it.ProductID)
+		if first, dup := seen[id]; dup && id != "" {
+			errs.add(fmt.Sprintf("items[%d].productId", i),
+				fmt.Sprintf("duplicates items[%d]", first))
+		} else {
+			seen[id] = i
+		}
+		if it.Qty < 1 || it.Qty > h.cfg.MaxQty {
+			errs.add(fmt.Sprintf("items[%d].qty", i),
+				fmt.Sprintf("must be between 1 and %d", h.cfg.MaxQty))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchCart(t *testing.T) {
+	const (
+		a = "aaaaaaaa-0000-0000-0000-000000000001"
+		b = "aaaaaaaa-0000-0000-0000-000000000002"
+		c = "aaaaaaaa-0000-0000-0000-000000000003"
+	)
+	cart := []CartItemDB{{ProductID: a, Qty: 2}, {ProductID: b, Qty: 1}}
+	tests := []struct {
+		name      string
+		requested []CheckoutItem
+		want      []CartMismatch
+	}{
+		{"exact", []CheckoutItem{{b, 1}, {a, 2}}, nil},
+		{"case-insensitive", []CheckoutItem{{strings.ToUpper(a), 2}, {b, 1}}, nil},
+		{
+			"qty", []CheckoutItem{{a, 3}, {b, 1}},
+			[]CartMismatch{{ProductID: a, Reason: "qty_mismatch", RequestedQty: 3, CartQty: 2}},
+		},
+		{
+			"not in cart, then missing", []CheckoutItem{{a, 2}, {c, 1}},
+			[]CartMismatch{
+				{ProductID: c, Reason: "not_in_cart", RequestedQty: 1},
+				{ProductID: b, Reason: "missing_from_request", CartQty: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchCart(tt.requested, cart); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mismatches = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckoutRejectsAStaleCart(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "STALE", 3, 10)
+	cart := seedCart(t, db, user, "open", 3, product)
+
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+		UserID: user, CartID: cart, PaymentRef: "pay-stale",
+		Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+	}))
+	e, _ := decode(t, body)["error"].(map[string]any)
+	details, _ := e["details"].([]any)
+	if resp.StatusCode != http.StatusConflict || e["code"] != "CART_MISMATCH" || len(details) != 1 {
+		t.Fatalf("got %d %s, want 409 CART_MISMATCH with one detail", resp.StatusCode, body)
+	}
+	if d := details[0].(map[string]any); d["reason"] != "qty_mismatch" || d["cartQty"] != 1.0 {
+		t.Errorf("detail = %v", d)
+	}
+	var status string
+	if err := db.Primary().QueryRow(context.Background(), `SELECT status FROM carts WHERE id = $1`, cart).Scan(&status); err != nil || status != "open" {
+		t.Errorf("cart status = %q, %v, want it left open", status, err)
+	}
+}
@@ -0,0 +1,126 @@
+// Command logstats summarizes access log files written by the server into
+// per-route latency percentile tables, as a cross-check against the
+// in-process histograms.
+//
+//	go run ./cmd/logstats access.log access.log.20240101T000000.000
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type record struct {
+	Route      string  `json:"route"`
+	Method     string  `json:"method"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Cache      string  `json:"cache"`
+	Phase      string  `json:"phase"`
+}
+
+type routeStats struct {
+	durations []float64
+	errors    int
+	hits      int
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: logstats <access.log> [more.log ...]")
+		os.Exit(2)
+	}
+
+	stats := make(map[string]*routeStats)
+	var malformed int
+	for _, path := range os.Args[1:] {
+		n, err := readFile(path, stats)
+		if err != nil {
+			log.Fatalf("read %s: %v", path, err)
+		}
+		malformed += n
+	}
+
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "route\tcount\terrors\tcache hit\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, k := range keys {
+		s := stats[k]
+		sort.Float64s(s.durations)
+		n := len(s.durations)
+		fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t%.2f%%\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			k, n,
+			100*float64(s.errors)/float64(n),
+			100*float64(s.hits)/float64(n),
+			percentile(s.durations, 0.50),
+			percentile(s.durations, 0.90),
+			percentile(s.durations, 0.99),
+			s.durations[n-1])
+	}
+	tw.Flush()
+
+	if malformed > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d malformed lines\n", malformed)
+	}
+	fmt.Fprintln(os.Stderr, "note: successes are sampled, so counts and error "+
+		"rates are relative to the sampled set")
+}
+
+func readFile(path string, stats map[string]*routeStats) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	malformed := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			malformed++
+			continue
+		}
+		key := r.Method + " " + r.Route
+		if r.Phase != "" {
+			key += " [" + r.Phase + "]"
+		}
+		s, ok := stats[key]
+		if !ok {
+			s = &routeStats{}
+			stats[key] = s
+		}
+		s.durations = append(s.durations, r.DurationMs)
+		if r.Status >= 400 {
+			s.errors++
+		}
+		if r.Cache == "hit" {
+			s.hits++
+		}
+	}
+	return malformed, sc.Err()
+}
+
+// percentile uses the nearest-rank method on a sorted slice
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
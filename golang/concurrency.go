@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	limiterInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "concurrency_limiter_in_flight",
+		Help: "Requests holding a concurrency limiter slot, by limiter.",
+	}, []string{"limiter"})
+
+	limiterRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "concurrency_limiter_rejected_total",
+		Help: "Requests rejected after waiting too long for a slot, by limiter.",
+	}, []string{"limiter"})
+)
+
+// concurrencyLimiter caps how many requests run a route's handler at once.
+// Beyond the cap requests wait up to maxWait for a slot and are then shed
+// with 503, so a spike queues in front of the handler for a bounded time
+// instead of piling up on pool.Acquire.
+func concurrencyLimiter(name string, limit int, maxWait time.Duration) fiber.Handler {
+	sem := semaphore.NewWeighted(int64(limit))
+	inFlight := limiterInFlight.WithLabelValues(name)
+	rejected := limiterRejected.WithLabelValues(name)
+	retryAfter := strconv.Itoa(max(1, int((maxWait+time.Second-1)/time.Second)))
+
+	return func(c *fiber.Ctx) error {
+		if !sem.TryAcquire(1) {
+			ctx, cancel := context.WithTimeout(c.UserContext(), maxWait)
+			err := sem.Acquire(ctx, 1)
+			cancel()
+			if err != nil {
+				rejected.Inc()
+				c.Set(fiber.HeaderRetryAfter, retryAfter)
+				return writeError(c, ErrServerBusy)
+			}
+		}
+		inFlight.Inc()
+		defer func() {
+			inFlight.Dec()
+			sem.Release(1)
+		}()
+		return c.Next()
+	}
+}
+
+// checkOverviewFanout warns when the overview limiter lets through more
+// requests than the pool can serve with every section in flight. Each
+// request holds up to overviewQueryFanout connections, so past that point
+// requests queue on pool.Acquire instead of in the limiter.
+func checkOverviewFanout(limit int, maxConns int32) {
+	switch need := limit * overviewQueryFanout; {
+	case limit == 0:
+		log.Printf("⚠️  CONCURRENCY_LIMIT_OVERVIEW unset; each overview uses up to %d of %d pool connections, set it to about %d",
+			overviewQueryFanout, maxConns, int(maxConns)/overviewQueryFanout)
+	case need > int(maxConns):
+		log.Printf("⚠️  CONCURRENCY_LIMIT_OVERVIEW=%d needs up to %d pool connections, DB_MAX_CONNS is %d",
+			limit, need, maxConns)
+	}
+}
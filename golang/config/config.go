@@ -0,0 +1,1230 @@
+// Package config loads the typed configuration shared by the server and the
+// seeder. Everything is read from the environment once at startup; invalid
+// values are collected and reported together instead of failing one at a
+// time deep inside a driver.
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type Config struct {
+	// DatabaseURL is DATABASE_URL if set, otherwise built from DB_* parts
+	DatabaseURL string
+	// ReplicaURL is DATABASE_REPLICA_URL; when set the overview reads go
+	// to a streaming replica
+	ReplicaURL string
+	DB         DBConfig
+	Redis      RedisConfig
+	Port       string
+	TLS        TLSConfig
+	// Prefork runs one process per core behind SO_REUSEPORT; each child
+	// gets its own share of the DB and Redis pools (see ShareAcross)
+	Prefork bool
+	// Pprof serves the Go runtime profiles under /debug/pprof/ as an
+	// admin route
+	Pprof bool
+	// MetricsAdmin puts /metrics behind the admin guard. It is public by
+	// default so Prometheus can scrape it without credentials.
+	MetricsAdmin bool
+	Socket       SocketConfig
+	Server       ServerConfig
+
+	Startup  StartupConfig
+	Warmup   WarmupConfig
+	Timeouts TimeoutConfig
+	Cache    CacheConfig
+	Overview OverviewConfig
+	Segment  SegmentConfig
+	Tax      TaxConfig
+	// Availability picks where overview availability comes from
+	Availability AvailabilityConfig
+	Checkout     CheckoutConfig
+	Reservations ReservationConfig
+	Outbox       OutboxConfig
+	OrderStream  OrderStreamConfig
+	Webhooks     WebhookConfig
+	RateLimit    RateLimitsConfig
+	Limits       ConcurrencyConfig
+	// RedisBreaker and RedisFailOpen decide what happens when Redis is down
+	RedisBreaker  RedisBreakerConfig
+	RedisFailOpen RedisFailOpenConfig
+	AccessLog     AccessLogConfig
+	Audit         AuditConfig
+	Metrics       MetricsConfig
+
+	// APIV1Sunset is the HTTP-date advertised in the v1 Sunset header
+	APIV1Sunset string
+	// AdminAPIKey, when set, admits admin routes that send it in
+	// X-Admin-Key, alongside any client certificate TLS_CLIENT_CA_FILE
+	// accepts. With neither configured the admin routes aren't served.
+	AdminAPIKey string
+}
+
+type DBConfig struct {
+	Host     string
+	Port     int
+	Name     string
+	User     string
+	Password string
+
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+
+	// ConnectionBudget is how many connections this service may hold on
+	// Postgres in total (its share of max_connections)
+	ConnectionBudget int
+	// ReplicaCheckInterval is how often the replica is pinged to decide
+	// whether reads fall back to the primary
+	ReplicaCheckInterval time.Duration
+}
+
+type RedisConfig struct {
+	// URL is a full redis:// or rediss:// URL; when empty Addr is used
+	URL  string
+	Addr string
+
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+}
+
+// RedisBreakerConfig opens the breaker after Threshold consecutive failures
+// no more than Window apart, and probes again after Cooldown
+type RedisBreakerConfig struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+}
+
+// RedisFailOpenConfig is the per-operation policy while Redis is failing:
+// true lets the request proceed without the Redis step, false rejects it
+// with 503. Cache reads and writes always degrade to a miss / no-op.
+type RedisFailOpenConfig struct {
+	Idempotency bool
+	RateLimit   bool
+	Lock        bool
+}
+
+// TLSConfig enables HTTPS when both files are set. ClientCAFile additionally
+// turns on mutual TLS for admin routes.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+func (t TLSConfig) Enabled() bool { return t.CertFile != "" }
+
+// ServerConfig mirrors the fasthttp knobs Fiber exposes so runs can match
+// the NestJS side's keep-alive and buffer settings. Zero timeouts mean
+// unlimited, as in fasthttp.
+type ServerConfig struct {
+	Concurrency      int
+	ReadBufferSize   int
+	WriteBufferSize  int
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	DisableKeepalive bool
+	// JSONEncoder is "stdlib" (encoding/json) or "goccy" (goccy/go-json)
+	JSONEncoder string
+}
+
+// SocketConfig makes the server listen on a unix domain socket instead of
+// PORT, for load generators running on the same host
+type SocketConfig struct {
+	Path string
+	Mode os.FileMode
+}
+
+// StartupConfig bounds how long the processes wait for Postgres and Redis
+// to accept connections before giving up
+type StartupConfig struct {
+	MaxAttempts int
+	Timeout     time.Duration
+}
+
+// WarmupConfig pre-opens connections before readiness reports ready so
+// short benchmark runs don't measure connection setup
+type WarmupConfig struct {
+	Enabled bool
+	// PrimeStatements also runs each overview query once per connection
+	PrimeStatements bool
+	// Timeout bounds the whole warmup; readiness is released when it
+	// expires, reporting the warmup as degraded
+	Timeout time.Duration
+}
+
+// TimeoutConfig holds the per-route request budgets plus the operational
+// ones: how long a readiness probe may wait on a dependency, how long
+// readiness reports failing before the listener closes, and how long
+// in-flight requests get to finish on shutdown.
+type TimeoutConfig struct {
+	Overview time.Duration
+	Checkout time.Duration
+	// ProductsQuery bounds the overview's products query on its own; past
+	// it the overview is served without products. 0 disables it.
+	ProductsQuery time.Duration
+
+	HealthProbe   time.Duration
+	ShutdownDrain time.Duration
+	Shutdown      time.Duration
+}
+
+type CacheConfig struct {
+	UserTTL    time.Duration
+	SummaryTTL time.Duration
+	// TTLJitter spreads every cache TTL by up to this fraction either way,
+	// so entries written in the same second don't all expire together
+	TTLJitter float64
+
+	// Strategy is "ttl" (entries vanish at SummaryTTL) or "swr": past
+	// SummaryTTL a stale copy is still served, up to SummaryStaleTTL, while
+	// it is refreshed in the background
+	Strategy        string
+	SummaryStaleTTL time.Duration
+
+	// Invalidation is how checkout and order changes find a user's
+	// summary keys: "registry" (a per-user SET of every key written) or
+	// "scan" (SCAN MATCH over the keyspace, InvalidationScanCount keys
+	// per call, with no registry kept)
+	Invalidation          string
+	InvalidationScanCount int
+
+	// TopProductsTTL caches each user's most-purchased products; checkout
+	// deletes the entry, so it can be long
+	TopProductsTTL time.Duration
+	// RecoTTL caches the recommended-products page shared by every v1
+	// overview user of the same warehouse. Checkout does not invalidate it: availability in the
+	// overview may lag reservations by up to this long, in exchange for
+	// running the inventory aggregation once per page and warehouse
+	// instead of per user.
+	RecoTTL time.Duration
+	// ProductsTTL caches the /v1/products catalog responses. Checkout does
+	// not invalidate them, so availability can be this stale.
+	ProductsTTL time.Duration
+	// CartTTL caches the cart page; checkout deletes the entry
+	CartTTL time.Duration
+	// OrderTTL caches the order page; status changes delete the entry
+	OrderTTL time.Duration
+
+	// CompressThreshold gzips summary and idempotency entries of at least
+	// this many bytes before they go to Redis; 0 disables compression
+	CompressThreshold int
+
+	// RebuildLockTTL bounds the Redis marker one instance holds while it
+	// rebuilds a summary; 0 disables the marker (per-process dedup only).
+	// Other instances wait up to RebuildWait for that result before
+	// building it themselves.
+	RebuildLockTTL time.Duration
+	RebuildWait    time.Duration
+}
+
+// OverviewConfig bounds the overview query parameters; anything outside is
+// a 400
+type OverviewConfig struct {
+	MaxLimit int
+	MaxPage  int
+	// MaxCategories caps how many ids ?categoryId= may list
+	MaxCategories int
+	// Availability is "regional" (v1 products count stock in the user's
+	// fulfillment warehouse, as checkout does) or "global" (all warehouses)
+	Availability string
+	// ReservedFrom is what live availability subtracts from stock:
+	// "counter" (inventory.reserved_qty) or "reservations" (the unexpired
+	// inventory_reservations rows, so stock held by an order past its
+	// expiry shows as available before the sweeper gets to it). The
+	// materialized view always uses the counter.
+	ReservedFrom string
+	// Personalized is the ?personalized= default: recommendations leave out
+	// products bought in the user's recent orders
+	Personalized bool
+	// Debug honours ?debug=true, which adds per-stage timings and skips
+	// the summary cache; leave it off for benchmark runs
+	Debug bool
+}
+
+// AvailabilityConfig selects how the v1 overview's all-warehouse
+// availability is computed: "live" aggregates inventory per request,
+// "materialized" reads the product_availability view, refreshed every
+// RefreshInterval. A view older than MaxStaleness is ignored in favour of
+// the live aggregate.
+type AvailabilityConfig struct {
+	Source          string
+	RefreshInterval time.Duration
+	MaxStaleness    time.Duration
+}
+
+// SegmentConfig sets the lifetime-spend thresholds above which a user is
+// vip, premium or standard (plans can lift a user higher regardless), and
+// how long the segment:{userId} entry lives without a checkout. The
+// thresholds only apply while the segment_rules table is empty; the API
+// reloads that table every RulesRefresh.
+type SegmentConfig struct {
+	VIPSpend      float64
+	PremiumSpend  float64
+	StandardSpend float64
+	TTL           time.Duration
+	RulesRefresh  time.Duration
+}
+
+// SegmentRule is one row of segment_rules. A rule matches a user on the
+// given plan or with lifetime spend above MinSpend; a rule with neither
+// matches everyone. Rules are tried in order and the first match wins.
+type SegmentRule struct {
+	Segment  string
+	Plan     string // "" matches no plan
+	MinSpend *float64
+}
+
+// Rules renders the SEGMENT_* thresholds as segment rules, ending in a
+// catch-all basic
+func (c SegmentConfig) Rules() []SegmentRule {
+	spend := func(f float64) *float64 { return &f }
+	return []SegmentRule{
+		{Segment: "vip", Plan: "enterprise", MinSpend: spend(c.VIPSpend)},
+		{Segment: "premium", Plan: "premium", MinSpend: spend(c.PremiumSpend)},
+		{Segment: "standard", Plan: "basic", MinSpend: spend(c.StandardSpend)},
+		{Segment: "basic"},
+	}
+}
+
+// TaxConfig sets the rate charged in a region without a tax_rates row
+// (0.08 is 8%) and how often the API reloads that table
+type TaxConfig struct {
+	DefaultRate float64
+	Refresh     time.Duration
+}
+
+// ReservationConfig drives the sweeper that expires orders whose
+// inventory reservations are past their expires_at and releases what they
+// reserved. Every SweepInterval one instance sweeps, up to BatchSize
+// orders per transaction; an interval of 0 disables it.
+type ReservationConfig struct {
+	SweepInterval time.Duration
+	BatchSize     int
+}
+
+// OutboxConfig drives the relay that publishes event_outbox rows to their
+// Redis streams. Every RelayInterval each instance publishes up to
+// BatchSize rows at a time; an interval of 0 disables it. A row whose
+// XADD Redis rejects is retried after RetryBackoff, doubling per attempt,
+// and dead-lettered after MaxAttempts; Redis being unreachable doesn't
+// count as an attempt. Readiness reports the outbox degraded once the
+// oldest unpublished row is older than MaxLag.
+type OutboxConfig struct {
+	RelayInterval time.Duration
+	BatchSize     int
+	MaxAttempts   int
+	RetryBackoff  time.Duration
+	MaxLag        time.Duration
+}
+
+// OrderStreamConfig runs a consumer of stream:order_events in the group
+// Group, under the name Consumer (hostname-pid when empty), reading up to
+// BatchSize entries per call and blocking up to Block for new ones.
+// Entries another consumer has held unacknowledged for ClaimIdle are
+// claimed and processed again. The stream is trimmed to roughly MaxLen
+// entries, and the daily stats it feeds expire StatsRetentionDays after
+// the day ends.
+type OrderStreamConfig struct {
+	Enabled            bool
+	Group              string
+	Consumer           string
+	BatchSize          int
+	Block              time.Duration
+	ClaimIdle          time.Duration
+	MaxLen             int
+	StatsRetentionDays int
+}
+
+// WebhookConfig drives delivery of order events to webhook subscribers.
+// When Enabled, each instance reads stream:order_events in the consumer
+// group Group and queues a delivery per matching subscription; entries
+// another instance has held unacknowledged for ClaimIdle are claimed and
+// queued again. Every PollInterval it sends up to BatchSize due
+// deliveries, Concurrency at a time, each bounded by Timeout. A failed
+// delivery is retried after RetryBackoff, doubling per attempt up to
+// MaxBackoff, and dead after MaxAttempts. BreakerThreshold consecutive
+// failures of one subscriber hold back its deliveries for BreakerCooldown.
+type WebhookConfig struct {
+	Enabled          bool
+	Group            string
+	ClaimIdle        time.Duration
+	PollInterval     time.Duration
+	BatchSize        int
+	Concurrency      int
+	Timeout          time.Duration
+	MaxAttempts      int
+	RetryBackoff     time.Duration
+	MaxBackoff       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// AllowPrivateIPs is WEBHOOK_ALLOW_PRIVATE_IPS: let deliveries reach
+	// loopback, private and shared (100.64.0.0/10) addresses, for
+	// subscribers on the same network.
+	// Link-local and cloud metadata addresses stay refused.
+	AllowPrivateIPs bool
+}
+
+type CheckoutConfig struct {
+	LockTTL time.Duration
+	// LockWatchdog keeps extending the lock while its checkout runs, as a
+	// backstop for a transaction that overruns LockTTL
+	LockWatchdog bool
+	// LockPerUser also takes the user's lock for a cart checkout, which
+	// otherwise only locks the cart; direct checkouts always lock the user
+	LockPerUser bool
+	// LockBackend is "redis" or, for runs without Redis, "postgres". The
+	// postgres backend takes the locks as advisory locks inside the
+	// transaction, so they are held for the transaction only rather than
+	// the whole checkout, and idempotency rests on idempotency_keys alone:
+	// no Redis placeholder, so a retry racing the original fails on the
+	// lock (or the key) instead of reporting it still processing. Rate
+	// limits still use Redis; CHECKOUT_RATE_LIMIT=0 and
+	// OVERVIEW_RATE_LIMIT=0 turn them off.
+	LockBackend string
+	// TxTimeout bounds the work after the lock is taken (transaction,
+	// idempotency record), which runs detached from the request so a
+	// client disconnect can't abandon it halfway. It must be shorter than
+	// LockTTL so the lock outlives it.
+	TxTimeout time.Duration
+	// PendingTTL bounds the placeholder that reserves a paymentRef while
+	// its checkout runs, so a crashed instance can't block retries for
+	// good. It must be longer than TxTimeout.
+	PendingTTL time.Duration
+
+	// Request limits; anything outside them is a 400 (413 for the body)
+	MaxBodyBytes int
+	MaxItems     int
+	MaxQty       int
+
+	// ReservationStrategy is how inventory is reserved: "conditional"
+	// (one guarded UPDATE per item, batched) or "locking" (SELECT FOR
+	// UPDATE, then UPDATE, per item), kept to benchmark one against the
+	// other
+	ReservationStrategy string
+	// CouponGrace widens both ends of a coupon's validity, whose end is
+	// inclusive to the second
+	CouponGrace time.Duration
+	// ReservationTTL is how long an order's inventory reservations hold
+	// before the sweeper may expire the order if it is still pending
+	ReservationTTL time.Duration
+	// PaymentWebhookSecret is PAYMENT_WEBHOOK_SECRET, the HMAC-SHA256 key
+	// payment webhooks are signed with; empty turns the webhook off
+	PaymentWebhookSecret string
+	// PaymentWebhookTolerance is how far a payment webhook's signed
+	// timestamp may be from now, either way, before it is refused as a
+	// replay
+	PaymentWebhookTolerance time.Duration
+
+	Async CheckoutAsyncConfig
+}
+
+// CheckoutAsyncConfig drives ?async=true checkouts, which are queued in
+// Redis and run by Workers goroutines per instance; 0 workers disables
+// the mode on the instance. Each status is kept for StatusTTL. A job a
+// crashed worker left unacknowledged is run again after ClaimIdle, which
+// idempotency makes safe, so ClaimIdle must outlast a checkout.
+type CheckoutAsyncConfig struct {
+	Workers   int
+	StatusTTL time.Duration
+	ClaimIdle time.Duration
+	// Block is how long an idle worker waits on the queue per read
+	Block time.Duration
+}
+
+// ConcurrencyConfig caps in-flight requests per route; 0 disables a cap.
+// Requests wait up to QueueWait for a slot before being shed with 503.
+type ConcurrencyConfig struct {
+	Overview  int
+	Checkout  int
+	QueueWait time.Duration
+}
+
+// RateLimitConfig is a per-user sliding window; Limit 0 disables it.
+// With Plans set, a user whose plan is listed gets that plan's limit
+// instead, and Limit applies to any other plan.
+type RateLimitConfig struct {
+	Limit  int
+	Window time.Duration
+	Plans  map[string]int
+}
+
+type RateLimitsConfig struct {
+	Checkout RateLimitConfig
+	Overview RateLimitConfig
+}
+
+type AccessLogConfig struct {
+	// Empty disables the access log entirely; "stdout" writes through the
+	// structured logger in Format instead of a rotated JSON file
+	Path          string
+	Format        string
+	SampleRate    float64
+	SlowThreshold time.Duration
+	MaxSizeMB     int
+	MaxAge        time.Duration
+	BufferRecords int
+}
+
+// AuditConfig drives the checkout_audit table: with FailedCheckouts on,
+// every checkout answered with an error is recorded there, body and all,
+// so a burst of failures can be replayed. Records wait in a buffer of
+// Buffer for a background writer and are dropped when it is full. Bodies
+// are cut at MaxBodyBytes. Every CleanupInterval, records older than
+// Retention, and all but the newest MaxRows, are deleted.
+type AuditConfig struct {
+	FailedCheckouts bool
+	Buffer          int
+	MaxBodyBytes    int
+	Retention       time.Duration
+	MaxRows         int
+	CleanupInterval time.Duration
+}
+
+type MetricsConfig struct {
+	OverviewBuckets []float64
+	CheckoutBuckets []float64
+	// CheckoutStatsFlush is how often checkout outcome counts are added to
+	// Redis, for runs without Prometheus; 0 keeps them out of Redis
+	CheckoutStatsFlush time.Duration
+	ActiveUsers        ActiveUsersConfig
+}
+
+// ActiveUsersConfig picks how daily active users are counted: "hll"
+// (approximate, fixed size) or "set" (exact, grows with the user count).
+// Each day is kept for RetentionDays after it ends.
+type ActiveUsersConfig struct {
+	Mode          string
+	RetentionDays int
+}
+
+// Latency buckets per endpoint family. The overview is mostly cache hits in
+// the low milliseconds while checkout holds a transaction open, so one set
+// of buckets would waste resolution on one side or the other.
+var (
+	DefaultOverviewBuckets = []float64{
+		.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+	}
+	DefaultCheckoutBuckets = []float64{
+		.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+	}
+)
+
+// Load reads the configuration from the process environment
+func Load() (*Config, error) {
+	return LoadFrom(os.LookupEnv)
+}
+
+// LoadFrom reads the configuration through lookup, which makes precedence
+// rules testable without touching the real environment
+func LoadFrom(lookup func(string) (string, bool)) (*Config, error) {
+	l := &loader{lookup: lookup}
+	cfg := &Config{}
+
+	cfg.DB = DBConfig{
+		Host:     l.str("DB_HOST", "localhost"),
+		Port:     l.int("DB_PORT", 5434),
+		Name:     l.str("DB_NAME", "loadtest"),
+		User:     l.str("DB_USER", "postgres"),
+		Password: l.str("DB_PASSWORD", "postgres"),
+		MaxConns: int32(l.int("DB_MAX_CONNS", 32)),
+		MinConns: int32(l.int("DB_MIN_CONNS", 4)),
+
+		MaxConnLifetime:   l.duration("DB_MAX_CONN_LIFETIME", time.Hour),
+		MaxConnIdleTime:   l.duration("DB_MAX_CONN_IDLE_TIME", 30*time.Minute),
+		HealthCheckPeriod: l.duration("DB_HEALTH_CHECK_PERIOD", time.Minute),
+		ConnectionBudget:  l.int("DB_CONNECTION_BUDGET", 100),
+	}
+	cfg.DatabaseURL = l.str("DATABASE_URL", "")
+	if cfg.DatabaseURL == "" {
+		if cfg.DB.Port < 1 || cfg.DB.Port > 65535 {
+			l.fail("DB_PORT", strconv.Itoa(cfg.DB.Port), "must be a TCP port")
+		}
+		cfg.DatabaseURL = (&url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(cfg.DB.User, cfg.DB.Password),
+			Host:   cfg.DB.Host + ":" + strconv.Itoa(cfg.DB.Port),
+			Path:   "/" + cfg.DB.Name,
+		}).String()
+	} else if u, err := url.Parse(cfg.DatabaseURL); err != nil ||
+		(u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		l.fail("DATABASE_URL", "<redacted>", "must be a postgres:// URL")
+	}
+	cfg.ReplicaURL = l.str("DATABASE_REPLICA_URL", "")
+	if cfg.ReplicaURL != "" {
+		if u, err := url.Parse(cfg.ReplicaURL); err != nil ||
+			(u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			l.fail("DATABASE_REPLICA_URL", "<redacted>", "must be a postgres:// URL")
+		}
+	}
+	cfg.DB.ReplicaCheckInterval = l.duration("DB_REPLICA_CHECK_INTERVAL", 2*time.Second)
+	l.positiveDuration("DB_REPLICA_CHECK_INTERVAL", cfg.DB.ReplicaCheckInterval)
+	l.positive("DB_MAX_CONNS", int(cfg.DB.MaxConns))
+	if cfg.DB.MinConns < 0 || cfg.DB.MinConns > cfg.DB.MaxConns {
+		l.fail("DB_MIN_CONNS", strconv.Itoa(int(cfg.DB.MinConns)),
+			"must be between 0 and DB_MAX_CONNS")
+	}
+	l.positiveDuration("DB_MAX_CONN_LIFETIME", cfg.DB.MaxConnLifetime)
+	l.positiveDuration("DB_MAX_CONN_IDLE_TIME", cfg.DB.MaxConnIdleTime)
+	l.positiveDuration("DB_HEALTH_CHECK_PERIOD", cfg.DB.HealthCheckPeriod)
+	l.positive("DB_CONNECTION_BUDGET", cfg.DB.ConnectionBudget)
+
+	cfg.Redis = RedisConfig{
+		PoolSize:     l.int("REDIS_POOL_SIZE", 20),
+		MinIdleConns: l.int("REDIS_MIN_IDLE_CONNS", 0),
+		MaxRetries:   l.int("REDIS_MAX_RETRIES", 1),
+		DialTimeout:  l.duration("REDIS_DIAL_TIMEOUT", 2*time.Second),
+		ReadTimeout:  l.duration("REDIS_READ_TIMEOUT", time.Second),
+		WriteTimeout: l.duration("REDIS_WRITE_TIMEOUT", time.Second),
+		PoolTimeout:  l.duration("REDIS_POOL_TIMEOUT", 2*time.Second),
+	}
+	// REDIS_URL used to be a bare host:port; keep accepting that form
+	if u := l.str("REDIS_URL", ""); strings.Contains(u, "://") {
+		cfg.Redis.URL = u
+		if _, err := redis.ParseURL(u); err != nil {
+			l.fail("REDIS_URL", "<redacted>", err.Error())
+		}
+	} else if u != "" {
+		cfg.Redis.Addr = u
+	} else {
+		port := l.int("REDIS_PORT", 6381)
+		if port < 1 || port > 65535 {
+			l.fail("REDIS_PORT", strconv.Itoa(port), "must be a TCP port")
+		}
+		cfg.Redis.Addr = l.str("REDIS_HOST", "localhost") + ":" + strconv.Itoa(port)
+	}
+	l.positive("REDIS_POOL_SIZE", cfg.Redis.PoolSize)
+	if cfg.Redis.MinIdleConns < 0 || cfg.Redis.MinIdleConns > cfg.Redis.PoolSize {
+		l.fail("REDIS_MIN_IDLE_CONNS", strconv.Itoa(cfg.Redis.MinIdleConns),
+			"must be between 0 and REDIS_POOL_SIZE")
+	}
+	if cfg.Redis.MaxRetries < -1 {
+		l.fail("REDIS_MAX_RETRIES", strconv.Itoa(cfg.Redis.MaxRetries),
+			"must be -1 (disabled) or more")
+	}
+	l.positiveDuration("REDIS_DIAL_TIMEOUT", cfg.Redis.DialTimeout)
+	l.positiveDuration("REDIS_READ_TIMEOUT", cfg.Redis.ReadTimeout)
+	l.positiveDuration("REDIS_WRITE_TIMEOUT", cfg.Redis.WriteTimeout)
+	l.positiveDuration("REDIS_POOL_TIMEOUT", cfg.Redis.PoolTimeout)
+
+	cfg.RedisBreaker = RedisBreakerConfig{
+		Threshold: l.int("REDIS_BREAKER_THRESHOLD", 5),
+		Window:    l.duration("REDIS_BREAKER_WINDOW", 10*time.Second),
+		Cooldown:  l.duration("REDIS_BREAKER_COOLDOWN", 5*time.Second),
+	}
+	l.positive("REDIS_BREAKER_THRESHOLD", cfg.RedisBreaker.Threshold)
+	l.positiveDuration("REDIS_BREAKER_WINDOW", cfg.RedisBreaker.Window)
+	l.positiveDuration("REDIS_BREAKER_COOLDOWN", cfg.RedisBreaker.Cooldown)
+
+	// Replaying a payment or running two checkouts at once is worse than a
+	// 503, so idempotency and the lock fail closed by default
+	cfg.RedisFailOpen = RedisFailOpenConfig{
+		Idempotency: l.failurePolicy("REDIS_FAILURE_POLICY_IDEMPOTENCY", false),
+		RateLimit:   l.failurePolicy("REDIS_FAILURE_POLICY_RATE_LIMIT", true),
+		Lock:        l.failurePolicy("REDIS_FAILURE_POLICY_LOCK", false),
+	}
+
+	cfg.Port = l.str("PORT", "3001")
+	if p, err := strconv.Atoi(cfg.Port); err != nil || p < 1 || p > 65535 {
+		l.fail("PORT", cfg.Port, "must be a TCP port")
+	}
+
+	cfg.Prefork = l.bool("PREFORK", false)
+	cfg.Pprof = l.bool("PPROF", false)
+	cfg.MetricsAdmin = l.bool("METRICS_ADMIN", false)
+
+	// Defaults are Fiber's own so leaving these unset changes nothing
+	cfg.Server = ServerConfig{
+		Concurrency:      l.int("SERVER_CONCURRENCY", 256*1024),
+		ReadBufferSize:   l.int("SERVER_READ_BUFFER_SIZE", 4096),
+		WriteBufferSize:  l.int("SERVER_WRITE_BUFFER_SIZE", 4096),
+		ReadTimeout:      l.duration("SERVER_READ_TIMEOUT", 0),
+		WriteTimeout:     l.duration("SERVER_WRITE_TIMEOUT", 0),
+		IdleTimeout:      l.duration("SERVER_IDLE_TIMEOUT", 0),
+		DisableKeepalive: l.bool("SERVER_DISABLE_KEEPALIVE", false),
+		JSONEncoder:      l.str("JSON_ENCODER", "stdlib"),
+	}
+	if e := cfg.Server.JSONEncoder; e != "stdlib" && e != "goccy" {
+		l.fail("JSON_ENCODER", e, "must be stdlib or goccy")
+	}
+	l.positive("SERVER_CONCURRENCY", cfg.Server.Concurrency)
+	l.positive("SERVER_READ_BUFFER_SIZE", cfg.Server.ReadBufferSize)
+	l.positive("SERVER_WRITE_BUFFER_SIZE", cfg.Server.WriteBufferSize)
+	l.nonNegativeDuration("SERVER_READ_TIMEOUT", cfg.Server.ReadTimeout)
+	l.nonNegativeDuration("SERVER_WRITE_TIMEOUT", cfg.Server.WriteTimeout)
+	l.nonNegativeDuration("SERVER_IDLE_TIMEOUT", cfg.Server.IdleTimeout)
+	if cfg.Server.DisableKeepalive && cfg.Server.IdleTimeout > 0 {
+		l.errs = append(l.errs, errors.New(
+			"SERVER_IDLE_TIMEOUT has no effect with SERVER_DISABLE_KEEPALIVE=true"))
+	}
+
+	// LISTEN_SOCKET replaces the TCP port with a unix domain socket
+	cfg.Socket = SocketConfig{
+		Path: l.str("LISTEN_SOCKET", ""),
+		Mode: l.fileMode("LISTEN_SOCKET_MODE", 0o660),
+	}
+	if cfg.Socket.Path != "" && cfg.Prefork {
+		l.errs = append(l.errs, errors.New(
+			"PREFORK cannot be combined with LISTEN_SOCKET"))
+	}
+
+	cfg.TLS = TLSConfig{
+		CertFile:     l.str("TLS_CERT_FILE", ""),
+		KeyFile:      l.str("TLS_KEY_FILE", ""),
+		ClientCAFile: l.str("TLS_CLIENT_CA_FILE", ""),
+	}
+	switch {
+	case (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == ""):
+		l.errs = append(l.errs, errors.New(
+			"TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	case cfg.TLS.Enabled():
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			l.fail("TLS_CERT_FILE", cfg.TLS.CertFile, err.Error())
+		}
+	}
+	if cfg.TLS.ClientCAFile != "" {
+		if !cfg.TLS.Enabled() {
+			l.errs = append(l.errs, errors.New(
+				"TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE"))
+		} else if _, err := os.ReadFile(cfg.TLS.ClientCAFile); err != nil {
+			l.fail("TLS_CLIENT_CA_FILE", cfg.TLS.ClientCAFile, err.Error())
+		}
+	}
+	// Fiber's prefork path only offers required client certs, which would
+	// lock out the public routes
+	if cfg.Prefork && cfg.TLS.ClientCAFile != "" {
+		l.errs = append(l.errs, errors.New(
+			"PREFORK cannot be combined with TLS_CLIENT_CA_FILE"))
+	}
+
+	cfg.AdminAPIKey = l.str("ADMIN_API_KEY", "")
+
+	cfg.Startup = StartupConfig{
+		MaxAttempts: l.int("STARTUP_RETRY_MAX_ATTEMPTS", 30),
+		Timeout:     l.duration("STARTUP_RETRY_TIMEOUT", 60*time.Second),
+	}
+	l.positive("STARTUP_RETRY_MAX_ATTEMPTS", cfg.Startup.MaxAttempts)
+	l.positiveDuration("STARTUP_RETRY_TIMEOUT", cfg.Startup.Timeout)
+
+	cfg.Warmup = WarmupConfig{
+		Enabled:         l.bool("WARMUP", false),
+		PrimeStatements: l.bool("WARMUP_PRIME_STATEMENTS", true),
+		Timeout:         l.duration("WARMUP_TIMEOUT", 30*time.Second),
+	}
+	l.positiveDuration("WARMUP_TIMEOUT", cfg.Warmup.Timeout)
+
+	cfg.Timeouts = TimeoutConfig{
+		Overview: l.duration("REQUEST_TIMEOUT_OVERVIEW", 2*time.Second),
+		Checkout: l.duration("REQUEST_TIMEOUT_CHECKOUT", 4*time.Second),
+
+		ProductsQuery: l.duration("QUERY_TIMEOUT_PRODUCTS", 500*time.Millisecond),
+
+		HealthProbe:   l.duration("HEALTH_PROBE_TIMEOUT", 500*time.Millisecond),
+		ShutdownDrain: l.duration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+		Shutdown:      l.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+	}
+	l.positiveDuration("REQUEST_TIMEOUT_OVERVIEW", cfg.Timeouts.Overview)
+	l.positiveDuration("REQUEST_TIMEOUT_CHECKOUT", cfg.Timeouts.Checkout)
+	l.nonNegativeDuration("QUERY_TIMEOUT_PRODUCTS", cfg.Timeouts.ProductsQuery)
+	if cfg.Timeouts.ProductsQuery >= cfg.Timeouts.Overview {
+		l.fail("QUERY_TIMEOUT_PRODUCTS", cfg.Timeouts.ProductsQuery.String(), "must be shorter than REQUEST_TIMEOUT_OVERVIEW")
+	}
+	l.positiveDuration("HEALTH_PROBE_TIMEOUT", cfg.Timeouts.HealthProbe)
+	l.positiveDuration("SHUTDOWN_TIMEOUT", cfg.Timeouts.Shutdown)
+	l.nonNegativeDuration("SHUTDOWN_DRAIN_DELAY", cfg.Timeouts.ShutdownDrain)
+
+	cfg.Cache = CacheConfig{
+		UserTTL:    l.duration("CACHE_USER_TTL", 120*time.Second),
+		SummaryTTL: l.duration("CACHE_SUMMARY_TTL", 30*time.Second),
+		TTLJitter:  l.float("CACHE_TTL_JITTER", 0.2),
+
+		Strategy:        l.str("CACHE_STRATEGY", "ttl"),
+		SummaryStaleTTL: l.duration("CACHE_SUMMARY_STALE_TTL", 5*time.Minute),
+
+		Invalidation:          l.str("CACHE_INVALIDATION", "registry"),
+		InvalidationScanCount: l.int("CACHE_INVALIDATION_SCAN_COUNT", 500),
+
+		TopProductsTTL: l.duration("CACHE_TOP_PRODUCTS_TTL", time.Hour),
+		RecoTTL:        l.duration("CACHE_RECO_TTL", 30*time.Second),
+		ProductsTTL:    l.duration("CACHE_PRODUCTS_TTL", 10*time.Second),
+		CartTTL:        l.duration("CACHE_CART_TTL", 5*time.Second),
+		OrderTTL:       l.duration("CACHE_ORDER_TTL", 30*time.Second),
+
+		CompressThreshold: l.int("CACHE_COMPRESS_THRESHOLD", 1024),
+
+		RebuildLockTTL: l.duration("CACHE_REBUILD_LOCK_TTL", 5*time.Second),
+		RebuildWait:    l.duration("CACHE_REBUILD_WAIT", 200*time.Millisecond),
+	}
+	l.positiveDuration("CACHE_USER_TTL", cfg.Cache.UserTTL)
+	l.positiveDuration("CACHE_SUMMARY_TTL", cfg.Cache.SummaryTTL)
+	if j := cfg.Cache.TTLJitter; j < 0 || j >= 1 {
+		l.fail("CACHE_TTL_JITTER", strconv.FormatFloat(j, 'g', -1, 64), "must be at least 0 and below 1")
+	}
+	l.positiveDuration("CACHE_TOP_PRODUCTS_TTL", cfg.Cache.TopProductsTTL)
+	l.positiveDuration("CACHE_RECO_TTL", cfg.Cache.RecoTTL)
+	l.positiveDuration("CACHE_PRODUCTS_TTL", cfg.Cache.ProductsTTL)
+	l.positiveDuration("CACHE_CART_TTL", cfg.Cache.CartTTL)
+	l.positiveDuration("CACHE_ORDER_TTL", cfg.Cache.OrderTTL)
+	if cfg.Cache.CompressThreshold < 0 {
+		l.fail("CACHE_COMPRESS_THRESHOLD", strconv.Itoa(cfg.Cache.CompressThreshold), "must be 0 (disabled) or more")
+	}
+	l.nonNegativeDuration("CACHE_REBUILD_LOCK_TTL", cfg.Cache.RebuildLockTTL)
+	switch cfg.Cache.Strategy {
+	case "ttl":
+	case "swr":
+		if cfg.Cache.SummaryStaleTTL <= cfg.Cache.SummaryTTL {
+			l.fail("CACHE_SUMMARY_STALE_TTL", cfg.Cache.SummaryStaleTTL.String(), "must be longer than CACHE_SUMMARY_TTL")
+		}
+	default:
+		l.fail("CACHE_STRATEGY", cfg.Cache.Strategy, "must be ttl or swr")
+	}
+	if i := cfg.Cache.Invalidation; i != "registry" && i != "scan" {
+		l.fail("CACHE_INVALIDATION", i, "must be registry or scan")
+	}
+	l.positive("CACHE_INVALIDATION_SCAN_COUNT", cfg.Cache.InvalidationScanCount)
+	l.nonNegativeDuration("CACHE_REBUILD_WAIT", cfg.Cache.RebuildWait)
+
+	cfg.Availability = AvailabilityConfig{
+		Source:          l.str("AVAILABILITY_SOURCE", "live"),
+		RefreshInterval: l.duration("AVAILABILITY_REFRESH_INTERVAL", 5*time.Second),
+		MaxStaleness:    l.duration("AVAILABILITY_MAX_STALENESS", 30*time.Second),
+	}
+	if src := cfg.Availability.Source; src != "live" && src != "materialized" {
+		l.fail("AVAILABILITY_SOURCE", src, "must be live or materialized")
+	}
+	l.positiveDuration("AVAILABILITY_REFRESH_INTERVAL", cfg.Availability.RefreshInterval)
+	if cfg.Availability.MaxStaleness < cfg.Availability.RefreshInterval {
+		l.fail("AVAILABILITY_MAX_STALENESS", cfg.Availability.MaxStaleness.String(), "must be at least AVAILABILITY_REFRESH_INTERVAL")
+	}
+
+	cfg.Overview = OverviewConfig{
+		MaxLimit: l.int("OVERVIEW_MAX_LIMIT", 100),
+		MaxPage:  l.int("OVERVIEW_MAX_PAGE", 1000),
+
+		MaxCategories: l.int("OVERVIEW_MAX_CATEGORIES", 10),
+
+		Availability: l.str("OVERVIEW_AVAILABILITY", "regional"),
+		ReservedFrom: l.str("OVERVIEW_RESERVED_FROM", "counter"),
+		Personalized: l.bool("OVERVIEW_PERSONALIZED", false),
+		Debug:        l.bool("OVERVIEW_DEBUG", false),
+	}
+	l.positive("OVERVIEW_MAX_LIMIT", cfg.Overview.MaxLimit)
+	l.positive("OVERVIEW_MAX_PAGE", cfg.Overview.MaxPage)
+	l.positive("OVERVIEW_MAX_CATEGORIES", cfg.Overview.MaxCategories)
+	if a := cfg.Overview.Availability; a != "regional" && a != "global" {
+		l.fail("OVERVIEW_AVAILABILITY", a, "must be regional or global")
+	}
+	if r := cfg.Overview.ReservedFrom; r != "counter" && r != "reservations" {
+		l.fail("OVERVIEW_RESERVED_FROM", r, "must be counter or reservations")
+	}
+
+	cfg.Segment = SegmentConfig{
+		VIPSpend:      l.float("SEGMENT_VIP_SPEND", 10000),
+		PremiumSpend:  l.float("SEGMENT_PREMIUM_SPEND", 5000),
+		StandardSpend: l.float("SEGMENT_STANDARD_SPEND", 1000),
+		TTL:           l.duration("SEGMENT_TTL", 7*24*time.Hour),
+		RulesRefresh:  l.duration("SEGMENT_RULES_REFRESH", 30*time.Second),
+	}
+	if sc := cfg.Segment; sc.StandardSpend < 0 || sc.PremiumSpend < sc.StandardSpend || sc.VIPSpend < sc.PremiumSpend {
+		l.fail("SEGMENT_VIP_SPEND", strconv.FormatFloat(sc.VIPSpend, 'g', -1, 64),
+			"thresholds must satisfy 0 <= SEGMENT_STANDARD_SPEND <= SEGMENT_PREMIUM_SPEND <= SEGMENT_VIP_SPEND")
+	}
+	l.positiveDuration("SEGMENT_TTL", cfg.Segment.TTL)
+	l.positiveDuration("SEGMENT_RULES_REFRESH", cfg.Segment.RulesRefresh)
+
+	cfg.Tax = TaxConfig{
+		DefaultRate: l.float("TAX_DEFAULT_RATE", 0.08),
+		Refresh:     l.duration("TAX_RATES_REFRESH", time.Minute),
+	}
+	if r := cfg.Tax.DefaultRate; r < 0 || r >= 1 {
+		l.fail("TAX_DEFAULT_RATE", strconv.FormatFloat(r, 'g', -1, 64), "must be at least 0 and below 1")
+	}
+	l.positiveDuration("TAX_RATES_REFRESH", cfg.Tax.Refresh)
+
+	cfg.Checkout = CheckoutConfig{
+		LockTTL:      l.duration("CHECKOUT_LOCK_TTL", 5*time.Second),
+		LockWatchdog: l.bool("CHECKOUT_LOCK_WATCHDOG", false),
+		LockPerUser:  l.bool("CHECKOUT_LOCK_PER_USER", false),
+		LockBackend:  l.str("LOCK_BACKEND", "redis"),
+		TxTimeout:    l.duration("CHECKOUT_TX_TIMEOUT", 4*time.Second),
+		PendingTTL:   l.duration("CHECKOUT_PENDING_TTL", 10*time.Second),
+		MaxBodyBytes: l.int("CHECKOUT_MAX_BODY_BYTES", 64*1024),
+		MaxItems:     l.int("CHECKOUT_MAX_ITEMS", 100),
+		MaxQty:       l.int("CHECKOUT_MAX_QTY", 100),
+
+		ReservationStrategy: l.str("CHECKOUT_RESERVATION_STRATEGY", "conditional"),
+		CouponGrace:         l.duration("COUPON_GRACE_PERIOD", 0),
+		// RESERVATION_PENDING_MAX_AGE is its name from before reservations
+		// carried their own expiry
+		ReservationTTL:          l.duration("RESERVATION_TTL", l.duration("RESERVATION_PENDING_MAX_AGE", 15*time.Minute)),
+		PaymentWebhookSecret:    l.str("PAYMENT_WEBHOOK_SECRET", ""),
+		PaymentWebhookTolerance: l.duration("PAYMENT_WEBHOOK_TOLERANCE", 5*time.Minute),
+	}
+	if b := cfg.Checkout.LockBackend; b != "redis" && b != "postgres" {
+		l.fail("LOCK_BACKEND", b, "must be redis or postgres")
+	}
+	if s := cfg.Checkout.ReservationStrategy; s != "conditional" && s != "locking" {
+		l.fail("CHECKOUT_RESERVATION_STRATEGY", s, "must be conditional or locking")
+	}
+	l.positiveDuration("CHECKOUT_LOCK_TTL", cfg.Checkout.LockTTL)
+	l.positiveDuration("CHECKOUT_TX_TIMEOUT", cfg.Checkout.TxTimeout)
+	if cfg.Checkout.TxTimeout >= cfg.Checkout.LockTTL {
+		l.fail("CHECKOUT_TX_TIMEOUT", cfg.Checkout.TxTimeout.String(), "must be shorter than CHECKOUT_LOCK_TTL")
+	}
+	if cfg.Checkout.PendingTTL <= cfg.Checkout.TxTimeout {
+		l.fail("CHECKOUT_PENDING_TTL", cfg.Checkout.PendingTTL.String(), "must be longer than CHECKOUT_TX_TIMEOUT")
+	}
+	l.positive("CHECKOUT_MAX_BODY_BYTES", cfg.Checkout.MaxBodyBytes)
+	l.positive("CHECKOUT_MAX_ITEMS", cfg.Checkout.MaxItems)
+	l.positive("CHECKOUT_MAX_QTY", cfg.Checkout.MaxQty)
+	l.positiveDuration("RESERVATION_TTL", cfg.Checkout.ReservationTTL)
+	l.nonNegativeDuration("COUPON_GRACE_PERIOD", cfg.Checkout.CouponGrace)
+	l.positiveDuration("PAYMENT_WEBHOOK_TOLERANCE", cfg.Checkout.PaymentWebhookTolerance)
+
+	cfg.Checkout.Async = CheckoutAsyncConfig{
+		Workers:   l.int("CHECKOUT_ASYNC_WORKERS", 8),
+		StatusTTL: l.duration("CHECKOUT_ASYNC_STATUS_TTL", 10*time.Minute),
+		ClaimIdle: l.duration("CHECKOUT_ASYNC_CLAIM_IDLE", time.Minute),
+		Block:     l.duration("CHECKOUT_ASYNC_BLOCK", 2*time.Second),
+	}
+	if cfg.Checkout.Async.Workers < 0 {
+		l.fail("CHECKOUT_ASYNC_WORKERS", strconv.Itoa(cfg.Checkout.Async.Workers), "must be 0 (disabled) or more")
+	}
+	l.positiveDuration("CHECKOUT_ASYNC_STATUS_TTL", cfg.Checkout.Async.StatusTTL)
+	l.positiveDuration("CHECKOUT_ASYNC_BLOCK", cfg.Checkout.Async.Block)
+	if cfg.Checkout.Async.ClaimIdle <= cfg.Timeouts.Checkout {
+		l.fail("CHECKOUT_ASYNC_CLAIM_IDLE", cfg.Checkout.Async.ClaimIdle.String(), "must be longer than REQUEST_TIMEOUT_CHECKOUT")
+	}
+
+	cfg.Reservations = ReservationConfig{
+		SweepInterval: l.duration("RESERVATION_SWEEP_INTERVAL", time.Minute),
+		BatchSize:     l.int("RESERVATION_SWEEP_BATCH", 500),
+	}
+	l.nonNegativeDuration("RESERVATION_SWEEP_INTERVAL", cfg.Reservations.SweepInterval)
+	l.positive("RESERVATION_SWEEP_BATCH", cfg.Reservations.BatchSize)
+
+	cfg.Outbox = OutboxConfig{
+		RelayInterval: l.duration("OUTBOX_RELAY_INTERVAL", 500*time.Millisecond),
+		BatchSize:     l.int("OUTBOX_BATCH", 200),
+		MaxAttempts:   l.int("OUTBOX_MAX_ATTEMPTS", 10),
+		RetryBackoff:  l.duration("OUTBOX_RETRY_BACKOFF", time.Second),
+		MaxLag:        l.duration("OUTBOX_MAX_LAG", 30*time.Second),
+	}
+	l.nonNegativeDuration("OUTBOX_RELAY_INTERVAL", cfg.Outbox.RelayInterval)
+	l.positive("OUTBOX_BATCH", cfg.Outbox.BatchSize)
+	l.positive("OUTBOX_MAX_ATTEMPTS", cfg.Outbox.MaxAttempts)
+	l.positiveDuration("OUTBOX_RETRY_BACKOFF", cfg.Outbox.RetryBackoff)
+	l.positiveDuration("OUTBOX_MAX_LAG", cfg.Outbox.MaxLag)
+
+	cfg.OrderStream = OrderStreamConfig{
+		Enabled:            l.bool("ORDER_STREAM_CONSUMER", true),
+		Group:              l.str("ORDER_STREAM_GROUP", "order-stats"),
+		Consumer:           l.str("ORDER_STREAM_CONSUMER_NAME", ""),
+		BatchSize:          l.int("ORDER_STREAM_BATCH", 100),
+		Block:              l.duration("ORDER_STREAM_BLOCK", 2*time.Second),
+		ClaimIdle:          l.duration("ORDER_STREAM_CLAIM_IDLE", 30*time.Second),
+		MaxLen:             l.int("ORDER_STREAM_MAXLEN", 100_000),
+		StatsRetentionDays: l.int("ORDER_STATS_RETENTION_DAYS", 30),
+	}
+	if cfg.OrderStream.Group == "" {
+		l.fail("ORDER_STREAM_GROUP", "", "must not be empty")
+	}
+	l.positive("ORDER_STREAM_BATCH", cfg.OrderStream.BatchSize)
+	l.positiveDuration("ORDER_STREAM_BLOCK", cfg.OrderStream.Block)
+	l.positiveDuration("ORDER_STREAM_CLAIM_IDLE", cfg.OrderStream.ClaimIdle)
+	l.positive("ORDER_STREAM_MAXLEN", cfg.OrderStream.MaxLen)
+	l.positive("ORDER_STATS_RETENTION_DAYS", cfg.OrderStream.StatsRetentionDays)
+
+	cfg.Webhooks = WebhookConfig{
+		Enabled:          l.bool("WEBHOOK_DELIVERY", false),
+		Group:            l.str("WEBHOOK_STREAM_GROUP", "webhooks"),
+		ClaimIdle:        l.duration("WEBHOOK_CLAIM_IDLE", 30*time.Second),
+		PollInterval:     l.duration("WEBHOOK_POLL_INTERVAL", time.Second),
+		BatchSize:        l.int("WEBHOOK_BATCH", 100),
+		Concurrency:      l.int("WEBHOOK_CONCURRENCY", 16),
+		Timeout:          l.duration("WEBHOOK_TIMEOUT", 5*time.Second),
+		MaxAttempts:      l.int("WEBHOOK_MAX_ATTEMPTS", 10),
+		RetryBackoff:     l.duration("WEBHOOK_RETRY_BACKOFF", time.Second),
+		MaxBackoff:       l.duration("WEBHOOK_MAX_BACKOFF", 10*time.Minute),
+		BreakerThreshold: l.int("WEBHOOK_BREAKER_THRESHOLD", 5),
+		BreakerCooldown:  l.duration("WEBHOOK_BREAKER_COOLDOWN", 30*time.Second),
+		AllowPrivateIPs:  l.bool("WEBHOOK_ALLOW_PRIVATE_IPS", false),
+	}
+	if cfg.Webhooks.Enabled {
+		if cfg.Webhooks.Group == "" {
+			l.fail("WEBHOOK_STREAM_GROUP", "", "must not be empty")
+		}
+		l.positiveDuration("WEBHOOK_CLAIM_IDLE", cfg.Webhooks.ClaimIdle)
+		l.positiveDuration("WEBHOOK_POLL_INTERVAL", cfg.Webhooks.PollInterval)
+		l.positive("WEBHOOK_BATCH", cfg.Webhooks.BatchSize)
+		l.positive("WEBHOOK_CONCURRENCY", cfg.Webhooks.Concurrency)
+		l.positiveDuration("WEBHOOK_TIMEOUT", cfg.Webhooks.Timeout)
+		l.positive("WEBHOOK_MAX_ATTEMPTS", cfg.Webhooks.MaxAttempts)
+		l.positiveDuration("WEBHOOK_RETRY_BACKOFF", cfg.Webhooks.RetryBackoff)
+		l.positiveDuration("WEBHOOK_MAX_BACKOFF", cfg.Webhooks.MaxBackoff)
+		l.positive("WEBHOOK_BREAKER_THRESHOLD", cfg.Webhooks.BreakerThreshold)
+		l.positiveDuration("WEBHOOK_BREAKER_COOLDOWN", cfg.Webhooks.BreakerCooldown)
+	}
+
+	cfg.RateLimit = RateLimitsConfig{
+		Checkout: RateLimitConfig{
+			Limit:  l.int("CHECKOUT_RATE_LIMIT", 10),
+			Window: l.duration("CHECKOUT_RATE_LIMIT_WINDOW", time.Minute),
+			// The scenario's plans; RATE_LIMIT_{PLAN} sets each one
+			Plans: map[string]int{
+				"free":       l.int("RATE_LIMIT_FREE", 5),
+				"basic":      l.int("RATE_LIMIT_BASIC", 10),
+				"premium":    l.int("RATE_LIMIT_PREMIUM", 30),
+				"enterprise": l.int("RATE_LIMIT_ENTERPRISE", 100),
+			},
+		},
+		Overview: RateLimitConfig{
+			Limit:  l.int("OVERVIEW_RATE_LIMIT", 600),
+			Window: l.duration("OVERVIEW_RATE_LIMIT_WINDOW", time.Minute),
+		},
+	}
+	cfg.Limits = ConcurrencyConfig{
+		Overview:  l.int("CONCURRENCY_LIMIT_OVERVIEW", 0),
+		Checkout:  l.int("CONCURRENCY_LIMIT_CHECKOUT", 0),
+		QueueWait: l.duration("CONCURRENCY_QUEUE_WAIT", 100*time.Millisecond),
+	}
+	if cfg.Limits.Overview < 0 {
+		l.fail("CONCURRENCY_LIMIT_OVERVIEW", strconv.Itoa(cfg.Limits.Overview), "must be 0 (disabled) or more")
+	}
+	if cfg.Limits.Checkout < 0 {
+		l.fail("CONCURRENCY_LIMIT_CHECKOUT", strconv.Itoa(cfg.Limits.Checkout), "must be 0 (disabled) or more")
+	}
+	l.positiveDuration("CONCURRENCY_QUEUE_WAIT", cfg.Limits.QueueWait)
+
+	for key, rl := range map[string]RateLimitConfig{
+		"CHECKOUT_RATE_LIMIT": cfg.RateLimit.Checkout,
+		"OVERVIEW_RATE_LIMIT": cfg.RateLimit.Overview,
+	} {
+		if rl.Limit < 0 {
+			l.fail(key, strconv.Itoa(rl.Limit), "must be 0 (disabled) or more")
+		}
+		l.positiveDuration(key+"_WINDOW", rl.Window)
+	}
+	for plan, limit := range cfg.RateLimit.Checkout.Plans {
+		l.positive("RATE_LIMIT_"+strings.ToUpper(plan), limit)
+	}
+
+	cfg.AccessLog = AccessLogConfig{
+		Path:          l.str("ACCESS_LOG_PATH", ""),
+		Format:        l.str("LOG_FORMAT", "text"),
+		SlowThreshold: l.duration("LOG_SLOW_THRESHOLD", 500*time.Millisecond),
+		MaxSizeMB:     l.int("ACCESS_LOG_MAX_SIZE_MB", 100),
+		MaxAge:        l.duration("ACCESS_LOG_MAX_AGE", time.Hour),
+		BufferRecords: l.int("ACCESS_LOG_BUFFER", 8192),
+	}
+	// ACCESS_LOG_SAMPLE_N (1-in-N) predates LOG_SAMPLE_RATE and still
+	// provides the default
+	sampleN := l.int("ACCESS_LOG_SAMPLE_N", 100)
+	l.positive("ACCESS_LOG_SAMPLE_N", sampleN)
+	cfg.AccessLog.SampleRate = l.float("LOG_SAMPLE_RATE", 1/float64(max(sampleN, 1)))
+	if r := cfg.AccessLog.SampleRate; r < 0 || r > 1 {
+		l.fail("LOG_SAMPLE_RATE", strconv.FormatFloat(r, 'g', -1, 64), "must be between 0 and 1")
+	}
+	if f := cfg.AccessLog.Format; f != "text" && f != "json" {
+		l.fail("LOG_FORMAT", f, "must be text or json")
+	}
+	if cfg.AccessLog.Path != "" {
+		l.positive("ACCESS_LOG_BUFFER", cfg.AccessLog.BufferRecords)
+	}
+
+	cfg.Audit = AuditConfig{
+		FailedCheckouts: l.bool("AUDIT_FAILED_CHECKOUTS", false),
+		Buffer:          l.int("AUDIT_BUFFER", 1024),
+		MaxBodyBytes:    l.int("AUDIT_MAX_BODY_BYTES", 8*1024),
+		Retention:       l.duration("AUDIT_RETENTION", 24*time.Hour),
+		MaxRows:         l.int("AUDIT_MAX_ROWS", 100000),
+		CleanupInterval: l.duration("AUDIT_CLEANUP_INTERVAL", 5*time.Minute),
+	}
+	if cfg.Audit.FailedCheckouts {
+		l.positive("AUDIT_BUFFER", cfg.Audit.Buffer)
+		l.positive("AUDIT_MAX_BODY_BYTES", cfg.Audit.MaxBodyBytes)
+		l.positiveDuration("AUDIT_RETENTION", cfg.Audit.Retention)
+		l.positive("AUDIT_MAX_ROWS", cfg.Audit.MaxRows)
+		l.positiveDuration("AUDIT_CLEANUP_INTERVAL", cfg.Audit.CleanupInterval)
+	}
+
+	cfg.Metrics = MetricsConfig{
+		OverviewBuckets:    l.buckets("METRICS_OVERVIEW_BUCKETS", DefaultOverviewBuckets),
+		CheckoutBuckets:    l.buckets("METRICS_CHECKOUT_BUCKETS", DefaultCheckoutBuckets),
+		CheckoutStatsFlush: l.duration("METRICS_CHECKOUT_STATS_FLUSH", 10*time.Second),
+		ActiveUsers: ActiveUsersConfig{
+			Mode:          l.str("ACTIVE_USERS_MODE", "hll"),
+			RetentionDays: l.int("ACTIVE_USERS_RETENTION_DAYS", 30),
+		},
+	}
+	if m := cfg.Metrics.ActiveUsers.Mode; m != "hll" && m != "set" {
+		l.fail("ACTIVE_USERS_MODE", m, "must be hll or set")
+	}
+	l.positive("ACTIVE_USERS_RETENTION_DAYS", cfg.Metrics.ActiveUsers.RetentionDays)
+	l.nonNegativeDuration("METRICS_CHECKOUT_STATS_FLUSH", cfg.Metrics.CheckoutStatsFlush)
+
+	cfg.APIV1Sunset = l.str("API_V1_SUNSET", "")
+	if cfg.APIV1Sunset != "" {
+		if _, err := time.Parse(time.RFC1123, cfg.APIV1Sunset); err != nil {
+			l.fail("API_V1_SUNSET", cfg.APIV1Sunset, "must be an HTTP-date")
+		}
+	}
+
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	return cfg, nil
+}
+
+// loader accumulates parse errors so they can all be reported at once
+type loader struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+func (l *loader) fail(key, value, reason string) {
+	l.errs = append(l.errs, fmt.Errorf("%s=%q: %s", key, value, reason))
+}
+
+func (l *loader) str(key, fallback string) string {
+	if v, ok := l.lookup(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (l *loader) int(key string, fallback int) int {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.fail(key, v, "must be an integer")
+		return fallback
+	}
+	return n
+}
+
+// failurePolicy reads "open" or "closed", returning true for open
+func (l *loader) failurePolicy(key string, fallbackOpen bool) bool {
+	switch v := l.str(key, ""); v {
+	case "":
+		return fallbackOpen
+	case "open":
+		return true
+	case "closed":
+		return false
+	default:
+		l.fail(key, v, "must be open or closed")
+		return fallbackOpen
+	}
+}
+
+func (l *loader) bool(key string, fallback bool) bool {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.fail(key, v, "must be true or false")
+		return fallback
+	}
+	return b
+}
+
+// fileMode reads octal permissions such as 0660
+func (l *loader) fileMode(key string, fallback os.FileMode) os.FileMode {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0o777 {
+		l.fail(key, v, "must be octal permissions like 0660")
+		return fallback
+	}
+	return os.FileMode(m)
+}
+
+func (l *loader) float(key string, fallback float64) float64 {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		l.fail(key, v, "must be a number")
+		return fallback
+	}
+	return f
+}
+
+func (l *loader) duration(key string, fallback time.Duration) time.Duration {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.fail(key, v, "must be a duration like 500ms or 30s")
+		return fallback
+	}
+	return d
+}
+
+// buckets reads a comma-separated list of increasing upper bounds in seconds
+func (l *loader) buckets(key string, fallback []float64) []float64 {
+	v, ok := l.lookup(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	var out []float64
+	for _, part := range strings.Split(v, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || (len(out) > 0 && b <= out[len(out)-1]) {
+			l.fail(key, v, "must be increasing seconds, comma-separated")
+			return fallback
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func (l *loader) positive(key string, v int) {
+	if v < 1 {
+		l.fail(key, strconv.Itoa(v), "must be at least 1")
+	}
+}
+
+func (l *loader) positiveDuration(key string, d time.Duration) {
+	if d <= 0 {
+		l.fail(key, d.String(), "must be positive")
+	}
+}
+
+func (l *loader) nonNegativeDuration(key string, d time.Duration) {
+	if d < 0 {
+		l.fail(key, d.String(), "must not be negative")
+	}
+}
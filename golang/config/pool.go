@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolConfig parses DatabaseURL and applies the DB_* pool knobs on top, so
+// the server and the seeder size their pools the same way
+func (c *Config) PoolConfig() (*pgxpool.Config, error) {
+	return c.poolConfig(c.DatabaseURL)
+}
+
+// ReplicaPoolConfig is PoolConfig for DATABASE_REPLICA_URL, sized the same
+func (c *Config) ReplicaPoolConfig() (*pgxpool.Config, error) {
+	return c.poolConfig(c.ReplicaURL)
+}
+
+func (c *Config) poolConfig(databaseURL string) (*pgxpool.Config, error) {
+	pc, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse database URL: %w", err)
+	}
+	pc.MaxConns = c.DB.MaxConns
+	pc.MinConns = c.DB.MinConns
+	pc.MaxConnLifetime = c.DB.MaxConnLifetime
+	pc.MaxConnIdleTime = c.DB.MaxConnIdleTime
+	pc.HealthCheckPeriod = c.DB.HealthCheckPeriod
+	return pc, nil
+}
+
+// ShareAcross divides the DB and Redis pool sizes between prefork children
+// so the process group as a whole stays at the configured size instead of
+// every child opening a full pool. Each child keeps at least one connection.
+func (c *Config) ShareAcross(children int) {
+	if children <= 1 {
+		return
+	}
+	share := func(n int) int { return max(1, n/children) }
+	c.DB.MaxConns = int32(share(int(c.DB.MaxConns)))
+	c.DB.MinConns /= int32(children)
+	c.Redis.PoolSize = share(c.Redis.PoolSize)
+	c.Redis.MinIdleConns /= children
+}
+
+// DescribePool renders the effective pool settings for the startup log
+func DescribePool(pc *pgxpool.Config) string {
+	return fmt.Sprintf(
+		"max_conns=%d min_conns=%d max_conn_lifetime=%s max_conn_idle_time=%s health_check_period=%s",
+		pc.MaxConns,
+		pc.MinConns,
+		pc.MaxConnLifetime,
+		pc.MaxConnIdleTime,
+		pc.HealthCheckPeriod,
+	)
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisOptions builds client options from REDIS_URL (full URL form) or
+// REDIS_HOST/REDIS_PORT. The REDIS_* pool and timeout knobs are applied on
+// top, so they win over query parameters embedded in the URL.
+func (c *Config) RedisOptions() (*redis.Options, error) {
+	opts := &redis.Options{Addr: c.Redis.Addr}
+	if c.Redis.URL != "" {
+		parsed, err := redis.ParseURL(c.Redis.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+		}
+		opts = parsed
+	}
+	opts.PoolSize = c.Redis.PoolSize
+	opts.MinIdleConns = c.Redis.MinIdleConns
+	opts.MaxRetries = c.Redis.MaxRetries
+	opts.DialTimeout = c.Redis.DialTimeout
+	opts.ReadTimeout = c.Redis.ReadTimeout
+	opts.WriteTimeout = c.Redis.WriteTimeout
+	opts.PoolTimeout = c.Redis.PoolTimeout
+	// Honour request deadlines instead of only the static timeouts above
+	opts.ContextTimeoutEnabled = true
+	return opts, nil
+}
+
+// DescribeRedis renders the effective client settings for the startup log,
+// without credentials
+func DescribeRedis(o *redis.Options) string {
+	return fmt.Sprintf(
+		"addr=%s db=%d tls=%t pool_size=%d min_idle_conns=%d max_retries=%d dial_timeout=%s read_timeout=%s write_timeout=%s pool_timeout=%s",
+		o.Addr, o.DB, o.TLSConfig != nil,
+		o.PoolSize, o.MinIdleConns, o.MaxRetries,
+		o.DialTimeout, o.ReadTimeout, o.WriteTimeout, o.PoolTimeout,
+	)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// CouponPreviewRequest names the order a coupon would apply to: an open
+// cart, or items priced as a direct checkout would price them. Items
+// given with a cart must match it, as in checkout.
+type CouponPreviewRequest struct {
+	UserID string         `json:"userId"`
+	Coupon string         `json:"coupon"`
+	CartID string         `json:"cartId"`
+	Items  []CheckoutItem `json:"items"`
+}
+
+func (h *CheckoutHandler) validatePreview(req CouponPreviewRequest) []FieldError {
+	var errs fieldErrors
+	errs.requireUUID("userId", req.UserID)
+	if req.Coupon == "" {
+		errs.add("coupon", "is required")
+	}
+	if req.CartID == "" && len(req.Items) == 0 {
+		errs.add("items", "is required without cartId")
+	} else if req.CartID != "" && uuid.Validate(req.CartID) != nil {
+		errs.add("cartId", "must be a UUID")
+	}
+	h.validateItems(&errs, req.Items)
+	return errs
+}
+
+// PreviewCoupon serves POST /v1/coupons/validate: it runs checkout's
+// coupon checks in a read-only transaction and returns the discount the
+// coupon would give, recording no use. A coupon that wouldn't apply gets
+// the error checkout would fail with. Nothing is locked, so a checkout
+// right after can still find the coupon used up.
+func (h *CheckoutHandler) PreviewCoupon(c *fiber.Ctx) error {
+	if len(c.Body()) > h.cfg.MaxBodyBytes {
+		return writeError(c, ErrBodyTooLarge)
+	}
+	var req CouponPreviewRequest
+	if err := decodeStrict(c.Body(), &req); err != nil {
+		return writeError(c, err)
+	}
+	if details := h.validatePreview(req); len(details) > 0 {
+		return writeError(c, ErrValidation.WithDetails(details))
+	}
+
+	ctx := c.UserContext()
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return writeError(c, dbError("begin coupon preview", err))
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	var items []CartItemDB
+	if req.CartID == "" {
+		items, err = loadDirectItems(ctx, tx, req.Items, false)
+	} else {
+		items, err = loadCartItems(ctx, tx, req.UserID, req.CartID, false)
+		if mismatches := matchCart(req.Items, items); err == nil && len(req.Items) > 0 && len(mismatches) > 0 {
+			err = ErrCartMismatch.WithDetails(mismatches)
+		}
+	}
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	discount, err := h.evaluateCoupon(ctx, tx, req.UserID, req.Coupon, items, false)
+	if err != nil {
+		return writeError(c, err)
+	}
+	var subtotal Cents
+	for _, item := range items {
+		subtotal += Cents(item.Qty) * item.UnitPrice
+	}
+	return c.JSON(fiber.Map{
+		"coupon":   req.Coupon,
+		"valid":    true,
+		"subtotal": subtotal.Dollars(),
+		"discount": discount.Dollars(),
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestValidatePreview(t *testing.T) {
+	h := &CheckoutHandler{cfg: testConfig(t).Checkout}
+	item := []CheckoutItem{{ProductID: testUserID, Qty: 1}}
+	for _, tt := range []struct {
+		name  string
+		req   CouponPreviewRequest
+		field string
+	}{
+		{"items", CouponPreviewRequest{UserID: testUserID, Coupon: "SAVE10", Items: item}, ""},
+		{"cart", CouponPreviewRequest{UserID: testUserID, Coupon: "SAVE10", CartID: testUserID}, ""},
+		{"no user", CouponPreviewRequest{Coupon: "SAVE10", Items: item}, "userId"},
+		{"no coupon", CouponPreviewRequest{UserID: testUserID, Items: item}, "coupon"},
+		{"nothing to price", CouponPreviewRequest{UserID: testUserID, Coupon: "SAVE10"}, "items"},
+		{"bad cart", CouponPreviewRequest{UserID: testUserID, Coupon: "SAVE10", CartID: "cart-1"}, "cartId"},
+		{"bad qty", CouponPreviewRequest{UserID: testUserID, Coupon: "SAVE10", Items: []CheckoutItem{{ProductID: testUserID}}}, "items[0].qty"},
+	} {
+		errs := h.validatePreview(tt.req)
+		if tt.field == "" && len(errs) > 0 || tt.field != "" && (len(errs) != 1 || errs[0].Field != tt.field) {
+			t.Errorf("%s: errors = %v, want %q", tt.name, errs, tt.field)
+		}
+	}
+}
+
+func TestPreviewCouponRejectsBadBodies(t *testing.T) {
+	h := &CheckoutHandler{cfg: testConfig(t).Checkout}
+	app := fiber.New()
+	app.Post("/v1/coupons/validate", h.PreviewCoupon)
+	for body, code := range map[string]string{
+		`{"userId":"` + testUserID + `","code":"SAVE10"}`:              "INVALID_JSON",
+		`{"userId":"` + testUserID + `"}`:                              "VALIDATION_FAILED",
+		`{"userId":"x","coupon":"` + strings.Repeat("A", 1<<20) + `"}`: "BODY_TOO_LARGE",
+	} {
+		resp, got := send(t, app, newRequest(http.MethodPost, "/v1/coupons/validate", body))
+		if e, _ := decode(t, got)["error"].(map[string]any); e["code"] != code {
+			t.Errorf("%.40s: got %d %s, want %s", body, resp.StatusCode, got, code)
+		}
+	}
+}
+
+// seedCoupon inserts coupon code with max_uses uses, valid from startsAt
+// to endsAt (SQL expressions), plus the optional eligibility rules
+func seedCoupon(t *testing.T, db *DBRouter, code, typ string, value float64, maxUses int,
+	startsAt, endsAt string, minOrder *float64, category *string) {
+	t.Helper()
+	mustExec(t, db, `
+		INSERT INTO coupons (code, type, value, max_uses, starts_at, ends_at, min_order_amount, applicable_category_id)
+		VALUES ($1, $2, $3, $4, `+startsAt+`, `+endsAt+`, $5, $6)`,
+		code, typ, value, maxUses, minOrder, category)
+	t.Cleanup(func() {
+		db.Primary().Exec(context.Background(), `DELETE FROM coupons WHERE code = $1`, code)
+	})
+}
+
+func TestPreviewCouponFailsAsCheckoutWould(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	_, h := checkoutApp(t, db, rdb)
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/coupons/validate", h.PreviewCoupon)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "PREVIEW", 20, 10)
+	other := seedCategory(t, db)
+	code := func(name string) string { return "T" + strings.ToUpper(uuid.NewString()[:8]) + name }
+	minimum := 100.0
+
+	expired, exhausted, tooSmall, wrongCategory := code("E"), code("X"), code("M"), code("C")
+	seedCoupon(t, db, expired, "fixed", 5, 100, "NOW() - INTERVAL '2 days'", "NOW() - INTERVAL '1 day'", nil, nil)
+	seedCoupon(t, db, exhausted, "fixed", 5, 1, "NOW() - INTERVAL '1 day'", "NOW() + INTERVAL '1 day'", nil, nil)
+	mustExec(t, db, `UPDATE coupons SET used_count = 1 WHERE code = $1`, exhausted)
+	seedCoupon(t, db, tooSmall, "fixed", 5, 100, "NOW() - INTERVAL '1 day'", "NOW() + INTERVAL '1 day'", &minimum, nil)
+	seedCoupon(t, db, wrongCategory, "percentage", 10, 100, "NOW() - INTERVAL '1 day'", "NOW() + INTERVAL '1 day'", nil, &other)
+
+	for _, tt := range []struct {
+		coupon string
+		status int
+		code   string
+	}{
+		{"NO-SUCH-COUPON", 400, "INVALID_COUPON"},
+		{expired, 400, "COUPON_NOT_ACTIVE"},
+		{exhausted, 400, "COUPON_EXHAUSTED"},
+		{tooSmall, 400, "COUPON_MIN_NOT_MET"},
+		{wrongCategory, 400, "COUPON_NOT_APPLICABLE"},
+	} {
+		resp, body := send(t, app, newRequest(http.MethodPost, "/v1/coupons/validate", CouponPreviewRequest{
+			UserID: user, Coupon: tt.coupon, Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+		}))
+		e, _ := decode(t, body)["error"].(map[string]any)
+		if resp.StatusCode != tt.status || e["code"] != tt.code {
+			t.Errorf("%s: got %d %s, want %s", tt.coupon, resp.StatusCode, body, tt.code)
+		}
+	}
+
+	var used int
+	err := db.Primary().QueryRow(context.Background(), `SELECT used_count FROM coupons WHERE code = $1`, exhausted).Scan(&used)
+	if err != nil || used != 1 {
+		t.Errorf("used_count = %d, %v, want the preview to leave it at 1", used, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// couponTx answers evaluateCoupon's two reads, the coupon and the user's
+// usage of it, without a database
+type couponTx struct {
+	pgx.Tx
+	coupon *CouponDB
+	used   int
+}
+
+// rowFunc is a pgx.Row that scans with a function
+type rowFunc func(dest ...any) error
+
+func (f rowFunc) Scan(dest ...any) error { return f(dest...) }
+
+func (tx couponTx) QueryRow(_ context.Context, sql string, _ ...any) pgx.Row {
+	return rowFunc(func(dest ...any) error {
+		switch {
+		case strings.Contains(sql, "FROM coupons"):
+			if tx.coupon == nil {
+				return pgx.ErrNoRows
+			}
+			c := tx.coupon
+			for i, v := range []any{c.Code, c.Type, c.Value, c.MaxUses, c.UsedCount, c.StartsAt, c.EndsAt,
+				c.MinOrderAmount, c.ApplicableCategoryID} {
+				reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+			}
+			return nil
+		case strings.Contains(sql, "FROM user_coupon_usage"):
+			if tx.used == 0 {
+				return pgx.ErrNoRows
+			}
+			*dest[0].(*int) = tx.used
+			return nil
+		}
+		return errors.New("unexpected query: " + sql)
+	})
+}
+
+// testCoupon is an active coupon with no usage limit or restriction
+func testCoupon(typ string, value Cents) *CouponDB {
+	return &CouponDB{
+		Code: "TEST", Type: typ, Value: value,
+		StartsAt: time.Now().Add(-time.Hour), EndsAt: time.Now().Add(time.Hour),
+	}
+}
+
+// evaluate runs evaluateCoupon for items against tx
+func evaluate(tx couponTx, items ...CartItemDB) (Cents, error) {
+	h := &CheckoutHandler{now: time.Now}
+	return h.evaluateCoupon(context.Background(), tx, testUserID, "TEST", items, true)
+}
+
+func TestCouponRestrictions(t *testing.T) {
+	const (
+		books = "bbbbbbbb-0000-0000-0000-000000000001"
+		games = "bbbbbbbb-0000-0000-0000-000000000002"
+	)
+	cat := func(id string) *string { return &id }
+	amount := func(c Cents) *Cents { return &c }
+	book := CartItemDB{ProductID: "p1", Qty: 2, UnitPrice: 1000, CategoryID: cat(books)}
+	game := CartItemDB{ProductID: "p2", Qty: 1, UnitPrice: 3000, CategoryID: cat(games)}
+	uncategorized := CartItemDB{ProductID: "p3", Qty: 1, UnitPrice: 500}
+
+	minimum := testCoupon("percentage", 1000)
+	minimum.MinOrderAmount = amount(5000)
+	booksOnly := testCoupon("percentage", 2500)
+	booksOnly.ApplicableCategoryID = cat(books)
+	booksFixed := testCoupon("fixed", 700)
+	booksFixed.ApplicableCategoryID = cat(books)
+
+	for _, tt := range []struct {
+		name   string
+		coupon *CouponDB
+		items  []CartItemDB
+		want   Cents
+		code   string
+	}{
+		{"below the minimum", minimum, []CartItemDB{book, uncategorized}, 0, "COUPON_MIN_NOT_MET"},
+		{"at the minimum", minimum, []CartItemDB{book, game}, 500, ""},
+		{"only the category is discounted", booksOnly, []CartItemDB{book, game, uncategorized}, 500, ""},
+		{"nothing in the category", booksOnly, []CartItemDB{game, uncategorized}, 0, "COUPON_NOT_APPLICABLE"},
+		{"a fixed amount covers the order", booksFixed, []CartItemDB{book, game}, 700, ""},
+		{"a fixed amount still needs the category", booksFixed, []CartItemDB{game}, 0, "COUPON_NOT_APPLICABLE"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluate(couponTx{coupon: tt.coupon}, tt.items...)
+			_, body := errorBody(err)
+			if tt.code != "" {
+				if err == nil || body["code"] != tt.code {
+					t.Errorf("got %d, %v, want %s", got, err, tt.code)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("discount = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponMinimumDetails(t *testing.T) {
+	coupon := testCoupon("fixed", 500)
+	minimum := Cents(10000)
+	coupon.MinOrderAmount = &minimum
+	_, err := evaluate(couponTx{coupon: coupon}, CartItemDB{Qty: 3, UnitPrice: 2550})
+	_, body := errorBody(err)
+	details, _ := body["details"].(fiber.Map)
+	if details["minOrderAmount"] != 100.0 || details["subtotal"] != 76.5 {
+		t.Errorf("details = %v, want the minimum and the subtotal in dollars", body["details"])
+	}
+}
+
+func TestCouponLookup(t *testing.T) {
+	item := CartItemDB{Qty: 1, UnitPrice: 1000}
+	exhausted := testCoupon("fixed", 100)
+	limit := 5
+	exhausted.MaxUses, exhausted.UsedCount = &limit, 5
+	expired := testCoupon("fixed", 100)
+	expired.EndsAt = time.Now().Add(-time.Hour)
+	for _, tt := range []struct {
+		name string
+		tx   couponTx
+		code string
+	}{
+		{"unknown", couponTx{}, "INVALID_COUPON"},
+		{"exhausted", couponTx{coupon: exhausted}, "COUPON_EXHAUSTED"},
+		{"expired", couponTx{coupon: expired}, "COUPON_NOT_ACTIVE"},
+		{"already used", couponTx{coupon: testCoupon("fixed", 100), used: 1}, "COUPON_ALREADY_USED"},
+	} {
+		if _, err := evaluate(tt.tx, item); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		} else if _, body := errorBody(err); body["code"] != tt.code {
+			t.Errorf("%s: code = %v, want %s", tt.name, body["code"], tt.code)
+		}
+	}
+}
+
+func TestCouponValidityBounds(t *testing.T) {
+	// Stored in another zone, and with a fraction of a second the inclusive
+	// end ignores
+	est := time.FixedZone("EST", -5*60*60)
+	starts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).In(est)
+	ends := time.Date(2024, 3, 31, 23, 59, 59, 400e6, time.UTC).In(est)
+	endOfLastSecond := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name  string
+		now   time.Time
+		grace time.Duration
+		bound string
+	}{
+		{"before the start", starts.Add(-time.Nanosecond), 0, "starts_at"},
+		{"at the start", starts, 0, ""},
+		{"at the end", ends, 0, ""},
+		{"later in the end's second", endOfLastSecond.Add(-time.Millisecond), 0, ""},
+		{"the next second", endOfLastSecond, 0, "ends_at"},
+		{"early within the grace", starts.Add(-time.Minute), time.Minute, ""},
+		{"late within the grace", endOfLastSecond.Add(time.Minute - time.Millisecond), time.Minute, ""},
+		{"past the grace", endOfLastSecond.Add(time.Minute), time.Minute, "ends_at"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon := testCoupon("fixed", 100)
+			coupon.StartsAt, coupon.EndsAt = starts, ends
+			h := &CheckoutHandler{now: func() time.Time { return tt.now.In(est) }}
+			h.cfg.CouponGrace = tt.grace
+			_, err := h.evaluateCoupon(context.Background(), couponTx{coupon: coupon}, testUserID, "TEST",
+				[]CartItemDB{{Qty: 1, UnitPrice: 1000}}, true)
+			if tt.bound == "" {
+				if err != nil {
+					t.Errorf("err = %v, want the coupon accepted", err)
+				}
+				return
+			}
+			_, body := errorBody(err)
+			details, _ := body["details"].(fiber.Map)
+			if body["code"] != "COUPON_NOT_ACTIVE" || details["bound"] != tt.bound {
+				t.Fatalf("body = %v, want COUPON_NOT_ACTIVE on %s", body, tt.bound)
+			}
+			// The detail compares in UTC, whatever zone the clock or
+			// column is in
+			if now, _ := details["now"].(time.Time); now.Location() != time.UTC || !now.Equal(tt.now) {
+				t.Errorf("now = %v, want %v in UTC", details["now"], tt.now)
+			}
+			if end, _ := details["endsAt"].(time.Time); end.Location() != time.UTC || !end.Equal(ends) {
+				t.Errorf("endsAt = %v, want %v in UTC", details["endsAt"], ends)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dbReadsRouted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_reads_routed_total",
+		Help: "Read-path pool selections, by pool.",
+	}, []string{"pool"})
+
+	dbReplicaUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "db_replica_up",
+		Help: "1 while the read replica passes health checks.",
+	})
+)
+
+// DBRouter sends read-path queries to the replica while it is healthy and
+// to the primary otherwise. Writes always use Primary. Without a replica
+// it is a thin wrapper around the primary pool.
+type DBRouter struct {
+	primary   *pgxpool.Pool
+	replica   *pgxpool.Pool
+	replicaUp atomic.Bool
+}
+
+func NewDBRouter(primary, replica *pgxpool.Pool) *DBRouter {
+	return &DBRouter{primary: primary, replica: replica}
+}
+
+func (r *DBRouter) Primary() *pgxpool.Pool {
+	return r.primary
+}
+
+// Replica is nil when DATABASE_REPLICA_URL is unset
+func (r *DBRouter) Replica() *pgxpool.Pool {
+	return r.replica
+}
+
+// Read returns the pool the read path should use right now
+func (r *DBRouter) Read() *pgxpool.Pool {
+	if r.replica != nil && r.replicaUp.Load() {
+		dbReadsRouted.WithLabelValues("replica").Inc()
+		return r.replica
+	}
+	dbReadsRouted.WithLabelValues("primary").Inc()
+	return r.primary
+}
+
+// Watch pings the replica every interval until ctx is done, flipping reads
+// between replica and primary as it goes down and comes back
+func (r *DBRouter) Watch(ctx context.Context, interval, timeout time.Duration) {
+	if r.replica == nil {
+		return
+	}
+	check := func() {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := r.replica.Ping(pingCtx)
+		cancel()
+		up := err == nil
+		if r.replicaUp.Swap(up) != up {
+			if up {
+				log.Println("✅ Read replica healthy, routing overview reads to it")
+			} else {
+				log.Printf("⚠️  Read replica unhealthy, falling back to primary: %v", err)
+			}
+		}
+		if up {
+			dbReplicaUp.Set(1)
+		} else {
+			dbReplicaUp.Set(0)
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	schemaOnce sync.Once
+	schemaErr  error
+)
+
+// testPool connects to TEST_DATABASE_URL, applying the seeder schema the
+// first time. Tests that need Postgres are skipped when it is unset; point
+// it at a scratch database, since they write rows of their own.
+func testPool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	schemaOnce.Do(func() {
+		var schema []byte
+		if schema, schemaErr = os.ReadFile("../seeder/schema.sql"); schemaErr == nil {
+			// No arguments, so pgx sends it as one multi-statement query
+			_, schemaErr = pool.Exec(context.Background(), string(schema))
+		}
+	})
+	if schemaErr != nil {
+		t.Fatalf("apply schema: %v", schemaErr)
+	}
+	return pool
+}
+
+// testRouter is testPool behind a DBRouter with no replica
+func testRouter(t testing.TB) *DBRouter {
+	return NewDBRouter(testPool(t), nil)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deferredWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redis_deferred_write_failures_total",
+	Help: "Redis writes run after the response was sent that failed, by operation.",
+}, []string{"op"})
+
+// deferredWriteTimeout bounds a write left running after its response, so
+// a hung Redis can't pile up goroutines
+const deferredWriteTimeout = 2 * time.Second
+
+var (
+	// deferredWrites tracks the writes still running, for shutdown
+	deferredWrites sync.WaitGroup
+	// lastDeferredLog throttles the failure log to one line per second
+	lastDeferredLog atomic.Int64
+)
+
+// afterResponse runs write in the background so the response doesn't wait
+// on Redis writes the client doesn't depend on. write gets the request's
+// values (trace, cache bypass flag) but not its cancellation, bounded by
+// deferredWriteTimeout instead. It must not touch the fiber.Ctx. A failure
+// is counted and logged under op; the response has already gone out.
+func afterResponse(ctx context.Context, op string, write func(ctx context.Context) error) {
+	ctx = context.WithoutCancel(ctx)
+	deferredWrites.Add(1)
+	go func() {
+		defer deferredWrites.Done()
+		ctx, cancel := context.WithTimeout(ctx, deferredWriteTimeout)
+		defer cancel()
+		if err := write(ctx); err != nil {
+			deferredWriteFailures.WithLabelValues(op).Inc()
+			now := time.Now().Unix()
+			if last := lastDeferredLog.Load(); now > last && lastDeferredLog.CompareAndSwap(last, now) {
+				log.Printf("⚠️  Deferred Redis %s failed: %v", op, err)
+			}
+		}
+	}()
+}
+
+// waitDeferredWrites blocks until every pending write has finished or hit
+// its timeout, so a shutdown doesn't drop a checkout's invalidation
+func waitDeferredWrites() {
+	deferredWrites.Wait()
+}
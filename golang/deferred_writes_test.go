@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type deferredTestKey struct{}
+
+func TestAfterResponseOutlivesTheRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), deferredTestKey{}, "req-1"))
+	release := make(chan struct{})
+	var value any
+	var ctxErr error
+	var left time.Duration
+	afterResponse(ctx, "test_store", func(ctx context.Context) error {
+		<-release
+		value, ctxErr = ctx.Value(deferredTestKey{}), ctx.Err()
+		deadline, _ := ctx.Deadline()
+		left = time.Until(deadline)
+		return nil
+	})
+	// The request is over before the write runs
+	cancel()
+	close(release)
+	waitDeferredWrites()
+
+	if value != "req-1" {
+		t.Errorf("write saw value %v, want the request's", value)
+	}
+	if ctxErr != nil {
+		t.Errorf("write's context = %v, want it detached from the request", ctxErr)
+	}
+	if left <= 0 || left > deferredWriteTimeout {
+		t.Errorf("write had %s left, want at most %s", left, deferredWriteTimeout)
+	}
+}
+
+func TestAfterResponseCountsFailures(t *testing.T) {
+	failures := deferredWriteFailures.WithLabelValues("test_fail")
+	before := testutil.ToFloat64(failures)
+	for range 3 {
+		afterResponse(context.Background(), "test_fail", func(context.Context) error {
+			return errors.New("redis: connection refused")
+		})
+	}
+	waitDeferredWrites()
+	if got := testutil.ToFloat64(failures) - before; got != 3 {
+		t.Errorf("counted %v failures, want 3", got)
+	}
+}
@@ -0,0 +1,214 @@
+// Package events defines the payload_json of every events.type, shared by
+// the server and the seeder. Producers build a typed payload and encode it
+// with Marshal, which stamps the schema version and validates it; readers
+// decode with Unmarshal, so every producer's rows have the same shape.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// SchemaVersion is the version Marshal stamps on payloads and the only
+// one Unmarshal accepts. Changing a payload's shape incompatibly means
+// bumping it and teaching Unmarshal the old version.
+const SchemaVersion = 1
+
+// The events.type values
+const (
+	OrderCreated   = "ORDER_CREATED"
+	OrderCancelled = "ORDER_CANCELLED"
+	OrderShipped   = "ORDER_SHIPPED"
+	OrderDelivered = "ORDER_DELIVERED"
+	// PaymentConfirmed is written beside ORDER_SHIPPED when a payment
+	// webhook completes the order
+	PaymentConfirmed = "PAYMENT_CONFIRMED"
+	CartUpdated      = "CART_UPDATED"
+	CouponUsed       = "COUPON_USED"
+)
+
+var (
+	// ErrUnknownType is returned for an events.type with no payload
+	ErrUnknownType = errors.New("unknown event type")
+	// ErrUnsupportedVersion is returned for a payload whose schema_version
+	// is missing or not SchemaVersion
+	ErrUnsupportedVersion = errors.New("unsupported schema_version")
+	// ErrInvalidPayload is returned for a payload missing a required field
+	ErrInvalidPayload = errors.New("invalid event payload")
+)
+
+// Payload is the payload_json of one event type
+type Payload interface {
+	// Type is the events.type the payload is stored under
+	Type() string
+	// Validate reports a required field that is missing
+	Validate() error
+	version() *Version
+}
+
+// Version is embedded in every payload
+type Version struct {
+	SchemaVersion int `json:"schema_version"`
+}
+
+func (v *Version) version() *Version { return v }
+
+// OrderCreatedPayload is written by checkout
+type OrderCreatedPayload struct {
+	Version
+	OrderID string `json:"orderId"`
+	// OrderNumber is empty for orders placed by a producer that doesn't
+	// number them
+	OrderNumber string  `json:"orderNumber,omitempty"`
+	Total       float64 `json:"total"`
+	// CartID is empty for a direct checkout
+	CartID string `json:"cartId,omitempty"`
+}
+
+func (*OrderCreatedPayload) Type() string { return OrderCreated }
+
+func (p *OrderCreatedPayload) Validate() error { return require("orderId", p.OrderID) }
+
+// OrderCancelledPayload is written when a pending order is cancelled
+type OrderCancelledPayload struct {
+	Version
+	OrderID       string  `json:"orderId"`
+	Total         float64 `json:"total"`
+	ReleasedUnits int     `json:"releasedUnits"`
+}
+
+func (*OrderCancelledPayload) Type() string { return OrderCancelled }
+
+func (p *OrderCancelledPayload) Validate() error { return require("orderId", p.OrderID) }
+
+// OrderShippedPayload is written when an order is fulfilled
+type OrderShippedPayload struct {
+	Version
+	OrderID      string `json:"orderId"`
+	ShippedUnits int    `json:"shippedUnits"`
+}
+
+func (*OrderShippedPayload) Type() string { return OrderShipped }
+
+func (p *OrderShippedPayload) Validate() error { return require("orderId", p.OrderID) }
+
+// PaymentConfirmedPayload is written when the payment provider confirms
+// a pending order's payment
+type PaymentConfirmedPayload struct {
+	Version
+	OrderID    string `json:"orderId"`
+	PaymentRef string `json:"paymentRef"`
+}
+
+func (*PaymentConfirmedPayload) Type() string { return PaymentConfirmed }
+
+func (p *PaymentConfirmedPayload) Validate() error {
+	if err := require("orderId", p.OrderID); err != nil {
+		return err
+	}
+	return require("paymentRef", p.PaymentRef)
+}
+
+// OrderDeliveredPayload is only seeded; nothing delivers orders yet
+type OrderDeliveredPayload struct {
+	Version
+	OrderID string `json:"orderId"`
+}
+
+func (*OrderDeliveredPayload) Type() string { return OrderDelivered }
+
+func (p *OrderDeliveredPayload) Validate() error { return require("orderId", p.OrderID) }
+
+// CartUpdatedPayload is only seeded
+type CartUpdatedPayload struct {
+	Version
+	CartID    string `json:"cartId"`
+	ProductID string `json:"productId"`
+	Qty       int    `json:"qty"`
+}
+
+func (*CartUpdatedPayload) Type() string { return CartUpdated }
+
+func (p *CartUpdatedPayload) Validate() error {
+	return errors.Join(require("cartId", p.CartID), require("productId", p.ProductID))
+}
+
+// CouponUsedPayload is only seeded
+type CouponUsedPayload struct {
+	Version
+	Code     string  `json:"code"`
+	Discount float64 `json:"discount"`
+}
+
+func (*CouponUsedPayload) Type() string { return CouponUsed }
+
+func (p *CouponUsedPayload) Validate() error { return require("code", p.Code) }
+
+func require(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%w: %s is required", ErrInvalidPayload, field)
+	}
+	return nil
+}
+
+// registry makes an empty payload for each type
+var registry = map[string]func() Payload{
+	OrderCreated:     func() Payload { return &OrderCreatedPayload{} },
+	OrderCancelled:   func() Payload { return &OrderCancelledPayload{} },
+	OrderShipped:     func() Payload { return &OrderShippedPayload{} },
+	OrderDelivered:   func() Payload { return &OrderDeliveredPayload{} },
+	PaymentConfirmed: func() Payload { return &PaymentConfirmedPayload{} },
+	CartUpdated:      func() Payload { return &CartUpdatedPayload{} },
+	CouponUsed:       func() Payload { return &CouponUsedPayload{} },
+}
+
+// Types lists every registered events.type, sorted
+func Types() []string {
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// Marshal validates p, stamps it with SchemaVersion and encodes it for
+// payload_json
+func Marshal(p Payload) (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", fmt.Errorf("%s: %w", p.Type(), err)
+	}
+	p.version().SchemaVersion = SchemaVersion
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Unmarshal decodes the payload_json of an eventType event. It fails with
+// ErrUnknownType, ErrUnsupportedVersion (which payloads written before
+// versioning get) or ErrInvalidPayload rather than guess at a shape.
+func Unmarshal(eventType string, data []byte) (Payload, error) {
+	newPayload, ok := registry[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, eventType)
+	}
+	var v Version
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if v.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, v.SchemaVersion)
+	}
+	p := newPayload()
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
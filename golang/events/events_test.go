@@ -0,0 +1,74 @@
+package events
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// produced is a payload of every type, shaped as its producer writes it
+var produced = []Payload{
+	&OrderCreatedPayload{OrderID: "o-1", OrderNumber: "ORD-2024-000000001", Total: 59.99, CartID: "c-1"},
+	&OrderCreatedPayload{OrderID: "o-2", Total: 12.5}, // direct, or seeded without a number
+	&OrderCancelledPayload{OrderID: "o-1", Total: 59.99, ReleasedUnits: 3},
+	&OrderShippedPayload{OrderID: "o-1", ShippedUnits: 3},
+	&OrderDeliveredPayload{OrderID: "o-1"},
+	&PaymentConfirmedPayload{OrderID: "o-1", PaymentRef: "pay-1"},
+	&CartUpdatedPayload{CartID: "c-1", ProductID: "p-1", Qty: 2},
+	&CouponUsedPayload{Code: "SAVE10", Discount: 5},
+}
+
+func TestEveryPayloadRoundTrips(t *testing.T) {
+	covered := map[string]bool{}
+	for _, p := range produced {
+		data, err := Marshal(p)
+		if err != nil {
+			t.Fatalf("%s: %v", p.Type(), err)
+		}
+		if !strings.Contains(data, `"schema_version":1`) {
+			t.Errorf("%s: %s isn't stamped with the version", p.Type(), data)
+		}
+		got, err := Unmarshal(p.Type(), []byte(data))
+		if err != nil || !reflect.DeepEqual(got, p) {
+			t.Errorf("%s: round trip = %#v, %v, want %#v", p.Type(), got, err, p)
+		}
+		covered[p.Type()] = true
+	}
+	for _, typ := range Types() {
+		if !covered[typ] {
+			t.Errorf("no payload of %s is tested", typ)
+		}
+	}
+}
+
+func TestMarshalValidates(t *testing.T) {
+	for _, p := range []Payload{
+		&OrderCreatedPayload{Total: 1},
+		&PaymentConfirmedPayload{OrderID: "o-1"},
+		&CartUpdatedPayload{Qty: 1},
+		&CouponUsedPayload{},
+	} {
+		if data, err := Marshal(p); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: %s, %v, want ErrInvalidPayload", p.Type(), data, err)
+		}
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name, typ, data string
+		want            error
+	}{
+		{"unknown type", "ORDER_TELEPORTED", `{"schema_version":1}`, ErrUnknownType},
+		{"unversioned", OrderCreated, `{"orderId":"o-1","total":5}`, ErrUnsupportedVersion},
+		{"from the future", OrderCreated, `{"schema_version":2,"orderId":"o-1"}`, ErrUnsupportedVersion},
+		{"not JSON", OrderCreated, `action=checkout`, ErrInvalidPayload},
+		{"wrong shape", OrderCreated, `{"schema_version":1,"orderId":7}`, ErrInvalidPayload},
+		{"missing a field", OrderShipped, `{"schema_version":1,"shippedUnits":1}`, ErrInvalidPayload},
+	} {
+		if p, err := Unmarshal(tt.typ, []byte(tt.data)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %#v, %v, want %v", tt.name, p, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// testConfig is the configuration with every variable unset, i.e. the
+// defaults the server runs with
+func testConfig(t testing.TB) *config.Config {
+	t.Helper()
+	cfg, err := config.LoadFrom(func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// overviewApp wires the overview handler as main does and mounts its
+// routes on a fresh app
+func overviewApp(t testing.TB, db *DBRouter, rdb *redis.Client) *fiber.App {
+	t.Helper()
+	return overviewAppWith(db, rdb, testConfig(t))
+}
+
+// overviewAppWith is overviewApp under cfg
+func overviewAppWith(db *DBRouter, rdb *redis.Client, cfg *config.Config) *fiber.App {
+	segments := newSegmentStore(rdb, cfg.Segment, newSegmentRules(db, cfg.Segment))
+	svc := NewUserOverviewService(db, rdb, cfg.Cache, segments, cfg.Timeouts.ProductsQuery,
+		NewAvailabilityView(db, rdb, cfg.Availability), NewActiveUsers(rdb, cfg.Metrics.ActiveUsers),
+		cfg.Overview.ReservedFrom)
+	h := NewUserOverviewHandler(svc, cfg.Overview)
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Get("/v1/users/:userId/overview", h.GetUserOverview)
+	app.Get("/v2/users/:userId/overview", h.GetUserOverviewV2)
+	app.Get("/v1/users/:userId/orders", h.GetUserOrders)
+	app.Get("/v1/users/:userId/cart", h.GetUserCart)
+	app.Get("/v1/orders/:orderId", h.GetOrder)
+	return app
+}
+
+// checkoutApp wires the checkout handler as main does, without the
+// middleware in front of it, and mounts POST /v1/checkout and the
+// order's cancel and fulfill (unguarded) routes
+func checkoutApp(t testing.TB, db *DBRouter, rdb *redis.Client) (*fiber.App, *CheckoutHandler) {
+	t.Helper()
+	cfg := testConfig(t)
+	segments := newSegmentStore(rdb, cfg.Segment, newSegmentRules(db, cfg.Segment))
+	h := NewCheckoutHandler(db.Primary(), rdb, cfg.Checkout, cfg.RedisFailOpen,
+		newCacheCodec(cfg.Cache.CompressThreshold), segments, newTaxRates(db, cfg.Tax),
+		newSummaryInvalidator(rdb, cfg.Cache), testCheckoutStats(cfg.Metrics.CheckoutBuckets))
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/checkout", h.Checkout)
+	app.Post("/v1/orders/:orderId/cancel", h.CancelOrder)
+	app.Post("/v1/orders/:orderId/fulfill", h.FulfillOrder)
+	return app, h
+}
+
+// checkoutStats is the one CheckoutStats every checkoutApp shares, since
+// its histograms can only be registered once per process. With no flush
+// interval it never touches Redis.
+var checkoutStats struct {
+	once  sync.Once
+	stats *CheckoutStats
+}
+
+func testCheckoutStats(buckets []float64) *CheckoutStats {
+	checkoutStats.once.Do(func() {
+		checkoutStats.stats = NewCheckoutStats(nil, 0, buckets)
+	})
+	return checkoutStats.stats
+}
+
+// mustExec runs a fixture statement, failing the test on error
+func mustExec(t testing.TB, db *DBRouter, sql string, args ...any) {
+	t.Helper()
+	if _, err := db.Primary().Exec(context.Background(), sql, args...); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+// seedUser inserts a user, removing it and everything hanging off it when
+// the test ends
+func seedUser(t testing.TB, db *DBRouter, plan, status string) string {
+	t.Helper()
+	var id string
+	err := db.Primary().QueryRow(context.Background(), `
+		INSERT INTO users (plan, region, status) VALUES ($1, 'us-east', $2) RETURNING id`,
+		plan, status).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		// order_items, inventory_reservations and cart_items cascade
+		for _, sql := range []string{
+			`DELETE FROM user_coupon_usage WHERE user_id = $1`,
+			`DELETE FROM idempotency_keys WHERE user_id = $1`,
+			`DELETE FROM orders WHERE user_id = $1`,
+			`DELETE FROM carts WHERE user_id = $1`,
+			`DELETE FROM events WHERE user_id = $1`,
+			`DELETE FROM users WHERE id = $1`,
+		} {
+			db.Primary().Exec(ctx, sql, id)
+		}
+	})
+	return id
+}
+
+// seedCategory inserts an empty category, so a test can page through
+// products no other test or seed data shares
+func seedCategory(t testing.TB, db *DBRouter) string {
+	t.Helper()
+	id := uuid.NewString()
+	mustExec(t, db, `INSERT INTO categories (id, name) VALUES ($1, $2)`, id, "test-"+id[:8])
+	t.Cleanup(func() {
+		db.Primary().Exec(context.Background(), `DELETE FROM categories WHERE id = $1`, id)
+	})
+	return id
+}
+
+// seedProduct inserts an active Electronics product stocked with qty units
+// in the us-east warehouse
+func seedProduct(t testing.TB, db *DBRouter, sku string, price float64, qty int) string {
+	t.Helper()
+	return seedProductIn(t, db, "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa", sku, price, qty)
+}
+
+// seedProductIn inserts an active product in category stocked with qty
+// units in the us-east warehouse. The SKU is sku with a random suffix, so
+// reruns against the same database don't collide.
+func seedProductIn(t testing.TB, db *DBRouter, category, sku string, price float64, qty int) string {
+	t.Helper()
+	sku += "-" + uuid.NewString()[:8]
+	var id string
+	err := db.Primary().QueryRow(context.Background(), `
+		INSERT INTO products (sku, price, category_id)
+		VALUES ($1, $2, $3) RETURNING id`,
+		sku, price, category).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, `
+		INSERT INTO inventory (product_id, warehouse_id, available_qty)
+		VALUES ($1, '11111111-1111-1111-1111-111111111111', $2)`, id, qty)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		for _, sql := range []string{
+			`DELETE FROM inventory_reservations WHERE product_id = $1`,
+			`DELETE FROM order_items WHERE product_id = $1`,
+			`DELETE FROM cart_items WHERE product_id = $1`,
+			`DELETE FROM inventory WHERE product_id = $1`,
+			`DELETE FROM products WHERE id = $1`,
+		} {
+			db.Primary().Exec(ctx, sql, id)
+		}
+	})
+	return id
+}
+
+// seedCart inserts a cart for userID with one unit of each product at
+// price. The user's cleanup removes it.
+func seedCart(t testing.TB, db *DBRouter, userID, status string, price float64, productIDs ...string) string {
+	t.Helper()
+	var id string
+	err := db.Primary().QueryRow(context.Background(), `
+		INSERT INTO carts (user_id, status) VALUES ($1, $2) RETURNING id`, userID, status).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range productIDs {
+		mustExec(t, db, `
+			INSERT INTO cart_items (cart_id, product_id, qty, unit_price)
+			VALUES ($1, $2, 1, $3)`, id, p, price)
+	}
+	return id
+}
+
+// seedOrder inserts an order for userID with one line per product, each of
+// qty units at price
+func seedOrder(t testing.TB, db *DBRouter, userID, status string, qty int, price float64, productIDs ...string) string {
+	t.Helper()
+	total := float64(qty*len(productIDs)) * price
+	var id string
+	err := db.Primary().QueryRow(context.Background(), `
+		INSERT INTO orders (user_id, status, subtotal, total)
+		VALUES ($1, $2, $3, $3) RETURNING id`, userID, status, total).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range productIDs {
+		mustExec(t, db, `
+			INSERT INTO order_items (order_id, product_id, qty, unit_price)
+			VALUES ($1, $2, $3, $4)`, id, p, qty, price)
+	}
+	return id
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// ComponentHealth is one dependency's result in the readiness body
+type ComponentHealth struct {
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+	Breaker   string  `json:"breaker,omitempty"`
+	// AgeSeconds is how old product_availability is
+	AgeSeconds *float64 `json:"ageSeconds,omitempty"`
+	// LagSeconds is how long the oldest unpublished outbox event has waited
+	LagSeconds *float64 `json:"lagSeconds,omitempty"`
+}
+
+type healthProbe struct {
+	critical bool
+	ping     func(context.Context) error
+}
+
+// Health serves the liveness and readiness probes. Liveness only says the
+// process is serving; readiness pings every dependency and turns to failing
+// once Drain is called so load balancers stop routing here before the
+// listener closes. Redis is not critical: the handlers degrade without it,
+// so an outage reports "degraded" but stays 200.
+type Health struct {
+	db           *DBRouter
+	rdb          *redis.Client
+	breaker      *RedisBreaker
+	availability *AvailabilityView
+	outbox       *OutboxRelay
+	timeout      time.Duration
+	draining     atomic.Bool
+	warming      atomic.Bool
+	warmupErr    atomic.Pointer[string]
+}
+
+func NewHealth(
+	db *DBRouter,
+	rdb *redis.Client,
+	breaker *RedisBreaker,
+	availability *AvailabilityView,
+	outbox *OutboxRelay,
+	timeout time.Duration,
+) *Health {
+	return &Health{
+		db:           db,
+		rdb:          rdb,
+		breaker:      breaker,
+		availability: availability,
+		outbox:       outbox,
+		timeout:      timeout,
+	}
+}
+
+// SetWarming holds readiness at 503 while startup warmup runs
+func (h *Health) SetWarming() {
+	h.warming.Store(true)
+}
+
+// WarmupDone releases readiness. A warmup that failed or ran out of time
+// only means a cold start, so it shows as a degraded component rather than
+// keeping the instance out of rotation.
+func (h *Health) WarmupDone(err error) {
+	if err != nil {
+		msg := err.Error()
+		h.warmupErr.Store(&msg)
+	}
+	h.warming.Store(false)
+}
+
+// Drain marks the instance as shutting down
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+func (h *Health) Live(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+func (h *Health) Ready(c *fiber.Ctx) error {
+	if h.draining.Load() {
+		return c.Status(fiber.StatusServiceUnavailable).
+			JSON(fiber.Map{"status": "draining"})
+	}
+	if h.warming.Load() {
+		return c.Status(fiber.StatusServiceUnavailable).
+			JSON(fiber.Map{"status": "warming"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), h.timeout)
+	defer cancel()
+
+	probes := map[string]healthProbe{
+		"postgres": {critical: true, ping: h.db.Primary().Ping},
+		"redis": {ping: func(ctx context.Context) error {
+			return h.rdb.Ping(ctx).Err()
+		}},
+	}
+	// Reads fall back to the primary, so the replica is never critical
+	if replica := h.db.Replica(); replica != nil {
+		probes["postgres_replica"] = healthProbe{ping: replica.Ping}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	components := make(map[string]ComponentHealth, len(probes))
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe healthProbe) {
+			defer wg.Done()
+			start := time.Now()
+			err := probe.ping(ctx)
+			result := ComponentHealth{
+				Status:    "up",
+				Critical:  probe.critical,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "down"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			components[name] = result
+			mu.Unlock()
+		}(name, probe)
+	}
+	wg.Wait()
+
+	if h.breaker != nil {
+		redisHealth := components["redis"]
+		redisHealth.Breaker = h.breaker.State().String()
+		components["redis"] = redisHealth
+	}
+	if h.availability.Enabled() {
+		components["product_availability"] = h.availability.health()
+	}
+	if h.outbox.Enabled() {
+		components["event_outbox"] = h.outbox.health()
+	}
+	if msg := h.warmupErr.Load(); msg != nil {
+		components["warmup"] = ComponentHealth{Status: "down", Error: *msg}
+	}
+
+	status, code := "ok", fiber.StatusOK
+	for _, comp := range components {
+		if comp.Status == "up" {
+			continue
+		}
+		if comp.Critical {
+			status, code = "unavailable", fiber.StatusServiceUnavailable
+			break
+		}
+		status = "degraded"
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status":     status,
+		"components": components,
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// headerIdempotencyKey names the checkout's idempotency key; without
+	// it the paymentRef is the key
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerIdempotentReplay marks a response replayed from a stored one
+	headerIdempotentReplay = "Idempotent-Replay"
+
+	// idempotencyPending prefixes the placeholder that reserves a key
+	// while its checkout runs; a finished entry is the request's
+	// fingerprint followed by the encoded response
+	idempotencyPending = "pending:"
+	// idempotencyCacheTTL is how long Redis keeps a finished entry;
+	// idempotency_keys keeps it after that
+	idempotencyCacheTTL = 10 * time.Minute
+)
+
+// idempotencyRedisKey is the Redis key of a checkout's idempotency entry
+func idempotencyRedisKey(key string) string {
+	return "idem:checkout:" + key
+}
+
+// checkoutIdempotencyKey picks the key a checkout is deduplicated on: the
+// Idempotency-Key header, or the paymentRef when the header is absent
+func checkoutIdempotencyKey(header string, req CheckoutRequest) string {
+	if header != "" {
+		return header
+	}
+	return req.PaymentRef
+}
+
+// requestFingerprint hashes what a checkout asks for, so reusing a key
+// for a different request can be told apart from a retry. The paymentRef
+// is left out, as a payment provider may retry under a new one; ids are
+// lowercased and items sorted, so equivalent spellings match.
+func requestFingerprint(req CheckoutRequest) string {
+	items := make([]CheckoutItem, len(req.Items))
+	for i, it := range req.Items {
+		items[i] = CheckoutItem{ProductID: strings.ToLower(it.ProductID), Qty: it.Qty}
+	}
+	slices.SortFunc(items, func(a, b CheckoutItem) int {
+		return strings.Compare(a.ProductID, b.ProductID)
+	})
+	canonical, _ := json.Marshal(CheckoutRequest{
+		UserID:         strings.ToLower(req.UserID),
+		CartID:         strings.ToLower(req.CartID),
+		Items:          items,
+		Coupon:         req.Coupon,
+		ShippingMethod: req.ShippingMethod,
+	})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyEntry is the Redis value for a finished checkout
+func (h *CheckoutHandler) idempotencyEntry(fingerprint string, payload []byte) []byte {
+	return append([]byte(fingerprint), h.codec.Encode(payload)...)
+}
+
+// parseIdempotencyEntry splits a finished entry. An entry written before
+// fingerprints were stored has none and comes back with fingerprint "".
+func parseIdempotencyEntry(entry []byte) (fingerprint string, payload []byte, err error) {
+	if n := sha256.Size * 2; len(entry) > n {
+		if _, err := hex.Decode(make([]byte, sha256.Size), entry[:n]); err == nil {
+			fingerprint, entry = string(entry[:n]), entry[n:]
+		}
+	}
+	payload, err = decodeCached(entry)
+	return fingerprint, payload, err
+}
+
+// replayIdempotent returns payload for a request with fingerprint, or
+// ErrIdempotencyReuse when the key was first used for something else
+func replayIdempotent(stored, fingerprint string, payload []byte) ([]byte, error) {
+	if stored != "" && stored != fingerprint {
+		return nil, ErrIdempotencyReuse
+	}
+	return payload, nil
+}
+
+// reserveIdempotency claims key for this checkout with SET NX, so
+// concurrent requests with the same key can't both check out. The loser
+// replays the stored response, or gets PROCESSING while the winner is
+// still running. release drops the placeholder if it is still ours.
+func (h *CheckoutHandler) reserveIdempotency(
+	ctx context.Context,
+	key, fingerprint string,
+) (replay []byte, release func(), err error) {
+	noop := func() {}
+	// Redis trouble: refuse, or with fail-open rely on idempotency_keys
+	unavailable := func() ([]byte, func(), error) {
+		if h.failOpen.Idempotency {
+			return nil, noop, nil
+		}
+		return nil, nil, ErrRedisUnavailable
+	}
+
+	token := idempotencyPending + uuid.NewString()
+	// A second pass covers an entry that vanished or was corrupt in between
+	for range 2 {
+		ok, err := h.rdb.SetNX(ctx, key, token, h.cfg.PendingTTL).Result()
+		if err != nil {
+			return unavailable()
+		}
+		if ok {
+			return nil, func() {
+				releaseMarkerScript.Run(context.WithoutCancel(ctx), h.rdb, []string{key}, token)
+			}, nil
+		}
+
+		existing, err := h.rdb.Get(ctx, key).Bytes()
+		switch {
+		case err == redis.Nil:
+			continue
+		case err != nil:
+			return unavailable()
+		case bytes.HasPrefix(existing, []byte(idempotencyPending)):
+			return nil, nil, ErrCheckoutPending
+		}
+		stored, payload, err := parseIdempotencyEntry(existing)
+		if err == nil {
+			payload, err = replayIdempotent(stored, fingerprint, payload)
+			return payload, nil, err
+		}
+		// A bad entry can't be replayed; drop it and fall back to
+		// idempotency_keys
+		cacheCorrupt.WithLabelValues("idempotency").Inc()
+		h.rdb.Del(ctx, key)
+	}
+	return nil, nil, ErrCheckoutPending
+}
+
+// ReplayMiddleware answers a retried checkout from its stored response
+// ahead of the rate and concurrency limits, so a client retrying with the
+// same key gets its original answer rather than a 429. Only a finished
+// Redis entry for the same request is served here; a new request, a key
+// reused for something else, a checkout still in progress or an entry
+// only idempotency_keys still holds goes through the limits to Checkout.
+// Async requests, which replay a checkout id instead, pass straight on.
+func (h *CheckoutHandler) ReplayMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if h.cfg.LockBackend != "redis" || wantsAsync(c) || len(c.Body()) > h.cfg.MaxBodyBytes {
+			return c.Next()
+		}
+		var req CheckoutRequest
+		if err := decodeStrict(c.Body(), &req); err != nil {
+			return c.Next()
+		}
+		// As parseRequest does, so the fingerprint matches the original's
+		req.ShippingMethod = shippingMethodOrDefault(req.ShippingMethod)
+		key := checkoutIdempotencyKey(c.Get(headerIdempotencyKey), req)
+		if key == "" {
+			return c.Next()
+		}
+		entry, err := h.rdb.Get(c.UserContext(), idempotencyRedisKey(key)).Bytes()
+		if err != nil || bytes.HasPrefix(entry, []byte(idempotencyPending)) {
+			return c.Next()
+		}
+		stored, payload, err := parseIdempotencyEntry(entry)
+		if err == nil {
+			payload, err = replayIdempotent(stored, requestFingerprint(req), payload)
+		}
+		if err != nil {
+			return c.Next()
+		}
+		c.Set(headerIdempotentReplay, "true")
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(payload)
+	}
+}
+
+// loadIdempotencyRecord looks key up in idempotency_keys, which outlives
+// the Redis entry and survives a Redis flush. It returns the response to
+// replay, or nil when the key is unused.
+func (h *CheckoutHandler) loadIdempotencyRecord(
+	ctx context.Context,
+	key, fingerprint string,
+) ([]byte, error) {
+	var stored, response string
+	err := h.db.QueryRow(ctx, `
+		SELECT request_hash, response_json FROM idempotency_keys WHERE key = $1`, key).
+		Scan(&stored, &response)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError("load idempotency key", err)
+	}
+	return replayIdempotent(stored, fingerprint, []byte(response))
+}
+
+// isIdempotencyKeyTaken reports whether a checkout failed because another
+// one committed the same key first
+func isIdempotencyKeyTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" &&
+		pgErr.ConstraintName == "idempotency_keys_pkey"
+}
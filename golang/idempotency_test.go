@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// idempotencyHandler is a CheckoutHandler with just what reserveIdempotency
+// uses
+func idempotencyHandler(rdb *redis.Client, failOpen bool) *CheckoutHandler {
+	return &CheckoutHandler{
+		rdb:      rdb,
+		cfg:      config.CheckoutConfig{LockBackend: "redis", PendingTTL: time.Minute},
+		failOpen: config.RedisFailOpenConfig{Idempotency: failOpen},
+		codec:    newCacheCodec(0),
+	}
+}
+
+func TestReserveIdempotencyAdmitsOneCheckout(t *testing.T) {
+	mr, rdb := testRedis(t)
+	h := idempotencyHandler(rdb, false)
+	ctx := context.Background()
+	key := idempotencyRedisKey("key-1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won, pending := 0, 0
+	var release func()
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replay, rel, err := h.reserveIdempotency(ctx, key, "fp")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil && replay == nil:
+				won++
+				release = rel
+			case errors.Is(err, ErrCheckoutPending):
+				pending++
+			default:
+				t.Errorf("reserve = %s, %v", replay, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 || pending != 19 {
+		t.Fatalf("%d won and %d were told PROCESSING, want 1 and 19", won, pending)
+	}
+	if ttl := mr.TTL(key); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("placeholder TTL = %s, want CHECKOUT_PENDING_TTL", ttl)
+	}
+
+	release()
+	if mr.Exists(key) {
+		t.Error("release left the placeholder")
+	}
+	if _, _, err := h.reserveIdempotency(ctx, key, "fp"); err != nil {
+		t.Errorf("after release: %v, want the key free again", err)
+	}
+}
+
+func TestReleaseOnlyDropsItsOwnPlaceholder(t *testing.T) {
+	mr, rdb := testRedis(t)
+	h := idempotencyHandler(rdb, false)
+	key := idempotencyRedisKey("key-1")
+	_, release, err := h.reserveIdempotency(context.Background(), key, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ours expired and someone else reserved the key
+	mr.Set(key, idempotencyPending+"someone-else")
+	release()
+	if got, _ := mr.Get(key); got != idempotencyPending+"someone-else" {
+		t.Errorf("entry = %q, want the other placeholder kept", got)
+	}
+}
+
+func TestReserveIdempotencyReplaysAFinishedEntry(t *testing.T) {
+	_, rdb := testRedis(t)
+	h := idempotencyHandler(rdb, false)
+	ctx := context.Background()
+	key := idempotencyRedisKey("key-1")
+	fp := requestFingerprint(CheckoutRequest{UserID: testUserID})
+	rdb.Set(ctx, key, h.idempotencyEntry(fp, []byte(`{"orderId":"o-1"}`)), 0)
+
+	replay, _, err := h.reserveIdempotency(ctx, key, fp)
+	if err != nil || string(replay) != `{"orderId":"o-1"}` {
+		t.Errorf("same request: %s, %v, want the stored response", replay, err)
+	}
+	other := requestFingerprint(CheckoutRequest{UserID: testUserID, Coupon: "SAVE10"})
+	if _, _, err := h.reserveIdempotency(ctx, key, other); !errors.Is(err, ErrIdempotencyReuse) {
+		t.Errorf("different request: err = %v, want IDEMPOTENCY_KEY_REUSED", err)
+	}
+}
+
+func TestReserveIdempotencyWithoutRedis(t *testing.T) {
+	_, rdb := testRedis(t)
+	rdb.Close()
+	key := idempotencyRedisKey("key-1")
+	if _, _, err := idempotencyHandler(rdb, false).reserveIdempotency(context.Background(), key, "fp"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Errorf("fail closed: err = %v, want REDIS_UNAVAILABLE", err)
+	}
+	replay, release, err := idempotencyHandler(rdb, true).reserveIdempotency(context.Background(), key, "fp")
+	if err != nil || replay != nil || release == nil {
+		t.Errorf("fail open: %s, %v, want to proceed on idempotency_keys alone", replay, err)
+	}
+}
+
+func TestCheckoutIdempotencyKey(t *testing.T) {
+	req := CheckoutRequest{PaymentRef: "pay-1"}
+	if got := checkoutIdempotencyKey("idem-1", req); got != "idem-1" {
+		t.Errorf("with the header: key = %q, want idem-1", got)
+	}
+	if got := checkoutIdempotencyKey("", req); got != "pay-1" {
+		t.Errorf("without it: key = %q, want the paymentRef", got)
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	const a, b = "AAAAAAAA-0000-0000-0000-000000000001", "bbbbbbbb-0000-0000-0000-000000000002"
+	base := CheckoutRequest{
+		UserID: testUserID, PaymentRef: "pay-1", ShippingMethod: "standard",
+		Items: []CheckoutItem{{ProductID: a, Qty: 1}, {ProductID: b, Qty: 2}},
+	}
+	fp := requestFingerprint(base)
+
+	retry := base
+	retry.PaymentRef = "pay-2"
+	retry.Items = []CheckoutItem{{ProductID: b, Qty: 2}, {ProductID: strings.ToLower(a), Qty: 1}}
+	if requestFingerprint(retry) != fp {
+		t.Error("a retry under a new paymentRef, items reordered and recased, looks different")
+	}
+	for name, change := range map[string]func(*CheckoutRequest){
+		"qty":      func(r *CheckoutRequest) { r.Items = []CheckoutItem{{ProductID: a, Qty: 3}, {ProductID: b, Qty: 2}} },
+		"coupon":   func(r *CheckoutRequest) { r.Coupon = "SAVE10" },
+		"shipping": func(r *CheckoutRequest) { r.ShippingMethod = "express" },
+		"cart":     func(r *CheckoutRequest) { r.CartID = testUserID },
+	} {
+		other := base
+		change(&other)
+		if requestFingerprint(other) == fp {
+			t.Errorf("changing the %s kept the fingerprint", name)
+		}
+	}
+}
+
+func TestCheckoutReplaysByIdempotencyKey(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "IDEM", 5, 10)
+	checkout := func(paymentRef string, qty int) (*http.Response, []byte) {
+		req := newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+			UserID: user, PaymentRef: paymentRef,
+			Items: []CheckoutItem{{ProductID: product, Qty: qty}},
+		})
+		req.Header.Set(headerIdempotencyKey, "idem-"+user)
+		return send(t, app, req)
+	}
+
+	resp, first := checkout("pay-1", 2)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerIdempotentReplay) != "" {
+		t.Fatalf("first: got %d %s", resp.StatusCode, first)
+	}
+	// The provider retries under a new paymentRef: Redis answers
+	resp, body := checkout("pay-2", 2)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerIdempotentReplay) != "true" || string(body) != string(first) {
+		t.Errorf("Redis hit: got %d replay %q %s, want the first response", resp.StatusCode, resp.Header.Get(headerIdempotentReplay), body)
+	}
+	// And after a flush, idempotency_keys does
+	mr.FlushAll()
+	resp, body = checkout("pay-3", 2)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerIdempotentReplay) != "true" || string(body) != string(first) {
+		t.Errorf("after a flush: got %d replay %q %s, want the first response", resp.StatusCode, resp.Header.Get(headerIdempotentReplay), body)
+	}
+	resp, body = checkout("pay-4", 3)
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusUnprocessableEntity || e["code"] != "IDEMPOTENCY_KEY_REUSED" {
+		t.Errorf("another body: got %d %s, want 422 IDEMPOTENCY_KEY_REUSED", resp.StatusCode, body)
+	}
+
+	var orders int
+	if err := db.Primary().QueryRow(context.Background(), `SELECT count(*) FROM orders WHERE user_id = $1`, user).Scan(&orders); err != nil || orders != 1 {
+		t.Errorf("orders = %d, %v, want 1", orders, err)
+	}
+}
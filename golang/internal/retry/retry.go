@@ -0,0 +1,221 @@
+// Package retry is the one place the service implements backoff. Every call
+// site that needs to retry (startup connections, serialization failures,
+// Redis commands, outbound deliveries) goes through Do or DoIdempotent so the
+// jitter, caps and metrics stay consistent.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	attemptsHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "retry_attempts",
+		Help:    "Attempts made per retried call, labelled by call site.",
+		Buckets: []float64{1, 2, 3, 4, 5, 7, 10, 15, 20},
+	}, []string{"call_site"})
+
+	giveUpsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_give_ups_total",
+		Help: "Calls that exhausted their retry policy, labelled by call site.",
+	}, []string{"call_site"})
+)
+
+// Clock abstracts time so tests can drive the backoff deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Policy bounds a retried call. Zero values fall back to the defaults noted
+// on each field.
+type Policy struct {
+	// Name labels the call site in metrics and error messages.
+	Name string
+	// MaxAttempts caps the total number of calls to fn (default 5).
+	MaxAttempts int
+	// BaseDelay is the backoff before the second attempt (default 100ms).
+	BaseDelay time.Duration
+	// MaxDelay caps a single backoff interval (default 5s).
+	MaxDelay time.Duration
+	// MaxElapsed caps the total time spent, including backoff. Zero means
+	// only MaxAttempts applies.
+	MaxElapsed time.Duration
+	// Retryable classifies errors. Nil treats every error as retryable
+	// except those wrapped with Permanent and context cancellation.
+	Retryable func(error) bool
+	// Unsent reports whether an error guarantees the operation never reached
+	// the remote side (e.g. pgconn.SafeToRetry). Do consults it in addition
+	// to errors wrapped with Unsent.
+	Unsent func(error) bool
+	// OnRetry is called before each backoff sleep, typically for logging.
+	OnRetry func(attempt int, err error, delay time.Duration)
+	// Clock and Jitter are injection points for tests. Jitter returns a
+	// value in [0, max].
+	Clock  Clock
+	Jitter func(max time.Duration) time.Duration
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.Name == "" {
+		p.Name = "unnamed"
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 100 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 5 * time.Second
+	}
+	if p.Clock == nil {
+		p.Clock = realClock{}
+	}
+	if p.Jitter == nil {
+		p.Jitter = func(max time.Duration) time.Duration {
+			return time.Duration(rand.Int64N(int64(max) + 1))
+		}
+	}
+	return p
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying under any policy.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type unsentError struct{ err error }
+
+func (e *unsentError) Error() string { return e.err.Error() }
+func (e *unsentError) Unwrap() error { return e.err }
+
+// Unsent marks err as having failed before the operation could take effect,
+// which makes it safe for Do to retry a non-idempotent operation.
+func Unsent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &unsentError{err: err}
+}
+
+// Do retries fn for operations that are NOT idempotent — inserts, payments,
+// anything where running twice is observable. An error is only retried when
+// it is retryable and provably unsent (wrapped with Unsent or accepted by
+// Policy.Unsent); anything that may already have been applied is returned
+// immediately.
+func Do(ctx context.Context, p Policy, fn func(ctx context.Context) error) error {
+	p = p.withDefaults()
+	return run(ctx, p, fn, func(err error) bool {
+		var u *unsentError
+		if errors.As(err, &u) {
+			return true
+		}
+		return p.Unsent != nil && p.Unsent(err)
+	})
+}
+
+// DoIdempotent retries fn on any retryable error. fn MUST be safe to execute
+// more than once with the same effect: reads, pings, SET with a fixed value,
+// deliveries that carry an idempotency id.
+func DoIdempotent(
+	ctx context.Context,
+	p Policy,
+	fn func(ctx context.Context) error,
+) error {
+	p = p.withDefaults()
+	return run(ctx, p, fn, func(error) bool { return true })
+}
+
+func run(
+	ctx context.Context,
+	p Policy,
+	fn func(ctx context.Context) error,
+	safe func(error) bool,
+) error {
+	start := p.Clock.Now()
+	attempt := 0
+	for {
+		attempt++
+		err := fn(ctx)
+		if err == nil {
+			attemptsHistogram.WithLabelValues(p.Name).Observe(float64(attempt))
+			return nil
+		}
+		if !p.retryable(err) || !safe(err) {
+			attemptsHistogram.WithLabelValues(p.Name).Observe(float64(attempt))
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return p.giveUp(attempt, err)
+		}
+
+		delay := p.Jitter(p.backoff(attempt))
+		if p.MaxElapsed > 0 && p.Clock.Now().Sub(start)+delay > p.MaxElapsed {
+			return p.giveUp(attempt, err)
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			giveUpsCounter.WithLabelValues(p.Name).Inc()
+			attemptsHistogram.WithLabelValues(p.Name).Observe(float64(attempt))
+			return fmt.Errorf("%s: %w (last error: %v)", p.Name, ctx.Err(), err)
+		case <-p.Clock.After(delay):
+		}
+	}
+}
+
+func (p Policy) retryable(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// backoff returns the exponential ceiling for the given attempt; the actual
+// sleep is a uniformly random value below it (full jitter).
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return d
+}
+
+func (p Policy) giveUp(attempt int, err error) error {
+	giveUpsCounter.WithLabelValues(p.Name).Inc()
+	attemptsHistogram.WithLabelValues(p.Name).Observe(float64(attempt))
+	return fmt.Errorf("%s: giving up after %d attempts: %w", p.Name, attempt, err)
+}
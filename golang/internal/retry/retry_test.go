@@ -0,0 +1,291 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock advances by exactly the requested delay on every After, so a
+// test sees the backoff schedule without sleeping
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// ceiling makes the jitter deterministic: always the full backoff
+func ceiling(max time.Duration) time.Duration { return max }
+
+// failing returns an fn that fails n times with err and then succeeds,
+// counting its calls in calls
+func failing(n int, err error, calls *int) func(context.Context) error {
+	return func(context.Context) error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+var errFlaky = errors.New("flaky")
+
+func TestDoIdempotentBacksOffExponentially(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	err := DoIdempotent(context.Background(), Policy{
+		Name:        "test",
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Clock:       clock,
+		Jitter:      ceiling,
+	}, failing(4, errFlaky, &calls))
+	if err != nil {
+		t.Fatalf("DoIdempotent = %v, want success on the fifth attempt", err)
+	}
+	if calls != 5 {
+		t.Errorf("calls = %d, want 5", calls)
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+	if !slices.Equal(clock.delays, want) {
+		t.Errorf("delays = %v, want %v", clock.delays, want)
+	}
+}
+
+func TestBackoffIsCappedByMaxDelay(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	_ = DoIdempotent(context.Background(), Policy{
+		MaxAttempts: 6,
+		BaseDelay:   time.Second,
+		MaxDelay:    3 * time.Second,
+		Clock:       clock,
+		Jitter:      ceiling,
+	}, failing(5, errFlaky, &calls))
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second, 3 * time.Second}
+	if !slices.Equal(clock.delays, want) {
+		t.Errorf("delays = %v, want %v", clock.delays, want)
+	}
+}
+
+func TestJitterIsAskedForTheFullCeiling(t *testing.T) {
+	clock := newFakeClock()
+	var asked []time.Duration
+	calls := 0
+	_ = DoIdempotent(context.Background(), Policy{
+		MaxAttempts: 3,
+		BaseDelay:   50 * time.Millisecond,
+		Clock:       clock,
+		Jitter: func(max time.Duration) time.Duration {
+			asked = append(asked, max)
+			return max / 2
+		},
+	}, failing(2, errFlaky, &calls))
+	if want := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}; !slices.Equal(asked, want) {
+		t.Errorf("jitter ceilings = %v, want %v", asked, want)
+	}
+	if want := []time.Duration{25 * time.Millisecond, 50 * time.Millisecond}; !slices.Equal(clock.delays, want) {
+		t.Errorf("slept %v, want the jittered %v", clock.delays, want)
+	}
+}
+
+func TestDefaultJitterStaysWithinCeiling(t *testing.T) {
+	p := Policy{}.withDefaults()
+	for i := 0; i < 1000; i++ {
+		if d := p.Jitter(time.Second); d < 0 || d > time.Second {
+			t.Fatalf("jitter = %s, want within [0, 1s]", d)
+		}
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	err := DoIdempotent(context.Background(), Policy{
+		Name:        "ping",
+		MaxAttempts: 3,
+		Clock:       clock,
+		Jitter:      ceiling,
+	}, failing(10, errFlaky, &calls))
+	if !errors.Is(err, errFlaky) {
+		t.Fatalf("err = %v, want it to wrap the last error", err)
+	}
+	if !strings.Contains(err.Error(), "ping: giving up after 3 attempts") {
+		t.Errorf("err = %q, want it to name the call site and attempts", err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+	if len(clock.delays) != 2 {
+		t.Errorf("slept %d times, want 2", len(clock.delays))
+	}
+}
+
+func TestGivesUpWhenTheNextSleepPassesMaxElapsed(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	err := DoIdempotent(context.Background(), Policy{
+		MaxAttempts: 100,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		MaxElapsed:  5 * time.Second,
+		Clock:       clock,
+		Jitter:      ceiling,
+	}, failing(100, errFlaky, &calls))
+	if !errors.Is(err, errFlaky) {
+		t.Fatalf("err = %v, want the last error", err)
+	}
+	// 1s + 2s fit in 5s; the next 4s sleep would not
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+	if elapsed := clock.now.Sub(newFakeClock().now); elapsed > 5*time.Second {
+		t.Errorf("elapsed %s, want no more than MaxElapsed", elapsed)
+	}
+}
+
+func TestDoOnlyRetriesUnsentErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		unsent    func(error) bool
+		wantCalls int
+	}{
+		{name: "maybe applied", err: errFlaky, wantCalls: 1},
+		{name: "wrapped with Unsent", err: Unsent(errFlaky), wantCalls: 3},
+		{name: "accepted by Policy.Unsent", err: errFlaky, unsent: func(err error) bool { return errors.Is(err, errFlaky) }, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), Policy{
+				MaxAttempts: 5,
+				Unsent:      tt.unsent,
+				Clock:       newFakeClock(),
+				Jitter:      ceiling,
+			}, failing(2, tt.err, &calls))
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantCalls == 1 && !errors.Is(err, errFlaky) {
+				t.Errorf("err = %v, want the first error returned as is", err)
+			}
+			if tt.wantCalls > 1 && err != nil {
+				t.Errorf("err = %v, want success after retrying", err)
+			}
+		})
+	}
+}
+
+func TestDoesNotRetryPermanentOrContextErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "permanent", err: Permanent(errFlaky)},
+		{name: "canceled", err: context.Canceled},
+		{name: "deadline", err: context.DeadlineExceeded},
+		{name: "wrapped deadline", err: errors.Join(errFlaky, context.DeadlineExceeded)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := DoIdempotent(context.Background(), Policy{
+				Clock:  newFakeClock(),
+				Jitter: ceiling,
+			}, failing(10, tt.err, &calls))
+			if calls != 1 {
+				t.Errorf("calls = %d, want 1", calls)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRetryableClassifiesErrors(t *testing.T) {
+	errFatal := errors.New("fatal")
+	calls := 0
+	err := DoIdempotent(context.Background(), Policy{
+		Retryable: func(err error) bool { return errors.Is(err, errFlaky) },
+		Clock:     newFakeClock(),
+		Jitter:    ceiling,
+	}, func(context.Context) error {
+		calls++
+		if calls == 1 {
+			return errFlaky
+		}
+		return errFatal
+	})
+	if !errors.Is(err, errFatal) || calls != 2 {
+		t.Errorf("err = %v after %d calls, want fatal after 2", err, calls)
+	}
+}
+
+func TestOnRetryIsCalledBeforeEachSleep(t *testing.T) {
+	type retried struct {
+		attempt int
+		delay   time.Duration
+	}
+	var got []retried
+	calls := 0
+	_ = DoIdempotent(context.Background(), Policy{
+		MaxAttempts: 3,
+		BaseDelay:   10 * time.Millisecond,
+		Clock:       newFakeClock(),
+		Jitter:      ceiling,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			got = append(got, retried{attempt, delay})
+		},
+	}, failing(5, errFlaky, &calls))
+	want := []retried{{1, 10 * time.Millisecond}, {2, 20 * time.Millisecond}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("OnRetry calls = %v, want %v", got, want)
+	}
+}
+
+// blockingClock never fires, so only the context can end the sleep
+type blockingClock struct{ fakeClock }
+
+func (c *blockingClock) After(time.Duration) <-chan time.Time { return make(chan time.Time) }
+
+func TestContextCancellationEndsTheBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := DoIdempotent(ctx, Policy{
+		Name:   "cancelled",
+		Clock:  &blockingClock{*newFakeClock()},
+		Jitter: ceiling,
+		OnRetry: func(int, error, time.Duration) {
+			cancel()
+		},
+	}, failing(10, errFlaky, &calls))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "flaky") {
+		t.Errorf("err = %q, want it to carry the last error", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
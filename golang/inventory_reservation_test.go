@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestReservationNeverOversells(t *testing.T) {
+	for _, strategy := range []string{"conditional", "locking"} {
+		t.Run(strategy, func(t *testing.T) {
+			db := testRouter(t)
+			_, rdb := testRedis(t)
+			app, h := checkoutApp(t, db, rdb)
+			h.cfg.ReservationStrategy = strategy
+			product := seedProduct(t, db, "HOT", 1, 5)
+			users := make([]string, 12)
+			for i := range users {
+				users[i] = seedUser(t, db, "pro", "active")
+			}
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			statuses := map[int]int{}
+			for _, user := range users {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := app.Test(newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+						UserID: user, PaymentRef: "pay-" + uuid.NewString(),
+						Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+					}), -1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					mu.Lock()
+					statuses[resp.StatusCode]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if statuses[fiber.StatusOK] != 5 || statuses[fiber.StatusConflict] != len(users)-5 {
+				t.Errorf("statuses = %v, want 5 placed and the rest 409", statuses)
+			}
+			if available, reserved := stock(t, db, product); available != 5 || reserved != 5 {
+				t.Errorf("stock = %d available, %d reserved, want 5 and 5", available, reserved)
+			}
+		})
+	}
+}
+
+func TestShortItemsAreListed(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	plenty := seedProduct(t, db, "PLENTY", 1, 10)
+	scarce := seedProduct(t, db, "SCARCE", 1, 1)
+
+	resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+		UserID: user, PaymentRef: "pay-" + uuid.NewString(),
+		Items: []CheckoutItem{{ProductID: plenty, Qty: 2}, {ProductID: scarce, Qty: 3}},
+	}))
+	e, _ := decode(t, body)["error"].(map[string]any)
+	if resp.StatusCode != fiber.StatusConflict || e["code"] != "INSUFFICIENT_INVENTORY" {
+		t.Fatalf("got %d %s, want 409 INSUFFICIENT_INVENTORY", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), scarce) || strings.Contains(string(body), plenty) {
+		t.Errorf("details = %v, want only the short product", e["details"])
+	}
+	// The plentiful item's reservation rolled back with the rest
+	if _, reserved := stock(t, db, plenty); reserved != 0 {
+		t.Errorf("reserved_qty = %d, want 0", reserved)
+	}
+}
+
+func TestShortfallError(t *testing.T) {
+	short := newShortfall(CartItemDB{ProductID: strings.ToUpper(testUserID), Qty: 3}, 1, true)
+	unstocked := newShortfall(CartItemDB{ProductID: testUserID, Qty: 2}, -4, false)
+	if short != (InventoryShortfall{testUserID, "INSUFFICIENT_INVENTORY", 3, 1}) {
+		t.Errorf("short = %+v", short)
+	}
+	if unstocked != (InventoryShortfall{testUserID, "NOT_STOCKED", 2, 0}) {
+		t.Errorf("unstocked = %+v", unstocked)
+	}
+	for _, tt := range []struct {
+		shortfalls []InventoryShortfall
+		code       string
+	}{
+		{[]InventoryShortfall{short}, "INSUFFICIENT_INVENTORY"},
+		{[]InventoryShortfall{unstocked, unstocked}, "NOT_STOCKED"},
+		{[]InventoryShortfall{unstocked, short}, "INSUFFICIENT_INVENTORY"},
+	} {
+		status, body := errorBody(shortfallError(tt.shortfalls))
+		if status != fiber.StatusConflict || body["code"] != tt.code || len(body["details"].([]InventoryShortfall)) != len(tt.shortfalls) {
+			t.Errorf("%v: got %d %v, want 409 %s listing each", tt.shortfalls, status, body, tt.code)
+		}
+	}
+}
+
+func TestEveryShortfallIsListed(t *testing.T) {
+	for _, strategy := range []string{"conditional", "locking"} {
+		t.Run(strategy, func(t *testing.T) {
+			db := testRouter(t)
+			_, rdb := testRedis(t)
+			app, h := checkoutApp(t, db, rdb)
+			h.cfg.ReservationStrategy = strategy
+			user := seedUser(t, db, "pro", "active")
+			plenty := seedProduct(t, db, "PLENTY", 1, 10)
+			scarce := seedProduct(t, db, "SCARCE", 1, 1)
+			unstocked := seedProduct(t, db, "UNSTOCKED", 1, 0)
+			mustExec(t, db, `DELETE FROM inventory WHERE product_id = $1`, unstocked)
+
+			resp, body := send(t, app, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+				UserID: user, PaymentRef: "pay-" + uuid.NewString(),
+				Items: []CheckoutItem{{ProductID: unstocked, Qty: 1}, {ProductID: plenty, Qty: 2}, {ProductID: scarce, Qty: 3}},
+			}))
+			e, _ := decode(t, body)["error"].(map[string]any)
+			if resp.StatusCode != fiber.StatusConflict || e["code"] != "INSUFFICIENT_INVENTORY" {
+				t.Fatalf("got %d %s, want 409 INSUFFICIENT_INVENTORY", resp.StatusCode, body)
+			}
+			got := map[string]string{}
+			for _, d := range e["details"].([]any) {
+				d := d.(map[string]any)
+				got[d["productId"].(string)] = fmt.Sprintf("%s %v/%v", d["code"], d["availableQty"], d["requestedQty"])
+			}
+			want := map[string]string{
+				scarce:    "INSUFFICIENT_INVENTORY 1/3",
+				unstocked: "NOT_STOCKED 0/1",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("shortfalls = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	gojson "github.com/goccy/go-json"
+)
+
+// jsonMarshal and jsonUnmarshal back Fiber's c.JSON and the rendered
+// overview and catalog payloads. JSON_ENCODER swaps them at startup so
+// encoding/json and goccy/go-json can be compared on the same build.
+var (
+	jsonMarshal   func(v any) ([]byte, error)    = json.Marshal
+	jsonUnmarshal func(data []byte, v any) error = json.Unmarshal
+)
+
+// useJSONEncoder selects the encoder by its JSON_ENCODER name. It must run
+// before the server starts.
+func useJSONEncoder(name string) {
+	switch name {
+	case "goccy":
+		jsonMarshal, jsonUnmarshal = gojson.Marshal, gojson.Unmarshal
+	default:
+		jsonMarshal, jsonUnmarshal = json.Marshal, json.Unmarshal
+	}
+}
+
+// payloadString reads a string field straight out of an encoded payload,
+// at any depth, so a cache hit can report it without decoding the body.
+// Only for fields that occur once and whose values never need escaping.
+func payloadString(payload []byte, field string) string {
+	key := []byte(`"` + field + `":"`)
+	i := bytes.Index(payload, key)
+	if i < 0 {
+		return ""
+	}
+	rest := payload[i+len(key):]
+	end := bytes.IndexByte(rest, '"')
+	if end < 0 {
+		return ""
+	}
+	return string(rest[:end])
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestPayloadString(t *testing.T) {
+	payload, err := jsonMarshal(mapOverviewV1(overviewFixture()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload string
+		field   string
+		want    string
+	}{
+		{string(payload), "user_segment", "basic"},
+		{string(payload), "plan", "pro"},
+		{`{"derived":{"user_segment":""}}`, "user_segment", ""},
+		{`{"user_segment":null}`, "user_segment", ""},
+		{`{"user_segment":"trunc`, "user_segment", ""},
+		{`{}`, "user_segment", ""},
+	}
+	for _, tt := range tests {
+		if got := payloadString([]byte(tt.payload), tt.field); got != tt.want {
+			t.Errorf("payloadString(%.40s…, %q) = %q, want %q", tt.payload, tt.field, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkOverviewEncode(b *testing.B) {
+	ov := overviewFixture()
+	for i := range 100 {
+		ov.Products = append(ov.Products, Product{ID: ov.User.ID, SKU: "SKU-" + string(rune('A'+i%26)), Price: 9.99, Available: i})
+	}
+	for _, name := range []string{"stdlib", "goccy"} {
+		b.Run(name, func(b *testing.B) {
+			useJSONEncoder(name)
+			b.Cleanup(func() { useJSONEncoder("stdlib") })
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := jsonMarshal(mapOverviewV1(ov)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+const (
+	// topBuyersKey ranks users by their all-time spend
+	topBuyersKey = "leaderboard:top_buyers"
+	// topBuyersDayRetention is how long a day's leaderboard is kept after
+	// the day ends, enough for any window the endpoint offers
+	topBuyersDayRetention = 40 * 24 * time.Hour
+	// topBuyersUnionTTL is how long a merged multi-day leaderboard is
+	// reused, and so how far behind a 7d window may be
+	topBuyersUnionTTL = 30 * time.Second
+)
+
+// topBuyersDayKey ranks users by what they spent on day (UTC)
+func topBuyersDayKey(day time.Time) string {
+	return topBuyersKey + ":" + day.UTC().Format(time.DateOnly)
+}
+
+// queueTopBuyer adds amount, negative to take an order back, to userID's
+// all-time spend and to their spend on the day the order was placed. A
+// day past its retention at now is left alone rather than recreated.
+func queueTopBuyer(ctx context.Context, pipe redis.Pipeliner, userID string, amount Cents, placed, now time.Time) {
+	pipe.ZIncrBy(ctx, topBuyersKey, amount.Dollars(), userID)
+	expireAt := placed.UTC().Truncate(24 * time.Hour).Add(24*time.Hour + topBuyersDayRetention)
+	if now.Before(expireAt) {
+		key := topBuyersDayKey(placed)
+		pipe.ZIncrBy(ctx, key, amount.Dollars(), userID)
+		pipe.ExpireAt(ctx, key, expireAt)
+	}
+}
+
+// TopBuyer is one leaderboard entry. Plan and Region are filled in on
+// request.
+type TopBuyer struct {
+	Rank       int     `json:"rank"`
+	UserID     string  `json:"userId"`
+	TotalSpend float64 `json:"totalSpend"`
+	Plan       string  `json:"plan,omitempty"`
+	Region     string  `json:"region,omitempty"`
+}
+
+// Leaderboard serves the top buyers checkout ranks in Redis
+type Leaderboard struct {
+	db    *DBRouter
+	rdb   *redis.Client
+	cache config.CacheConfig
+	ttl   ttlPolicy
+	// now picks the day the today and 7d windows end on; time.Now outside
+	// of tests
+	now func() time.Time
+}
+
+func NewLeaderboard(db *DBRouter, rdb *redis.Client, cache config.CacheConfig) *Leaderboard {
+	return &Leaderboard{db: db, rdb: rdb, cache: cache, ttl: newTTLPolicy(cache.TTLJitter), now: time.Now}
+}
+
+// TopBuyers returns the limit biggest spenders over window: all (all
+// time), today or 7d (the last seven UTC days, today included)
+func (l *Leaderboard) TopBuyers(ctx context.Context, window string, limit int, now time.Time) ([]TopBuyer, error) {
+	key := topBuyersKey
+	switch window {
+	case "today":
+		key = topBuyersDayKey(now)
+	case "7d":
+		var err error
+		if key, err = l.mergeDays(ctx, now, 7); err != nil {
+			return nil, err
+		}
+	}
+	ranked, err := l.rdb.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	buyers := make([]TopBuyer, len(ranked))
+	for i, z := range ranked {
+		buyers[i] = TopBuyer{
+			Rank:   i + 1,
+			UserID: z.Member.(string),
+			// Scores are float sums; round away the drift
+			TotalSpend: math.Round(z.Score*100) / 100,
+		}
+	}
+	return buyers, nil
+}
+
+// mergeDays returns a key holding the union of the days days ending at
+// now, summing each user's spend. The union is built with ZUNIONSTORE at
+// most once per topBuyersUnionTTL and reused in between.
+func (l *Leaderboard) mergeDays(ctx context.Context, now time.Time, days int) (string, error) {
+	dest := fmt.Sprintf("%s:%dd:%s", topBuyersKey, days, now.UTC().Format(time.DateOnly))
+	exists, err := l.rdb.Exists(ctx, dest).Result()
+	if err != nil || exists == 1 {
+		return dest, err
+	}
+	keys := make([]string, days)
+	for i := range days {
+		keys[i] = topBuyersDayKey(now.AddDate(0, 0, -i))
+	}
+	_, err = l.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZUnionStore(ctx, dest, &redis.ZStore{Keys: keys, Aggregate: "SUM"})
+		pipe.Expire(ctx, dest, topBuyersUnionTTL)
+		return nil
+	})
+	return dest, err
+}
+
+// enrich fills in each buyer's plan and region from the user cache the
+// overview keeps, loading the misses in one query and caching them
+func (l *Leaderboard) enrich(ctx context.Context, buyers []TopBuyer) error {
+	if len(buyers) == 0 {
+		return nil
+	}
+	keys := make([]string, len(buyers))
+	for i, b := range buyers {
+		keys[i] = userCacheKey(b.UserID)
+	}
+	cached, err := l.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		// Load everyone from Postgres instead
+		cached = make([]any, len(keys))
+	}
+	// Keyed by lowercased id, as Postgres spells them
+	var missing []string
+	byID := make(map[string]User, len(buyers))
+	for i, b := range buyers {
+		var user User
+		if raw, ok := cached[i].(string); ok && json.Unmarshal([]byte(raw), &user) == nil {
+			byID[strings.ToLower(b.UserID)] = user
+		} else {
+			missing = append(missing, b.UserID)
+		}
+	}
+
+	if len(missing) > 0 {
+		rows, err := l.db.Read().Query(ctx, `
+			SELECT id::text, plan, region, status FROM users
+			WHERE id = ANY($1::text[]::uuid[])`, missing)
+		if err != nil {
+			return dbError("load leaderboard users", err)
+		}
+		defer rows.Close()
+		pipe := l.rdb.Pipeline()
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(&user.ID, &user.Plan, &user.Region, &user.Status); err != nil {
+				return err
+			}
+			byID[user.ID] = user
+			data, _ := json.Marshal(user)
+			pipe.SetEx(ctx, userCacheKey(user.ID), data, l.ttl.TTL(l.cache.UserTTL))
+		}
+		if err := rows.Err(); err != nil {
+			return dbError("load leaderboard users", err)
+		}
+		pipe.Exec(ctx)
+	}
+
+	for i, b := range buyers {
+		user := byID[strings.ToLower(b.UserID)]
+		buyers[i].Plan, buyers[i].Region = user.Plan, user.Region
+	}
+	return nil
+}
+
+// Handler serves GET /v1/leaderboard/top-buyers?limit=&window=&enrich=
+func (l *Leaderboard) Handler(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	limit := p.Int("limit", 10, 100)
+	window := p.OneOf("window", "all", "all", "today", "7d")
+	enrich := p.Bool("enrich", false)
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	ctx := c.UserContext()
+	buyers, err := l.TopBuyers(ctx, window, limit, l.now())
+	if err != nil {
+		return writeError(c, ErrRedisUnavailable.With(err))
+	}
+	if enrich {
+		if err := l.enrich(ctx, buyers); err != nil {
+			return writeError(c, err)
+		}
+	}
+	return c.JSON(fiber.Map{
+		"window": window,
+		"limit":  limit,
+		"buyers": buyers,
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	buyerA = "00000000-0000-4000-8000-00000000000a"
+	buyerB = "00000000-0000-4000-8000-00000000000b"
+	buyerC = "00000000-0000-4000-8000-00000000000c"
+)
+
+// spend queues the orders placed at each time, as checkout does at now
+func spend(t *testing.T, rdb *redis.Client, now time.Time, userID string, amount Cents, placed ...time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, at := range placed {
+			queueTopBuyer(ctx, pipe, userID, amount, at, now)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ranking returns the buyers' ids in rank order
+func ranking(t *testing.T, buyers []TopBuyer) []string {
+	t.Helper()
+	ids := make([]string, len(buyers))
+	for i, b := range buyers {
+		if b.Rank != i+1 {
+			t.Errorf("%s at position %d has rank %d", b.UserID, i+1, b.Rank)
+		}
+		ids[i] = b.UserID
+	}
+	return ids
+}
+
+func TestTopBuyersRanking(t *testing.T) {
+	_, rdb := testRedis(t)
+	l := NewLeaderboard(nil, rdb, testConfig(t).Cache)
+	now := time.Now()
+	spend(t, rdb, now, buyerA, 10, now, now, now) // 0.30000000000000004 in floats
+	spend(t, rdb, now, buyerB, 5000, now)
+	spend(t, rdb, now, buyerC, 2000, now, now)
+	spend(t, rdb, now, buyerB, -4500, now) // a cancellation takes its order back
+
+	buyers, err := l.TopBuyers(context.Background(), "all", 10, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ranking(t, buyers); len(got) != 3 || got[0] != buyerC || got[1] != buyerB || got[2] != buyerA {
+		t.Errorf("ranking = %v, want C, B, A", got)
+	}
+	if buyers[0].TotalSpend != 40 || buyers[1].TotalSpend != 5 || buyers[2].TotalSpend != 0.3 {
+		t.Errorf("spend = %v, %v, %v, want 40, 5, 0.3", buyers[0].TotalSpend, buyers[1].TotalSpend, buyers[2].TotalSpend)
+	}
+	if top, _ := l.TopBuyers(context.Background(), "all", 1, now); len(top) != 1 || top[0].UserID != buyerC {
+		t.Errorf("limit 1 = %v, want C alone", top)
+	}
+}
+
+func TestTopBuyersWindows(t *testing.T) {
+	mr, rdb := testRedis(t)
+	l := NewLeaderboard(nil, rdb, testConfig(t).Cache)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	day := 24 * time.Hour
+	spend(t, rdb, now, buyerA, 1000, now)
+	spend(t, rdb, now, buyerB, 3000, now.Add(-3*day))
+	spend(t, rdb, now, buyerB, 500, now.Add(-6*day))
+	spend(t, rdb, now, buyerC, 10000, now.Add(-10*day))
+	spend(t, rdb, now, buyerC, 100, now.Add(-50*day)) // past the day's retention
+
+	for _, tt := range []struct {
+		window string
+		want   []string
+		spend  []float64
+	}{
+		{"all", []string{buyerC, buyerB, buyerA}, []float64{101, 35, 10}},
+		{"today", []string{buyerA}, []float64{10}},
+		{"7d", []string{buyerB, buyerA}, []float64{35, 10}},
+	} {
+		buyers, err := l.TopBuyers(ctx, tt.window, 10, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ranking(t, buyers)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: ranking = %v, want %v", tt.window, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] || buyers[i].TotalSpend != tt.spend[i] {
+				t.Errorf("%s: %d: %s with %v, want %s with %v", tt.window, i+1, got[i], buyers[i].TotalSpend, tt.want[i], tt.spend[i])
+			}
+		}
+	}
+	if mr.Exists(topBuyersDayKey(now.Add(-50 * day))) {
+		t.Error("a day past its retention was recreated")
+	}
+	if ttl := mr.TTL(topBuyersDayKey(now)); ttl < topBuyersDayRetention || ttl > topBuyersDayRetention+day {
+		t.Errorf("today's TTL = %s, want the day plus its retention", ttl)
+	}
+
+	// The merged week is reused until it expires
+	spend(t, rdb, now, buyerA, 5000, now)
+	if buyers, _ := l.TopBuyers(ctx, "7d", 10, now); buyers[0].UserID != buyerB {
+		t.Errorf("7d leader = %s within the union's TTL, want the cached B", buyers[0].UserID)
+	}
+	mr.FastForward(topBuyersUnionTTL)
+	if buyers, _ := l.TopBuyers(ctx, "7d", 10, now); buyers[0].UserID != buyerA || buyers[0].TotalSpend != 60 {
+		t.Errorf("7d leader = %+v after the TTL, want A with 60", buyers[0])
+	}
+}
+
+func TestCheckoutAndCancelDateTheLeaderboardByTheHandlerClock(t *testing.T) {
+	mr, rdb := testRedis(t)
+	cfg := testConfig(t)
+	placed := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	mr.SetTime(placed)
+	h := &CheckoutHandler{
+		rdb:       rdb,
+		summaries: newSummaryInvalidator(rdb, cfg.Cache),
+		segments:  newSegmentStore(rdb, cfg.Segment, newSegmentRules(nil, cfg.Segment)),
+		now:       func() time.Time { return placed },
+	}
+	ctx := context.Background()
+	day := topBuyersDayKey(placed)
+
+	if err := h.postCommitRedisOps(ctx, buyerA, "order-1", 1999); err != nil {
+		t.Fatal(err)
+	}
+	if score, err := mr.ZScore(day, buyerA); err != nil || score != 19.99 {
+		t.Errorf("%s: score = %v, %v, want 19.99", day, score, err)
+	}
+	if mr.Exists(topBuyersDayKey(time.Now())) {
+		t.Error("the order was counted on the wall clock's day")
+	}
+
+	// Two days on, the cancellation takes it back off the day it was placed
+	h.now = func() time.Time { return placed.Add(48 * time.Hour) }
+	if err := h.postCancelRedisOps(ctx, buyerA, "order-1", 1999, placed); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{day, topBuyersKey} {
+		if score, _ := mr.ZScore(key, buyerA); score != 0 {
+			t.Errorf("%s: score = %v after the cancellation, want 0", key, score)
+		}
+	}
+}
+
+func TestLeaderboardHandler(t *testing.T) {
+	mr, rdb := testRedis(t)
+	l := NewLeaderboard(nil, rdb, testConfig(t).Cache)
+	app := fiber.New()
+	app.Get("/v1/leaderboard/top-buyers", l.Handler)
+	// The last second of a UTC day, so the clock decides what today is
+	now := time.Date(2024, 6, 1, 23, 59, 59, 0, time.UTC)
+	mr.SetTime(now)
+	l.now = func() time.Time { return now }
+	spend(t, rdb, now, buyerA, 1000, now)
+	spend(t, rdb, now, buyerB, 2000, now)
+	spend(t, rdb, now, buyerC, 5000, now.Add(time.Second))
+	// Both users are cached, so enriching needs no query
+	for id, user := range map[string]User{
+		buyerA: {ID: buyerA, Plan: "free", Region: "us-east", Status: "active"},
+		buyerB: {ID: buyerB, Plan: "enterprise", Region: "eu-west", Status: "active"},
+	} {
+		raw, _ := json.Marshal(user)
+		mr.Set(userCacheKey(id), string(raw))
+	}
+
+	resp, body := send(t, app, newRequest(http.MethodGet, "/v1/leaderboard/top-buyers?limit=5&window=today&enrich=true", nil))
+	got := decode(t, body)
+	buyers, _ := got["buyers"].([]any)
+	if resp.StatusCode != fiber.StatusOK || got["window"] != "today" || got["limit"] != 5.0 || len(buyers) != 2 {
+		t.Fatalf("got %d %s", resp.StatusCode, body)
+	}
+	first := buyers[0].(map[string]any)
+	if first["userId"] != buyerB || first["rank"] != 1.0 || first["plan"] != "enterprise" || first["region"] != "eu-west" {
+		t.Errorf("first = %v, want B enriched from the user cache", first)
+	}
+	if resp, body := send(t, app, newRequest(http.MethodGet, "/v1/leaderboard/top-buyers", nil)); resp.StatusCode != fiber.StatusOK ||
+		decode(t, body)["window"] != "all" {
+		t.Errorf("defaults: got %d %s, want the all-time board", resp.StatusCode, body)
+	}
+	for _, query := range []string{"limit=0", "limit=101", "window=month", "enrich=maybe"} {
+		if resp, _ := send(t, app, newRequest(http.MethodGet, "/v1/leaderboard/top-buyers?"+query, nil)); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("?%s: status = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
@@ -5,93 +5,656 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+	"loastest-go/startup"
 )
 
 func main() {
-	// Database connection - support both DATABASE_URL and individual vars
-	dbURL := getEnv("DATABASE_URL", "")
-	if dbURL == "" {
-		dbHost := getEnv("DB_HOST", "localhost")
-		dbPort := getEnv("DB_PORT", "5434")
-		dbName := getEnv("DB_NAME", "loadtest")
-		dbUser := getEnv("DB_USER", "postgres")
-		dbPassword := getEnv("DB_PASSWORD", "postgres")
-		dbURL = fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
-			dbUser, dbPassword, dbHost, dbPort, dbName)
-	}
-
-	pool, err := pgxpool.New(context.Background(), dbURL)
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	// With PREFORK every child re-runs main and opens its own pools, so
+	// each gets a share of the configured sizes. The parent only supervises.
+	processes := 1
+	if cfg.Prefork {
+		processes = preforkChildren()
+		cfg.ShareAcross(processes)
+		if !fiber.IsChild() {
+			checkConnectionBudget(cfg, processes)
+			if err := runPreforkParent(processes); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	} else {
+		checkConnectionBudget(cfg, processes)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+	if tracingEnabled {
+		log.Println("🔭 OpenTelemetry tracing enabled")
+	}
+
+	version := newVersionInfo(cfg.Prefork, cfg.Pprof, tracingEnabled)
+	log.Printf("🏷️  commit=%s built=%s go=%s prefork=%t pprof=%t tracing=%t",
+		version.Commit, version.BuildTime, version.GoVersion,
+		version.Prefork, version.Pprof, version.Tracing)
+
+	// Database connection - DATABASE_URL wins over the individual DB_* vars
+	poolConfig, err := cfg.PoolConfig()
+	if err != nil {
+		log.Fatalf("Invalid database configuration: %v", err)
+	}
+	if tracingEnabled {
+		poolConfig.ConnConfig.Tracer = pgxTracer{}
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v", err)
 	}
 	defer pool.Close()
 
-	// Test connection
-	if err := pool.Ping(context.Background()); err != nil {
-		log.Fatalf("Unable to ping database: %v", err)
+	// Wait for Postgres; in compose it often starts after us
+	if err := startup.Wait(context.Background(), cfg.Startup, "PostgreSQL", pool.Ping); err != nil {
+		log.Fatalf("Unable to connect to database: %v", err)
 	}
 	log.Println("✅ PostgreSQL connected")
+	log.Printf("   pool: %s", config.DescribePool(poolConfig))
+	prometheus.MustRegister(newPoolCollector(pool, "primary"))
 
-	// Redis connection - support both REDIS_URL and individual vars
-	redisAddr := getEnv("REDIS_URL", "")
-	if redisAddr == "" {
-		redisHost := getEnv("REDIS_HOST", "localhost")
-		redisPort := getEnv("REDIS_PORT", "6381")
-		redisAddr = fmt.Sprintf("%s:%s", redisHost, redisPort)
+	// Optional read replica for the overview path. It is not waited for:
+	// until it answers, reads stay on the primary.
+	var replica *pgxpool.Pool
+	if cfg.ReplicaURL != "" {
+		replicaConfig, err := cfg.ReplicaPoolConfig()
+		if err != nil {
+			log.Fatalf("Invalid replica configuration: %v", err)
+		}
+		if tracingEnabled {
+			replicaConfig.ConnConfig.Tracer = pgxTracer{}
+		}
+		replica, err = pgxpool.NewWithConfig(context.Background(), replicaConfig)
+		if err != nil {
+			log.Fatalf("Unable to create replica pool: %v", err)
+		}
+		defer replica.Close()
+		prometheus.MustRegister(newPoolCollector(replica, "replica"))
+		log.Printf("   replica pool: %s", config.DescribePool(replicaConfig))
 	}
+	dbRouter := NewDBRouter(pool, replica)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	go dbRouter.Watch(watchCtx, cfg.DB.ReplicaCheckInterval, cfg.Timeouts.HealthProbe)
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		PoolSize: 20,
-	})
+	// Redis connection - REDIS_URL wins over REDIS_HOST/REDIS_PORT
+	redisOptions, err := cfg.RedisOptions()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	rdb := redis.NewClient(redisOptions)
 	defer rdb.Close()
+	if err := instrumentRedis(rdb); err != nil {
+		log.Fatalf("Unable to instrument Redis: %v", err)
+	}
 
-	// Test Redis connection
-	if err := rdb.Ping(context.Background()).Err(); err != nil {
+	// Wait for Redis
+	err = startup.Wait(context.Background(), cfg.Startup, "Redis", func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	})
+	if err != nil {
 		log.Fatalf("Unable to connect to Redis: %v", err)
 	}
 	log.Println("✅ Redis connected")
+	// Added after the startup wait so slow boots don't trip it
+	redisBreaker := NewRedisBreaker(cfg.RedisBreaker)
+	rdb.AddHook(redisBreaker.Hook())
+	log.Printf("   redis: %s", config.DescribeRedis(redisOptions))
+	if fiber.IsChild() {
+		log.Printf("👶 prefork child pid=%d of %d: db max_conns=%d redis pool_size=%d",
+			os.Getpid(), processes, poolConfig.MaxConns, redisOptions.PoolSize)
+	}
 
 	// Initialize handlers
-	userHandler := NewUserOverviewHandler(pool, rdb)
-	checkoutHandler := NewCheckoutHandler(pool, rdb)
+	availability := NewAvailabilityView(dbRouter, rdb, cfg.Availability)
+	if availability.Enabled() {
+		go availability.Run(watchCtx)
+	}
+	if sweeper := NewReservationSweeper(dbRouter, rdb, cfg.Reservations); sweeper.Enabled() {
+		go sweeper.Run(watchCtx)
+	}
+	outbox := NewOutboxRelay(dbRouter, rdb, cfg.Outbox)
+	if outbox.Enabled() {
+		go outbox.Run(watchCtx)
+	}
+	orderStream := NewOrderStreamConsumer(rdb, cfg.OrderStream)
+	if orderStream.Enabled() {
+		go orderStream.Run(watchCtx)
+	}
+	webhooks := NewWebhookDispatcher(dbRouter, rdb, cfg.Webhooks)
+	if webhooks.Enabled() {
+		webhooks.Start(watchCtx)
+	}
+	rules := newSegmentRules(dbRouter, cfg.Segment)
+	if err := rules.Reload(context.Background()); err != nil {
+		log.Printf("⚠️  Segment rules not loaded, using SEGMENT_* thresholds: %v", err)
+	}
+	go rules.Run(watchCtx)
+	segments := newSegmentStore(rdb, cfg.Segment, rules)
+	taxes := newTaxRates(dbRouter, cfg.Tax)
+	if err := taxes.Reload(context.Background()); err != nil {
+		log.Printf("⚠️  Tax rates not loaded, using TAX_DEFAULT_RATE: %v", err)
+	}
+	go taxes.Run(watchCtx)
+	activeUsers := NewActiveUsers(rdb, cfg.Metrics.ActiveUsers)
+	overviewService := NewUserOverviewService(dbRouter, rdb, cfg.Cache, segments,
+		cfg.Timeouts.ProductsQuery, availability, activeUsers, cfg.Overview.ReservedFrom)
+	userHandler := NewUserOverviewHandler(overviewService, cfg.Overview)
+	catalog := NewProductCatalog(dbRouter, rdb, cfg.Cache, cfg.Overview)
+	checkoutStats := NewCheckoutStats(rdb, cfg.Metrics.CheckoutStatsFlush, cfg.Metrics.CheckoutBuckets)
+	if checkoutStats.Enabled() {
+		go checkoutStats.Run(watchCtx)
+	}
+	checkoutHandler := NewCheckoutHandler(pool, rdb, cfg.Checkout, cfg.RedisFailOpen,
+		newCacheCodec(cfg.Cache.CompressThreshold), segments, taxes,
+		newSummaryInvalidator(rdb, cfg.Cache), checkoutStats)
+	checkoutAudit := NewCheckoutAudit(dbRouter, cfg.Audit)
+	if checkoutAudit.Enabled() {
+		checkoutAudit.Start(watchCtx)
+		defer checkoutAudit.Close()
+		log.Printf("📝 Failed checkouts audited to checkout_audit (retention %s, max %d rows)",
+			cfg.Audit.Retention, cfg.Audit.MaxRows)
+	}
+	checkoutQueue := NewCheckoutQueue(checkoutHandler, rdb, cfg.Timeouts.Checkout)
+	if checkoutQueue.Enabled() {
+		checkoutQueue.Start(watchCtx)
+	}
+
+	useJSONEncoder(cfg.Server.JSONEncoder)
 
 	// Create Fiber app with optimized config
 	app := fiber.New(fiber.Config{
-		Prefork:               false,
+		Prefork:               cfg.Prefork,
 		CaseSensitive:         true,
 		StrictRouting:         true,
 		ServerHeader:          "Fiber",
 		AppName:               "LoadTest Benchmark",
 		DisableStartupMessage: false,
+
+		Concurrency:      cfg.Server.Concurrency,
+		ReadBufferSize:   cfg.Server.ReadBufferSize,
+		WriteBufferSize:  cfg.Server.WriteBufferSize,
+		ReadTimeout:      cfg.Server.ReadTimeout,
+		WriteTimeout:     cfg.Server.WriteTimeout,
+		IdleTimeout:      cfg.Server.IdleTimeout,
+		DisableKeepalive: cfg.Server.DisableKeepalive,
+		JSONEncoder:      jsonMarshal,
+		JSONDecoder:      jsonUnmarshal,
 	})
+	log.Printf("   server: %s json=%s", describeServer(app.Config()), cfg.Server.JSONEncoder)
 
 	// Middleware
-	app.Use(recover.New())
+	app.Use(recoverMiddleware())
+	app.Use(requestid.New())
+	httpMetrics := NewHTTPMetrics(
+		cfg.Metrics.OverviewBuckets,
+		cfg.Metrics.CheckoutBuckets,
+	)
+	app.Use(httpMetrics.Middleware())
+	if tracingEnabled {
+		app.Use(tracingMiddleware())
+	}
+
+	// Optional sampled access log; when disabled the middleware is not
+	// registered at all so the hot path pays nothing
+	if cfg.AccessLog.Path != "" {
+		accessLog, err := NewAccessLogger(AccessLogConfig{
+			Path:          cfg.AccessLog.Path,
+			Format:        cfg.AccessLog.Format,
+			SampleRate:    cfg.AccessLog.SampleRate,
+			SlowThreshold: cfg.AccessLog.SlowThreshold,
+			MaxSizeBytes:  int64(cfg.AccessLog.MaxSizeMB) << 20,
+			MaxAge:        cfg.AccessLog.MaxAge,
+			BufferRecords: cfg.AccessLog.BufferRecords,
+		})
+		if err != nil {
+			log.Fatalf("Unable to open access log: %v", err)
+		}
+		defer accessLog.Close()
+		app.Use(accessLog.Middleware())
+		log.Printf("📝 Access log enabled at %s (sample rate %g, slow >= %s)",
+			cfg.AccessLog.Path, cfg.AccessLog.SampleRate, cfg.AccessLog.SlowThreshold)
+	}
 
 	// Routes
-	v1 := app.Group("/v1")
-	v1.Get("/users/:userId/overview", userHandler.GetUserOverview)
-	v1.Post("/checkout", checkoutHandler.Checkout)
+	var adminGuard fiber.Handler
+	if cfg.TLS.ClientCAFile != "" || cfg.AdminAPIKey != "" {
+		adminGuard = requireAdmin(cfg.TLS.ClientCAFile != "", cfg.AdminAPIKey)
+	}
+	routes := NewRouteRegistry(cfg.APIV1Sunset, adminGuard)
+	// Per-user rate limits first, then the concurrency caps, so throttled
+	// requests never hold a slot
+	var overviewLimit, checkoutLimit []fiber.Handler
+	// userLimits are the per-user limits in force, for the limits admin
+	var userLimits []RateLimit
+	if rl := cfg.RateLimit.Overview; rl.Limit > 0 {
+		limit := RateLimit{
+			Name: "overview", Limit: rl.Limit, Window: rl.Window, Key: userIDFromParam,
+		}
+		overviewLimit = append(overviewLimit, rateLimitMiddleware(rdb, limit, cfg.RedisFailOpen.RateLimit))
+		userLimits = append(userLimits, limit)
+	}
+	if rl := cfg.RateLimit.Checkout; rl.Limit > 0 {
+		limit := RateLimit{
+			Name: "checkout", Limit: rl.Limit, Window: rl.Window, Key: userIDFromBody,
+			Plans: rl.Plans, Plan: userPlan(overviewService),
+		}
+		checkoutLimit = append(checkoutLimit, rateLimitMiddleware(rdb, limit, cfg.RedisFailOpen.RateLimit))
+		userLimits = append(userLimits, limit)
+	}
+	if n := cfg.Limits.Overview; n > 0 {
+		// Shared by v1 and v2: both hit the same queries
+		overviewLimit = append(overviewLimit,
+			concurrencyLimiter("overview", n, cfg.Limits.QueueWait))
+	}
+	checkOverviewFanout(cfg.Limits.Overview, poolConfig.MaxConns)
+	if n := cfg.Limits.Checkout; n > 0 {
+		checkoutLimit = append(checkoutLimit,
+			concurrencyLimiter("checkout", n, cfg.Limits.QueueWait))
+	}
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/users/:userId/overview",
+		Summary:    "User overview (frozen; use v2)",
+		Successor:  "/v2/users/:userId/overview",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetUserOverview,
+	})
+	routes.Add(Route{
+		Version:    "v2",
+		Method:     fiber.MethodGet,
+		Path:       "/users/:userId/overview",
+		Summary:    "User overview with pagination, account stats and regional availability",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetUserOverviewV2,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/users/:userId/orders",
+		Summary:    "User order history, filterable by status and date, keyset-paginated",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetUserOrders,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/users/:userId/events",
+		Summary:    "User activity feed, filterable by event type, keyset-paginated",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetUserEvents,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/users/:userId/cart",
+		Summary:    "Open cart with item detail and regional availability",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetUserCart,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/products",
+		Summary:    "Product catalog with filters, sorting and availability",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    catalog.ListProducts,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/products/:productId",
+		Summary:    "Product with per-warehouse availability",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    catalog.GetProduct,
+	})
+	// Outcomes are counted and failures audited outside the limits, so
+	// their rejections are too
+	checkoutMiddleware := []fiber.Handler{checkoutStats.Middleware()}
+	if checkoutAudit.Enabled() {
+		checkoutMiddleware = append(checkoutMiddleware, checkoutAudit.Middleware())
+	}
+	// Retries of a finished checkout are answered before the limits, so
+	// a replay is never throttled
+	checkoutMiddleware = append(checkoutMiddleware, checkoutHandler.ReplayMiddleware())
+	checkoutMiddleware = append(checkoutMiddleware, checkoutLimit...)
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodPost,
+		Path:       "/checkout",
+		Summary:    "Checkout an open cart; ?async=true queues it and answers 202",
+		Timeout:    cfg.Timeouts.Checkout,
+		Middleware: checkoutMiddleware,
+		Handler:    checkoutQueue.Checkout,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPost,
+		Path:    "/checkout/quote",
+		Summary: "Price a checkout request, with per-item lines, without placing the order",
+		Timeout: cfg.Timeouts.Checkout,
+		Handler: checkoutHandler.Quote,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPost,
+		Path:    "/coupons/validate",
+		Summary: "Check a coupon against a cart or items and preview its discount, without using it",
+		Timeout: cfg.Timeouts.Checkout,
+		Handler: checkoutHandler.PreviewCoupon,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/checkout/:checkoutId/status",
+		Summary: "Status of an async checkout, with its result once it has run",
+		Timeout: cfg.Timeouts.Overview,
+		Handler: checkoutQueue.Status,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodPost,
+		Path:       "/orders/:orderId/cancel",
+		Summary:    "Cancel a pending order, releasing its inventory and coupon",
+		Timeout:    cfg.Timeouts.Checkout,
+		Middleware: checkoutLimit,
+		Handler:    checkoutHandler.CancelOrder,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodPost,
+		Path:       "/orders/:orderId/reorder",
+		Summary:    "Copy an order's items into an open cart at current prices; ?mode=strict|merge for an existing cart",
+		Timeout:    cfg.Timeouts.Checkout,
+		Middleware: checkoutLimit,
+		Handler:    checkoutHandler.Reorder,
+	})
+	routes.Add(Route{
+		Version:    "v1",
+		Method:     fiber.MethodGet,
+		Path:       "/orders/:orderId",
+		Summary:    "One order, by id or ORD- number, with its totals and items; optional userId ownership check",
+		Timeout:    cfg.Timeouts.Overview,
+		Middleware: overviewLimit,
+		Handler:    userHandler.GetOrder,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPost,
+		Path:    "/orders/:orderId/fulfill",
+		Summary: "Fulfill a pending order, shipping its reserved stock",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Checkout,
+		Handler: checkoutHandler.FulfillOrder,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPost,
+		Path:    "/webhooks/payment",
+		Summary: "Apply a signed payment outcome: succeeded completes the order, failed cancels it",
+		Timeout: cfg.Timeouts.Checkout,
+		Handler: checkoutHandler.PaymentWebhook,
+	})
 
-	// Health check
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
+	// Health checks - /health is kept as an alias for readiness
+	health := NewHealth(dbRouter, rdb, redisBreaker, availability, outbox, cfg.Timeouts.HealthProbe)
+	routes.Add(Route{
+		Method:  fiber.MethodGet,
+		Path:    "/health/live",
+		Summary: "Liveness probe",
+		Handler: health.Live,
+	})
+	routes.Add(Route{
+		Method:  fiber.MethodGet,
+		Path:    "/health/ready",
+		Summary: "Readiness probe (Postgres and Redis)",
+		Handler: health.Ready,
+	})
+	routes.Add(Route{
+		Method:  fiber.MethodGet,
+		Path:    "/health",
+		Summary: "Health check (alias of /health/ready)",
+		Handler: health.Ready,
+	})
+	routes.Add(Route{
+		Method:  fiber.MethodGet,
+		Path:    "/version",
+		Summary: "Build metadata and enabled features",
+		Handler: versionHandler(version),
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/internal/cache-stats",
+		Summary: "Overview cache hit ratios since process start",
+		Admin:   true,
+		Handler: cacheStatsHandler,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/internal/metrics/active-users",
+		Summary: "Distinct overview users per day over the last ?days= days",
+		Admin:   true,
+		Handler: activeUsers.Handler,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/internal/stats/orders",
+		Summary: "Orders and revenue per day over the last ?days= days, from stream:order_events",
+		Admin:   true,
+		Handler: orderStream.StatsHandler,
+	})
+	limitsAdmin := NewLimitsAdmin(dbRouter, rdb, userLimits, cfg.Checkout)
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/admin/users/:userId/limits",
+		Summary: "A user's rate-limit windows and whether their checkout locks are held",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: limitsAdmin.GetLimits,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodDelete,
+		Path:    "/admin/users/:userId/limits",
+		Summary: "Clear a user's rate-limit windows and checkout locks",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: limitsAdmin.ClearLimits,
 	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/internal/checkout-stats",
+		Summary: "Checkout outcomes since this process started, and across instances from Redis",
+		Admin:   true,
+		Handler: checkoutStats.Handler,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/admin/checkout-audit",
+		Summary: "Recent failed checkouts with their sanitized bodies, optionally of one ?code=",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: checkoutAudit.Handler,
+	})
+	webhookAdmin := NewWebhookAdmin(dbRouter)
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/admin/webhooks",
+		Summary: "Webhook subscriptions to order events",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.List,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPost,
+		Path:    "/admin/webhooks",
+		Summary: "Subscribe a URL to order events; the signing secret is only returned here",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.Create,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/admin/webhooks/:webhookId",
+		Summary: "One webhook subscription",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.Get,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodPatch,
+		Path:    "/admin/webhooks/:webhookId",
+		Summary: "Change a webhook subscription's URL, secret, event types or active flag",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.Update,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodDelete,
+		Path:    "/admin/webhooks/:webhookId",
+		Summary: "Delete a webhook subscription and its deliveries",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.Delete,
+	})
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/admin/webhooks/:webhookId/deliveries",
+		Summary: "A subscription's newest deliveries with every attempt, optionally of one ?status=",
+		Admin:   true,
+		Timeout: cfg.Timeouts.Overview,
+		Handler: webhookAdmin.Deliveries,
+	})
+	leaderboard := NewLeaderboard(dbRouter, rdb, cfg.Cache)
+	routes.Add(Route{
+		Version: "v1",
+		Method:  fiber.MethodGet,
+		Path:    "/leaderboard/top-buyers",
+		Summary: "Top buyers by spend over ?window=all|today|7d, optionally with ?enrich=true plan and region",
+		Timeout: cfg.Timeouts.Overview,
+		Handler: leaderboard.Handler,
+	})
+	if cfg.Pprof {
+		routes.Add(Route{
+			Method:  fiber.MethodGet,
+			Path:    "/debug/pprof/*",
+			Summary: "Go runtime profiles for go tool pprof",
+			Admin:   true,
+			Handler: pprof.New(),
+		})
+	}
+	routes.Add(Route{
+		Method:  fiber.MethodGet,
+		Path:    "/metrics",
+		Summary: "Prometheus metrics",
+		Admin:   cfg.MetricsAdmin,
+		Handler: metricsHandler(),
+	})
+	routes.Mount(app)
 
-	port := getEnv("PORT", "3001")
-	log.Printf("🚀 Fiber server running on port %s", port)
-	log.Fatal(app.Listen(":" + port))
-}
+	// Warm pools in the background; readiness stays 503 until it's done or
+	// WARMUP_TIMEOUT runs out. A failed warmup only means a cold start, so
+	// it doesn't stop the server.
+	if cfg.Warmup.Enabled {
+		startWarmup(health, cfg.Warmup.Timeout, func(ctx context.Context) error {
+			return warmup(ctx, dbRouter, rdb, overviewService, cfg.Warmup.PrimeStatements)
+		})
+	}
+
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		scheme = "https"
+	}
+	if cfg.Socket.Path != "" {
+		log.Printf("🚀 Fiber server running on unix socket %s (%s)", cfg.Socket.Path, scheme)
+	} else {
+		log.Printf("🚀 Fiber server running on port %s (%s)", cfg.Port, scheme)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- listen(app, cfg) }()
 
-func getEnv(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	// Graceful shutdown: fail readiness first so the load balancer stops
+	// routing here, then let in-flight requests finish
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-stop.Done():
 	}
-	return fallback
+
+	log.Printf("🛑 Shutting down, draining for %s", cfg.Timeouts.ShutdownDrain)
+	health.Drain()
+	time.Sleep(cfg.Timeouts.ShutdownDrain)
+	if err := app.ShutdownWithTimeout(cfg.Timeouts.Shutdown); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	// Stop taking queued checkouts; the ones running finish first
+	stopWatch()
+	checkoutQueue.Wait()
+	waitDeferredWrites()
+	if cfg.Socket.Path != "" {
+		// Closing the listener unlinks the socket; this covers the case
+		// where shutdown timed out first
+		if err := os.Remove(cfg.Socket.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Remove socket: %v", err)
+		}
+	}
+}
+
+// describeServer renders the effective fasthttp settings so each benchmark
+// run records the server configuration it used
+func describeServer(c fiber.Config) string {
+	return fmt.Sprintf(
+		"prefork=%t concurrency=%d read_buffer=%d write_buffer=%d read_timeout=%s write_timeout=%s idle_timeout=%s disable_keepalive=%t",
+		c.Prefork, c.Concurrency, c.ReadBufferSize, c.WriteBufferSize,
+		c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.DisableKeepalive,
+	)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+)
+
+// HTTPMetrics records request counts and per-route latency histograms
+type HTTPMetrics struct {
+	durations map[string]*prometheus.HistogramVec
+}
+
+// NewHTTPMetrics registers a latency histogram per tracked route. All share
+// the metric name http_request_duration_seconds; the route is a const label
+// so each can carry its own buckets.
+func NewHTTPMetrics(overviewBuckets, checkoutBuckets []float64) *HTTPMetrics {
+	m := &HTTPMetrics{durations: map[string]*prometheus.HistogramVec{}}
+	tracked := map[string][]float64{
+		"/v1/users/:userId/overview": overviewBuckets,
+		"/v2/users/:userId/overview": overviewBuckets,
+		"/v1/checkout":               checkoutBuckets,
+	}
+	for route, buckets := range tracked {
+		m.durations[route] = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "http_request_duration_seconds",
+			Help:        "HTTP request latency by route and status code.",
+			ConstLabels: prometheus.Labels{"route": route},
+			Buckets:     buckets,
+		}, []string{"status"})
+	}
+	return m
+}
+
+func (m *HTTPMetrics) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		httpInFlight.Inc()
+		// Deferred so a panic unwinding to the recover middleware doesn't
+		// leak the gauge
+		defer httpInFlight.Dec()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fe, ok := err.(*fiber.Error); ok {
+				status = fe.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		route := c.Route().Path
+		code := strconv.Itoa(status)
+		httpRequests.WithLabelValues(route, c.Method(), code).Inc()
+		if h, ok := m.durations[route]; ok {
+			h.WithLabelValues(code).Observe(time.Since(start).Seconds())
+		}
+		return err
+	}
+}
+
+func metricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
+
+// poolCollector exports pgxpool.Stat() on every scrape
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired        *prometheus.Desc
+	idle            *prometheus.Desc
+	total           *prometheus.Desc
+	max             *prometheus.Desc
+	acquireCount    *prometheus.Desc
+	emptyAcquire    *prometheus.Desc
+	acquireDuration *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool, name string) *poolCollector {
+	labels := prometheus.Labels{"pool": name}
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc("pgxpool_"+metric, help, nil, labels)
+	}
+	return &poolCollector{
+		pool:            pool,
+		acquired:        desc("acquired_conns", "Connections currently checked out."),
+		idle:            desc("idle_conns", "Idle connections in the pool."),
+		total:           desc("total_conns", "Total connections in the pool."),
+		max:             desc("max_conns", "Configured maximum pool size."),
+		acquireCount:    desc("acquire_total", "Successful acquires."),
+		emptyAcquire:    desc("empty_acquire_total", "Acquires that had to wait for a connection."),
+		acquireDuration: desc("acquire_duration_seconds_total", "Total time spent waiting to acquire."),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(p, ch)
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := p.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(p.acquired, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(p.total, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(p.max, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(p.acquireCount, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.emptyAcquire, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.acquireDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Cents is an amount of money in integer cents. Checkout does its money
+// arithmetic in Cents, so every rounding step is one the code asks for
+// rather than wherever float64 drops a digit. It scans from and encodes to
+// NUMERIC columns directly, without a trip through float8.
+type Cents int64
+
+// Dollars is the amount as the float the JSON responses carry
+func (c Cents) Dollars() float64 {
+	return float64(c) / 100
+}
+
+// MulDiv returns c * num / den rounded half away from zero, e.g. a rate of
+// 8/100 for tax or a percentage of 1500/10000 (15%). den must be positive.
+func (c Cents) MulDiv(num, den int64) Cents {
+	return Cents(divRound(int64(c)*num, den))
+}
+
+// divRound divides n by a positive d, rounding half away from zero
+func divRound(n, d int64) int64 {
+	q, r := n/d, n%d
+	switch {
+	case r >= 0 && 2*r >= d:
+		q++
+	case r < 0 && -2*r >= d:
+		q--
+	}
+	return q
+}
+
+// ScanNumeric implements pgtype.NumericScanner. A value with more than two
+// decimal places is rounded to the cent; a NULL is an error, so nullable
+// columns scan into *Cents.
+func (c *Cents) ScanNumeric(n pgtype.Numeric) error {
+	v, err := scaledNumeric(n, 2)
+	if err != nil {
+		return fmt.Errorf("cannot scan into Cents: %w", err)
+	}
+	*c = Cents(v)
+	return nil
+}
+
+// NumericValue implements pgtype.NumericValuer
+func (c Cents) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(c)), Exp: -2, Valid: true}, nil
+}
+
+// TaxRate is a tax rate in ten-thousandths, so 825 is 8.25%, matching the
+// four decimal places of tax_rates.rate and orders.tax_rate
+type TaxRate int64
+
+// taxRateOf converts a fractional rate such as 0.0825
+func taxRateOf(rate float64) TaxRate {
+	return TaxRate(math.Round(rate * 10000))
+}
+
+// Apply returns the tax on amount, rounded half away from zero to the cent
+func (r TaxRate) Apply(amount Cents) Cents {
+	return amount.MulDiv(int64(r), 10000)
+}
+
+// ScanNumeric implements pgtype.NumericScanner
+func (r *TaxRate) ScanNumeric(n pgtype.Numeric) error {
+	v, err := scaledNumeric(n, 4)
+	if err != nil {
+		return fmt.Errorf("cannot scan into TaxRate: %w", err)
+	}
+	*r = TaxRate(v)
+	return nil
+}
+
+// NumericValue implements pgtype.NumericValuer
+func (r TaxRate) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(r)), Exp: -4, Valid: true}, nil
+}
+
+// scaledNumeric returns n * 10^places as an integer, rounding any further
+// digits half away from zero, like divRound
+func scaledNumeric(n pgtype.Numeric, places int32) (int64, error) {
+	if !n.Valid {
+		return 0, errors.New("NULL")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return 0, errors.New("non-finite numeric")
+	}
+	v := new(big.Int).Set(n.Int)
+	if exp := n.Exp + places; exp >= 0 {
+		v.Mul(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	} else {
+		d := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil)
+		q, r := new(big.Int).QuoRem(v, d, new(big.Int))
+		if r.Abs(r).Lsh(r, 1).Cmp(d) >= 0 {
+			q.Add(q, big.NewInt(int64(v.Sign())))
+		}
+		v = q
+	}
+	if !v.IsInt64() {
+		return 0, fmt.Errorf("numeric %s out of range", v)
+	}
+	return v.Int64(), nil
+}
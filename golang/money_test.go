@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestMulDivRoundsHalfAwayFromZero(t *testing.T) {
+	for _, tt := range []struct {
+		c        Cents
+		num, den int64
+		want     Cents
+	}{
+		{10_99, 8, 100, 88}, // 87.92: the old float truncation gave 87
+		{12_50, 8, 100, 1_00},
+		{6_25, 8, 100, 50},
+		{1_00, 1, 8, 13},   // 12.5 rounds up
+		{-1_00, 1, 8, -13}, // and down below zero
+		{99_99, 1500, 10000, 15_00},
+		{33_33, 1, 3, 11_11},
+	} {
+		if got := tt.c.MulDiv(tt.num, tt.den); got != tt.want {
+			t.Errorf("%d * %d/%d = %d, want %d", tt.c, tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestTaxRate(t *testing.T) {
+	if r := taxRateOf(0.0825); r != 825 {
+		t.Errorf("taxRateOf(0.0825) = %d, want 825", r)
+	}
+	// 19.99 at 8% is 1.5992; truncating to the cent lost a penny
+	if tax := TaxRate(800).Apply(19_99); tax != 1_60 {
+		t.Errorf("tax on 19.99 = %d, want 160", tax)
+	}
+}
+
+func TestTotalsAlwaysReconcile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		items := make([]CartItemDB, 1+rng.Intn(5))
+		for j := range items {
+			items[j] = CartItemDB{Qty: 1 + rng.Intn(10), UnitPrice: Cents(1 + rng.Intn(500_00))}
+		}
+		discount := Cents(rng.Intn(300_00))
+		rate := TaxRate(rng.Intn(1500))
+		method := shippingMethods[rng.Intn(len(shippingMethods))]
+		p := priceOrder(items, discount, rate, method)
+
+		var lines float64
+		for _, line := range p.Lines {
+			lines += line.LineTotal
+		}
+		if p.Total != p.Subtotal-p.Discount+p.Tax+p.Shipping ||
+			p.Discount > p.Subtotal || p.Tax < 0 || p.Total < 0 ||
+			Cents(lines*100+0.5) != p.Subtotal {
+			t.Fatalf("%+v at %d via %s doesn't reconcile: %+v", items, rate, method, p)
+		}
+		if want := rate.Apply(p.Subtotal - p.Discount); p.Tax != want {
+			t.Fatalf("tax = %d, want %d", p.Tax, want)
+		}
+	}
+}
+
+func TestScanNumeric(t *testing.T) {
+	numeric := func(v int64, exp int32) pgtype.Numeric {
+		return pgtype.Numeric{Int: big.NewInt(v), Exp: exp, Valid: true}
+	}
+	for _, tt := range []struct {
+		n    pgtype.Numeric
+		want Cents
+	}{
+		{numeric(1999, -2), 19_99},
+		{numeric(5, 0), 5_00},
+		{numeric(12345, -3), 12_35},
+		{numeric(-12345, -3), -12_35},
+		{numeric(12344, -3), 12_34},
+		{numeric(3, 2), 300_00},
+	} {
+		var c Cents
+		if err := c.ScanNumeric(tt.n); err != nil || c != tt.want {
+			t.Errorf("scan %dE%d = %d, %v, want %d", tt.n.Int, tt.n.Exp, c, err, tt.want)
+		}
+	}
+
+	var c Cents
+	for name, n := range map[string]pgtype.Numeric{
+		"NULL":         {},
+		"NaN":          {NaN: true, Valid: true},
+		"out of range": numeric(1, 30),
+	} {
+		if err := c.ScanNumeric(n); err == nil {
+			t.Errorf("%s scanned as %d", name, c)
+		}
+	}
+
+	var r TaxRate
+	if err := r.ScanNumeric(numeric(825, -4)); err != nil || r != 825 {
+		t.Errorf("tax rate = %d, %v, want 825", r, err)
+	}
+	if n, _ := Cents(19_99).NumericValue(); n.Int.Int64() != 1999 || n.Exp != -2 {
+		t.Errorf("NumericValue = %dE%d", n.Int, n.Exp)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sentBeforeFailure is an error pgconn would mark SafeToRetry
+type sentBeforeFailure struct{}
+
+func (sentBeforeFailure) Error() string     { return "conn closed before the query was sent" }
+func (sentBeforeFailure) SafeToRetry() bool { return true }
+
+func TestDBError(t *testing.T) {
+	refused := unreachableRouter(t).Primary().Ping(context.Background())
+	if refused == nil {
+		t.Fatal("ping of an unreachable pool succeeded")
+	}
+	tests := []struct {
+		name        string
+		err         error
+		unavailable bool
+	}{
+		{"no rows", fmt.Errorf("scan: %w", pgx.ErrNoRows), false},
+		{"query error", &pgconn.PgError{Code: "42P01", Message: `relation "carts" does not exist`}, false},
+		{"connection refused", refused, true},
+		{"safe to retry, wrapped", fmt.Errorf("begin: %w", sentBeforeFailure{}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dbError("load cart", tt.err)
+			if got := errors.Is(err, ErrDBUnavailable); got != tt.unavailable {
+				t.Errorf("unavailable = %t, want %t (%v)", got, tt.unavailable, err)
+			}
+			// Wrapping keeps the cause matchable, ErrNoRows included
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%v no longer matches its cause", err)
+			}
+		})
+	}
+}
+
+func TestLookupsReportAnUnreachableDatabaseAs503(t *testing.T) {
+	db := unreachableRouter(t)
+	_, rdb := testRedis(t)
+	overview := overviewApp(t, db, rdb)
+	checkout, _ := checkoutApp(t, db, rdb)
+
+	for name, req := range map[string]struct {
+		app *fiber.App
+		req *http.Request
+	}{
+		"overview": {overview, newRequest(http.MethodGet, "/v1/users/"+testUserID+"/overview", nil)},
+		"cart":     {overview, newRequest(http.MethodGet, "/v1/users/"+testUserID+"/cart", nil)},
+		"checkout": {checkout, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+			UserID: testUserID, CartID: testUserID, PaymentRef: "pay-1",
+			Items: []CheckoutItem{{ProductID: testUserID, Qty: 1}},
+		})},
+	} {
+		resp, body := send(t, req.app, req.req)
+		code, _ := decode(t, body)["error"].(map[string]any)
+		if resp.StatusCode != fiber.StatusServiceUnavailable || code["code"] != "DATABASE_UNAVAILABLE" {
+			t.Errorf("%s: got %d %s, want 503 DATABASE_UNAVAILABLE", name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestMissingRowsAreNotFound(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	overview := overviewApp(t, db, rdb)
+	checkout, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "free", "active")
+	product := seedProduct(t, db, "NOROWS", 5, 10)
+	closed := seedCart(t, db, user, "checked_out", 5, product)
+
+	checkoutReq := func(cartID string) *http.Request {
+		return newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+			UserID: user, CartID: cartID, PaymentRef: "pay-" + cartID,
+			Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+		})
+	}
+	for _, tt := range []struct {
+		name   string
+		app    *fiber.App
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{"unknown user", overview, newRequest(http.MethodGet, "/v1/users/"+testUserID+"/overview", nil), 404, "USER_NOT_FOUND"},
+		{"no open cart", overview, newRequest(http.MethodGet, "/v1/users/"+user+"/cart", nil), 404, "NO_OPEN_CART"},
+		{"unknown cart", checkout, checkoutReq(testUserID), 400, "CART_NOT_FOUND"},
+		{"closed cart", checkout, checkoutReq(closed), 400, "CART_NOT_FOUND"},
+	} {
+		resp, body := send(t, tt.app, tt.req)
+		e, _ := decode(t, body)["error"].(map[string]any)
+		if resp.StatusCode != tt.status || e["code"] != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, resp.StatusCode, body, tt.status, tt.code)
+		}
+	}
+
+	// The user without a cart still has an overview, cart null
+	resp, body := send(t, overview, newRequest(http.MethodGet, "/v1/users/"+user+"/overview", nil))
+	if got := decode(t, body); resp.StatusCode != 200 || got["cart"] != nil {
+		t.Errorf("overview: got %d cart %v, want 200 with no cart", resp.StatusCode, got["cart"])
+	}
+}
+
+func TestInactiveUsersAreForbidden(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	overview := overviewApp(t, db, rdb)
+	checkout, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "suspended")
+	product := seedProduct(t, db, "INACTIVE", 5, 10)
+
+	check := func(name string, app *fiber.App, req *http.Request, status int, code string) {
+		t.Helper()
+		resp, body := send(t, app, req)
+		e, _ := decode(t, body)["error"].(map[string]any)
+		if resp.StatusCode != status || e["code"] != code {
+			t.Errorf("%s: got %d %s, want %d %s", name, resp.StatusCode, body, status, code)
+		}
+	}
+	// The second request finds the user in the cache, status included
+	for _, round := range []string{"db", "cached"} {
+		for _, v := range []string{"v1", "v2"} {
+			check(v+" "+round, overview, newRequest(http.MethodGet, "/"+v+"/users/"+user+"/overview", nil), 403, "USER_INACTIVE")
+		}
+	}
+	check("missing", overview, newRequest(http.MethodGet, "/v2/users/"+testUserID+"/overview", nil), 404, "USER_NOT_FOUND")
+	check("checkout", checkout, newRequest(http.MethodPost, "/v1/checkout", CheckoutRequest{
+		UserID: user, PaymentRef: "pay-inactive", Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+	}), 403, "USER_INACTIVE")
+}
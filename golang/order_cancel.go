@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/events"
+)
+
+// headerUserID names the caller on order requests, as an alternative to a
+// userId in the body or query
+const headerUserID = "X-User-Id"
+
+type CancelOrderRequest struct {
+	UserID string `json:"userId"`
+}
+
+type CancelOrderResponse struct {
+	OrderID string  `json:"orderId"`
+	Status  string  `json:"status"`
+	Total   float64 `json:"total"`
+	// ReleasedUnits is how much reserved inventory went back on sale
+	ReleasedUnits int `json:"releasedUnits"`
+	// total is Total in cents, taken back off the leaderboard
+	total Cents
+	// placedAt dates the order on the daily leaderboard
+	placedAt time.Time
+}
+
+// CancelOrder undoes a pending checkout: the order becomes cancelled, its
+// reservations go back to inventory and its coupon use is returned. The
+// owner is named by the body's userId or the X-User-Id header; an order
+// belonging to someone else is reported as not found.
+func (h *CheckoutHandler) CancelOrder(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	p := newQueryParams(c)
+	orderID := p.PathUUID("orderId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+
+	if len(c.Body()) > h.cfg.MaxBodyBytes {
+		return writeError(c, ErrBodyTooLarge)
+	}
+	var req CancelOrderRequest
+	if len(c.Body()) > 0 {
+		if err := decodeStrict(c.Body(), &req); err != nil {
+			return writeError(c, err)
+		}
+	}
+	userID, err := orderOwner("userId", req.UserID, c.Get(headerUserID))
+	if err != nil {
+		return writeError(c, err)
+	}
+	if userID == "" {
+		return writeError(c, ErrValidation.WithDetails([]FieldError{{
+			Field: "userId", Message: "is required, in the body or the " + headerUserID + " header",
+		}}))
+	}
+
+	resp, err := h.cancelOrder(ctx, orderID, userID)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(resp)
+}
+
+// orderOwner picks the caller's user id from field (in the body or query)
+// or the header, which must agree when both are given. It is "" when
+// neither names one.
+func orderOwner(field, fromRequest, fromHeader string) (string, error) {
+	invalid := func(field, msg string) error {
+		return ErrValidation.WithDetails([]FieldError{{Field: field, Message: msg}})
+	}
+	var ids []string
+	for _, src := range []struct{ field, raw string }{
+		{field, fromRequest},
+		{headerUserID, fromHeader},
+	} {
+		if src.raw == "" {
+			continue
+		}
+		id, err := uuid.Parse(src.raw)
+		if err != nil {
+			return "", invalid(src.field, "must be a UUID")
+		}
+		ids = append(ids, id.String())
+	}
+	switch {
+	case len(ids) == 0:
+		return "", nil
+	case len(ids) == 2 && ids[0] != ids[1]:
+		return "", invalid(headerUserID, "must match "+field)
+	}
+	return ids[0], nil
+}
+
+func (h *CheckoutHandler) cancelOrder(
+	ctx context.Context,
+	orderID, userID string,
+) (*CancelOrderResponse, error) {
+	// As with checkout, a disconnect mustn't abandon the transaction or
+	// skip the cache invalidation that follows it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.cfg.TxTimeout)
+	defer cancel()
+
+	spanCtx, span := startSpan(ctx, "order.cancel")
+	resp, err := h.cancelOrderTransaction(spanCtx, orderID, userID)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	afterResponse(ctx, "post_cancel", func(ctx context.Context) error {
+		return h.postCancelRedisOps(ctx, userID, orderID, resp.total, resp.placedAt)
+	})
+	return resp, nil
+}
+
+// cancelOrderTransaction locks the order row first, so it serializes with
+// the reservation sweeper and anything else that moves an order on from
+// pending; whichever commits first wins and the other sees the new status.
+func (h *CheckoutHandler) cancelOrderTransaction(
+	ctx context.Context,
+	orderID, userID string,
+) (*CancelOrderResponse, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	var owner, status string
+	var total Cents
+	var coupon *string
+	var placedAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT user_id::text, status, total, coupon_code, created_at
+		FROM orders WHERE id = $1
+		FOR UPDATE`, orderID).Scan(&owner, &status, &total, &coupon, &placedAt)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && owner != userID) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, dbError("load order", err)
+	}
+	if !canTransition(status, "cancelled") {
+		return nil, transitionError(ErrOrderNotPending, status, "cancelled")
+	}
+
+	// Reservations are given back exactly as recorded at checkout; an
+	// order from before they were recorded has nothing to release
+	var released int
+	err = tx.QueryRow(ctx, `
+		WITH released AS (
+			DELETE FROM inventory_reservations WHERE order_id = $1
+			RETURNING product_id, warehouse_id, qty
+		), restocked AS (
+			UPDATE inventory i
+			SET reserved_qty = GREATEST(i.reserved_qty - r.qty, 0), updated_at = NOW()
+			FROM released r
+			WHERE i.product_id = r.product_id AND i.warehouse_id = r.warehouse_id
+		)
+		SELECT COALESCE(SUM(qty), 0)::int FROM released`, orderID).Scan(&released)
+	if err != nil {
+		return nil, dbError("release reservations", err)
+	}
+
+	payload, err := events.Marshal(&events.OrderCancelledPayload{
+		OrderID:       orderID,
+		Total:         total.Dollars(),
+		ReleasedUnits: released,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stmts := []batchStmt{
+		{"cancel order",
+			`UPDATE orders SET status = 'cancelled' WHERE id = $1`,
+			[]any{orderID}},
+		{"log cancel event", `
+			INSERT INTO events(id, user_id, type, payload_json, created_at)
+			VALUES($1, $2, $3, $4, NOW())`,
+			[]any{uuid.New().String(), userID, events.OrderCancelled, payload}},
+		outboxEntry(orderEventsStream, map[string]string{
+			"type":          events.OrderCancelled,
+			"userId":        userID,
+			"orderId":       orderID,
+			"total":         strconv.FormatFloat(total.Dollars(), 'f', -1, 64),
+			"releasedUnits": strconv.Itoa(released),
+		}),
+	}
+	if coupon != nil {
+		stmts = append(stmts,
+			batchStmt{"return coupon",
+				`UPDATE coupons SET used_count = GREATEST(used_count - 1, 0) WHERE code = $1`,
+				[]any{*coupon}},
+			batchStmt{"return coupon usage", `
+				UPDATE user_coupon_usage SET used_count = GREATEST(used_count - 1, 0)
+				WHERE user_id = $1 AND coupon_code = $2`,
+				[]any{userID, *coupon}})
+	}
+	if err := execBatch(ctx, tx, stmts...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &CancelOrderResponse{
+		OrderID:       orderID,
+		Status:        "cancelled",
+		Total:         total.Dollars(),
+		ReleasedUnits: released,
+		total:         total,
+		placedAt:      placedAt,
+	}, nil
+}
+
+// postCancelRedisOps drops the cached order and the summaries that counted
+// it, and takes its total back off the leaderboards
+func (h *CheckoutHandler) postCancelRedisOps(ctx context.Context, userID, orderID string, total Cents, placedAt time.Time) error {
+	_, err := h.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := h.summaries.Queue(ctx, pipe, userID, topProductsKey(userID), orderCacheKey(orderID)); err != nil {
+			return err
+		}
+		queueTopBuyer(ctx, pipe, userID, -total, placedAt, h.now())
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOrderOwner(t *testing.T) {
+	const other = "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	for _, tt := range []struct {
+		name, body, header string
+		want               string
+		invalid            string
+	}{
+		{name: "neither"},
+		{name: "body", body: testUserID, want: testUserID},
+		{name: "header", header: testUserID, want: testUserID},
+		{name: "both agree", body: testUserID, header: "7F0C9A52-1D1E-4C55-9D5E-3A1F6F0B2C11", want: testUserID},
+		{name: "both disagree", body: testUserID, header: other, invalid: headerUserID},
+		{name: "bad body", body: "me", header: testUserID, invalid: "userId"},
+		{name: "bad header", header: "me", invalid: headerUserID},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderOwner("userId", tt.body, tt.header)
+			if tt.invalid == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("owner = %q, %v, want %q", got, err, tt.want)
+				}
+				return
+			}
+			_, body := errorBody(err)
+			fields, _ := body["details"].([]FieldError)
+			if body["code"] != "VALIDATION_FAILED" || len(fields) != 1 || fields[0].Field != tt.invalid {
+				t.Errorf("err = %v, want %s rejected", body, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestCancelOrderNeedsItsOwner(t *testing.T) {
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, unreachableRouter(t), rdb)
+	for name, req := range map[string]*http.Request{
+		"no owner":     newRequest(http.MethodPost, "/v1/orders/"+testUserID+"/cancel", nil),
+		"bad order id": newRequest(http.MethodPost, "/v1/orders/42/cancel", CancelOrderRequest{UserID: testUserID}),
+		"extra field":  newRequest(http.MethodPost, "/v1/orders/"+testUserID+"/cancel", map[string]string{"reason": "x"}),
+	} {
+		if resp, body := send(t, app, req); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	ctx := context.Background()
+	user := seedUser(t, db, "pro", "active")
+	stranger := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "CANCEL", 5, 100)
+	order := seedOrder(t, db, user, "pending", 3, 5, product)
+	seedReservation(t, db, order, product, 3, time.Now().Add(time.Hour))
+	mr.Set(orderCacheKey(order), "{}")
+
+	cancel := func(userID string) (*http.Response, map[string]any) {
+		req := newRequest(http.MethodPost, "/v1/orders/"+order+"/cancel", nil)
+		req.Header.Set(headerUserID, userID)
+		resp, body := send(t, app, req)
+		return resp, decode(t, body)
+	}
+
+	if resp, body := cancel(stranger); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("someone else's order: got %d %v, want 404", resp.StatusCode, body)
+	}
+	resp, body := cancel(user)
+	if resp.StatusCode != fiber.StatusOK || body["status"] != "cancelled" || body["releasedUnits"] != 3.0 || body["total"] != 15.0 {
+		t.Fatalf("cancel: got %d %v, want 200 releasing 3 units", resp.StatusCode, body)
+	}
+	var reserved, events int
+	err := db.Primary().QueryRow(ctx, `
+		SELECT reserved_qty,
+			(SELECT COUNT(*) FROM events WHERE user_id = $2 AND type = 'ORDER_CANCELLED')
+		FROM inventory WHERE product_id = $1`, product, user).Scan(&reserved, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != 0 || events != 1 {
+		t.Errorf("reserved_qty = %d with %d cancel events, want 0 and 1", reserved, events)
+	}
+	waitDeferredWrites()
+	if mr.Exists(orderCacheKey(order)) {
+		t.Error("the cancelled order's cached page survived")
+	}
+
+	resp, body = cancel(user)
+	e, _ := body["error"].(map[string]any)
+	details, _ := e["details"].(map[string]any)
+	if resp.StatusCode != fiber.StatusConflict || e["code"] != "ORDER_NOT_CANCELLABLE" || details["status"] != "cancelled" {
+		t.Errorf("second cancel: got %d %v, want 409 naming the status", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// OrderDetail is one order with its totals breakdown and lines
+type OrderDetail struct {
+	ID             string            `json:"id"`
+	OrderNumber    *string           `json:"order_number"`
+	UserID         string            `json:"user_id"`
+	Status         string            `json:"status"`
+	Subtotal       float64           `json:"subtotal"`
+	Discount       float64           `json:"discount"`
+	Tax            float64           `json:"tax"`
+	Shipping       float64           `json:"shipping"`
+	ShippingMethod string            `json:"shipping_method"`
+	Total          float64           `json:"total"`
+	CreatedAt      time.Time         `json:"created_at"`
+	Items          []OrderDetailItem `json:"items"`
+}
+
+type OrderDetailItem struct {
+	ProductID string  `json:"product_id"`
+	SKU       string  `json:"sku"`
+	Qty       int     `json:"qty"`
+	UnitPrice float64 `json:"unit_price"`
+	LineTotal float64 `json:"line_total"`
+}
+
+// orderCacheKey caches the order page. Every status change (cancel,
+// fulfill, the reservation sweeper) deletes it.
+func orderCacheKey(orderID string) string {
+	return "cache:order:" + orderID
+}
+
+// OrderPayload returns the rendered order, from Redis when cached for
+// CACHE_ORDER_TTL. The bool reports a cache hit.
+func (s *UserOverviewService) OrderPayload(ctx context.Context, orderID string) ([]byte, bool, error) {
+	key := orderCacheKey(orderID)
+	if !isCacheBypassed(ctx) {
+		cached, err := s.rdb.Get(ctx, key).Bytes()
+		switch {
+		case err == nil:
+			s.recordCache(ctx, "order", "hit")
+			return cached, true, nil
+		case err != redis.Nil:
+			cacheBypassed(ctx, "get_order", err)
+		}
+	}
+	if isCacheBypassed(ctx) {
+		s.recordCache(ctx, "order", "bypass")
+	} else {
+		s.recordCache(ctx, "order", "miss")
+	}
+
+	order, err := s.LoadOrder(ctx, orderID)
+	if err != nil {
+		return nil, false, err
+	}
+	payload, err := jsonMarshal(order)
+	if err != nil || isCacheBypassed(ctx) {
+		return payload, false, err
+	}
+	if err := s.rdb.SetEx(ctx, key, payload, s.ttl.TTL(s.cache.OrderTTL)).Err(); err != nil {
+		cacheBypassed(ctx, "set_order", err)
+	}
+	return payload, false, nil
+}
+
+// LoadOrder reads an order and its lines, or ErrOrderNotFound. It reads
+// the primary: clients poll an order right after placing it, and a
+// lagging replica would report it missing or still pending.
+func (s *UserOverviewService) LoadOrder(ctx context.Context, orderID string) (*OrderDetail, error) {
+	ctx, span := startSpan(ctx, "order.load")
+	defer span.End()
+
+	var o OrderDetail
+	err := s.db.Primary().QueryRow(ctx, `
+		SELECT id::text, order_number, user_id::text, status, subtotal::float8, discount::float8,
+			tax::float8, shipping::float8, shipping_method, total::float8, created_at
+		FROM orders WHERE id = $1`, orderID).
+		Scan(&o.ID, &o.OrderNumber, &o.UserID, &o.Status, &o.Subtotal, &o.Discount,
+			&o.Tax, &o.Shipping, &o.ShippingMethod, &o.Total, &o.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, dbError("load order", err)
+	}
+
+	rows, err := s.db.Primary().Query(ctx, `
+		SELECT oi.product_id::text, p.sku, oi.qty, oi.unit_price::float8
+		FROM order_items oi
+		JOIN products p ON p.id = oi.product_id
+		WHERE oi.order_id = $1
+		ORDER BY oi.unit_price * oi.qty DESC, oi.product_id`, orderID)
+	if err != nil {
+		return nil, dbError("load order items", err)
+	}
+	defer rows.Close()
+
+	o.Items = make([]OrderDetailItem, 0, 4)
+	for rows.Next() {
+		var it OrderDetailItem
+		if err := rows.Scan(&it.ProductID, &it.SKU, &it.Qty, &it.UnitPrice); err != nil {
+			return nil, err
+		}
+		it.LineTotal = float64(it.Qty) * it.UnitPrice
+		o.Items = append(o.Items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load order items", err)
+	}
+	return &o, nil
+}
+
+// GetOrder serves one order, by id or by order number. With ?userId= or
+// X-User-Id it 404s unless the order is that user's.
+func (h *UserOverviewHandler) GetOrder(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	c.SetUserContext(ctx)
+	defer markBypass(c, bypassed)
+	number := c.Params("orderId")
+	var orderID string
+	if !orderNumberPattern.MatchString(number) {
+		p := newQueryParams(c)
+		orderID = p.PathUUID("orderId")
+		if err := p.Err(); err != nil {
+			return writeError(c, err)
+		}
+	}
+	owner, err := orderOwner("userId", c.Query("userId"), c.Get(headerUserID))
+	if err != nil {
+		return writeError(c, err)
+	}
+	// Numbers are resolved on every request; the cache is keyed by id,
+	// which is what status changes invalidate
+	if orderID == "" {
+		if orderID, err = h.svc.orderIDByNumber(ctx, number); err != nil {
+			return writeError(c, err)
+		}
+	}
+
+	payload, hit, err := h.svc.OrderPayload(ctx, orderID)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if owner != "" {
+		var o struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(payload, &o); err != nil {
+			return writeError(c, err)
+		}
+		if o.UserID != owner {
+			return writeError(c, ErrOrderNotFound)
+		}
+	}
+	if hit {
+		c.Set(headerCache, "HIT")
+	} else {
+		c.Set(headerCache, "MISS")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(payload)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestGetOrderValidatesItsInput(t *testing.T) {
+	_, rdb := testRedis(t)
+	app := overviewApp(t, unreachableRouter(t), rdb)
+	const other = "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	mismatch := newRequest(http.MethodGet, "/v1/orders/"+testUserID+"?userId="+testUserID, nil)
+	mismatch.Header.Set(headerUserID, other)
+	for name, req := range map[string]*http.Request{
+		"bad id":       newRequest(http.MethodGet, "/v1/orders/42", nil),
+		"bad owner":    newRequest(http.MethodGet, "/v1/orders/"+testUserID+"?userId=me", nil),
+		"owners clash": mismatch,
+	} {
+		if resp, body := send(t, app, req); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	checkout, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	stranger := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "DETAIL", 2.5, 10)
+	order := seedOrder(t, db, user, "pending", 4, 2.5, product)
+
+	resp, body := send(t, app, newRequest(http.MethodGet, "/v1/orders/"+order, nil))
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerCache) != "MISS" {
+		t.Fatalf("got %d X-Cache %q: %s", resp.StatusCode, resp.Header.Get(headerCache), body)
+	}
+	got := decode(t, body)
+	if got["id"] != order || got["user_id"] != user || got["status"] != "pending" || got["total"] != 10.0 {
+		t.Errorf("order = %v", got)
+	}
+	items, _ := got["items"].([]any)
+	if len(items) != 1 {
+		t.Fatalf("items = %v, want one line", got["items"])
+	}
+	line := items[0].(map[string]any)
+	if line["product_id"] != product || !strings.HasPrefix(line["sku"].(string), "DETAIL-") ||
+		line["qty"] != 4.0 || line["unit_price"] != 2.5 || line["line_total"] != 10.0 {
+		t.Errorf("line = %v", line)
+	}
+	if !mr.Exists(orderCacheKey(order)) {
+		t.Fatal("the order page wasn't cached")
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/v1/orders/"+order, nil)); resp.Header.Get(headerCache) != "HIT" {
+		t.Errorf("second read: X-Cache = %q, want HIT", resp.Header.Get(headerCache))
+	}
+
+	// The order number finds the same page
+	number := fmt.Sprintf("ORD-2099-%09d", rand.IntN(1e9))
+	mustExec(t, db, `UPDATE orders SET order_number = $2 WHERE id = $1`, order, number)
+	resp, body = send(t, app, newRequest(http.MethodGet, "/v1/orders/"+number, nil))
+	if resp.StatusCode != fiber.StatusOK || decode(t, body)["id"] != order {
+		t.Errorf("by number: got %d %s, want the order", resp.StatusCode, body)
+	}
+
+	// Someone else asking, even from the cache, is told it doesn't exist
+	for _, owner := range []string{user, stranger} {
+		req := newRequest(http.MethodGet, "/v1/orders/"+order, nil)
+		req.Header.Set(headerUserID, owner)
+		want := fiber.StatusOK
+		if owner == stranger {
+			want = fiber.StatusNotFound
+		}
+		if resp, _ := send(t, app, req); resp.StatusCode != want {
+			t.Errorf("as %s: status = %d, want %d", owner, resp.StatusCode, want)
+		}
+	}
+
+	// A status change drops the cached page
+	if status, body := orderAction(t, checkout, order, user, "cancel"); status != fiber.StatusOK {
+		t.Fatalf("cancel: got %d %v", status, body)
+	}
+	waitDeferredWrites()
+	resp, body = send(t, app, newRequest(http.MethodGet, "/v1/orders/"+order, nil))
+	if resp.Header.Get(headerCache) != "MISS" || decode(t, body)["status"] != "cancelled" {
+		t.Errorf("after cancel: X-Cache %q, %s, want a fresh cancelled order", resp.Header.Get(headerCache), body)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"loastest-go/events"
+)
+
+type FulfillOrderResponse struct {
+	OrderID string `json:"orderId"`
+	Status  string `json:"status"`
+	// ShippedUnits is how much stock left the warehouse
+	ShippedUnits int `json:"shippedUnits"`
+}
+
+// FulfillOrder completes a pending order: what checkout reserved leaves
+// the warehouse for good, so available_qty and reserved_qty both drop by
+// the reserved quantities. It is an admin route.
+func (h *CheckoutHandler) FulfillOrder(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	orderID := p.PathUUID("orderId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+
+	// Detached like checkout, so a disconnect can't abandon it halfway
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.UserContext()), h.cfg.TxTimeout)
+	defer cancel()
+
+	spanCtx, span := startSpan(ctx, "order.fulfill")
+	resp, userID, err := h.fulfillOrderTransaction(spanCtx, orderID)
+	endSpan(span, err)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	// The status shows in the order page and the user's recent orders
+	afterResponse(ctx, "post_fulfill", func(ctx context.Context) error {
+		return h.summaries.Invalidate(ctx, userID, orderCacheKey(orderID))
+	})
+	return c.JSON(resp)
+}
+
+// fulfillOrderTransaction locks the order row first, so it serializes with
+// cancellation and the reservation sweeper; a second fulfill, or one after
+// a cancel, sees the new status and gets the 409. It returns the order's
+// owner for the cache invalidation. extra runs in the same transaction,
+// after the order is completed.
+func (h *CheckoutHandler) fulfillOrderTransaction(
+	ctx context.Context,
+	orderID string,
+	extra ...batchStmt,
+) (*FulfillOrderResponse, string, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	var userID, status string
+	err = tx.QueryRow(ctx, `
+		SELECT user_id::text, status FROM orders WHERE id = $1
+		FOR UPDATE`, orderID).Scan(&userID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, "", dbError("load order", err)
+	}
+	if !canTransition(status, "completed") {
+		return nil, "", transitionError(ErrOrderTransition, status, "completed")
+	}
+
+	// The reservation rows say exactly what to ship and from where. A row
+	// whose inventory would go negative isn't updated, which shows up as a
+	// count mismatch and rolls the whole order back. An order from before
+	// reservations were recorded reserved nothing and ships nothing here.
+	var reserved, shipped, units int
+	err = tx.QueryRow(ctx, `
+		WITH reserved AS (
+			DELETE FROM inventory_reservations WHERE order_id = $1
+			RETURNING product_id, warehouse_id, qty
+		), shipped AS (
+			UPDATE inventory i
+			SET available_qty = i.available_qty - r.qty,
+				reserved_qty = i.reserved_qty - r.qty,
+				updated_at = NOW()
+			FROM reserved r
+			WHERE i.product_id = r.product_id AND i.warehouse_id = r.warehouse_id
+				AND i.available_qty >= r.qty AND i.reserved_qty >= r.qty
+			RETURNING i.product_id
+		)
+		SELECT (SELECT COUNT(*) FROM reserved)::int,
+			(SELECT COUNT(*) FROM shipped)::int,
+			(SELECT COALESCE(SUM(qty), 0) FROM reserved)::int`, orderID).
+		Scan(&reserved, &shipped, &units)
+	if err != nil {
+		return nil, "", dbError("ship reservations", err)
+	}
+	if shipped != reserved {
+		return nil, "", ErrInsufficientStock.WithDetails(fiber.Map{
+			"orderId": orderID, "reservations": reserved, "shippable": shipped,
+		})
+	}
+
+	payload, err := events.Marshal(&events.OrderShippedPayload{
+		OrderID:      orderID,
+		ShippedUnits: units,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	stmts := append([]batchStmt{
+		{"complete order",
+			`UPDATE orders SET status = 'completed' WHERE id = $1`,
+			[]any{orderID}},
+		{"log ship event", `
+			INSERT INTO events(id, user_id, type, payload_json, created_at)
+			VALUES($1, $2, $3, $4, NOW())`,
+			[]any{uuid.New().String(), userID, events.OrderShipped, payload}},
+		outboxEntry(orderEventsStream, map[string]string{
+			"type":         events.OrderShipped,
+			"userId":       userID,
+			"orderId":      orderID,
+			"shippedUnits": strconv.Itoa(units),
+		}),
+	}, extra...)
+	if err := execBatch(ctx, tx, stmts...); err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, "", err
+	}
+
+	return &FulfillOrderResponse{
+		OrderID:      orderID,
+		Status:       "completed",
+		ShippedUnits: units,
+	}, userID, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	for _, tt := range []struct {
+		from, to string
+		ok       bool
+	}{
+		{"pending", "completed", true},
+		{"pending", "cancelled", true},
+		{"pending", "expired", true},
+		{"completed", "shipped", true},
+		{"shipped", "delivered", true},
+		{"pending", "shipped", false},
+		{"completed", "cancelled", false},
+		{"completed", "completed", false},
+		{"cancelled", "completed", false},
+		{"expired", "completed", false},
+		{"delivered", "shipped", false},
+	} {
+		if got := canTransition(tt.from, tt.to); got != tt.ok {
+			t.Errorf("%s -> %s: allowed = %t, want %t", tt.from, tt.to, got, tt.ok)
+		}
+	}
+}
+
+// orderAction posts to an order's cancel or fulfill route as its owner
+func orderAction(t *testing.T, app *fiber.App, order, user, action string) (int, map[string]any) {
+	t.Helper()
+	req := newRequest(http.MethodPost, "/v1/orders/"+order+"/"+action, nil)
+	req.Header.Set(headerUserID, user)
+	resp, body := send(t, app, req)
+	return resp.StatusCode, decode(t, body)
+}
+
+// stock returns the product's available and reserved units in the test
+// warehouse
+func stock(t *testing.T, db *DBRouter, product string) (available, reserved int) {
+	t.Helper()
+	err := db.Primary().QueryRow(context.Background(), `
+		SELECT available_qty, reserved_qty FROM inventory
+		WHERE product_id = $1 AND warehouse_id = $2`, product, testWarehouseID).Scan(&available, &reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return available, reserved
+}
+
+// errorOf is the code and details status of an error body
+func errorOf(body map[string]any) (code, status any) {
+	e, _ := body["error"].(map[string]any)
+	details, _ := e["details"].(map[string]any)
+	return e["code"], details["status"]
+}
+
+func TestFulfillThenCancel(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "FULFILL", 5, 10)
+	order := seedOrder(t, db, user, "pending", 3, 5, product)
+	seedReservation(t, db, order, product, 3, time.Now().Add(time.Hour))
+
+	status, body := orderAction(t, app, order, user, "fulfill")
+	if status != fiber.StatusOK || body["status"] != "completed" || body["shippedUnits"] != 3.0 {
+		t.Fatalf("fulfill: got %d %v, want 200 shipping 3 units", status, body)
+	}
+	if available, reserved := stock(t, db, product); available != 7 || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved, want 7 and 0", available, reserved)
+	}
+
+	status, body = orderAction(t, app, order, user, "fulfill")
+	if code, from := errorOf(body); status != fiber.StatusConflict || code != "INVALID_TRANSITION" || from != "completed" {
+		t.Errorf("second fulfill: got %d %v, want 409 INVALID_TRANSITION from completed", status, body)
+	}
+	status, body = orderAction(t, app, order, user, "cancel")
+	if code, from := errorOf(body); status != fiber.StatusConflict || code != "ORDER_NOT_CANCELLABLE" || from != "completed" {
+		t.Errorf("cancel after fulfill: got %d %v, want 409 ORDER_NOT_CANCELLABLE", status, body)
+	}
+	if available, reserved := stock(t, db, product); available != 7 || reserved != 0 {
+		t.Errorf("after the refused calls: stock = %d/%d, want it unchanged", available, reserved)
+	}
+}
+
+func TestCancelThenFulfill(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "UNFULFILLED", 5, 10)
+	order := seedOrder(t, db, user, "pending", 2, 5, product)
+	seedReservation(t, db, order, product, 2, time.Now().Add(time.Hour))
+
+	if status, body := orderAction(t, app, order, user, "cancel"); status != fiber.StatusOK {
+		t.Fatalf("cancel: got %d %v", status, body)
+	}
+	status, body := orderAction(t, app, order, user, "fulfill")
+	if code, from := errorOf(body); status != fiber.StatusConflict || code != "INVALID_TRANSITION" || from != "cancelled" {
+		t.Errorf("fulfill after cancel: got %d %v, want 409 INVALID_TRANSITION from cancelled", status, body)
+	}
+	// Nothing shipped: the cancel put the reservation back on sale
+	if available, reserved := stock(t, db, product); available != 10 || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved, want 10 and 0", available, reserved)
+	}
+}
+
+func TestFulfillRacingCancel(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "RACE", 5, 10)
+
+	for range 5 {
+		order := seedOrder(t, db, user, "pending", 1, 5, product)
+		seedReservation(t, db, order, product, 1, time.Now().Add(time.Hour))
+		var wg sync.WaitGroup
+		statuses := make(map[string]int)
+		var mu sync.Mutex
+		for _, action := range []string{"fulfill", "cancel"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// send would FailNow off the test's goroutine
+				req := newRequest(http.MethodPost, "/v1/orders/"+order+"/"+action, nil)
+				req.Header.Set(headerUserID, user)
+				resp, err := app.Test(req, -1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				mu.Lock()
+				statuses[action] = resp.StatusCode
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if (statuses["fulfill"] == 200) == (statuses["cancel"] == 200) {
+			t.Fatalf("fulfill %d, cancel %d: want exactly one to win", statuses["fulfill"], statuses["cancel"])
+		}
+		for action, status := range statuses {
+			if status != 200 && status != fiber.StatusConflict {
+				t.Errorf("%s lost with %d, want 409", action, status)
+			}
+		}
+	}
+	// However each race went, every reservation was released once
+	if _, reserved := stock(t, db, product); reserved != 0 {
+		t.Errorf("reserved_qty = %d, want 0", reserved)
+	}
+}
+
+func TestFulfillWithoutStockRollsBack(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "SHORT", 5, 10)
+	order := seedOrder(t, db, user, "pending", 3, 5, product)
+	seedReservation(t, db, order, product, 3, time.Now().Add(time.Hour))
+	// Stock counted out of the warehouse since the order reserved it
+	mustExec(t, db, `UPDATE inventory SET available_qty = 1 WHERE product_id = $1`, product)
+
+	status, body := orderAction(t, app, order, user, "fulfill")
+	if code, _ := errorOf(body); status != fiber.StatusConflict || code != "INSUFFICIENT_INVENTORY" {
+		t.Fatalf("got %d %v, want 409 INSUFFICIENT_INVENTORY", status, body)
+	}
+	if available, reserved := stock(t, db, product); available != 1 || reserved != 3 {
+		t.Errorf("stock = %d/%d, want the rollback to leave 1/3", available, reserved)
+	}
+	// Still pending, so it can be cancelled and its reservation released
+	if status, body := orderAction(t, app, order, user, "cancel"); status != fiber.StatusOK || body["releasedUnits"] != 3.0 {
+		t.Errorf("cancel: got %d %v, want the 3 units released", status, body)
+	}
+}
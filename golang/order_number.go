@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// orderNumberPattern matches the human-readable order numbers that
+// formatOrderNumber writes, such as ORD-2024-000123456
+var orderNumberPattern = regexp.MustCompile(`^ORD-\d{4}-\d{9,}$`)
+
+// formatOrderNumber numbers an order from order_number_seq and the UTC
+// year it was placed. Zero padding keeps numbers of one year sorting in
+// sequence order.
+func formatOrderNumber(placed time.Time, seq int64) string {
+	return fmt.Sprintf("ORD-%d-%09d", placed.UTC().Year(), seq)
+}
+
+// nextOrderNumber draws the next number from order_number_seq. NOW() is
+// the transaction's start, so the year matches the order's created_at. A
+// rolled back checkout leaves a gap in the sequence, as sequences do.
+func nextOrderNumber(ctx context.Context, tx pgx.Tx) (string, error) {
+	var seq int64
+	var now time.Time
+	err := tx.QueryRow(ctx, `SELECT nextval('order_number_seq'), NOW()`).Scan(&seq, &now)
+	if err != nil {
+		return "", dbError("draw order number", err)
+	}
+	return formatOrderNumber(now, seq), nil
+}
+
+// orderIDByNumber resolves an order number to the order's id, or
+// ErrOrderNotFound. It reads the primary, as LoadOrder does.
+func (s *UserOverviewService) orderIDByNumber(ctx context.Context, number string) (string, error) {
+	var orderID string
+	err := s.db.Primary().QueryRow(ctx,
+		`SELECT id::text FROM orders WHERE order_number = $1`, number).Scan(&orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", dbError("find order by number", err)
+	}
+	return orderID, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestFormatOrderNumber(t *testing.T) {
+	// Still 2024 in UTC, whatever the local date
+	placed := time.Date(2025, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*3600))
+	for seq, want := range map[int64]string{
+		1:             "ORD-2024-000000001",
+		123456:        "ORD-2024-000123456",
+		1_234_567_890: "ORD-2024-1234567890",
+	} {
+		got := formatOrderNumber(placed, seq)
+		if got != want || !orderNumberPattern.MatchString(got) {
+			t.Errorf("seq %d = %q, want %q", seq, got, want)
+		}
+	}
+
+	numbers := []string{
+		formatOrderNumber(placed, 10), formatOrderNumber(placed, 9), formatOrderNumber(placed, 100),
+	}
+	sort.Strings(numbers)
+	if numbers[0] != "ORD-2024-000000009" || numbers[2] != "ORD-2024-000000100" {
+		t.Errorf("sorted = %v, want sequence order", numbers)
+	}
+	for _, s := range []string{"ORD-24-000000001", "ORD-2024-00001", "ord-2024-000000001", "ORD-2024-000000001x"} {
+		if orderNumberPattern.MatchString(s) {
+			t.Errorf("%q matched", s)
+		}
+	}
+}
+
+func TestGetOrderByAMalformedNumber(t *testing.T) {
+	_, rdb := testRedis(t)
+	app := overviewApp(t, unreachableRouter(t), rdb)
+	// Not an order number, so it must be a UUID
+	resp, body := send(t, app, newRequest(http.MethodGet, "/v1/orders/ORD-2024-1", nil))
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusBadRequest || e["code"] != "INVALID_QUERY" {
+		t.Errorf("got %d %s, want 400 INVALID_QUERY", resp.StatusCode, body)
+	}
+}
+
+func TestCheckoutNumbersItsOrders(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	app, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "NUMBERED", 1, 10)
+
+	var numbers []string
+	for _, ref := range []string{"pay-n1", "pay-n2"} {
+		out := postCheckout(t, app, CheckoutRequest{
+			UserID: user, PaymentRef: ref, Items: []CheckoutItem{{ProductID: product, Qty: 1}},
+		})
+		var stored string
+		err := db.Primary().QueryRow(ctx, `SELECT order_number FROM orders WHERE id = $1`, out.OrderID).Scan(&stored)
+		if err != nil || stored != out.OrderNumber || !orderNumberPattern.MatchString(stored) {
+			t.Fatalf("order_number = %q, %v, responded %q", stored, err, out.OrderNumber)
+		}
+		numbers = append(numbers, stored)
+	}
+	if numbers[0] >= numbers[1] {
+		t.Errorf("numbers %v don't sort in checkout order", numbers)
+	}
+
+	// Numbers are unique
+	order := seedOrder(t, db, user, "pending", 1, 1, product)
+	_, err := db.Primary().Exec(ctx, `UPDATE orders SET order_number = $2 WHERE id = $1`, order, numbers[0])
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.ConstraintName != "idx_orders_order_number" {
+		t.Errorf("a duplicate number: err = %v, want the unique index", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Reorder line statuses. Added lines are in the cart; the others were
+// left out.
+const (
+	reorderAdded    = "added"
+	reorderLowStock = "low_stock"
+	reorderInactive = "product_inactive"
+	reorderNoStock  = "out_of_stock"
+)
+
+type ReorderRequest struct {
+	UserID string `json:"userId"`
+}
+
+type ReorderResponse struct {
+	OrderID string `json:"orderId"`
+	CartID  string `json:"cartId"`
+	// Merged reports that the items went into the user's existing open
+	// cart rather than a new one
+	Merged  bool          `json:"merged"`
+	Items   []ReorderLine `json:"items"`
+	Added   int           `json:"added"`
+	Skipped int           `json:"skipped"`
+}
+
+// ReorderLine is one product of the past order
+type ReorderLine struct {
+	ProductID string `json:"productId"`
+	// Qty is how many the order had; CartQty is how many the cart now
+	// has, more than Qty when merged with an existing line
+	Qty     int `json:"qty"`
+	CartQty int `json:"cartQty"`
+	// UnitPrice is the product's current price, which the line is added at
+	UnitPrice float64 `json:"unitPrice"`
+	// Status is added, low_stock (added, but the warehouse has fewer than
+	// Qty), product_inactive or out_of_stock (both left out)
+	Status       string `json:"status"`
+	AvailableQty int    `json:"availableQty"`
+	price        Cents
+}
+
+// Reorder serves POST /v1/orders/:orderId/reorder: the order's items go
+// into an open cart at current prices, for the owner named as in
+// CancelOrder. ?mode=strict (the default) refuses when the user already
+// has an open cart; ?mode=merge adds to it instead.
+func (h *CheckoutHandler) Reorder(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	orderID := p.PathUUID("orderId")
+	mode := p.OneOf("mode", "strict", "strict", "merge")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+
+	if len(c.Body()) > h.cfg.MaxBodyBytes {
+		return writeError(c, ErrBodyTooLarge)
+	}
+	var req ReorderRequest
+	if len(c.Body()) > 0 {
+		if err := decodeStrict(c.Body(), &req); err != nil {
+			return writeError(c, err)
+		}
+	}
+	userID, err := orderOwner("userId", req.UserID, c.Get(headerUserID))
+	if err != nil {
+		return writeError(c, err)
+	}
+	if userID == "" {
+		return writeError(c, ErrValidation.WithDetails([]FieldError{{
+			Field: "userId", Message: "is required, in the body or the " + headerUserID + " header",
+		}}))
+	}
+
+	// Detached like checkout, so a disconnect can't skip the invalidation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.UserContext()), h.cfg.TxTimeout)
+	defer cancel()
+
+	spanCtx, span := startSpan(ctx, "order.reorder")
+	resp, err := h.reorderTransaction(spanCtx, orderID, userID, mode == "merge")
+	endSpan(span, err)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	afterResponse(ctx, "post_reorder", func(ctx context.Context) error {
+		return h.summaries.Invalidate(ctx, userID, cartCacheKey(userID))
+	})
+	return c.JSON(resp)
+}
+
+// reorderTransaction locks the user's row first, so concurrent reorders
+// for one user take turns: the second finds the cart the first opened,
+// and in strict mode is refused rather than opening another.
+func (h *CheckoutHandler) reorderTransaction(
+	ctx context.Context,
+	orderID, userID string,
+	merge bool,
+) (*ReorderResponse, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	var region, status string
+	err = tx.QueryRow(ctx, `SELECT region, status FROM users WHERE id = $1 FOR UPDATE`, userID).
+		Scan(&region, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, dbError("lock user", err)
+	}
+	if status != "active" {
+		return nil, ErrUserInactive
+	}
+
+	// Someone else's order is reported as not found, as in CancelOrder
+	var owner string
+	err = tx.QueryRow(ctx, `SELECT user_id::text FROM orders WHERE id = $1`, orderID).Scan(&owner)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && owner != userID) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, dbError("load order", err)
+	}
+
+	lines, err := loadReorderLines(ctx, tx, orderID, warehouseForRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	resp := &ReorderResponse{OrderID: orderID, Items: lines}
+	var productIDs []string
+	var qtys []int
+	var prices []Cents
+	for _, l := range lines {
+		if l.Status == reorderAdded || l.Status == reorderLowStock {
+			productIDs = append(productIDs, l.ProductID)
+			qtys = append(qtys, l.Qty)
+			prices = append(prices, l.price)
+		}
+	}
+	resp.Added, resp.Skipped = len(productIDs), len(lines)-len(productIDs)
+	if resp.Added == 0 {
+		return nil, ErrNothingToReorder.WithDetails(lines)
+	}
+
+	// The cart row lock waits out a checkout of the cart; one it closed is
+	// no longer open when the row is rechecked, so a new cart is opened
+	var cartID string
+	err = tx.QueryRow(ctx, `
+		SELECT id::text FROM carts
+		WHERE user_id = $1 AND status = 'open'
+		ORDER BY updated_at DESC
+		LIMIT 1
+		FOR UPDATE`, userID).Scan(&cartID)
+	switch {
+	case err == nil && !merge:
+		return nil, ErrOpenCartExists.WithDetails(fiber.Map{"cartId": cartID})
+	case err == nil:
+		resp.Merged = true
+		_, err = tx.Exec(ctx, `UPDATE carts SET updated_at = NOW() WHERE id = $1`, cartID)
+		if err != nil {
+			return nil, dbError("touch cart", err)
+		}
+	case errors.Is(err, pgx.ErrNoRows):
+		cartID = uuid.New().String()
+		_, err = tx.Exec(ctx, `
+			INSERT INTO carts(id, user_id, status, updated_at) VALUES($1, $2, 'open', NOW())`,
+			cartID, userID)
+		if err != nil {
+			return nil, dbError("create cart", err)
+		}
+	default:
+		return nil, dbError("load open cart", err)
+	}
+	resp.CartID = cartID
+
+	// A merged line takes the current price and is capped at
+	// CHECKOUT_MAX_QTY, so the cart can still be checked out
+	rows, err := tx.Query(ctx, `
+		INSERT INTO cart_items(cart_id, product_id, qty, unit_price)
+		SELECT $1, t.product_id::uuid, LEAST(t.qty, $5), t.unit_price
+		FROM unnest($2::text[], $3::int[], $4::numeric[]) AS t(product_id, qty, unit_price)
+		ON CONFLICT (cart_id, product_id) DO UPDATE
+		SET qty = LEAST(cart_items.qty + EXCLUDED.qty, $5), unit_price = EXCLUDED.unit_price
+		RETURNING product_id::text, qty`,
+		cartID, productIDs, qtys, prices, h.cfg.MaxQty)
+	if err != nil {
+		return nil, dbError("add cart items", err)
+	}
+	cartQty := make(map[string]int, len(productIDs))
+	for rows.Next() {
+		var id string
+		var qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cartQty[id] = qty
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, dbError("add cart items", err)
+	}
+	for i := range resp.Items {
+		resp.Items[i].CartQty = cartQty[resp.Items[i].ProductID]
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// loadReorderLines reads the order's products, merging repeated lines,
+// with their current price and status and what warehouseID has free
+func loadReorderLines(ctx context.Context, tx pgx.Tx, orderID, warehouseID string) ([]ReorderLine, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT oi.product_id::text, SUM(oi.qty)::int, p.price, p.status,
+			COALESCE(MAX(i.available_qty - i.reserved_qty), 0)::int
+		FROM order_items oi
+		JOIN products p ON p.id = oi.product_id
+		LEFT JOIN inventory i ON i.product_id = oi.product_id AND i.warehouse_id = $2
+		WHERE oi.order_id = $1
+		GROUP BY oi.product_id, p.price, p.status
+		ORDER BY oi.product_id`, orderID, warehouseID)
+	if err != nil {
+		return nil, dbError("load order items", err)
+	}
+	defer rows.Close()
+	lines := []ReorderLine{}
+	for rows.Next() {
+		var l ReorderLine
+		var productStatus string
+		if err := rows.Scan(&l.ProductID, &l.Qty, &l.price, &productStatus, &l.AvailableQty); err != nil {
+			return nil, err
+		}
+		l.UnitPrice = l.price.Dollars()
+		l.AvailableQty = max(l.AvailableQty, 0)
+		switch {
+		case productStatus != "active":
+			l.Status = reorderInactive
+		case l.AvailableQty == 0:
+			l.Status = reorderNoStock
+		case l.AvailableQty < l.Qty:
+			l.Status = reorderLowStock
+		default:
+			l.Status = reorderAdded
+		}
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load order items", err)
+	}
+	return lines, nil
+}
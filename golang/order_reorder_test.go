@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// postReorder posts to the order's reorder route as user, with query
+func postReorder(order, user, query string) *http.Request {
+	req := newRequest(http.MethodPost, "/v1/orders/"+order+"/reorder"+query, nil)
+	if user != "" {
+		req.Header.Set(headerUserID, user)
+	}
+	return req
+}
+
+func TestReorderRejectsBadRequests(t *testing.T) {
+	h := &CheckoutHandler{}
+	h.cfg.MaxBodyBytes = 1 << 10
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/orders/:orderId/reorder", h.Reorder)
+	order := uuid.NewString()
+	mismatched := newRequest(http.MethodPost, "/v1/orders/"+order+"/reorder", ReorderRequest{UserID: testUserID})
+	mismatched.Header.Set(headerUserID, uuid.NewString())
+
+	for name, tt := range map[string]struct {
+		req  *http.Request
+		code string
+	}{
+		"bad order id":     {postReorder("42", testUserID, ""), "INVALID_QUERY"},
+		"unknown mode":     {postReorder(order, testUserID, "?mode=replace"), "INVALID_QUERY"},
+		"no user":          {postReorder(order, "", ""), "VALIDATION_FAILED"},
+		"bad user":         {postReorder(order, "alice", ""), "VALIDATION_FAILED"},
+		"users disagree":   {mismatched, "VALIDATION_FAILED"},
+		"unknown body key": {newRequest(http.MethodPost, "/v1/orders/"+order+"/reorder", `{"user":"x"}`), "INVALID_JSON"},
+	} {
+		resp, body := send(t, app, tt.req)
+		if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusBadRequest || e["code"] != tt.code {
+			t.Errorf("%s: got %d %s, want 400 %s", name, resp.StatusCode, body, tt.code)
+		}
+	}
+}
+
+// reorderApp is checkoutApp with the reorder route mounted
+func reorderApp(t *testing.T, db *DBRouter) *fiber.App {
+	_, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	app.Post("/v1/orders/:orderId/reorder", h.Reorder)
+	return app
+}
+
+// reorder posts the reorder and decodes a 200
+func reorder(t *testing.T, app *fiber.App, order, user, query string) ReorderResponse {
+	t.Helper()
+	resp, body := send(t, app, postReorder(order, user, query))
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("reorder: status = %d: %s", resp.StatusCode, body)
+	}
+	var out ReorderResponse
+	if err := jsonUnmarshal(body, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestReorderAtCurrentPrices(t *testing.T) {
+	db := testRouter(t)
+	app := reorderApp(t, db)
+	user := seedUser(t, db, "pro", "active")
+	repriced := seedProduct(t, db, "REORDER-PRICE", 5, 10)
+	scarce := seedProduct(t, db, "REORDER-SCARCE", 5, 1)
+	retired := seedProduct(t, db, "REORDER-RETIRED", 5, 10)
+	sold := seedProduct(t, db, "REORDER-SOLD", 5, 0)
+	order := seedOrder(t, db, user, "completed", 2, 5, repriced, scarce, retired, sold)
+	mustExec(t, db, `UPDATE products SET price = 6.25 WHERE id = $1`, repriced)
+	mustExec(t, db, `UPDATE products SET status = 'inactive' WHERE id = $1`, retired)
+
+	out := reorder(t, app, order, user, "")
+	if out.Merged || out.Added != 2 || out.Skipped != 2 {
+		t.Errorf("reorder = %+v, want a new cart with 2 added and 2 skipped", out)
+	}
+	status := map[string]string{}
+	for _, l := range out.Items {
+		status[l.ProductID] = l.Status
+	}
+	want := map[string]string{
+		repriced: reorderAdded, scarce: reorderLowStock, retired: reorderInactive, sold: reorderNoStock,
+	}
+	for id, s := range want {
+		if status[id] != s {
+			t.Errorf("product %s is %q, want %s", id, status[id], s)
+		}
+	}
+
+	rows, err := db.Primary().Query(context.Background(), `
+		SELECT product_id::text, qty, unit_price::float8 FROM cart_items WHERE cart_id = $1`, out.CartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	items := map[string][2]float64{}
+	for rows.Next() {
+		var id string
+		var qty int
+		var price float64
+		if err := rows.Scan(&id, &qty, &price); err != nil {
+			t.Fatal(err)
+		}
+		items[id] = [2]float64{float64(qty), price}
+	}
+	if len(items) != 2 || items[repriced] != [2]float64{2, 6.25} || items[scarce] != [2]float64{2, 5} {
+		t.Errorf("cart = %v, want the repriced and scarce lines at current prices", items)
+	}
+
+	// Nothing left to sell is a conflict, not an empty cart
+	mustExec(t, db, `UPDATE products SET status = 'inactive' WHERE id = ANY($1::uuid[])`, []string{repriced, scarce})
+	mustExec(t, db, `UPDATE carts SET status = 'closed' WHERE id = $1`, out.CartID)
+	resp, body := send(t, app, postReorder(order, user, ""))
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusConflict || e["code"] != "NOTHING_TO_REORDER" {
+		t.Errorf("all retired: got %d %s, want 409 NOTHING_TO_REORDER", resp.StatusCode, body)
+	}
+}
+
+func TestReorderIntoAnOpenCart(t *testing.T) {
+	db := testRouter(t)
+	app := reorderApp(t, db)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "REORDER-MERGE", 5, 50)
+	order := seedOrder(t, db, user, "completed", 3, 5, product)
+	cart := seedCart(t, db, user, "open", 5, product)
+
+	resp, body := send(t, app, postReorder(order, user, "?mode=strict"))
+	e, _ := decode(t, body)["error"].(map[string]any)
+	details, _ := e["details"].(map[string]any)
+	if resp.StatusCode != fiber.StatusConflict || e["code"] != "OPEN_CART_EXISTS" || details["cartId"] != cart {
+		t.Errorf("strict: got %d %s, want 409 OPEN_CART_EXISTS naming the cart", resp.StatusCode, body)
+	}
+
+	out := reorder(t, app, order, user, "?mode=merge")
+	if !out.Merged || out.CartID != cart || len(out.Items) != 1 || out.Items[0].CartQty != 4 {
+		t.Errorf("merge = %+v, want the 3 units added to the cart's 1", out)
+	}
+
+	// Someone else's order is not found, whatever the mode
+	other := seedUser(t, db, "pro", "active")
+	resp, body = send(t, app, postReorder(order, other, "?mode=merge"))
+	if e, _ := decode(t, body)["error"].(map[string]any); resp.StatusCode != fiber.StatusNotFound || e["code"] != "ORDER_NOT_FOUND" {
+		t.Errorf("another user: got %d %s, want 404 ORDER_NOT_FOUND", resp.StatusCode, body)
+	}
+}
+
+func TestConcurrentReordersOpenOneCart(t *testing.T) {
+	db := testRouter(t)
+	app := reorderApp(t, db)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "REORDER-RACE", 5, 50)
+	order := seedOrder(t, db, user, "completed", 1, 5, product)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// send would FailNow off the test's goroutine
+			resp, err := app.Test(postReorder(order, user, ""), -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			mu.Lock()
+			statuses[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if statuses[fiber.StatusOK] != 1 || statuses[fiber.StatusConflict] != 3 {
+		t.Errorf("statuses = %v, want one cart opened and the rest refused", statuses)
+	}
+	var carts int
+	if err := db.Primary().QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM carts WHERE user_id = $1 AND status = 'open'`, user).Scan(&carts); err != nil || carts != 1 {
+		t.Errorf("open carts = %d, %v, want 1", carts, err)
+	}
+}
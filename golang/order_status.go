@@ -0,0 +1,29 @@
+package main
+
+import "github.com/gofiber/fiber/v2"
+
+// orderTransitions is every status change an order may make. Checkout
+// creates orders pending; from there they are fulfilled (completed) by an
+// admin or a payment webhook, cancelled by the user or a failed payment,
+// or expired by the reservation sweeper, and a completed order moves on
+// to shipped and delivered. Anything not listed is a 409.
+var orderTransitions = map[string][]string{
+	"pending":   {"completed", "cancelled", "expired"},
+	"completed": {"shipped"},
+	"shipped":   {"delivered"},
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionError is the 409 for an order that can't go from one status
+// to another
+func transitionError(base *AppError, from, to string) error {
+	return base.WithDetails(fiber.Map{"status": from, "requested": to})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+	"loastest-go/events"
+)
+
+var (
+	orderStreamEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_stream_entries_total",
+		Help: "stream:order_events entries handled by this instance's consumer, by outcome (counted, duplicate, skipped).",
+	}, []string{"outcome"})
+	orderStreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "order_stream_lag_entries",
+		Help: "stream:order_events entries not yet delivered to the consumer group, as of this instance's last check; 0 when Redis can't tell.",
+	})
+	orderStreamPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "order_stream_pending_entries",
+		Help: "stream:order_events entries delivered to the consumer group but not yet acknowledged, as of this instance's last check.",
+	})
+)
+
+// countOrderScript acknowledges entry ARGV[2] for group ARGV[1] on stream
+// KEYS[1] and, only if it was still pending, adds its order and ARGV[3]
+// cents to the day's stats hash KEYS[2], expiring at unix time ARGV[4].
+// Counting and acknowledging together means an entry claimed from a
+// crashed consumer, or processed twice in a race, is counted once.
+var countOrderScript = redis.NewScript(`
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+  return 0
+end
+redis.call('HINCRBY', KEYS[2], 'orders', 1)
+redis.call('HINCRBY', KEYS[2], 'revenue_cents', ARGV[3])
+redis.call('EXPIREAT', KEYS[2], ARGV[4])
+return 1
+`)
+
+// OrderStreamConsumer reads stream:order_events in a consumer group and
+// keeps per-day order counts and revenue in metrics:orders:{yyyy-mm-dd}
+// hashes, dated by when the entry reached the stream. The outbox delivers
+// at least once, so an order it publishes twice is counted twice; a
+// redelivered entry is not. It also trims the stream, which nothing else
+// bounds.
+type OrderStreamConsumer struct {
+	rdb      *redis.Client
+	cfg      config.OrderStreamConfig
+	consumer string
+}
+
+// NewOrderStreamConsumer names the consumer ORDER_STREAM_CONSUMER_NAME,
+// or hostname-pid when that is unset. Prefork children add their pid to a
+// configured name, since each reads on its own.
+func NewOrderStreamConsumer(rdb *redis.Client, cfg config.OrderStreamConfig) *OrderStreamConsumer {
+	consumer := cfg.Consumer
+	if consumer == "" {
+		host, _ := os.Hostname()
+		consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	} else if fiber.IsChild() {
+		consumer = fmt.Sprintf("%s-%d", consumer, os.Getpid())
+	}
+	return &OrderStreamConsumer{rdb: rdb, cfg: cfg, consumer: consumer}
+}
+
+// Enabled reports whether ORDER_STREAM_CONSUMER turns the consumer on
+func (o *OrderStreamConsumer) Enabled() bool {
+	return o.cfg.Enabled
+}
+
+func (o *OrderStreamConsumer) key(day time.Time) string {
+	return "metrics:orders:" + day.UTC().Format(time.DateOnly)
+}
+
+// Run consumes until ctx is done. Failures are logged and retried after a
+// second; entries left unacknowledged are claimed again after ClaimIdle.
+func (o *OrderStreamConsumer) Run(ctx context.Context) {
+	log.Printf("📨 Consuming %s as %s/%s", orderEventsStream, o.cfg.Group, o.consumer)
+	grouped := false
+	var nextClaim, nextTrim time.Time
+	for ctx.Err() == nil {
+		err := func() error {
+			if !grouped {
+				if err := o.createGroup(ctx); err != nil {
+					return err
+				}
+				grouped = true
+			}
+			if now := time.Now(); now.After(nextClaim) {
+				if err := o.claim(ctx); err != nil {
+					return err
+				}
+				nextClaim = now.Add(o.cfg.ClaimIdle)
+			}
+			if err := o.read(ctx); err != nil {
+				return err
+			}
+			if now := time.Now(); now.After(nextTrim) {
+				nextTrim = now.Add(o.cfg.Block)
+				return o.trim(ctx)
+			}
+			return nil
+		}()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		// The stream or group is gone, e.g. after a FLUSHALL
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			grouped = false
+		}
+		log.Printf("⚠️  Order stream consumer failed: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// createGroup creates the group, and the stream if need be, reading from
+// the start of the stream so entries added before it existed are counted
+func (o *OrderStreamConsumer) createGroup(ctx context.Context) error {
+	err := o.rdb.XGroupCreateMkStream(ctx, orderEventsStream, o.cfg.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// claim takes over entries that another consumer, presumably crashed, has
+// held unacknowledged for ClaimIdle, and processes them
+func (o *OrderStreamConsumer) claim(ctx context.Context) error {
+	start := "0-0"
+	for {
+		msgs, next, err := o.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   orderEventsStream,
+			Group:    o.cfg.Group,
+			Consumer: o.consumer,
+			MinIdle:  o.cfg.ClaimIdle,
+			Start:    start,
+			Count:    int64(o.cfg.BatchSize),
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if err := o.process(ctx, msgs); err != nil {
+			return err
+		}
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// read processes the next batch of new entries, waiting up to Block for
+// one to arrive
+func (o *OrderStreamConsumer) read(ctx context.Context) error {
+	streams, err := o.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    o.cfg.Group,
+		Consumer: o.consumer,
+		Streams:  []string{orderEventsStream, ">"},
+		Count:    int64(o.cfg.BatchSize),
+		Block:    o.cfg.Block,
+	}).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		if err := o.process(ctx, stream.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// process counts and acknowledges msgs in one pipeline. Entries that
+// aren't new orders are acknowledged without being counted. On error
+// whatever wasn't acknowledged stays pending, to be claimed again.
+func (o *OrderStreamConsumer) process(ctx context.Context, msgs []redis.XMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	pipe := o.rdb.Pipeline()
+	cmds := make([]*redis.Cmd, len(msgs))
+	for i, msg := range msgs {
+		day, total, ok := parseOrderEvent(msg)
+		if !ok {
+			pipe.XAck(ctx, orderEventsStream, o.cfg.Group, msg.ID)
+			continue
+		}
+		expireAt := day.Truncate(24*time.Hour).AddDate(0, 0, o.cfg.StatsRetentionDays+1)
+		// EVALSHA can't fall back to EVAL inside a pipeline, so this sends
+		// the script
+		cmds[i] = countOrderScript.Eval(ctx, pipe,
+			[]string{orderEventsStream, o.key(day)},
+			o.cfg.Group, msg.ID, int64(total), expireAt.Unix())
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		switch {
+		case cmd == nil:
+			orderStreamEntries.WithLabelValues("skipped").Inc()
+		case cmd.Val() == int64(1):
+			orderStreamEntries.WithLabelValues("counted").Inc()
+		default:
+			orderStreamEntries.WithLabelValues("duplicate").Inc()
+		}
+	}
+	return nil
+}
+
+// parseOrderEvent reads an ORDER_CREATED entry: the time it was added,
+// taken from its id, and the order total. Other events aren't orders.
+func parseOrderEvent(msg redis.XMessage) (time.Time, Cents, bool) {
+	if t, _ := msg.Values["type"].(string); t != "" && t != events.OrderCreated {
+		return time.Time{}, 0, false
+	}
+	ms, _, _ := strings.Cut(msg.ID, "-")
+	at, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if id, _ := msg.Values["orderId"].(string); id == "" {
+		return time.Time{}, 0, false
+	}
+	raw, _ := msg.Values["total"].(string)
+	total, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.UnixMilli(at).UTC(), Cents(math.Round(total * 100)), true
+}
+
+// trim caps the stream at about MaxLen entries and refreshes the lag and
+// pending gauges. Entries trimmed before the group reads them never reach
+// the stats, so MaxLen should cover the orders of any backlog expected.
+func (o *OrderStreamConsumer) trim(ctx context.Context) error {
+	if err := o.rdb.XTrimMaxLenApprox(ctx, orderEventsStream, int64(o.cfg.MaxLen), 0).Err(); err != nil {
+		return err
+	}
+	groups, err := o.rdb.XInfoGroups(ctx, orderEventsStream).Result()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Name == o.cfg.Group {
+			orderStreamLag.Set(float64(g.Lag))
+			orderStreamPending.Set(float64(g.Pending))
+		}
+	}
+	return nil
+}
+
+// DailyOrderStats is one day of the window
+type DailyOrderStats struct {
+	Date    string  `json:"date"`
+	Orders  int64   `json:"orders"`
+	Revenue float64 `json:"revenue"`
+	revenue Cents
+}
+
+// Stats returns the order count and revenue for each of the days days
+// ending at now, oldest first
+func (o *OrderStreamConsumer) Stats(ctx context.Context, days int, now time.Time) ([]DailyOrderStats, error) {
+	pipe := o.rdb.Pipeline()
+	cmds := make([]*redis.SliceCmd, days)
+	daily := make([]DailyOrderStats, days)
+	for i := range days {
+		day := now.UTC().AddDate(0, 0, i-days+1)
+		daily[i].Date = day.Format(time.DateOnly)
+		cmds[i] = pipe.HMGet(ctx, o.key(day), "orders", "revenue_cents")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		vals := cmd.Val()
+		orders, _ := vals[0].(string)
+		cents, _ := vals[1].(string)
+		daily[i].Orders, _ = strconv.ParseInt(orders, 10, 64)
+		n, _ := strconv.ParseInt(cents, 10, 64)
+		daily[i].revenue = Cents(n)
+		daily[i].Revenue = daily[i].revenue.Dollars()
+	}
+	return daily, nil
+}
+
+// StatsHandler serves GET /v1/internal/stats/orders?days=
+func (o *OrderStreamConsumer) StatsHandler(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	days := p.Int("days", 7, o.cfg.StatsRetentionDays)
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	daily, err := o.Stats(c.UserContext(), days, time.Now())
+	if err != nil {
+		return writeError(c, ErrRedisUnavailable.With(err))
+	}
+	var orders int64
+	var revenue Cents
+	for _, d := range daily {
+		orders += d.Orders
+		revenue += d.revenue
+	}
+	return c.JSON(fiber.Map{
+		"consuming": o.Enabled(),
+		"days":      days,
+		"orders":    orders,
+		"revenue":   revenue.Dollars(),
+		"daily":     daily,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// streamConsumer is an OrderStreamConsumer named name in group "stats"
+func streamConsumer(rdb *redis.Client, name string) *OrderStreamConsumer {
+	return NewOrderStreamConsumer(rdb, config.OrderStreamConfig{
+		Enabled: true, Group: "stats", Consumer: name, BatchSize: 10,
+		Block: time.Millisecond, ClaimIdle: time.Minute, MaxLen: 1000, StatsRetentionDays: 7,
+	})
+}
+
+// addStreamEntry adds values to stream:order_events as entry id
+func addStreamEntry(t *testing.T, rdb *redis.Client, id string, values ...any) {
+	t.Helper()
+	err := rdb.XAdd(context.Background(), &redis.XAddArgs{Stream: orderEventsStream, ID: id, Values: values}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseOrderEvent(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	id := fmt.Sprintf("%d-0", at.UnixMilli())
+	for _, tt := range []struct {
+		name   string
+		values map[string]any
+		total  Cents
+		ok     bool
+	}{
+		{"created", map[string]any{"type": "ORDER_CREATED", "orderId": "o-1", "total": "19.99"}, 19_99, true},
+		{"untyped, from before types", map[string]any{"orderId": "o-1", "total": "5"}, 5_00, true},
+		{"cancelled", map[string]any{"type": "ORDER_CANCELLED", "orderId": "o-1", "total": "5"}, 0, false},
+		{"no order", map[string]any{"type": "ORDER_CREATED", "total": "5"}, 0, false},
+		{"bad total", map[string]any{"type": "ORDER_CREATED", "orderId": "o-1", "total": "five"}, 0, false},
+	} {
+		day, total, ok := parseOrderEvent(redis.XMessage{ID: id, Values: tt.values})
+		if ok != tt.ok || total != tt.total || (ok && !day.Equal(at)) {
+			t.Errorf("%s: got %s %d %v, want %d %v", tt.name, day, total, ok, tt.total, tt.ok)
+		}
+	}
+}
+
+func TestOrderStreamReclaimsACrashedConsumersEntries(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	ms := now.UnixMilli()
+	crashed, survivor := streamConsumer(rdb, "crashed"), streamConsumer(rdb, "survivor")
+	if err := crashed.createGroup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := survivor.createGroup(ctx); err != nil {
+		t.Fatalf("a second createGroup: %v", err)
+	}
+	addStreamEntry(t, rdb, fmt.Sprintf("%d-1", ms), "type", "ORDER_CREATED", "orderId", "o-1", "total", "10.50")
+	addStreamEntry(t, rdb, fmt.Sprintf("%d-2", ms), "type", "ORDER_CREATED", "orderId", "o-2", "total", "4.25")
+	addStreamEntry(t, rdb, fmt.Sprintf("%d-3", ms), "type", "ORDER_CANCELLED", "orderId", "o-1")
+
+	// The crashed consumer read everything and acknowledged nothing
+	msgs, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "stats", Consumer: "crashed", Streams: []string{orderEventsStream, ">"}, Count: 10,
+	}).Result()
+	if err != nil || len(msgs[0].Messages) != 3 {
+		t.Fatalf("crashed read %v, %v", msgs, err)
+	}
+	// Not idle long enough yet: nothing to claim, nothing new to read
+	if err := survivor.claim(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := survivor.read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(survivor.key(now)) {
+		t.Fatal("counted entries another consumer still holds")
+	}
+
+	mr.SetTime(now.Add(2 * time.Minute))
+	if err := survivor.claim(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := survivor.Stats(ctx, 1, now)
+	if err != nil || stats[0].Orders != 2 || stats[0].revenue != 14_75 {
+		t.Fatalf("stats = %+v, %v, want 2 orders of 14.75", stats, err)
+	}
+	if pending, _ := rdb.XPending(ctx, orderEventsStream, "stats").Result(); pending.Count != 0 {
+		t.Errorf("%d entries still pending, want all acknowledged", pending.Count)
+	}
+
+	// The crashed consumer comes back and finishes what it started
+	if err := crashed.process(ctx, msgs[0].Messages); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := survivor.Stats(ctx, 1, now); stats[0].Orders != 2 {
+		t.Errorf("orders = %d after a redelivery, want 2", stats[0].Orders)
+	}
+	if ttl := mr.TTL(survivor.key(now)); ttl <= 0 {
+		t.Error("the day's stats don't expire")
+	}
+}
+
+func TestOrderStreamTrimsAndServesStats(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	o := streamConsumer(rdb, "only")
+	o.cfg.MaxLen = 10
+	if err := o.createGroup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i := range 50 {
+		addStreamEntry(t, rdb, fmt.Sprintf("%d-%d", now.UnixMilli(), i+1),
+			"type", "ORDER_CREATED", "orderId", fmt.Sprint("o-", i), "total", "2")
+	}
+	if err := o.read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.trim(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := rdb.XLen(ctx, orderEventsStream).Result(); n > 10 {
+		t.Errorf("stream length = %d after trimming, want about 10", n)
+	}
+	mr.HSet(o.key(now.AddDate(0, 0, -1)), "orders", "3", "revenue_cents", "1500")
+
+	app := fiber.New()
+	app.Get("/stats", o.StatsHandler)
+	resp, body := send(t, app, newRequest(http.MethodGet, "/stats?days=2", nil))
+	got := decode(t, body)
+	daily, _ := got["daily"].([]any)
+	if resp.StatusCode != fiber.StatusOK || got["orders"] != 13.0 || got["revenue"] != 35.0 || len(daily) != 2 {
+		t.Errorf("got %d %s, want the batch read plus yesterday's 3 over 2 days", resp.StatusCode, body)
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/stats?days=30", nil)); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("days past the retention: status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+var (
+	outboxEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_events_total",
+		Help: "Outbox rows handled by this instance's relay, by outcome (published, retried, dead).",
+	}, []string{"outcome"})
+	outboxLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_lag_seconds",
+		Help: "Age of the oldest unpublished outbox row, as of this instance's last relay pass; 0 when none is waiting.",
+	})
+)
+
+// orderEventsStream receives an entry per order event for downstream
+// consumers, its events.type in the type field. Entries from before the
+// field was added are all ORDER_CREATED.
+const orderEventsStream = "stream:order_events"
+
+// outboxInsertSQL queues a stream entry in the caller's transaction, so it
+// is published if and only if the transaction commits
+const outboxInsertSQL = `
+	INSERT INTO event_outbox(stream, payload, created_at)
+	VALUES($1, $2, NOW())`
+
+// outboxEntry returns the batch statement that queues fields for stream
+func outboxEntry(stream string, fields map[string]string) batchStmt {
+	payload, _ := json.Marshal(fields)
+	return batchStmt{"queue outbox event", outboxInsertSQL, []any{stream, string(payload)}}
+}
+
+// OutboxRelay publishes event_outbox rows to their streams. Every instance
+// runs one; SKIP LOCKED gives each row to one relay at a time. A row is
+// marked published only after its XADD succeeded, so delivery is at least
+// once: a crash between the two sends it again, and each entry carries
+// its outboxId for consumers to drop the repeat.
+type OutboxRelay struct {
+	db  *DBRouter
+	rdb *redis.Client
+	cfg config.OutboxConfig
+	// lag is the last measured age of the oldest unpublished row, in
+	// nanoseconds, or -1 before the first measurement
+	lag atomic.Int64
+}
+
+func NewOutboxRelay(db *DBRouter, rdb *redis.Client, cfg config.OutboxConfig) *OutboxRelay {
+	r := &OutboxRelay{db: db, rdb: rdb, cfg: cfg}
+	r.lag.Store(-1)
+	return r
+}
+
+// Enabled reports whether OUTBOX_RELAY_INTERVAL turns the relay on
+func (r *OutboxRelay) Enabled() bool {
+	return r.cfg.RelayInterval > 0
+}
+
+// Run relays every interval until ctx is done
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.RelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.tick(ctx)
+		}
+	}
+}
+
+// tick publishes batches until one comes back short, then measures the lag
+func (r *OutboxRelay) tick(ctx context.Context) {
+	for {
+		n, err := r.relayBatch(ctx)
+		if err != nil {
+			log.Printf("⚠️  Outbox relay failed: %v", err)
+			break
+		}
+		if n < r.cfg.BatchSize {
+			break
+		}
+	}
+	if err := r.measureLag(ctx); err != nil {
+		log.Printf("⚠️  Outbox lag not measured: %v", err)
+	}
+}
+
+type outboxRow struct {
+	id       int64
+	stream   string
+	fields   map[string]string
+	attempts int
+}
+
+// relayBatch claims up to BatchSize due rows and publishes them. Rows
+// Redis rejects are rescheduled or dead-lettered; if Redis can't be
+// reached at all the transaction rolls back, leaving every row as it was
+// for the next pass. It returns how many rows it claimed.
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, max(r.cfg.RelayInterval, 5*time.Second))
+	defer cancel()
+
+	tx, err := r.db.Primary().Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, stream, payload, attempts FROM event_outbox
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, r.cfg.BatchSize)
+	if err != nil {
+		return 0, dbError("load outbox", err)
+	}
+	var batch []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		var payload string
+		if err := rows.Scan(&row.id, &row.stream, &payload, &row.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// A payload that isn't a flat object can never be published
+		if json.Unmarshal([]byte(payload), &row.fields) != nil {
+			row.fields = nil
+		}
+		batch = append(batch, row)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, dbError("load outbox", err)
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	pipe := r.rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(batch))
+	for i, row := range batch {
+		if row.fields == nil {
+			continue
+		}
+		values := make(map[string]any, len(row.fields)+1)
+		for k, v := range row.fields {
+			values[k] = v
+		}
+		values["outboxId"] = row.id
+		cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{Stream: row.stream, Values: values})
+	}
+	pipe.Exec(ctx)
+
+	var published, failedIDs []int64
+	var failedErrs []string
+	dead := 0
+	for i, row := range batch {
+		var err error = errors.New("payload is not a JSON object of strings")
+		if cmds[i] != nil {
+			err = cmds[i].Err()
+		}
+		var rejected redis.Error
+		switch {
+		case err == nil:
+			published = append(published, row.id)
+		case cmds[i] == nil || errors.As(err, &rejected):
+			failedIDs = append(failedIDs, row.id)
+			failedErrs = append(failedErrs, err.Error())
+			if row.attempts+1 >= r.cfg.MaxAttempts {
+				dead++
+			}
+		default:
+			// No reply: Redis is unreachable, which is no fault of the row
+			return 0, err
+		}
+	}
+
+	err = execBatch(ctx, tx,
+		batchStmt{"mark outbox published", `
+			UPDATE event_outbox SET status = 'published', published_at = NOW()
+			WHERE id = ANY($1)`,
+			[]any{published}},
+		batchStmt{"reschedule outbox", `
+			UPDATE event_outbox o
+			SET attempts = o.attempts + 1,
+				last_error = f.err,
+				status = CASE WHEN o.attempts + 1 >= $3 THEN 'dead' ELSE 'pending' END,
+				next_attempt_at = NOW() + make_interval(secs => $4 * 2 ^ LEAST(o.attempts, 16))
+			FROM unnest($1::bigint[], $2::text[]) AS f(id, err)
+			WHERE o.id = f.id`,
+			[]any{failedIDs, failedErrs, r.cfg.MaxAttempts, r.cfg.RetryBackoff.Seconds()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	outboxEvents.WithLabelValues("published").Add(float64(len(published)))
+	if len(failedIDs) > 0 {
+		outboxEvents.WithLabelValues("retried").Add(float64(len(failedIDs) - dead))
+		outboxEvents.WithLabelValues("dead").Add(float64(dead))
+		log.Printf("⚠️  Outbox: Redis rejected %d events (%d dead-lettered), e.g. %s",
+			len(failedIDs), dead, failedErrs[0])
+	}
+	return len(batch), nil
+}
+
+// measureLag records the age of the oldest unpublished row. Dead rows
+// don't count: they wait for an operator, not the relay.
+func (r *OutboxRelay) measureLag(ctx context.Context) error {
+	var age *float64
+	err := r.db.Primary().QueryRow(ctx, `
+		SELECT EXTRACT(EPOCH FROM NOW() - MIN(created_at))::float8
+		FROM event_outbox WHERE status = 'pending'`).Scan(&age)
+	if err != nil {
+		return err
+	}
+	var lag time.Duration
+	if age != nil {
+		lag = time.Duration(max(*age, 0) * float64(time.Second))
+	}
+	r.lag.Store(int64(lag))
+	outboxLag.Set(lag.Seconds())
+	return nil
+}
+
+// health reports the outbox as down, which readiness shows as degraded,
+// once the lag passes OUTBOX_MAX_LAG
+func (r *OutboxRelay) health() ComponentHealth {
+	result := ComponentHealth{Status: "up"}
+	lag := r.lag.Load()
+	if lag < 0 {
+		result.Status, result.Error = "down", "lag not measured yet"
+		return result
+	}
+	seconds := time.Duration(lag).Seconds()
+	result.LagSeconds = &seconds
+	if time.Duration(lag) > r.cfg.MaxLag {
+		result.Status, result.Error = "down", "older than OUTBOX_MAX_LAG"
+	}
+	return result
+}
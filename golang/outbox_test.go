@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"loastest-go/config"
+)
+
+func TestOutboxHealth(t *testing.T) {
+	r := NewOutboxRelay(nil, nil, config.OutboxConfig{MaxLag: time.Minute})
+	if h := r.health(); h.Status != "down" || h.Error != "lag not measured yet" {
+		t.Errorf("before a pass: %+v, want down", h)
+	}
+	r.lag.Store(int64(30 * time.Second))
+	if h := r.health(); h.Status != "up" || *h.LagSeconds != 30 {
+		t.Errorf("30s behind: %+v, want up", h)
+	}
+	r.lag.Store(int64(2 * time.Minute))
+	if h := r.health(); h.Status != "down" || *h.LagSeconds != 120 {
+		t.Errorf("2m behind: %+v, want down", h)
+	}
+}
+
+// queueOutbox queues a row per payload for stream and returns their ids
+func queueOutbox(t *testing.T, db *DBRouter, stream string, payloads ...string) []int64 {
+	t.Helper()
+	ctx := context.Background()
+	var ids []int64
+	for _, payload := range payloads {
+		var id int64
+		err := db.Primary().QueryRow(ctx, outboxInsertSQL+` RETURNING id`, stream, payload).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	t.Cleanup(func() {
+		db.Primary().Exec(ctx, `DELETE FROM event_outbox WHERE id = ANY($1)`, ids)
+	})
+	return ids
+}
+
+// relayAll runs relay batches until one comes back short
+func relayAll(r *OutboxRelay) error {
+	for {
+		n, err := r.relayBatch(context.Background())
+		if err != nil || n < r.cfg.BatchSize {
+			return err
+		}
+	}
+}
+
+// outboxStatus returns each row's status
+func outboxStatus(t *testing.T, db *DBRouter, ids []int64) map[int64]string {
+	t.Helper()
+	rows, err := db.Primary().Query(context.Background(), `
+		SELECT id, status FROM event_outbox WHERE id = ANY($1)`, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	status := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var s string
+		if err := rows.Scan(&id, &s); err != nil {
+			t.Fatal(err)
+		}
+		status[id] = s
+	}
+	return status
+}
+
+func TestOutboxSurvivesRedisGoingDown(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	stream := "stream:test_outbox:" + uuid.NewString()
+	ids := queueOutbox(t, db, stream, `{"orderId":"o-1"}`, `{"orderId":"o-2"}`, `{"orderId":"o-3"}`)
+	relay := NewOutboxRelay(db, rdb, config.OutboxConfig{BatchSize: 100, MaxAttempts: 3, RetryBackoff: time.Second})
+
+	addr := mr.Addr()
+	mr.Close()
+	if err := relayAll(relay); err == nil {
+		t.Fatal("relayed with Redis down")
+	}
+	for id, s := range outboxStatus(t, db, ids) {
+		if s != "pending" {
+			t.Errorf("row %d is %s with Redis down, want pending", id, s)
+		}
+	}
+	var attempts int
+	db.Primary().QueryRow(ctx, `SELECT max(attempts) FROM event_outbox WHERE id = ANY($1)`, ids).Scan(&attempts)
+	if attempts != 0 {
+		t.Errorf("an outage cost a row %d attempts, want none", attempts)
+	}
+
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := relayAll(relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, s := range outboxStatus(t, db, ids) {
+		if s != "published" {
+			t.Errorf("row %d is %s after recovery, want published", id, s)
+		}
+	}
+	entries, err := rdb.XRange(ctx, stream, "-", "+").Result()
+	if err != nil || len(entries) != len(ids) {
+		t.Fatalf("stream has %d entries, %v, want %d", len(entries), err, len(ids))
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		id, _ := e.Values["outboxId"].(string)
+		if seen[id] {
+			t.Errorf("outbox row %s published twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestOutboxDeadLettersWhatRedisRejects(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	stream := "stream:test_outbox:" + uuid.NewString()
+	// A string key where the stream should be: every XADD is refused
+	rdb.Set(ctx, stream, "not a stream", 0)
+	ids := queueOutbox(t, db, stream, `{"orderId":"o-1"}`)
+	malformed := queueOutbox(t, db, "stream:test_outbox:"+uuid.NewString(), `["not","an","object"]`)
+	relay := NewOutboxRelay(db, rdb, config.OutboxConfig{BatchSize: 100, MaxAttempts: 2})
+
+	for range 3 {
+		if err := relayAll(relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, s := range outboxStatus(t, db, append(ids, malformed...)) {
+		if s != "dead" {
+			t.Errorf("row %d is %s, want dead after MaxAttempts", id, s)
+		}
+	}
+	var lastError string
+	db.Primary().QueryRow(ctx, `SELECT last_error FROM event_outbox WHERE id = $1`, ids[0]).Scan(&lastError)
+	if lastError == "" {
+		t.Error("the rejection wasn't recorded")
+	}
+	if n, _ := rdb.Exists(ctx, stream).Result(); n != 1 || rdb.Type(ctx, stream).Val() != "string" {
+		t.Error("the stream key was overwritten")
+	}
+}
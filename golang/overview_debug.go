@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With OVERVIEW_DEBUG=true, ?debug=true on an overview adds a timings
+// object measured around the real Redis and Postgres calls. A debug
+// request still reads its summary key, so the lookup is timed, but always
+// rebuilds and never stores the result.
+
+type debugTimingsKey struct{}
+
+// debugTimings accumulates time per stage; the Load sections record from
+// their own goroutines
+type debugTimings struct {
+	start  time.Time
+	mu     sync.Mutex
+	stages map[string]time.Duration
+}
+
+// OverviewTimings is the debug breakdown in milliseconds. The query stages
+// run concurrently, so they add up to more than their share of TotalMs.
+type OverviewTimings struct {
+	RedisUserCacheMs float64 `json:"redis_user_cache_ms"`
+	RedisSummaryMs   float64 `json:"redis_summary_ms"`
+	OrdersQueryMs    float64 `json:"orders_query_ms"`
+	CartQueryMs      float64 `json:"cart_query_ms"`
+	ProductsQueryMs  float64 `json:"products_query_ms"`
+	MarshalMs        float64 `json:"marshal_ms"`
+	TotalMs          float64 `json:"total_ms"`
+}
+
+func withDebugTimings(ctx context.Context) context.Context {
+	t := &debugTimings{start: time.Now(), stages: make(map[string]time.Duration)}
+	return context.WithValue(ctx, debugTimingsKey{}, t)
+}
+
+// timeStage starts timing stage when ctx is a debug request; call the
+// returned func when it ends
+func timeStage(ctx context.Context, stage string) func() {
+	t, _ := ctx.Value(debugTimingsKey{}).(*debugTimings)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		t.mu.Lock()
+		t.stages[stage] += elapsed
+		t.mu.Unlock()
+	}
+}
+
+func (t *debugTimings) report() OverviewTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return OverviewTimings{
+		RedisUserCacheMs: ms(t.stages["redis_user_cache"]),
+		RedisSummaryMs:   ms(t.stages["redis_summary"]),
+		OrdersQueryMs:    ms(t.stages["orders_query"]),
+		CartQueryMs:      ms(t.stages["cart_query"]),
+		ProductsQueryMs:  ms(t.stages["products_query"]),
+		MarshalMs:        ms(t.stages["marshal"]),
+		TotalMs:          ms(time.Since(t.start)),
+	}
+}
+
+// overviewContext readies the request context for the summary lookup.
+// Normally both cache reads go out in one round trip before the user
+// lookup; a debug request skips that so each read is timed on its own.
+func (h *UserOverviewHandler) overviewContext(
+	c *fiber.Ctx,
+	ctx context.Context,
+	q OverviewQuery,
+	summaryKey string,
+) context.Context {
+	if q.Debug {
+		ctx = withDebugTimings(ctx)
+	} else {
+		ctx = h.svc.PrefetchOverview(ctx, q.UserID, summaryKey)
+	}
+	c.SetUserContext(ctx)
+	return ctx
+}
+
+// summary serves the cached summary, or for a debug request builds it and
+// appends the timings
+func (h *UserOverviewHandler) summary(
+	ctx context.Context,
+	q OverviewQuery,
+	summaryKey string,
+	build SummaryBuilder,
+) (SummaryResult, error) {
+	if !q.Debug {
+		return h.svc.Summary(ctx, summaryKey, q.UserID, build)
+	}
+	stop := timeStage(ctx, "redis_summary")
+	h.svc.GetSummary(ctx, summaryKey)
+	stop()
+
+	b, err := build(ctx)
+	if err != nil {
+		return SummaryResult{}, err
+	}
+	t, _ := ctx.Value(debugTimingsKey{}).(*debugTimings)
+	payload, err := withTimings(b.Payload, t.report())
+	if err != nil {
+		return SummaryResult{}, err
+	}
+	return SummaryResult{Payload: payload, Outcome: "debug", Segment: b.Segment}, nil
+}
+
+// withTimings adds a timings field to a rendered JSON object. Splicing it
+// in keeps the response's own marshal the one that was timed.
+func withTimings(payload []byte, t OverviewTimings) ([]byte, error) {
+	timings, err := jsonMarshal(t)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(payload)+len(timings)+len(`,"timings":`))
+	out = append(out, payload[:len(payload)-1]...)
+	out = append(out, `,"timings":`...)
+	out = append(out, timings...)
+	return append(out, '}'), nil
+}
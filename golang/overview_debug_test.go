@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWithTimingsSplicesIntoThePayload(t *testing.T) {
+	payload, err := withTimings([]byte(`{"user":{"id":"u1"}}`), OverviewTimings{OrdersQueryMs: 1.5, TotalMs: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		User    map[string]any     `json:"user"`
+		Timings map[string]float64 `json:"timings"`
+	}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("%s: %v", payload, err)
+	}
+	if got.User["id"] != "u1" || got.Timings["orders_query_ms"] != 1.5 || got.Timings["total_ms"] != 3 {
+		t.Errorf("payload = %s", payload)
+	}
+	if len(got.Timings) != 7 {
+		t.Errorf("timings has %d stages, want 7: %v", len(got.Timings), got.Timings)
+	}
+}
+
+func TestTimeStageAccumulates(t *testing.T) {
+	// Outside a debug request it's a no-op
+	timeStage(context.Background(), "orders_query")()
+
+	ctx := withDebugTimings(context.Background())
+	for range 2 {
+		stop := timeStage(ctx, "cart_query")
+		time.Sleep(5 * time.Millisecond)
+		stop()
+	}
+	report := ctx.Value(debugTimingsKey{}).(*debugTimings).report()
+	if report.CartQueryMs < 10 {
+		t.Errorf("cart_query_ms = %v, want both stages summed", report.CartQueryMs)
+	}
+	if report.OrdersQueryMs != 0 || report.TotalMs < report.CartQueryMs {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestOverviewDebugTimings(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	user := seedUser(t, db, "pro", "active")
+	seedProduct(t, db, "DEBUG", 5, 5)
+
+	cfg := testConfig(t)
+	cfg.Overview.Debug = true
+	app := overviewAppWith(db, rdb, cfg)
+	for _, v := range []string{"v1", "v2"} {
+		resp, body := send(t, app, newRequest(http.MethodGet, "/"+v+"/users/"+user+"/overview?debug=true", nil))
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: status = %d: %s", v, resp.StatusCode, body)
+		}
+		timings, _ := decode(t, body)["timings"].(map[string]any)
+		if timings == nil || timings["total_ms"].(float64) <= 0 || timings["products_query_ms"].(float64) <= 0 {
+			t.Errorf("%s: timings = %v", v, timings)
+		}
+	}
+	// Debug responses are never stored
+	if keys := mr.Keys(); slices.ContainsFunc(keys, func(k string) bool {
+		return strings.HasPrefix(k, summaryKeyPrefix(user))
+	}) {
+		t.Errorf("debug requests stored a summary: %v", keys)
+	}
+
+	// Off by default, the parameter is ignored
+	app = overviewApp(t, db, rdb)
+	_, body := send(t, app, newRequest(http.MethodGet, "/v1/users/"+user+"/overview?debug=true", nil))
+	if _, ok := decode(t, body)["timings"]; ok {
+		t.Errorf("timings served with OVERVIEW_DEBUG unset: %s", body)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OverviewSections selects which parts of the overview to load, from the
+// ?include= parameter. Skipped sections run no query and render as null.
+type OverviewSections uint8
+
+const (
+	SectionOrders OverviewSections = 1 << iota
+	SectionCart
+	SectionProducts
+	SectionDerived
+
+	allSections = SectionOrders | SectionCart | SectionProducts | SectionDerived
+)
+
+// sectionNames is in canonical order, which String and the cache key use
+var sectionNames = []struct {
+	name    string
+	section OverviewSections
+}{
+	{"orders", SectionOrders},
+	{"cart", SectionCart},
+	{"products", SectionProducts},
+	{"derived", SectionDerived},
+}
+
+// parseSections reads a comma-separated include list; empty means all
+func parseSections(raw string) (OverviewSections, error) {
+	if raw == "" {
+		return allSections, nil
+	}
+	var sections OverviewSections
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, sn := range sectionNames {
+			if sn.name == name {
+				sections |= sn.section
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown section %q (want orders, cart, products or derived)", name)
+		}
+	}
+	return sections, nil
+}
+
+func (s OverviewSections) Has(section OverviewSections) bool {
+	return s&section != 0
+}
+
+func (s OverviewSections) String() string {
+	names := make([]string, 0, len(sectionNames))
+	for _, sn := range sectionNames {
+		if s.Has(sn.section) {
+			names = append(names, sn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
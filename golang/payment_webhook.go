@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"loastest-go/events"
+)
+
+// Payment outcomes a webhook reports
+const (
+	paymentSucceeded = "succeeded"
+	paymentFailed    = "failed"
+)
+
+// PaymentWebhookRequest is the webhook's body, {paymentRef, status,
+// signature}. A provider that can sign the request as the webhooks this
+// service delivers are, with X-Webhook-Timestamp and X-Webhook-Signature,
+// should: the timestamp lets a stale replay be refused. Signature is then
+// ignored.
+type PaymentWebhookRequest struct {
+	PaymentRef string `json:"paymentRef"`
+	Status     string `json:"status"`
+	// Signature is the hex HMAC-SHA256 of "<paymentRef>:<status>" keyed
+	// with PAYMENT_WEBHOOK_SECRET, checked when the request carries no
+	// X-Webhook-Signature
+	Signature string `json:"signature"`
+}
+
+type PaymentWebhookResponse struct {
+	OrderID string `json:"orderId"`
+	// Status is the order's status once the payment outcome is applied
+	Status string `json:"status"`
+	// Replayed reports that an earlier delivery of the webhook already
+	// applied the outcome, so this one changed nothing
+	Replayed bool `json:"replayed"`
+}
+
+// PaymentWebhook serves POST /v1/webhooks/payment. A succeeded payment
+// completes the pending order checked out with the paymentRef, shipping
+// its reservations as FulfillOrder does, and records PAYMENT_CONFIRMED; a
+// failed one cancels it as CancelOrder does. Providers redeliver, so an
+// order that already has the outcome is answered 200 with replayed rather
+// than the 409 of a second fulfill or cancel.
+func (h *CheckoutHandler) PaymentWebhook(c *fiber.Ctx) error {
+	if h.cfg.PaymentWebhookSecret == "" {
+		return writeError(c, ErrWebhookDisabled)
+	}
+	if len(c.Body()) > h.cfg.MaxBodyBytes {
+		return writeError(c, ErrBodyTooLarge)
+	}
+	// A body signed in the headers is verified before anything in it is
+	// looked at
+	headerSigned := c.Get(headerWebhookSignature) != ""
+	if headerSigned {
+		if err := h.verifyPaymentSignature(c); err != nil {
+			return writeError(c, err)
+		}
+	}
+	var req PaymentWebhookRequest
+	if err := decodeStrict(c.Body(), &req); err != nil {
+		return writeError(c, err)
+	}
+	if !headerSigned && !h.validBodySignature(req) {
+		return writeError(c, ErrBadSignature)
+	}
+	var errs fieldErrors
+	if req.PaymentRef == "" {
+		errs.add("paymentRef", "is required")
+	}
+	if req.Status != paymentSucceeded && req.Status != paymentFailed {
+		errs.add("status", "must be succeeded or failed")
+	}
+	if len(errs) > 0 {
+		return writeError(c, ErrValidation.WithDetails(errs))
+	}
+
+	// Detached like checkout, so a disconnect can't abandon it halfway
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.UserContext()), h.cfg.TxTimeout)
+	defer cancel()
+
+	spanCtx, span := startSpan(ctx, "payment.webhook")
+	resp, err := h.applyPayment(spanCtx, req)
+	endSpan(span, err)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(resp)
+}
+
+// verifyPaymentSignature checks the request's signature in constant time,
+// so it can't be guessed a byte at a time, and turns away a timestamp
+// more than PAYMENT_WEBHOOK_TOLERANCE either side of now, so a captured
+// request can't be replayed later
+func (h *CheckoutHandler) verifyPaymentSignature(c *fiber.Ctx) error {
+	timestamp := c.Get(headerWebhookTimestamp)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	got, ok := strings.CutPrefix(c.Get(headerWebhookSignature), "sha256=")
+	if !ok {
+		return ErrBadSignature
+	}
+	mac, err := hex.DecodeString(got)
+	if err != nil || !hmac.Equal(mac, webhookMAC(h.cfg.PaymentWebhookSecret, timestamp, c.Body())) {
+		return ErrBadSignature
+	}
+	// Checked once the signature holds, so the timestamp is the sender's
+	if skew := h.now().Sub(time.Unix(sent, 0)).Abs(); skew > h.cfg.PaymentWebhookTolerance {
+		return ErrSignatureExpired.WithDetails(fiber.Map{
+			"timestamp": sent, "toleranceSeconds": h.cfg.PaymentWebhookTolerance.Seconds(),
+		})
+	}
+	return nil
+}
+
+// validBodySignature checks the body's signature, in constant time like
+// verifyPaymentSignature. Nothing dates it, so a captured request can be
+// sent again; that only ever replays the outcome it carried.
+func (h *CheckoutHandler) validBodySignature(req PaymentWebhookRequest) bool {
+	got, err := hex.DecodeString(req.Signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(h.cfg.PaymentWebhookSecret))
+	mac.Write([]byte(req.PaymentRef + ":" + req.Status))
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (h *CheckoutHandler) applyPayment(ctx context.Context, req PaymentWebhookRequest) (*PaymentWebhookResponse, error) {
+	orderID, userID, status, err := h.orderByPaymentRef(ctx, req.PaymentRef)
+	if err != nil {
+		return nil, err
+	}
+	if paymentApplied(req.Status, status) {
+		return &PaymentWebhookResponse{OrderID: orderID, Status: status, Replayed: true}, nil
+	}
+
+	resp := &PaymentWebhookResponse{OrderID: orderID}
+	if req.Status == paymentSucceeded {
+		resp.Status = "completed"
+		err = h.confirmPayment(ctx, orderID, userID, req.PaymentRef)
+	} else {
+		resp.Status = "cancelled"
+		_, err = h.cancelOrder(ctx, orderID, userID)
+	}
+	// Two deliveries at once both get past the check above; the order lock
+	// lets one through and the other finds the outcome already applied
+	if errors.Is(err, ErrOrderTransition) || errors.Is(err, ErrOrderNotPending) {
+		if _, _, now, lookupErr := h.orderByPaymentRef(ctx, req.PaymentRef); lookupErr == nil && paymentApplied(req.Status, now) {
+			return &PaymentWebhookResponse{OrderID: orderID, Status: now, Replayed: true}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// confirmPayment completes the order and records PAYMENT_CONFIRMED in the
+// same transaction
+func (h *CheckoutHandler) confirmPayment(ctx context.Context, orderID, userID, paymentRef string) error {
+	payload, err := events.Marshal(&events.PaymentConfirmedPayload{
+		OrderID:    orderID,
+		PaymentRef: paymentRef,
+	})
+	if err != nil {
+		return err
+	}
+	_, _, err = h.fulfillOrderTransaction(ctx, orderID,
+		batchStmt{"log payment event", `
+			INSERT INTO events(id, user_id, type, payload_json, created_at)
+			VALUES($1, $2, $3, $4, NOW())`,
+			[]any{uuid.New().String(), userID, events.PaymentConfirmed, payload}},
+		outboxEntry(orderEventsStream, map[string]string{
+			"type":       events.PaymentConfirmed,
+			"userId":     userID,
+			"orderId":    orderID,
+			"paymentRef": paymentRef,
+		}))
+	if err != nil {
+		return err
+	}
+	afterResponse(ctx, "post_payment", func(ctx context.Context) error {
+		return h.summaries.Invalidate(ctx, userID, orderCacheKey(orderID))
+	})
+	return nil
+}
+
+// orderByPaymentRef finds the order checked out with paymentRef. Nothing
+// makes payment_ref unique, and a webhook applied to whichever of two
+// orders came first could complete the wrong one, so a ref on more than
+// one order is refused.
+func (h *CheckoutHandler) orderByPaymentRef(ctx context.Context, paymentRef string) (orderID, userID, status string, err error) {
+	rows, err := h.db.Query(ctx, `
+		SELECT id::text, user_id::text, status FROM orders
+		WHERE payment_ref = $1
+		LIMIT 2`, paymentRef)
+	if err != nil {
+		return "", "", "", dbError("load order", err)
+	}
+	defer rows.Close()
+	found := 0
+	for rows.Next() {
+		if err := rows.Scan(&orderID, &userID, &status); err != nil {
+			return "", "", "", dbError("load order", err)
+		}
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return "", "", "", dbError("load order", err)
+	}
+	switch found {
+	case 0:
+		return "", "", "", ErrPaymentNotFound
+	case 1:
+		return orderID, userID, status, nil
+	}
+	return "", "", "", ErrPaymentAmbiguous
+}
+
+// paymentApplied reports whether an order in status already has the
+// payment outcome: a paid order may have moved on past completed since
+func paymentApplied(outcome, status string) bool {
+	if outcome == paymentFailed {
+		return status == "cancelled"
+	}
+	return status == "completed" || status == "shipped" || status == "delivered"
+}
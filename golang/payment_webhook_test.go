@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"loastest-go/events"
+)
+
+const testWebhookSecret = "whsec-test"
+
+// paymentRequest is a payment webhook carrying body, signed with secret
+// as sent at
+func paymentRequest(secret string, at time.Time, body any) *http.Request {
+	data, err := jsonMarshal(body)
+	if s, ok := body.(string); ok {
+		data, err = []byte(s), nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req := newRequest(http.MethodPost, "/v1/webhooks/payment", data)
+	req.Header.Set(headerWebhookTimestamp, timestamp)
+	req.Header.Set(headerWebhookSignature, "sha256="+webhookSignature(secret, timestamp, data))
+	return req
+}
+
+// bodySignature is the body's signature of paymentRef and status
+func bodySignature(secret, paymentRef, status string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(paymentRef + ":" + status))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodySignedPayment is a payment webhook signed in its body with secret,
+// as the request documents it
+func bodySignedPayment(secret, paymentRef, status string) *http.Request {
+	return newRequest(http.MethodPost, "/v1/webhooks/payment", PaymentWebhookRequest{
+		PaymentRef: paymentRef, Status: status, Signature: bodySignature(secret, paymentRef, status),
+	})
+}
+
+func TestPaymentWebhookChecksTheSignature(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := &CheckoutHandler{now: func() time.Time { return now }}
+	h.cfg.MaxBodyBytes = 1 << 10
+	h.cfg.PaymentWebhookTolerance = 5 * time.Minute
+	app := fiber.New(fiber.Config{JSONEncoder: jsonMarshal, JSONDecoder: jsonUnmarshal})
+	app.Post("/v1/webhooks/payment", h.PaymentWebhook)
+
+	// An invalid status is refused after the signature, so a 400 means
+	// the signature held
+	body := PaymentWebhookRequest{PaymentRef: "pay-1", Status: "refunded"}
+	if resp, _ := send(t, app, paymentRequest(testWebhookSecret, now, body)); resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("no secret: status = %d, want 503", resp.StatusCode)
+	}
+	h.cfg.PaymentWebhookSecret = testWebhookSecret
+
+	tampered := paymentRequest(testWebhookSecret, now, body)
+	tampered.Header.Set(headerWebhookTimestamp, strconv.FormatInt(now.Unix()+1, 10))
+	unprefixed := paymentRequest(testWebhookSecret, now, body)
+	unprefixed.Header.Set(headerWebhookSignature, unprefixed.Header.Get(headerWebhookSignature)[len("sha256="):])
+	unsigned := newRequest(http.MethodPost, "/v1/webhooks/payment", PaymentWebhookRequest{PaymentRef: "pay-1", Status: paymentSucceeded})
+	// Signed for one status, sent with another
+	swapped := newRequest(http.MethodPost, "/v1/webhooks/payment", PaymentWebhookRequest{
+		PaymentRef: "pay-1", Status: paymentSucceeded, Signature: bodySignature(testWebhookSecret, "pay-1", paymentFailed),
+	})
+
+	for name, tt := range map[string]struct {
+		req    *http.Request
+		status int
+		code   string
+	}{
+		"valid":                 {paymentRequest(testWebhookSecret, now, body), fiber.StatusBadRequest, "VALIDATION_FAILED"},
+		"within the tolerance":  {paymentRequest(testWebhookSecret, now.Add(-5*time.Minute), body), fiber.StatusBadRequest, "VALIDATION_FAILED"},
+		"ahead within it":       {paymentRequest(testWebhookSecret, now.Add(5*time.Minute), body), fiber.StatusBadRequest, "VALIDATION_FAILED"},
+		"headers win":           {paymentRequest(testWebhookSecret, now, `{"paymentRef":"pay-1","status":"refunded","signature":"00"}`), fiber.StatusBadRequest, "VALIDATION_FAILED"},
+		"body signature":        {bodySignedPayment(testWebhookSecret, "pay-1", "refunded"), fiber.StatusBadRequest, "VALIDATION_FAILED"},
+		"body, wrong secret":    {bodySignedPayment("guess", "pay-1", paymentSucceeded), fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"body, status swapped":  {swapped, fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"unknown body field":    {newRequest(http.MethodPost, "/v1/webhooks/payment", `{"paymentRef":"pay-1","sig":"00"}`), fiber.StatusBadRequest, "INVALID_JSON"},
+		"wrong secret":          {paymentRequest("guess", now, body), fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"timestamp changed":     {tampered, fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"no sha256= prefix":     {unprefixed, fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"unsigned":              {unsigned, fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"stale":                 {paymentRequest(testWebhookSecret, now.Add(-5*time.Minute-time.Second), body), fiber.StatusUnauthorized, ErrSignatureExpired.Code},
+		"from the future":       {paymentRequest(testWebhookSecret, now.Add(time.Hour), body), fiber.StatusUnauthorized, ErrSignatureExpired.Code},
+		"stale and bad":         {paymentRequest("guess", now.Add(-time.Hour), body), fiber.StatusUnauthorized, ErrBadSignature.Code},
+		"signed body too large": {paymentRequest(testWebhookSecret, now, make([]byte, 2<<10)), fiber.StatusRequestEntityTooLarge, ErrBodyTooLarge.Code},
+	} {
+		resp, raw := send(t, app, tt.req)
+		if e, _ := decode(t, raw)["error"].(map[string]any); resp.StatusCode != tt.status || e["code"] != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", name, resp.StatusCode, raw, tt.status, tt.code)
+		}
+	}
+}
+
+// paymentApp is checkoutApp with the payment webhook mounted and its
+// secret set
+func paymentApp(t *testing.T, db *DBRouter) *fiber.App {
+	_, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	h.cfg.PaymentWebhookSecret = testWebhookSecret
+	app.Post("/v1/webhooks/payment", h.PaymentWebhook)
+	return app
+}
+
+// payOrder seeds a pending order holding a reservation of 3 units, checked
+// out with paymentRef
+func payOrder(t *testing.T, db *DBRouter, user, product, paymentRef string) string {
+	order := seedOrder(t, db, user, "pending", 3, 5, product)
+	seedReservation(t, db, order, product, 3, time.Now().Add(time.Hour))
+	mustExec(t, db, `UPDATE orders SET payment_ref = $2 WHERE id = $1`, order, paymentRef)
+	return order
+}
+
+// postPayment sends a payment webhook signed now and decodes its body
+func postPayment(t *testing.T, app *fiber.App, paymentRef, status string) (int, map[string]any) {
+	t.Helper()
+	resp, body := send(t, app, paymentRequest(testWebhookSecret, time.Now(),
+		PaymentWebhookRequest{PaymentRef: paymentRef, Status: status}))
+	return resp.StatusCode, decode(t, body)
+}
+
+func TestPaymentWebhookAppliesTheOutcome(t *testing.T) {
+	db := testRouter(t)
+	app := paymentApp(t, db)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "PAYMENT", 5, 10)
+	paidRef, declinedRef := "pay-"+uuid.NewString(), "pay-"+uuid.NewString()
+	paid := payOrder(t, db, user, product, paidRef)
+	declined := payOrder(t, db, user, product, declinedRef)
+
+	status, body := postPayment(t, app, paidRef, paymentSucceeded)
+	if status != fiber.StatusOK || body["orderId"] != paid || body["status"] != "completed" || body["replayed"] != false {
+		t.Fatalf("succeeded: got %d %v, want the order completed", status, body)
+	}
+	var confirmed int
+	db.Primary().QueryRow(context.Background(), `
+		SELECT COUNT(*) FROM events WHERE user_id = $1 AND type = $2`, user, events.PaymentConfirmed).Scan(&confirmed)
+	if confirmed != 1 {
+		t.Errorf("%d PAYMENT_CONFIRMED events, want 1", confirmed)
+	}
+
+	// The body-signed form the provider may send instead
+	resp, raw := send(t, app, bodySignedPayment(testWebhookSecret, declinedRef, paymentFailed))
+	status, body = resp.StatusCode, decode(t, raw)
+	if status != fiber.StatusOK || body["orderId"] != declined || body["status"] != "cancelled" || body["replayed"] != false {
+		t.Fatalf("failed: got %d %v, want the order cancelled", status, body)
+	}
+	// One order's 3 units shipped, the other's went back on the shelf
+	if available, reserved := stock(t, db, product); available != 7 || reserved != 0 {
+		t.Errorf("stock = %d available, %d reserved, want 7 and 0", available, reserved)
+	}
+
+	// Redeliveries change nothing and say so
+	for ref, want := range map[string]string{paidRef: "completed", declinedRef: "cancelled"} {
+		outcome := paymentSucceeded
+		if want == "cancelled" {
+			outcome = paymentFailed
+		}
+		if status, body := postPayment(t, app, ref, outcome); status != fiber.StatusOK || body["status"] != want || body["replayed"] != true {
+			t.Errorf("replayed %s: got %d %v, want 200 %s replayed", outcome, status, body, want)
+		}
+	}
+	if available, reserved := stock(t, db, product); available != 7 || reserved != 0 {
+		t.Errorf("stock after the replays = %d available, %d reserved, want 7 and 0", available, reserved)
+	}
+	// The opposite outcome can't undo the first
+	if status, body := postPayment(t, app, paidRef, paymentFailed); status != fiber.StatusConflict {
+		t.Errorf("failed after succeeded: got %d %v, want 409", status, body)
+	}
+}
+
+func TestPaymentWebhookNeedsOneOrder(t *testing.T) {
+	db := testRouter(t)
+	app := paymentApp(t, db)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "PAYMENT-REF", 5, 10)
+
+	status, body := postPayment(t, app, "pay-"+uuid.NewString(), paymentSucceeded)
+	if code, _ := errorOf(body); status != fiber.StatusNotFound || code != ErrPaymentNotFound.Code {
+		t.Errorf("unknown ref: got %d %v, want 404 %s", status, body, ErrPaymentNotFound.Code)
+	}
+
+	// A paymentRef checked out again once its idempotency record expired
+	ref := "pay-" + uuid.NewString()
+	first := payOrder(t, db, user, product, ref)
+	payOrder(t, db, user, product, ref)
+	status, body = postPayment(t, app, ref, paymentSucceeded)
+	if code, _ := errorOf(body); status != fiber.StatusConflict || code != ErrPaymentAmbiguous.Code {
+		t.Errorf("ambiguous ref: got %d %v, want 409 %s", status, body, ErrPaymentAmbiguous.Code)
+	}
+	var orderStatus string
+	db.Primary().QueryRow(context.Background(), `SELECT status FROM orders WHERE id = $1`, first).Scan(&orderStatus)
+	if orderStatus != "pending" {
+		t.Errorf("order is %s after an ambiguous webhook, want it left pending", orderStatus)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// productIDs lists the ids in an overview body's products
+func productIDs(t *testing.T, body []byte) []string {
+	t.Helper()
+	var ids []string
+	products, _ := decode(t, body)["products"].([]any)
+	for _, p := range products {
+		ids = append(ids, p.(map[string]any)["id"].(string))
+	}
+	return ids
+}
+
+func TestPersonalizedOverviewSkipsPurchasedProducts(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	category := seedCategory(t, db)
+	bought := seedProductIn(t, db, category, "BOUGHT", 10, 50)
+	fresh := seedProductIn(t, db, category, "FRESH", 10, 5)
+	seedOrder(t, db, user, "completed", 1, 10, bought)
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{bought, fresh}},
+		{"&personalized=true", []string{fresh}},
+	} {
+		for _, v := range []string{"v1", "v2"} {
+			target := "/" + v + "/users/" + user + "/overview?categoryId=" + category + tt.query
+			resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status = %d: %s", target, resp.StatusCode, body)
+			}
+			got := productIDs(t, body)
+			slices.Sort(got)
+			slices.Sort(tt.want)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s: products = %v, want %v", target, got, tt.want)
+			}
+			// The orders section is still there, loaded once with the products
+			if orders, _ := decode(t, body)["orders"].([]any); len(orders) != 1 {
+				t.Errorf("%s: %d orders, want 1", target, len(orders))
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"loastest-go/config"
+)
+
+// preforkChildEnv marks a process as a prefork child; it is what
+// fiber.IsChild checks, so the child's Listen binds with SO_REUSEPORT
+const preforkChildEnv = "FIBER_PREFORK_CHILD=1"
+
+// preforkChildren is how many processes are forked: one per GOMAXPROCS.
+// Read it before Listen; Fiber pins each child to GOMAXPROCS(1) afterwards.
+func preforkChildren() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// checkConnectionBudget warns when every process opening its full pool
+// could exceed the Postgres connections this service is allowed. Pools are
+// already divided by ShareAcross, but the one-connection floor can still
+// push a many-core host over a small budget.
+func checkConnectionBudget(cfg *config.Config, processes int) {
+	total := processes * int(cfg.DB.MaxConns)
+	if total > cfg.DB.ConnectionBudget {
+		log.Printf("⚠️  %d process(es) × DB_MAX_CONNS %d = %d connections exceeds DB_CONNECTION_BUDGET %d",
+			processes, cfg.DB.MaxConns, total, cfg.DB.ConnectionBudget)
+	}
+}
+
+// runPreforkParent starts the children and supervises them, opening no
+// pools of its own; the children re-run main and connect individually.
+// Fiber's prefork master isn't used: it SIGKILLs the remaining children as
+// soon as the first one exits, cutting their drain short.
+func runPreforkParent(children int) error {
+	cmds := make([]*exec.Cmd, children)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), preforkChildEnv)
+		cmds[i] = cmd
+	}
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return superviseChildren(stop, cmds)
+}
+
+// superviseChildren starts cmds and waits until ctx is done or one of them
+// exits. Either way SIGTERM goes to the children still running — to their
+// pids only, never the process group, which may hold the shell or test
+// runner that started us — and it returns once every child has exited.
+func superviseChildren(ctx context.Context, cmds []*exec.Cmd) error {
+	exited := make(chan error, len(cmds))
+	running := 0
+	var err error
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			err = fmt.Errorf("start prefork child: %w", err)
+			break
+		}
+		running++
+		go func(cmd *exec.Cmd) {
+			werr := cmd.Wait()
+			if werr == nil {
+				werr = fmt.Errorf("prefork child %d exited", cmd.Process.Pid)
+			}
+			exited <- werr
+		}(cmd)
+	}
+	if err == nil {
+		log.Printf("👮 prefork parent pid=%d supervising %d children", os.Getpid(), running)
+		select {
+		case err = <-exited:
+			running--
+		case <-ctx.Done():
+		}
+	}
+
+	log.Printf("🛑 Forwarding shutdown to prefork children")
+	for _, cmd := range cmds {
+		if cmd.Process == nil {
+			continue
+		}
+		if serr := cmd.Process.Signal(syscall.SIGTERM); serr != nil && !errors.Is(serr, os.ErrProcessDone) {
+			log.Printf("Signal prefork child %d: %v", cmd.Process.Pid, serr)
+		}
+	}
+	for ; running > 0; running-- {
+		<-exited
+	}
+	return err
+}
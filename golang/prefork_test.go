@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// drainingChild is a stand-in prefork child: it runs until SIGTERM, then
+// takes a moment to drain and records that it finished in marker
+func drainingChild(marker string) *exec.Cmd {
+	return exec.Command("sh", "-c",
+		`trap 'sleep 0.2; echo drained > "$0"; exit 0' TERM; while :; do sleep 0.02; done`, marker)
+}
+
+func drained(t *testing.T, markers ...string) {
+	t.Helper()
+	for _, m := range markers {
+		if _, err := os.Stat(m); err != nil {
+			t.Errorf("child %s did not finish draining: %v", filepath.Base(m), err)
+		}
+	}
+}
+
+func TestSuperviseChildrenForwardsShutdown(t *testing.T) {
+	dir := t.TempDir()
+	markers := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+	var cmds []*exec.Cmd
+	for _, m := range markers {
+		cmds = append(cmds, drainingChild(m))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- superviseChildren(ctx, cmds) }()
+
+	// Let the children install their traps
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("superviseChildren = %v, want nil after a requested shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("children were not shut down")
+	}
+	// Reaching here at all means the test binary, in the same process
+	// group, was not sent SIGTERM
+	drained(t, markers...)
+}
+
+func TestSuperviseChildrenStopsTheRestWhenOneExits(t *testing.T) {
+	dir := t.TempDir()
+	slow := filepath.Join(dir, "slow")
+	cmds := []*exec.Cmd{
+		drainingChild(slow),
+		exec.Command("sh", "-c", "sleep 0.2; exit 3"),
+	}
+	err := superviseChildren(context.Background(), cmds)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("superviseChildren = %v, want the crashed child's exit status", err)
+	}
+	// The survivor gets to drain instead of being killed
+	drained(t, slow)
+}
+
+func TestPreforkChildEnvMarksAFiberChild(t *testing.T) {
+	key, value, _ := strings.Cut(preforkChildEnv, "=")
+	t.Setenv(key, value)
+	if !fiber.IsChild() {
+		t.Errorf("%s does not make fiber.IsChild true", preforkChildEnv)
+	}
+}
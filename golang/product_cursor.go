@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// productCursor is the (available, product_id) pair of the last product on
+// a page. Products are ordered by both descending, so the next page starts
+// strictly after it; unlike OFFSET this doesn't re-aggregate and discard
+// the earlier pages, and stock moving between requests can't repeat or skip
+// a product the client has not seen yet.
+type productCursor struct {
+	Available int
+	ProductID string
+}
+
+// String encodes the cursor as the opaque token clients send back
+func (c productCursor) String() string {
+	raw := strconv.Itoa(c.Available) + ":" + c.ProductID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseProductCursor(token string) (*productCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("is not a valid cursor")
+	}
+	avail, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, errors.New("is not a valid cursor")
+	}
+	n, err := strconv.Atoi(avail)
+	if err != nil || uuid.Validate(id) != nil {
+		return nil, errors.New("is not a valid cursor")
+	}
+	return &productCursor{Available: n, ProductID: id}, nil
+}
+
+// keysetCondition returns the SQL comparison that starts a page after c,
+// appending its parameters to args. availableExpr must match the ORDER BY.
+func keysetCondition(availableExpr string, c *productCursor, args *[]any) string {
+	*args = append(*args, c.Available, c.ProductID)
+	n := len(*args)
+	return fmt.Sprintf("(%s, p.id) < ($%d::int, $%d::uuid)", availableExpr, n-1, n)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// ProductCatalog serves the product endpoints. Responses are cached for
+// CACHE_PRODUCTS_TTL under cache:products:, keyed by the normalized
+// filters; checkout doesn't invalidate them.
+type ProductCatalog struct {
+	db    *DBRouter
+	rdb   *redis.Client
+	cache config.CacheConfig
+	ttl   ttlPolicy
+	cfg   config.OverviewConfig
+}
+
+func NewProductCatalog(
+	db *DBRouter,
+	rdb *redis.Client,
+	cache config.CacheConfig,
+	cfg config.OverviewConfig,
+) *ProductCatalog {
+	return &ProductCatalog{
+		db:    db,
+		rdb:   rdb,
+		cache: cache,
+		ttl:   newTTLPolicy(cache.TTLJitter),
+		cfg:   cfg,
+	}
+}
+
+type ProductsQuery struct {
+	CategoryID string
+	Status     string
+	MinPrice   *float64
+	MaxPrice   *float64
+	Sort       string
+	Page       int
+	Limit      int
+}
+
+// productSorts maps ?sort= to its ORDER BY; p.id breaks ties so pages are
+// stable
+var productSorts = map[string]string{
+	"price":     "p.price ASC, p.id ASC",
+	"available": "available DESC, p.id DESC",
+	"sku":       "p.sku ASC",
+}
+
+func (q ProductsQuery) cacheKey() string {
+	price := func(f *float64) string {
+		if f == nil {
+			return "-"
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	category := q.CategoryID
+	if category == "" {
+		category = "all"
+	}
+	return strings.Join([]string{
+		"cache:products:list", category, q.Status, price(q.MinPrice), price(q.MaxPrice),
+		q.Sort, strconv.Itoa(q.Page), strconv.Itoa(q.Limit),
+	}, ":")
+}
+
+type ProductsResponse struct {
+	Products   []Product          `json:"products"`
+	Pagination ProductsPagination `json:"pagination"`
+}
+
+type ProductsPagination struct {
+	Page     int  `json:"page"`
+	Limit    int  `json:"limit"`
+	Returned int  `json:"returned"`
+	HasMore  bool `json:"has_more"`
+}
+
+type ProductDetail struct {
+	ID         string                  `json:"id"`
+	SKU        string                  `json:"sku"`
+	Price      float64                 `json:"price"`
+	Status     string                  `json:"status"`
+	CategoryID *string                 `json:"category_id"`
+	Available  int                     `json:"available"`
+	Warehouses []WarehouseAvailability `json:"warehouses"`
+}
+
+type WarehouseAvailability struct {
+	WarehouseID  string `json:"warehouse_id"`
+	Region       string `json:"region"`
+	AvailableQty int    `json:"available_qty"`
+	ReservedQty  int    `json:"reserved_qty"`
+	Available    int    `json:"available"`
+}
+
+func (pc *ProductCatalog) parseProductsQuery(c *fiber.Ctx) (ProductsQuery, error) {
+	p := newQueryParams(c)
+	q := ProductsQuery{
+		CategoryID: p.UUID("categoryId", c.Query("categoryId")),
+		Status:     p.OneOf("status", "active", "active", "inactive"),
+		MinPrice:   p.Float("minPrice"),
+		MaxPrice:   p.Float("maxPrice"),
+		Sort:       p.OneOf("sort", "available", "price", "available", "sku"),
+		Page:       p.Int("page", 1, pc.cfg.MaxPage),
+		Limit:      p.Int("limit", 20, pc.cfg.MaxLimit),
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MinPrice > *q.MaxPrice {
+		p.fail("maxPrice", "must not be below minPrice")
+	}
+	return q, p.Err()
+}
+
+// ListProducts serves GET /v1/products
+func (pc *ProductCatalog) ListProducts(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	defer markBypass(c, bypassed)
+	q, err := pc.parseProductsQuery(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return pc.cached(ctx, c, q.cacheKey(), func() (any, error) {
+		products, err := pc.listProducts(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		resp := ProductsResponse{Products: products}
+		if len(resp.Products) > q.Limit {
+			resp.Pagination.HasMore = true
+			resp.Products = resp.Products[:q.Limit]
+		}
+		resp.Pagination.Page = q.Page
+		resp.Pagination.Limit = q.Limit
+		resp.Pagination.Returned = len(resp.Products)
+		return resp, nil
+	})
+}
+
+// GetProduct serves GET /v1/products/:productId
+func (pc *ProductCatalog) GetProduct(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	defer markBypass(c, bypassed)
+	p := newQueryParams(c)
+	productID := p.PathUUID("productId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+
+	return pc.cached(ctx, c, "cache:products:item:"+productID, func() (any, error) {
+		return pc.getProduct(ctx, productID)
+	})
+}
+
+// cached serves key from Redis or renders load and caches it. Redis
+// failures degrade to uncached responses, as on the overview.
+func (pc *ProductCatalog) cached(
+	ctx context.Context,
+	c *fiber.Ctx,
+	key string,
+	load func() (any, error),
+) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	cached, err := pc.rdb.Get(ctx, key).Bytes()
+	if err == nil {
+		c.Set(headerCache, "HIT")
+		return c.Send(cached)
+	}
+	if err != redis.Nil {
+		cacheBypassed(ctx, "get_products", err)
+	}
+
+	v, err := load()
+	if err != nil {
+		return writeError(c, err)
+	}
+	payload, err := jsonMarshal(v)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if !isCacheBypassed(ctx) {
+		if err := pc.rdb.SetEx(ctx, key, payload, pc.ttl.TTL(pc.cache.ProductsTTL)).Err(); err != nil {
+			cacheBypassed(ctx, "set_products", err)
+		}
+	}
+	c.Set(headerCache, "MISS")
+	return c.Send(payload)
+}
+
+// listProducts fetches limit+1 rows so the caller can tell if there's more
+func (pc *ProductCatalog) listProducts(ctx context.Context, q ProductsQuery) ([]Product, error) {
+	args := []any{q.Status}
+	where := "p.status = $1"
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.CategoryID != "" {
+		where += " AND p.category_id = " + arg(q.CategoryID)
+	}
+	if q.MinPrice != nil {
+		where += " AND p.price >= " + arg(*q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		where += " AND p.price <= " + arg(*q.MaxPrice)
+	}
+	offsetArg, limitArg := arg((q.Page-1)*q.Limit), arg(q.Limit+1)
+
+	rows, err := pc.db.Read().Query(ctx, fmt.Sprintf(`
+		SELECT p.id, p.sku, p.price,
+			   COALESCE(SUM(i.available_qty - i.reserved_qty), 0)::int as available
+		FROM products p
+		LEFT JOIN inventory i ON i.product_id = p.id
+		WHERE %s
+		GROUP BY p.id
+		ORDER BY %s
+		OFFSET %s LIMIT %s`, where, productSorts[q.Sort], offsetArg, limitArg),
+		args...)
+	if err != nil {
+		return nil, dbError("list products", err)
+	}
+	products, err := scanProducts(rows)
+	if products == nil && err == nil {
+		products = []Product{}
+	}
+	return products, err
+}
+
+func (pc *ProductCatalog) getProduct(ctx context.Context, productID string) (*ProductDetail, error) {
+	db := pc.db.Read()
+	var p ProductDetail
+	err := db.QueryRow(ctx, `
+		SELECT id, sku, price, status, category_id::text
+		FROM products WHERE id = $1`, productID).
+		Scan(&p.ID, &p.SKU, &p.Price, &p.Status, &p.CategoryID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, dbError("load product", err)
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT w.id, w.region, i.available_qty, i.reserved_qty
+		FROM inventory i
+		JOIN warehouses w ON w.id = i.warehouse_id
+		WHERE i.product_id = $1
+		ORDER BY w.region`, productID)
+	if err != nil {
+		return nil, dbError("load product inventory", err)
+	}
+	defer rows.Close()
+
+	p.Warehouses = []WarehouseAvailability{}
+	for rows.Next() {
+		var w WarehouseAvailability
+		if err := rows.Scan(&w.WarehouseID, &w.Region, &w.AvailableQty, &w.ReservedQty); err != nil {
+			return nil, err
+		}
+		w.Available = w.AvailableQty - w.ReservedQty
+		p.Available += w.Available
+		p.Warehouses = append(p.Warehouses, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load product inventory", err)
+	}
+	return &p, nil
+}
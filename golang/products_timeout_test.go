@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProductsTimeoutDegradesWithoutCaching(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	cfg := testConfig(t)
+	cfg.Timeouts.ProductsQuery = time.Nanosecond
+	app := overviewAppWith(db, rdb, cfg)
+	user := seedUser(t, db, "pro", "active")
+	seedProduct(t, db, "SLOW", 10, 5)
+
+	target := "/v2/users/" + user + "/overview"
+	for i := range 2 {
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		got := decode(t, body)
+		if resp.StatusCode != http.StatusOK || got["productsDegraded"] != true {
+			t.Fatalf("request %d: got %d %s, want 200 with productsDegraded", i+1, resp.StatusCode, body)
+		}
+		if products, _ := got["products"].([]any); products == nil || len(products) != 0 {
+			t.Errorf("request %d: products = %v, want []", i+1, got["products"])
+		}
+		// The other sections still came back
+		if u, _ := got["user"].(map[string]any); u["id"] != user {
+			t.Errorf("request %d: user = %v", i+1, got["user"])
+		}
+		// A partial body is never cached, so the next request tries again
+		if x := resp.Header.Get(headerCache); x != "MISS" {
+			t.Errorf("request %d: X-Cache = %q, want MISS", i+1, x)
+		}
+		waitDeferredWrites()
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, summaryKeyPrefix(user)) {
+			t.Errorf("degraded summary was cached under %s", key)
+		}
+	}
+}
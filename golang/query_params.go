@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// queryParams reads path and query parameters, collecting a FieldError for
+// each bad one so a single 400 can report them all
+type queryParams struct {
+	c    *fiber.Ctx
+	errs []FieldError
+}
+
+func newQueryParams(c *fiber.Ctx) *queryParams {
+	return &queryParams{c: c}
+}
+
+func (p *queryParams) fail(field, msg string) {
+	p.errs = append(p.errs, FieldError{Field: field, Message: msg})
+}
+
+// Int reads an optional integer in [1, maxValue]
+func (p *queryParams) Int(field string, fallback, maxValue int) int {
+	raw := p.c.Query(field)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > maxValue {
+		p.fail(field, fmt.Sprintf("must be an integer between 1 and %d", maxValue))
+	}
+	return n
+}
+
+// Float reads an optional non-negative number
+func (p *queryParams) Float(field string) *float64 {
+	raw := p.c.Query(field)
+	if raw == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		p.fail(field, "must be a non-negative number")
+		return nil
+	}
+	return &f
+}
+
+// Bool reads an optional true/false, returning fallback if unset
+func (p *queryParams) Bool(field string, fallback bool) bool {
+	raw := p.c.Query(field)
+	if raw == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.fail(field, "must be true or false")
+	}
+	return b
+}
+
+// OneOf reads an optional value from allowed, returning fallback if unset
+func (p *queryParams) OneOf(field, fallback string, allowed ...string) string {
+	raw := p.c.Query(field)
+	if raw == "" {
+		return fallback
+	}
+	if !slices.Contains(allowed, raw) {
+		p.fail(field, "must be one of "+strings.Join(allowed, ", "))
+	}
+	return raw
+}
+
+// UUID canonicalizes raw, which is required if it came from the path
+func (p *queryParams) UUID(field, raw string) string {
+	if raw == "" {
+		return ""
+	}
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		p.fail(field, "must be a UUID")
+		return ""
+	}
+	return id.String()
+}
+
+// UUIDs reads an optional list of UUIDs, given comma-separated, repeated,
+// or both. The result is canonical, sorted and deduplicated, so equivalent
+// lists compare equal; more than maxItems distinct ids is an error.
+func (p *queryParams) UUIDs(field string, maxItems int) []string {
+	var ids []string
+	for _, raw := range p.c.Context().QueryArgs().PeekMulti(field) {
+		for _, part := range strings.Split(string(raw), ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			id, err := uuid.Parse(part)
+			if err != nil {
+				p.fail(field, "must be a comma-separated list of UUIDs")
+				return nil
+			}
+			ids = append(ids, id.String())
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if len(ids) > maxItems {
+		p.fail(field, fmt.Sprintf("must list at most %d ids", maxItems))
+		return nil
+	}
+	return ids
+}
+
+// PathUUID reads a required UUID path parameter
+func (p *queryParams) PathUUID(field string) string {
+	raw := p.c.Params(field)
+	if raw == "" {
+		p.fail(field, "is required")
+		return ""
+	}
+	return p.UUID(field, raw)
+}
+
+// Time reads an optional RFC 3339 timestamp or YYYY-MM-DD date (UTC)
+func (p *queryParams) Time(field string) *time.Time {
+	raw := p.c.Query(field)
+	if raw == "" {
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return &t
+		}
+	}
+	p.fail(field, "must be an RFC 3339 timestamp or YYYY-MM-DD date")
+	return nil
+}
+
+// Err is nil when every parameter was valid
+func (p *queryParams) Err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return ErrInvalidQuery.WithDetails(p.errs)
+}
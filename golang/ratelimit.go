@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	rateLimitErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_errors_total",
+		Help: "Rate limit checks that could not reach Redis, by limiter.",
+	}, []string{"limiter"})
+	rateLimitChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_checks_total",
+		Help: "Rate limit checks, by limiter, the user's plan (all for limiters that don't look at it, unknown when it couldn't be resolved) and outcome (allowed, limited).",
+	}, []string{"limiter", "plan", "outcome"})
+)
+
+// rateLimitScript is a two-bucket sliding window. KEYS[1] is a hash of
+// request counts per window-sized bucket; the previous bucket's count is
+// weighted by how much of it still overlaps the window ending now, so a
+// burst either side of a bucket boundary still counts against one limit.
+// Rejected requests aren't counted. The clock is Redis's, so instances
+// with skewed clocks agree, and the check, increment and expiry are one
+// atomic step. ARGV is the window in milliseconds and the limit. Returns
+// {allowed, remaining, ms until the quota is fully restored, ms until the
+// next request would be allowed}.
+var rateLimitScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local cur = math.floor(now / window)
+local elapsed = now - cur * window
+local count = tonumber(redis.call('HGET', KEYS[1], cur) or 0)
+local prev = tonumber(redis.call('HGET', KEYS[1], cur - 1) or 0)
+local used = prev * (window - elapsed) / window + count
+
+local allowed = 0
+if used + 1 <= limit then
+  allowed = 1
+  count = redis.call('HINCRBY', KEYS[1], cur, 1)
+  used = used + 1
+  redis.call('HDEL', KEYS[1], cur - 2)
+  redis.call('PEXPIRE', KEYS[1], window * 2)
+end
+
+local reset = 0
+if count > 0 then
+  reset = 2 * window - elapsed
+elseif prev > 0 then
+  reset = window - elapsed
+end
+
+local retry = 0
+if allowed == 0 then
+  if count < limit then
+    -- wait for the previous bucket's weight to drop enough
+    retry = math.ceil(window * (1 - (limit - 1 - count) / prev)) - elapsed
+  else
+    -- the current bucket alone is full; wait into the next one
+    retry = window - elapsed + math.ceil(window * (1 - (limit - 1) / count))
+  end
+end
+return {allowed, math.floor(math.max(limit - used, 0)), reset, retry}
+`)
+
+// RateLimit is a sliding-window limit per key. Requests for which Key
+// returns "" are not limited (they fail validation further down anyway).
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    func(c *fiber.Ctx) string
+	// Plans, if set, are per-plan limits that replace Limit for the plan
+	// Plan resolves the key to. Limit still applies to other plans and to
+	// keys whose plan can't be resolved.
+	Plans map[string]int
+	Plan  func(ctx context.Context, key string) (string, error)
+}
+
+// rateLimitKey is the rateLimitScript hash for limiter name and key. The
+// ":sw" suffix keeps clear of the fixed-window string keys.
+func rateLimitKey(name, key string) string {
+	return "rl:user:" + key + ":" + name + ":sw"
+}
+
+// limitFor returns the plan label and limit that apply to key
+func (rl RateLimit) limitFor(ctx context.Context, key string) (string, int) {
+	if rl.Plans == nil {
+		return "all", rl.Limit
+	}
+	plan, err := rl.Plan(ctx, key)
+	if limit, ok := rl.Plans[plan]; ok && err == nil {
+		return plan, limit
+	}
+	return "unknown", rl.Limit
+}
+
+// rateLimitMiddleware enforces rl in Redis. When Redis is unavailable the
+// failure is counted and the request is let through if failOpen, otherwise
+// rejected with 503.
+func rateLimitMiddleware(rdb *redis.Client, rl RateLimit, failOpen bool) fiber.Handler {
+	window := max(rl.Window.Milliseconds(), 1)
+	return func(c *fiber.Ctx) error {
+		key := rl.Key(c)
+		if key == "" {
+			return c.Next()
+		}
+
+		ctx := c.UserContext()
+		spanCtx, span := startSpan(ctx, "ratelimit."+rl.Name)
+		plan, limit := rl.limitFor(spanCtx, key)
+		res, err := rateLimitScript.Run(spanCtx, rdb,
+			[]string{rateLimitKey(rl.Name, key)}, window, limit).Int64Slice()
+		endSpan(span, err)
+		if err != nil || len(res) != 4 {
+			rateLimitErrors.WithLabelValues(rl.Name).Inc()
+			if failOpen {
+				return c.Next()
+			}
+			return writeError(c, ErrRedisUnavailable)
+		}
+		allowed, remaining := res[0] == 1, res[1]
+		reset, retry := time.Duration(res[2])*time.Millisecond, time.Duration(res[3])*time.Millisecond
+
+		c.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		c.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		c.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(reset), 10))
+		if !allowed {
+			rateLimitChecks.WithLabelValues(rl.Name, plan, "limited").Inc()
+			c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(ceilSeconds(retry), 1), 10))
+			return writeError(c, ErrRateLimited.WithDetails(fiber.Map{
+				"plan":          plan,
+				"limit":         limit,
+				"windowSeconds": rl.Window.Seconds(),
+			}))
+		}
+		rateLimitChecks.WithLabelValues(rl.Name, plan, "allowed").Inc()
+		return c.Next()
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds for the rate limit headers
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// userIDFromParam keys the limit on the :userId path parameter. Non-UUIDs
+// are left to the handler's 400 rather than minting junk Redis keys.
+func userIDFromParam(c *fiber.Ctx) string {
+	id, err := uuid.Parse(c.Params("userId"))
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// userIDFromBody keys the limit on the JSON body's userId, which like
+// userIDFromParam must be a UUID
+func userIDFromBody(c *fiber.Ctx) string {
+	var body struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return ""
+	}
+	id, err := uuid.Parse(body.UserID)
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// userPlan resolves a user's plan through the overview's cached user, so
+// a per-plan limit usually costs one Redis GET rather than a query
+func userPlan(s *UserOverviewService) func(ctx context.Context, userID string) (string, error) {
+	return func(ctx context.Context, userID string) (string, error) {
+		user, err := s.ResolveUser(ctx, userID)
+		if err != nil || user == nil {
+			return "", err
+		}
+		return user.Plan, nil
+	}
+}
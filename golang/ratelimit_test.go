@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+const testUserID = "7f0c9a52-1d1e-4c55-9d5e-3a1f6f0b2c11"
+
+func checkoutLimit(limit int) RateLimit {
+	return RateLimit{Name: "checkout", Limit: limit, Window: time.Minute, Key: userIDFromBody}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	_, rdb := testRedis(t)
+	app := fiber.New()
+	app.Post("/checkout", rateLimitMiddleware(rdb, checkoutLimit(2), false), okHandler)
+	body := CheckoutRequest{UserID: testUserID}
+
+	for i, want := range []struct {
+		status    int
+		remaining string
+	}{{200, "1"}, {200, "0"}, {429, "0"}} {
+		resp, got := send(t, app, newRequest(http.MethodPost, "/checkout", body))
+		if resp.StatusCode != want.status {
+			t.Fatalf("request %d: status = %d, want %d: %s", i+1, resp.StatusCode, want.status, got)
+		}
+		if h := resp.Header.Get("X-RateLimit-Remaining"); h != want.remaining {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %s", i+1, h, want.remaining)
+		}
+		if resp.Header.Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q", i+1, resp.Header.Get("X-RateLimit-Limit"))
+		}
+		if want.status != 429 {
+			continue
+		}
+		retry, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter))
+		if err != nil || retry < 1 || retry > 120 {
+			t.Errorf("Retry-After = %q, want within two windows", resp.Header.Get(fiber.HeaderRetryAfter))
+		}
+		if e, _ := decode(t, got)["error"].(map[string]any); e["code"] != "RATE_LIMITED" {
+			t.Errorf("error = %v, want RATE_LIMITED", e)
+		}
+	}
+
+	// Other users and requests without a user id are not limited
+	other := CheckoutRequest{UserID: "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"}
+	for _, b := range []any{other, `{"userId":"not-a-uuid"}`} {
+		if resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", b)); resp.StatusCode != 200 {
+			t.Errorf("%v: status = %d, want 200", b, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitRedisFailurePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		failOpen bool
+		status   int
+	}{{true, 200}, {false, 503}} {
+		mr, rdb := testRedis(t)
+		mr.Close()
+		app := fiber.New()
+		app.Post("/checkout", rateLimitMiddleware(rdb, checkoutLimit(1), tt.failOpen), okHandler)
+		resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID}))
+		if resp.StatusCode != tt.status {
+			t.Errorf("failOpen=%t: status = %d, want %d", tt.failOpen, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// replayApp is the checkout route's replay and limit chain in front of a
+// handler that counts the checkouts that got through
+func replayApp(t *testing.T, rdb *redis.Client, checkouts *int) (*fiber.App, *CheckoutHandler) {
+	h := &CheckoutHandler{
+		rdb:   rdb,
+		cfg:   config.CheckoutConfig{LockBackend: "redis", MaxBodyBytes: 1 << 16},
+		codec: newCacheCodec(0),
+	}
+	app := fiber.New()
+	app.Post("/checkout", h.ReplayMiddleware(), rateLimitMiddleware(rdb, checkoutLimit(1), false),
+		func(c *fiber.Ctx) error {
+			*checkouts++
+			return c.JSON(fiber.Map{"orderId": "new"})
+		})
+	return app, h
+}
+
+func TestReplaysAreServedAheadOfTheRateLimit(t *testing.T) {
+	_, rdb := testRedis(t)
+	checkouts := 0
+	app, h := replayApp(t, rdb, &checkouts)
+	req := CheckoutRequest{UserID: testUserID, CartID: "c3b2a1d0-5e6f-4a7b-8c9d-0e1f2a3b4c5d", PaymentRef: "pay-1"}
+	// The first attempt finished and stored its response (shipping
+	// method defaulted, as Checkout does)
+	stored := req
+	stored.ShippingMethod = shippingMethodOrDefault("")
+	original := []byte(`{"orderId":"o-1","status":"pending"}`)
+	rdb.Set(context.Background(), idempotencyRedisKey("key-1"), h.idempotencyEntry(requestFingerprint(stored), original), 0)
+
+	// Use up the user's one request
+	fresh := req
+	fresh.PaymentRef = "pay-2"
+	if resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", fresh)); resp.StatusCode != 200 {
+		t.Fatalf("first checkout: status = %d", resp.StatusCode)
+	}
+
+	retry := newRequest(http.MethodPost, "/checkout", req)
+	retry.Header.Set(headerIdempotencyKey, "key-1")
+	resp, body := send(t, app, retry)
+	if resp.StatusCode != 200 || string(body) != string(original) {
+		t.Fatalf("retry: got %d %s, want the stored response", resp.StatusCode, body)
+	}
+	if resp.Header.Get(headerIdempotentReplay) != "true" {
+		t.Error("retry is not marked Idempotent-Replay")
+	}
+
+	// Anything that isn't an exact replay still meets the limit
+	reused := newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID, CartID: req.CartID, Coupon: "SAVE10"})
+	reused.Header.Set(headerIdempotencyKey, "key-1")
+	for name, r := range map[string]*http.Request{
+		"new request": newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID, PaymentRef: "pay-3"}),
+		"key reused":  reused,
+		"async replay": func() *http.Request {
+			r := newRequest(http.MethodPost, "/checkout?async=true", req)
+			r.Header.Set(headerIdempotencyKey, "key-1")
+			return r
+		}(),
+	} {
+		if resp, _ := send(t, app, r); resp.StatusCode != fiber.StatusTooManyRequests {
+			t.Errorf("%s: status = %d, want 429", name, resp.StatusCode)
+		}
+	}
+	if checkouts != 1 {
+		t.Errorf("%d checkouts ran, want 1", checkouts)
+	}
+}
+
+func TestReplayWaitsForAPendingCheckout(t *testing.T) {
+	_, rdb := testRedis(t)
+	checkouts := 0
+	app, _ := replayApp(t, rdb, &checkouts)
+	rdb.Set(context.Background(), idempotencyRedisKey("pay-1"), idempotencyPending+"token", 0)
+
+	resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID, PaymentRef: "pay-1"}))
+	if resp.Header.Get(headerIdempotentReplay) != "" || checkouts != 1 {
+		t.Errorf("a pending key was replayed (status %d, %d checkouts)", resp.StatusCode, checkouts)
+	}
+}
+
+func TestRateLimitWindowSlides(t *testing.T) {
+	mr, rdb := testRedis(t)
+	app := fiber.New()
+	limit := RateLimit{Name: "checkout", Limit: 4, Window: 10 * time.Second, Key: userIDFromBody}
+	app.Post("/checkout", rateLimitMiddleware(rdb, limit, false), okHandler)
+	// The script reads Redis's clock; bucket boundaries fall on multiples
+	// of the window
+	bucket := time.Unix(1_700_000_000, 0)
+	post := func(at time.Duration) *http.Response {
+		t.Helper()
+		mr.SetTime(bucket.Add(at))
+		resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", CheckoutRequest{UserID: testUserID}))
+		return resp
+	}
+
+	// The whole quota just before a bucket boundary...
+	for range 4 {
+		if resp := post(9 * time.Second); resp.StatusCode != 200 {
+			t.Fatalf("status = %d, want the quota spent", resp.StatusCode)
+		}
+	}
+	// ...still counts just after it, where a fixed window would reset
+	resp := post(11 * time.Second)
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("after the boundary: status = %d, want 429", resp.StatusCode)
+	}
+	// 90% of the previous bucket overlaps; at 75% one request fits
+	if got := resp.Header.Get(fiber.HeaderRetryAfter); got != "2" {
+		t.Errorf("Retry-After = %q, want 2 (1.5s rounded up)", got)
+	}
+	if got := resp.Header.Get("X-RateLimit-Reset"); got != "9" {
+		t.Errorf("X-RateLimit-Reset = %q, want 9", got)
+	}
+	// The rejection wasn't counted
+	if got := mr.HGet(rateLimitKey("checkout", testUserID), "170001"); got != "" {
+		t.Errorf("current bucket = %q after a rejection, want empty", got)
+	}
+
+	if resp := post(12500 * time.Millisecond); resp.StatusCode != 200 {
+		t.Errorf("at Retry-After: status = %d, want 200", resp.StatusCode)
+	}
+	// Halfway through, half the old bucket and the new request leave one
+	if resp := post(15 * time.Second); resp.StatusCode != 200 {
+		t.Errorf("halfway: status = %d, want 200", resp.StatusCode)
+	}
+	if resp := post(15 * time.Second); resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Errorf("halfway, over the quota: status = %d, want 429", resp.StatusCode)
+	}
+	if ttl := mr.TTL(rateLimitKey("checkout", testUserID)); ttl != 20*time.Second {
+		t.Errorf("TTL = %s, want two windows", ttl)
+	}
+}
+
+func TestRateLimitPerPlan(t *testing.T) {
+	_, rdb := testRedis(t)
+	users := map[string]string{
+		"00000000-0000-4000-8000-000000000001": "free",
+		"00000000-0000-4000-8000-000000000002": "enterprise",
+		"00000000-0000-4000-8000-000000000003": "legacy",
+	}
+	const unresolved = "00000000-0000-4000-8000-000000000004"
+	rl := checkoutLimit(3)
+	rl.Plans = map[string]int{"free": 2, "enterprise": 6}
+	rl.Plan = func(_ context.Context, userID string) (string, error) {
+		if plan, ok := users[userID]; ok {
+			return plan, nil
+		}
+		return "", errors.New("user cache unavailable")
+	}
+	app := fiber.New()
+	app.Post("/checkout", rateLimitMiddleware(rdb, rl, false), okHandler)
+
+	for _, tt := range []struct {
+		user, plan string
+		limit      int
+	}{
+		{"00000000-0000-4000-8000-000000000001", "free", 2},
+		{"00000000-0000-4000-8000-000000000002", "enterprise", 6},
+		{"00000000-0000-4000-8000-000000000003", "unknown", 3},
+		{unresolved, "unknown", 3},
+	} {
+		limited := testutil.ToFloat64(rateLimitChecks.WithLabelValues("checkout", tt.plan, "limited"))
+		allowed := testutil.ToFloat64(rateLimitChecks.WithLabelValues("checkout", tt.plan, "allowed"))
+		body := CheckoutRequest{UserID: tt.user}
+		for i := range tt.limit {
+			if resp, _ := send(t, app, newRequest(http.MethodPost, "/checkout", body)); resp.StatusCode != 200 {
+				t.Fatalf("%s request %d: status = %d, want 200", users[tt.user], i+1, resp.StatusCode)
+			}
+		}
+		resp, got := send(t, app, newRequest(http.MethodPost, "/checkout", body))
+		e, _ := decode(t, got)["error"].(map[string]any)
+		details, _ := e["details"].(map[string]any)
+		if resp.StatusCode != 429 || details["plan"] != tt.plan || details["limit"] != float64(tt.limit) ||
+			details["windowSeconds"] != 60.0 || resp.Header.Get("X-RateLimit-Limit") != strconv.Itoa(tt.limit) {
+			t.Errorf("%s: got %d %s, want 429 at the %s limit of %d", tt.user, resp.StatusCode, got, tt.plan, tt.limit)
+		}
+		if d := testutil.ToFloat64(rateLimitChecks.WithLabelValues("checkout", tt.plan, "limited")) - limited; d != 1 {
+			t.Errorf("%s: limited count rose by %v, want 1", tt.plan, d)
+		}
+		if d := testutil.ToFloat64(rateLimitChecks.WithLabelValues("checkout", tt.plan, "allowed")) - allowed; d != float64(tt.limit) {
+			t.Errorf("%s: allowed count rose by %v, want %d", tt.plan, d, tt.limit)
+		}
+	}
+}
+
+func TestUserPlanGoesThroughTheUserCache(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	cfg := testConfig(t)
+	svc := NewUserOverviewService(db, rdb, cfg.Cache, nil, 0, nil,
+		NewActiveUsers(rdb, cfg.Metrics.ActiveUsers), cfg.Overview.ReservedFrom)
+	plan := userPlan(svc)
+	user := seedUser(t, db, "enterprise", "active")
+
+	if got, err := plan(context.Background(), user); err != nil || got != "enterprise" {
+		t.Fatalf("plan = %q, %v, want enterprise", got, err)
+	}
+	if !mr.Exists(userCacheKey(user)) {
+		t.Error("the user wasn't cached for the next check")
+	}
+	if got, err := plan(context.Background(), "00000000-0000-4000-8000-000000000009"); err != nil || got != "" {
+		t.Errorf("missing user: plan = %q, %v, want none", got, err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var panicsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_panics_total",
+	Help: "Handler panics recovered, by route.",
+}, []string{"route"})
+
+// recoverMiddleware replaces Fiber's recover so a panic can be traced from
+// the client back to the server log: the stack is logged together with the
+// request id and a fresh error id, and only the error id is returned.
+func recoverMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			errorID := uuid.New().String()
+			requestID, _ := c.Locals(localRequestID).(string)
+			route := c.Route().Path
+			panicsTotal.WithLabelValues(route).Inc()
+			log.Printf("panic: %v\nerrorId=%s requestId=%s route=%s %s\n%s",
+				r, errorID, requestID, c.Method(), route, debug.Stack())
+
+			err = c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "internal error",
+				"errorId": errorID,
+			})
+		}()
+		return c.Next()
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	app := fiber.New()
+	app.Use(recoverMiddleware())
+	app.Use(requestid.New())
+	app.Get("/boom", func(c *fiber.Ctx) error { panic("deliberate test panic") })
+
+	before := testutil.ToFloat64(panicsTotal.WithLabelValues("/boom"))
+	req := newRequest(http.MethodGet, "/boom", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "req-panic")
+	resp, body := send(t, app, req)
+
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	got := decode(t, body)
+	errorID, _ := got["errorId"].(string)
+	if got["error"] != "internal error" || errorID == "" || len(got) != 2 {
+		t.Fatalf(`body = %s, want {"error":"internal error","errorId":...}`, body)
+	}
+	if strings.Contains(string(body), "deliberate") {
+		t.Errorf("panic value leaked to the client: %s", body)
+	}
+
+	out := logs.String()
+	for _, want := range []string{
+		"panic: deliberate test panic",
+		"errorId=" + errorID,
+		"requestId=req-panic",
+		"route=GET /boom",
+		"recovery_test.go", // the stack reaches the panicking handler
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log is missing %q:\n%s", want, out)
+		}
+	}
+	if got := testutil.ToFloat64(panicsTotal.WithLabelValues("/boom")) - before; got != 1 {
+		t.Errorf("http_panics_total{route=/boom} grew by %v, want 1", got)
+	}
+}
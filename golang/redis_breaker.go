@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+var (
+	breakerStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_breaker_state",
+		Help: "Redis circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	})
+	breakerRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_breaker_rejected_total",
+		Help: "Redis commands short-circuited while the breaker was open.",
+	})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_breaker_transitions_total",
+		Help: "Redis circuit breaker state changes, by new state.",
+	}, []string{"state"})
+)
+
+// RedisBreaker stops sending commands to Redis after Threshold consecutive
+// failures within Window, so a stalled Redis costs callers nothing instead
+// of a full read timeout each. After Cooldown one probe command is let
+// through; its result closes or re-opens the breaker.
+type RedisBreaker struct {
+	cfg config.RedisBreakerConfig
+
+	mu          sync.Mutex
+	state       breakerState
+	failures    int
+	lastFailure time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+func NewRedisBreaker(cfg config.RedisBreakerConfig) *RedisBreaker {
+	return &RedisBreaker{cfg: cfg}
+}
+
+func (b *RedisBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a command may be sent, claiming the probe slot when
+// the cooldown has elapsed
+func (b *RedisBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record counts the outcome of a command sent with ctx. A command cut
+// short because the caller gave up or ran out of its own deadline says
+// nothing about Redis, whichever error it surfaced as.
+func (b *RedisBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && (callerGaveUp(ctx) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)) {
+		// Just free the probe slot
+		b.probing = false
+		return
+	}
+	if !isRedisFailure(err) {
+		b.failures = 0
+		b.probing = false
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.lastFailure) > b.cfg.Window {
+		b.failures = 0
+	}
+	b.failures++
+	b.lastFailure = now
+	b.probing = false
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.Threshold {
+		b.openedAt = now
+		if b.state != breakerOpen {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// callerGaveUp reports whether ctx is done or past its deadline. The
+// connection's deadline is set from ctx's, so a read can time out a moment
+// before ctx's own timer marks it done.
+func callerGaveUp(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+func (b *RedisBreaker) transition(to breakerState) {
+	b.state = to
+	breakerStateGauge.Set(float64(to))
+	breakerTransitions.WithLabelValues(to.String()).Inc()
+}
+
+// isRedisFailure separates Redis being unhealthy from normal outcomes such
+// as a missing key or an error reply
+func isRedisFailure(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		// Server replied (WRONGTYPE, NOSCRIPT, ...); the connection is fine
+		return false
+	}
+	return true
+}
+
+// Hook returns a go-redis hook that applies the breaker to every command
+// and pipeline on the client
+func (b *RedisBreaker) Hook() redis.Hook {
+	return breakerHook{b}
+}
+
+type breakerHook struct{ b *RedisBreaker }
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.b.allow() {
+			breakerRejected.Inc()
+			cmd.SetErr(ErrRedisUnavailable)
+			return ErrRedisUnavailable
+		}
+		err := next(ctx, cmd)
+		h.b.record(ctx, err)
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !h.b.allow() {
+			breakerRejected.Inc()
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrRedisUnavailable)
+			}
+			return ErrRedisUnavailable
+		}
+		err := next(ctx, cmds)
+		h.b.record(ctx, err)
+		return err
+	}
+}
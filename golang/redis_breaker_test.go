@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// breakerClient is a client for mr behind a breaker that opens after two
+// failures
+func breakerClient(t *testing.T, mr *miniredis.Miniredis, cooldown time.Duration) (*redis.Client, *RedisBreaker) {
+	t.Helper()
+	b := NewRedisBreaker(config.RedisBreakerConfig{Threshold: 2, Window: time.Minute, Cooldown: cooldown})
+	rdb := redis.NewClient(&redis.Options{
+		Addr:                  mr.Addr(),
+		MaxRetries:            -1,
+		DialTimeout:           100 * time.Millisecond,
+		ReadTimeout:           100 * time.Millisecond,
+		ContextTimeoutEnabled: true,
+	})
+	rdb.AddHook(b.Hook())
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, b
+}
+
+func TestRedisBreakerOpensAndRecovers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, b := breakerClient(t, mr, 50*time.Millisecond)
+	ctx := context.Background()
+
+	// Misses and error replies are not failures
+	rdb.Get(ctx, "missing")
+	rdb.Set(ctx, "s", "x", 0)
+	rdb.HGet(ctx, "s", "f") // WRONGTYPE
+	if b.State() != breakerClosed {
+		t.Fatalf("state = %s after normal outcomes", b.State())
+	}
+
+	addr := mr.Addr()
+	mr.Close()
+	for i := 0; i < 2; i++ {
+		rdb.Get(ctx, "k")
+	}
+	if b.State() != breakerOpen {
+		t.Fatalf("state = %s after two failures, want open", b.State())
+	}
+	// Open: short-circuited without touching the network
+	start := time.Now()
+	if err := rdb.Get(ctx, "k").Err(); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("open breaker err = %v, want ErrRedisUnavailable", err)
+	}
+	if time.Since(start) > 20*time.Millisecond {
+		t.Errorf("open breaker took %s to reject", time.Since(start))
+	}
+
+	// After the cooldown one probe goes through and closes it
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := rdb.Set(ctx, "k", "v", 0).Err(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("state = %s after a successful probe, want closed", b.State())
+	}
+}
+
+func TestRedisBreakerIgnoresTheCallersOwnDeadline(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, b := breakerClient(t, mr, time.Minute)
+	slow := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		// BLPOP on an empty list blocks past the caller's deadline
+		rdb.BLPop(ctx, time.Second, "empty")
+	}
+	for i := 0; i < 5; i++ {
+		slow()
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		rdb.Get(cancelled, "k")
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("state = %s after callers gave up, want closed", b.State())
+	}
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Errorf("healthy Redis rejected: %v", err)
+	}
+}
+
+func TestRedisBreakerHalfOpenProbeSlotIsFreedByACancelledCaller(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, b := breakerClient(t, mr, 10*time.Millisecond)
+	addr := mr.Addr()
+	mr.Close()
+	rdb.Get(context.Background(), "k")
+	rdb.Get(context.Background(), "k")
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// The probe's caller gives up; the next command must get to probe
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	rdb.BLPop(ctx, time.Second, "empty")
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("second probe rejected: %v", err)
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("state = %s, want closed", b.State())
+	}
+}
+
+func TestOverviewSurvivesRedisDyingMidFlight(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	breaker := NewRedisBreaker(config.RedisBreakerConfig{Threshold: 3, Window: time.Minute, Cooldown: time.Minute})
+	rdb.AddHook(breaker.Hook())
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	target := "/v1/users/" + user + "/overview"
+
+	const requests = 40
+	statuses := make([]int, requests)
+	bodies := make([][]byte, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		if i == requests/2 {
+			// Kill Redis with half the requests still in flight
+			mr.Close()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Not send: t.Fatal can't be called off the test goroutine
+			resp, err := app.Test(newRequest(http.MethodGet, target, nil), -1)
+			if err != nil {
+				bodies[i] = []byte(err.Error())
+				return
+			}
+			defer resp.Body.Close()
+			statuses[i] = resp.StatusCode
+			bodies[i], _ = io.ReadAll(resp.Body)
+		}()
+	}
+	wg.Wait()
+
+	for i := range requests {
+		if statuses[i] != fiber.StatusOK {
+			t.Errorf("request %d: status = %d: %s", i, statuses[i], bodies[i])
+			continue
+		}
+		if u, _ := decode(t, bodies[i])["user"].(map[string]any); u["id"] != user {
+			t.Errorf("request %d: user = %v, want %s", i, u, user)
+		}
+	}
+	if breaker.State() != breakerOpen {
+		t.Errorf("breaker = %s with Redis gone, want open", breaker.State())
+	}
+
+	// Once open, requests don't wait on Redis at all
+	resp, _ := send(t, app, newRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(headerCache) != "BYPASS" {
+		t.Errorf("got %d X-Cache %q, want 200 BYPASS", resp.StatusCode, resp.Header.Get(headerCache))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+var (
+	reservationSweeps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reservation_sweeps_total",
+		Help: "Reservation sweep attempts by this instance, by outcome (swept, failed, skipped when another instance held the lock).",
+	}, []string{"outcome"})
+	reservationOrdersExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservation_orders_expired_total",
+		Help: "Pending orders marked expired by the reservation sweeper.",
+	})
+	reservationsReleased = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_released_total",
+		Help: "Inventory reservation rows released by the reservation sweeper.",
+	})
+	reservedUnitsReleased = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservation_units_released_total",
+		Help: "Units returned from reserved_qty by the reservation sweeper.",
+	})
+)
+
+const reservationSweepLockKey = "lock:reservation_sweep"
+
+// sweepReservationsSQL expires one batch of pending orders with an
+// expired reservation and gives back what they reserved, as a single
+// statement so the status change, the reservation rows and reserved_qty
+// move together. Only orders with reservation rows are candidates, so
+// pending orders from before the table existed are left alone.
+//
+// Fulfilling or cancelling an order races the sweep on the order row:
+// both lock it before touching its reservations. SKIP LOCKED leaves an
+// order another transaction holds to the next sweep, by which time its
+// status is no longer pending and its reservations are gone; an order
+// the sweep locks first is expired, and the other side then finds it
+// no longer pending.
+const sweepReservationsSQL = `
+	WITH stale AS (
+		SELECT o.id FROM orders o
+		WHERE o.status = 'pending'
+			AND o.id IN (
+				SELECT order_id FROM inventory_reservations
+				WHERE expires_at < NOW())
+		ORDER BY o.created_at
+		LIMIT $1
+		FOR UPDATE OF o SKIP LOCKED
+	), expired AS (
+		UPDATE orders o SET status = 'expired'
+		FROM stale WHERE o.id = stale.id
+		RETURNING o.id
+	), released AS (
+		DELETE FROM inventory_reservations r
+		USING expired e WHERE r.order_id = e.id
+		RETURNING r.product_id, r.warehouse_id, r.qty
+	), restocked AS (
+		UPDATE inventory i
+		SET reserved_qty = GREATEST(i.reserved_qty - t.qty, 0), updated_at = NOW()
+		FROM (
+			SELECT product_id, warehouse_id, SUM(qty)::int AS qty
+			FROM released GROUP BY product_id, warehouse_id
+		) t
+		WHERE i.product_id = t.product_id AND i.warehouse_id = t.warehouse_id
+	)
+	SELECT (SELECT COALESCE(array_agg(id::text), '{}') FROM expired),
+		(SELECT COUNT(*) FROM released),
+		(SELECT COALESCE(SUM(qty), 0) FROM released)`
+
+// ReservationSweeper releases the inventory that checkout reserved for
+// orders nobody completed. Every instance runs it, but a Redis lock held
+// for one interval lets only one of them sweep per tick.
+type ReservationSweeper struct {
+	db  *DBRouter
+	rdb *redis.Client
+	cfg config.ReservationConfig
+}
+
+func NewReservationSweeper(
+	db *DBRouter,
+	rdb *redis.Client,
+	cfg config.ReservationConfig,
+) *ReservationSweeper {
+	return &ReservationSweeper{db: db, rdb: rdb, cfg: cfg}
+}
+
+// Enabled reports whether RESERVATION_SWEEP_INTERVAL turns the sweeper on
+func (s *ReservationSweeper) Enabled() bool {
+	return s.cfg.SweepInterval > 0
+}
+
+// Run sweeps every interval until ctx is done
+func (s *ReservationSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.tick(ctx)
+		}
+	}
+}
+
+func (s *ReservationSweeper) tick(ctx context.Context) {
+	// Like the availability refresh, the lock just expires after one
+	// interval, limiting the cluster to one sweep per tick
+	claimed, err := s.rdb.SetNX(ctx, reservationSweepLockKey, uuid.NewString(), s.cfg.SweepInterval).Result()
+	switch {
+	case err != nil:
+		log.Printf("⚠️  Reservation sweep lock failed: %v", err)
+	case claimed:
+		s.sweep(ctx)
+	default:
+		reservationSweeps.WithLabelValues("skipped").Inc()
+	}
+}
+
+// sweep expires batches until one comes back short or the interval is up
+func (s *ReservationSweeper) sweep(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.SweepInterval)
+	defer cancel()
+
+	var orders, rows, units int64
+	for {
+		var ids []string
+		var r, u int64
+		err := s.db.Primary().QueryRow(ctx, sweepReservationsSQL, s.cfg.BatchSize).Scan(&ids, &r, &u)
+		if err != nil {
+			reservationSweeps.WithLabelValues("failed").Inc()
+			log.Printf("⚠️  Reservation sweep failed: %v", err)
+			break
+		}
+		s.invalidate(ctx, ids)
+		n := int64(len(ids))
+		reservationOrdersExpired.Add(float64(n))
+		reservationsReleased.Add(float64(r))
+		reservedUnitsReleased.Add(float64(u))
+		orders, rows, units = orders+n, rows+r, units+u
+		if n < int64(s.cfg.BatchSize) {
+			reservationSweeps.WithLabelValues("swept").Inc()
+			break
+		}
+	}
+	if orders > 0 {
+		log.Printf("🧹 Expired %d pending orders, released %d reservations (%d units)", orders, rows, units)
+	}
+}
+
+// invalidate drops the cached pages of the orders just expired; a failure
+// leaves them to CACHE_ORDER_TTL
+func (s *ReservationSweeper) invalidate(ctx context.Context, orderIDs []string) {
+	if len(orderIDs) == 0 {
+		return
+	}
+	keys := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		keys[i] = orderCacheKey(id)
+	}
+	if err := s.rdb.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("⚠️  Expired orders not invalidated: %v", err)
+	}
+}
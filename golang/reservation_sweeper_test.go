@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"loastest-go/config"
+)
+
+const testWarehouseID = "11111111-1111-1111-1111-111111111111"
+
+func TestReservationSweepTakesTurns(t *testing.T) {
+	mr, rdb := testRedis(t)
+	s := NewReservationSweeper(unreachableRouter(t), rdb, config.ReservationConfig{SweepInterval: time.Minute, BatchSize: 10})
+
+	skipped := testutil.ToFloat64(reservationSweeps.WithLabelValues("skipped"))
+	failed := testutil.ToFloat64(reservationSweeps.WithLabelValues("failed"))
+	// This instance claims the tick; its sweep can't reach Postgres
+	s.tick(context.Background())
+	if got := testutil.ToFloat64(reservationSweeps.WithLabelValues("failed")) - failed; got != 1 {
+		t.Errorf("failed sweeps = %v, want 1", got)
+	}
+	if ttl := mr.TTL(reservationSweepLockKey); ttl != time.Minute {
+		t.Errorf("lock TTL = %s, want one interval", ttl)
+	}
+	// Another tick within the interval leaves it to the holder
+	s.tick(context.Background())
+	if got := testutil.ToFloat64(reservationSweeps.WithLabelValues("skipped")) - skipped; got != 1 {
+		t.Errorf("skipped sweeps = %v, want 1", got)
+	}
+}
+
+// seedReservation reserves qty of product for order in the test warehouse,
+// expiring at expires, and counts it in reserved_qty as checkout does
+func seedReservation(t *testing.T, db *DBRouter, order, product string, qty int, expires time.Time) {
+	t.Helper()
+	mustExec(t, db, `
+		INSERT INTO inventory_reservations (order_id, product_id, warehouse_id, qty, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, order, product, testWarehouseID, qty, expires)
+	mustExec(t, db, `
+		UPDATE inventory SET reserved_qty = reserved_qty + $3
+		WHERE product_id = $1 AND warehouse_id = $2`, product, testWarehouseID, qty)
+}
+
+func TestSweepReleasesExpiredReservations(t *testing.T) {
+	db := testRouter(t)
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "SWEEP", 5, 100)
+
+	abandoned := seedOrder(t, db, user, "pending", 3, 5, product)
+	seedReservation(t, db, abandoned, product, 3, time.Now().Add(-time.Minute))
+	waiting := seedOrder(t, db, user, "pending", 2, 5, product)
+	seedReservation(t, db, waiting, product, 2, time.Now().Add(time.Hour))
+	completed := seedOrder(t, db, user, "completed", 4, 5, product)
+	seedReservation(t, db, completed, product, 4, time.Now().Add(-time.Minute))
+	// Seeded before reservations were recorded; nothing to release exactly
+	legacy := seedOrder(t, db, user, "pending", 1, 5, product)
+	mr.Set(orderCacheKey(abandoned), "{}")
+
+	// A batch of one walks the backlog a batch at a time
+	s := NewReservationSweeper(db, rdb, config.ReservationConfig{SweepInterval: time.Minute, BatchSize: 1})
+	s.sweep(ctx)
+
+	status := func(order string) string {
+		var s string
+		if err := db.Primary().QueryRow(ctx, `SELECT status FROM orders WHERE id = $1`, order).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	for order, want := range map[string]string{
+		abandoned: "expired", waiting: "pending", completed: "completed", legacy: "pending",
+	} {
+		if got := status(order); got != want {
+			t.Errorf("order %s is %s, want %s", order, got, want)
+		}
+	}
+	var reserved, rows int
+	err := db.Primary().QueryRow(ctx, `
+		SELECT reserved_qty, (SELECT COUNT(*) FROM inventory_reservations WHERE product_id = $1)
+		FROM inventory WHERE product_id = $1`, product).Scan(&reserved, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != 6 || rows != 2 {
+		t.Errorf("reserved_qty = %d with %d reservations, want 6 and 2", reserved, rows)
+	}
+	if mr.Exists(orderCacheKey(abandoned)) {
+		t.Error("the expired order's cached page survived")
+	}
+}
+
+func TestSweepRacingFulfill(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, _ := checkoutApp(t, db, rdb)
+	ctx := context.Background()
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "SWEEP-RACE", 5, 20)
+	orders := make([]string, 8)
+	for i := range orders {
+		orders[i] = seedOrder(t, db, user, "pending", 1, 5, product)
+		seedReservation(t, db, orders[i], product, 1, time.Now().Add(-time.Second))
+	}
+
+	s := NewReservationSweeper(db, rdb, config.ReservationConfig{SweepInterval: time.Minute, BatchSize: 1})
+	var wg sync.WaitGroup
+	fulfilled := make([]int, len(orders))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.sweep(ctx)
+	}()
+	for i, order := range orders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// send would FailNow off the test's goroutine
+			req := newRequest(http.MethodPost, "/v1/orders/"+order+"/fulfill", nil)
+			req.Header.Set(headerUserID, user)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			fulfilled[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	// A sweep that lost every race leaves nothing; one that skipped a
+	// locked order gets it next time, if it is still pending
+	s.sweep(ctx)
+
+	shipped := 0
+	for i, order := range orders {
+		var status string
+		if err := db.Primary().QueryRow(ctx, `SELECT status FROM orders WHERE id = $1`, order).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case fulfilled[i] == fiber.StatusOK && status == "completed":
+			shipped++
+		case fulfilled[i] == fiber.StatusConflict && status == "expired":
+		default:
+			t.Errorf("order %s: fulfill %d, status %s, want completed or expired, not both", order, fulfilled[i], status)
+		}
+	}
+	var rows int
+	if err := db.Primary().QueryRow(ctx, `
+		SELECT COUNT(*) FROM inventory_reservations WHERE product_id = $1`, product).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	// Each reservation was released once, by whichever side won
+	if available, reserved := stock(t, db, product); available != 20-shipped || reserved != 0 || rows != 0 {
+		t.Errorf("stock = %d/%d with %d reservations, want %d/0 with none", available, reserved, rows, 20-shipped)
+	}
+}
+
+func TestCheckoutReservesUntilTheTTL(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app, h := checkoutApp(t, db, rdb)
+	h.cfg.ReservationTTL = 10 * time.Minute
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "RESERVE-TTL", 5, 10)
+
+	out := postCheckout(t, app, CheckoutRequest{
+		UserID: user, PaymentRef: "pay-ttl", Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+	})
+	var qty, holds int
+	err := db.Primary().QueryRow(context.Background(), `
+		SELECT qty, EXTRACT(EPOCH FROM expires_at - created_at)::int
+		FROM inventory_reservations WHERE order_id = $1`, out.OrderID).Scan(&qty, &holds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qty != 2 || holds != 600 {
+		t.Errorf("reservation = %d units for %ds, want 2 for 600s", qty, holds)
+	}
+}
+
+func TestOverviewSubtractsUnexpiredReservations(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	user := seedUser(t, db, "pro", "active")
+	category := seedCategory(t, db)
+	product := seedProductIn(t, db, category, "RESERVED-FROM", 5, 10)
+	other := seedUser(t, db, "pro", "active")
+	held := seedOrder(t, db, other, "pending", 3, 5, product)
+	seedReservation(t, db, held, product, 3, time.Now().Add(time.Hour))
+	lapsed := seedOrder(t, db, other, "pending", 2, 5, product)
+	seedReservation(t, db, lapsed, product, 2, time.Now().Add(-time.Minute))
+
+	// The counter still holds the lapsed units until the sweeper runs;
+	// the rows already know they are free
+	for from, want := range map[string]float64{"counter": 5, "reservations": 7} {
+		cfg := testConfig(t)
+		cfg.Overview.ReservedFrom = from
+		app := overviewAppWith(db, rdb, cfg)
+		target := "/v1/users/" + user + "/overview?categoryId=" + category
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		products, _ := decode(t, body)["products"].([]any)
+		if resp.StatusCode != fiber.StatusOK || len(products) != 1 {
+			t.Fatalf("%s: got %d %s", from, resp.StatusCode, body)
+		}
+		if got := products[0].(map[string]any)["available"]; got != want {
+			t.Errorf("%s: available = %v, want %v", from, got, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Route is one entry in the versioned API surface. Version is empty for
+// unversioned operational endpoints (health, manifest).
+type Route struct {
+	Version string
+	Method  string
+	Path    string
+	Summary string
+	// Successor is the full path of the route that replaces this one in a
+	// newer version; setting it marks the route deprecated.
+	Successor string
+	// Admin routes require a verified client certificate when mutual TLS
+	// is configured, or the ADMIN_API_KEY when one is set. With neither
+	// they aren't served at all.
+	Admin bool
+	// Timeout is the request budget; zero means no deadline
+	Timeout time.Duration
+	// Middleware runs after the timeout and before Handler, e.g. rate
+	// limits
+	Middleware []fiber.Handler
+	Handler    fiber.Handler
+}
+
+func (r Route) FullPath() string {
+	if r.Version == "" {
+		return r.Path
+	}
+	return "/" + r.Version + r.Path
+}
+
+// RouteRegistry is the single list of routes the app serves. Mounting and
+// the OpenAPI document both come from it so they can't disagree.
+type RouteRegistry struct {
+	routes []Route
+	// Sunset is the HTTP-date advertised on deprecated routes, if any
+	sunset string
+	// adminGuard wraps Admin routes; without one they aren't mounted
+	adminGuard fiber.Handler
+}
+
+func NewRouteRegistry(sunset string, adminGuard fiber.Handler) *RouteRegistry {
+	return &RouteRegistry{sunset: sunset, adminGuard: adminGuard}
+}
+
+// Add registers rt. An Admin route is dropped, with a warning, when there
+// is no admin guard, so a server without credentials configured fails
+// closed rather than serving fulfillment and the admin API to anyone.
+func (r *RouteRegistry) Add(rt Route) {
+	if rt.Admin && r.adminGuard == nil {
+		log.Printf("⚠️  %s %s not served: set ADMIN_API_KEY or TLS_CLIENT_CA_FILE to serve admin routes", rt.Method, rt.FullPath())
+		return
+	}
+	r.routes = append(r.routes, rt)
+}
+
+func (r *RouteRegistry) Mount(app *fiber.App) {
+	for _, rt := range r.routes {
+		handlers := append(append([]fiber.Handler(nil), rt.Middleware...), rt.Handler)
+		if rt.Timeout > 0 {
+			handlers = append([]fiber.Handler{timeoutMiddleware(rt.Timeout)}, handlers...)
+		}
+		if rt.Admin {
+			handlers = append([]fiber.Handler{r.adminGuard}, handlers...)
+		}
+		if rt.Successor != "" {
+			handlers = append(
+				[]fiber.Handler{deprecationHeaders(rt.Successor, r.sunset)},
+				handlers...,
+			)
+		}
+		app.Add(rt.Method, rt.FullPath(), handlers...)
+	}
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(r.OpenAPI())
+	})
+}
+
+// deprecationHeaders follows draft-ietf-httpapi-deprecation-header and
+// RFC 8594 (Sunset) so clients can detect the migration path
+func deprecationHeaders(successor, sunset string) fiber.Handler {
+	link := "<" + successor + `>; rel="successor-version"`
+	return func(c *fiber.Ctx) error {
+		c.Set("Deprecation", "true")
+		c.Set(fiber.HeaderLink, link)
+		if sunset != "" {
+			c.Set("Sunset", sunset)
+		}
+		return c.Next()
+	}
+}
+
+// OpenAPI renders a minimal OpenAPI 3 document covering every version
+func (r *RouteRegistry) OpenAPI() fiber.Map {
+	paths := fiber.Map{}
+	routes := append([]Route(nil), r.routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].FullPath() < routes[j].FullPath()
+	})
+
+	for _, rt := range routes {
+		path, params := openAPIPath(rt.FullPath())
+		item, ok := paths[path].(fiber.Map)
+		if !ok {
+			item = fiber.Map{}
+			paths[path] = item
+		}
+		op := fiber.Map{
+			"summary":    rt.Summary,
+			"deprecated": rt.Successor != "",
+			"responses":  fiber.Map{"200": fiber.Map{"description": "OK"}},
+		}
+		if rt.Version != "" {
+			op["tags"] = []string{rt.Version}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		item[strings.ToLower(rt.Method)] = op
+	}
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":   "LoadTest Benchmark",
+			"version": "2",
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIPath converts Fiber's :param syntax to {param}
+func openAPIPath(path string) (string, []fiber.Map) {
+	var params []fiber.Map
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") {
+			name := strings.TrimSuffix(seg[1:], "?")
+			segments[i] = "{" + name + "}"
+			params = append(params, fiber.Map{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   fiber.Map{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func okHandler(c *fiber.Ctx) error { return c.SendString("ok") }
+
+func TestDeprecatedRoutesAdvertiseTheirSuccessor(t *testing.T) {
+	routes := NewRouteRegistry("Wed, 31 Dec 2025 23:59:59 GMT", nil)
+	routes.Add(Route{Version: "v1", Method: fiber.MethodGet, Path: "/users/:userId/overview",
+		Successor: "/v2/users/:userId/overview", Handler: okHandler})
+	routes.Add(Route{Version: "v2", Method: fiber.MethodGet, Path: "/users/:userId/overview", Handler: okHandler})
+	app := fiber.New()
+	routes.Mount(app)
+
+	resp, _ := send(t, app, newRequest(http.MethodGet, "/v1/users/42/overview", nil))
+	want := map[string]string{
+		"Deprecation": "true",
+		"Link":        `</v2/users/:userId/overview>; rel="successor-version"`,
+		"Sunset":      "Wed, 31 Dec 2025 23:59:59 GMT",
+	}
+	for h, v := range want {
+		if got := resp.Header.Get(h); got != v {
+			t.Errorf("v1 %s = %q, want %q", h, got, v)
+		}
+	}
+
+	resp, _ = send(t, app, newRequest(http.MethodGet, "/v2/users/42/overview", nil))
+	for h := range want {
+		if got := resp.Header.Get(h); got != "" {
+			t.Errorf("v2 sends %s: %q", h, got)
+		}
+	}
+}
+
+func TestOpenAPICoversEveryVersion(t *testing.T) {
+	routes := NewRouteRegistry("", nil)
+	routes.Add(Route{Version: "v1", Method: fiber.MethodGet, Path: "/users/:userId/overview",
+		Successor: "/v2/users/:userId/overview", Handler: okHandler})
+	routes.Add(Route{Version: "v2", Method: fiber.MethodGet, Path: "/users/:userId/overview", Handler: okHandler})
+	routes.Add(Route{Method: fiber.MethodGet, Path: "/health/live", Handler: okHandler})
+	app := fiber.New()
+	routes.Mount(app)
+
+	_, body := send(t, app, newRequest(http.MethodGet, "/openapi.json", nil))
+	paths, _ := decode(t, body)["paths"].(map[string]any)
+	tests := []struct {
+		path       string
+		tag        string
+		deprecated bool
+	}{
+		{path: "/v1/users/{userId}/overview", tag: "v1", deprecated: true},
+		{path: "/v2/users/{userId}/overview", tag: "v2"},
+		{path: "/health/live"},
+	}
+	for _, tt := range tests {
+		item, ok := paths[tt.path].(map[string]any)
+		if !ok {
+			t.Errorf("%s missing from %v", tt.path, paths)
+			continue
+		}
+		op := item["get"].(map[string]any)
+		if op["deprecated"] != tt.deprecated {
+			t.Errorf("%s deprecated = %v, want %v", tt.path, op["deprecated"], tt.deprecated)
+		}
+		tags, _ := op["tags"].([]any)
+		if tt.tag != "" && (len(tags) != 1 || tags[0] != tt.tag) {
+			t.Errorf("%s tags = %v, want [%s]", tt.path, tags, tt.tag)
+		}
+		if tt.tag == "" && tags != nil {
+			t.Errorf("%s is unversioned but tagged %v", tt.path, tags)
+		}
+	}
+}
+
+func TestAdminRoutesFailClosed(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	routes := NewRouteRegistry("", nil)
+	routes.Add(Route{Version: "v1", Method: fiber.MethodGet, Path: "/public", Handler: okHandler})
+	routes.Add(Route{Method: fiber.MethodGet, Path: "/admin/thing", Admin: true, Handler: okHandler})
+	if line := logged.String(); !strings.Contains(line, "GET /admin/thing not served") {
+		t.Errorf("log = %q, want the unserved route named", line)
+	}
+	app := fiber.New()
+	routes.Mount(app)
+
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/v1/public", nil)); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("public route: status = %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/admin/thing", nil)); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("unguarded admin route: status = %d, want 404", resp.StatusCode)
+	}
+	if _, ok := routes.OpenAPI()["paths"].(fiber.Map)["/admin/thing"]; ok {
+		t.Error("the unserved admin route is documented")
+	}
+}
+
+func TestAdminRoutesRequireCredentials(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		certs    bool
+		key      string
+		accepted []any
+	}{
+		{"key", false, "secret", []any{headerAdminKey}},
+		{"certificate", true, "", []any{"client certificate"}},
+		{"either", true, "secret", []any{"client certificate", headerAdminKey}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := NewRouteRegistry("", requireAdmin(tt.certs, tt.key))
+			routes.Add(Route{Method: fiber.MethodGet, Path: "/admin/thing", Admin: true, Handler: okHandler})
+			app := fiber.New()
+			routes.Mount(app)
+
+			req := newRequest(http.MethodGet, "/admin/thing", nil)
+			req.Header.Set(headerAdminKey, "wrong")
+			resp, body := send(t, app, req)
+			e, _ := decode(t, body)["error"].(map[string]any)
+			details, _ := e["details"].(map[string]any)
+			if resp.StatusCode != fiber.StatusUnauthorized || e["code"] != "UNAUTHORIZED" ||
+				!reflect.DeepEqual(details["accepted"], tt.accepted) {
+				t.Errorf("got %d %s, want 401 UNAUTHORIZED accepting %v", resp.StatusCode, body, tt.accepted)
+			}
+			if tt.key == "" {
+				return
+			}
+			req = newRequest(http.MethodGet, "/admin/thing", nil)
+			req.Header.Set(headerAdminKey, tt.key)
+			if resp, _ := send(t, app, req); resp.StatusCode != fiber.StatusOK {
+				t.Errorf("with the key: status = %d, want 200", resp.StatusCode)
+			}
+		})
+	}
+}
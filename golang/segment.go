@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// segmentStore keeps each user's segment in the Redis hash segment:{userId}
+// (segment, spend, plan). The overview fills it from a lifetime-spend
+// aggregate on a miss; checkout adds each new order's total to it, so the
+// aggregate only runs once per SEGMENT_TTL.
+type segmentStore struct {
+	rdb   *redis.Client
+	cfg   config.SegmentConfig
+	rules *segmentRules
+}
+
+func newSegmentStore(
+	rdb *redis.Client,
+	cfg config.SegmentConfig,
+	rules *segmentRules,
+) *segmentStore {
+	return &segmentStore{rdb: rdb, cfg: cfg, rules: rules}
+}
+
+func segmentKey(userID string) string {
+	return "segment:" + userID
+}
+
+// addSpendScript bumps the cached spend and returns {plan, spend}, or nil
+// when there is no entry; checkout must not create one from a single order
+var addSpendScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return nil
+end
+local spend = redis.call('HINCRBYFLOAT', KEYS[1], 'spend', ARGV[1])
+return {redis.call('HGET', KEYS[1], 'plan'), spend}
+`)
+
+// Get returns the cached segment, or "" on a miss
+func (st *segmentStore) Get(ctx context.Context, userID string) (string, error) {
+	segment, err := st.rdb.HGet(ctx, segmentKey(userID), "segment").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return segment, err
+}
+
+// Store computes the segment from lifetime spend and caches it
+func (st *segmentStore) Store(ctx context.Context, user *User, spend float64) (string, error) {
+	segment := st.compute(user.Plan, user.Region, spend)
+	return segment, st.set(ctx, user.ID, user.Plan, segment, spend)
+}
+
+// compute evaluates the current segment rules
+func (st *segmentStore) compute(plan, region string, spend float64) string {
+	return computeSegment(plan, region, spend, st.rules.Rules())
+}
+
+// AddOrder folds a committed order into the cached spend and recomputes the
+// segment. Without an entry it does nothing; the next overview aggregates.
+// A miss racing the checkout can count the order twice or not at all;
+// SEGMENT_TTL bounds how long that lasts.
+func (st *segmentStore) AddOrder(ctx context.Context, userID string, total float64) error {
+	key := segmentKey(userID)
+	res, err := addSpendScript.Run(ctx, st.rdb, []string{key},
+		strconv.FormatFloat(total, 'f', -1, 64)).StringSlice()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	plan := res[0]
+	spend, err := strconv.ParseFloat(res[1], 64)
+	if err != nil {
+		return err
+	}
+	// Region only feeds the simulated CPU work, not the outcome
+	segment := st.compute(plan, "", spend)
+	return st.set(ctx, userID, plan, segment, spend)
+}
+
+func (st *segmentStore) set(ctx context.Context, userID, plan, segment string, spend float64) error {
+	key := segmentKey(userID)
+	pipe := st.rdb.Pipeline()
+	pipe.HSet(ctx, key, "segment", segment, "spend", spend, "plan", plan)
+	pipe.Expire(ctx, key, st.cfg.TTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// computeSegment returns the segment of the first rule that matches
+func computeSegment(plan, region string, totalSpend float64, rules []config.SegmentRule) string {
+	// Simulate some CPU work
+	str := plan + ":" + region + ":" + strconv.FormatFloat(
+		totalSpend,
+		'f',
+		2,
+		64,
+	)
+	hash := 0
+	for _, c := range str {
+		hash = (hash << 5) - hash + int(c)
+	}
+
+	for _, rule := range rules {
+		if matchesSegmentRule(rule, plan, totalSpend) {
+			return rule.Segment
+		}
+	}
+	return defaultSegment
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"loastest-go/config"
+)
+
+// defaultSegment is the segment of a user no rule matches
+const defaultSegment = "basic"
+
+// segmentRules holds the rules computeSegment evaluates. They come from the
+// segment_rules table, reloaded every SEGMENT_RULES_REFRESH so the
+// segmentation can change without a redeploy; before the first load, and
+// whenever the table is empty, the SEGMENT_* thresholds apply. Segments
+// already cached in Redis keep their value until checkout or SEGMENT_TTL.
+type segmentRules struct {
+	db       *DBRouter
+	fallback []config.SegmentRule
+	refresh  time.Duration
+	current  atomic.Pointer[[]config.SegmentRule]
+}
+
+func newSegmentRules(db *DBRouter, cfg config.SegmentConfig) *segmentRules {
+	r := &segmentRules{db: db, fallback: cfg.Rules(), refresh: cfg.RulesRefresh}
+	r.current.Store(&r.fallback)
+	return r
+}
+
+// Rules returns the rules in evaluation order
+func (r *segmentRules) Rules() []config.SegmentRule {
+	return *r.current.Load()
+}
+
+// Run reloads the rules every interval until ctx is done; a failed reload
+// keeps the previous rules
+func (r *segmentRules) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(ctx); err != nil {
+				log.Printf("⚠️  Segment rules reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reload reads segment_rules and swaps it in, or the fallback when the
+// table is empty
+func (r *segmentRules) Reload(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.refresh)
+	defer cancel()
+	rows, err := r.db.Read().Query(ctx, `
+		SELECT segment, COALESCE(plan, ''), min_spend::float8
+		FROM segment_rules
+		ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var rules []config.SegmentRule
+	for rows.Next() {
+		var rule config.SegmentRule
+		if err := rows.Scan(&rule.Segment, &rule.Plan, &rule.MinSpend); err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		rules = r.fallback
+	}
+	r.current.Store(&rules)
+	return nil
+}
+
+// matchesSegmentRule reports whether rule applies to a user on plan with
+// the given lifetime spend
+func matchesSegmentRule(rule config.SegmentRule, plan string, totalSpend float64) bool {
+	if rule.Plan == "" && rule.MinSpend == nil {
+		return true
+	}
+	return (rule.Plan != "" && rule.Plan == plan) ||
+		(rule.MinSpend != nil && totalSpend > *rule.MinSpend)
+}
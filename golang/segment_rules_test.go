@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"loastest-go/config"
+)
+
+func TestComputeSegment(t *testing.T) {
+	spend := func(f float64) *float64 { return &f }
+	cfg := testConfig(t).Segment
+	custom := []config.SegmentRule{
+		{Segment: "whale", MinSpend: spend(50000)},
+		{Segment: "team", Plan: "enterprise"},
+		{Segment: "everyone"},
+	}
+	tests := []struct {
+		name  string
+		rules []config.SegmentRule
+		plan  string
+		spend float64
+		want  string
+	}{
+		{"plan matches", cfg.Rules(), "enterprise", 0, "vip"},
+		{"spend matches", cfg.Rules(), "basic", 20000, "vip"},
+		{"spend must exceed", cfg.Rules(), "basic", 10000, "premium"},
+		{"first match wins", cfg.Rules(), "premium", 6000, "premium"},
+		{"catch-all", cfg.Rules(), "free", 0, "basic"},
+		{"custom spend first", custom, "enterprise", 60000, "whale"},
+		{"custom plan", custom, "enterprise", 10, "team"},
+		{"custom catch-all", custom, "basic", 10, "everyone"},
+		{"no rules", nil, "enterprise", 1e6, defaultSegment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := computeSegment(tt.plan, "us-east", tt.spend, tt.rules); got != tt.want {
+				t.Errorf("segment = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedReloadKeepsTheRules(t *testing.T) {
+	cfg := testConfig(t).Segment
+	rules := newSegmentRules(unreachableRouter(t), cfg)
+	custom := []config.SegmentRule{{Segment: "everyone"}}
+	rules.current.Store(&custom)
+	if err := rules.Reload(context.Background()); err == nil {
+		t.Fatal("reload against an unreachable database succeeded")
+	}
+	if got := rules.Rules(); len(got) != 1 || got[0].Segment != "everyone" {
+		t.Errorf("rules = %v, want the previous ones", got)
+	}
+}
+
+func TestReloadReadsTheTable(t *testing.T) {
+	db := testRouter(t)
+	ctx := context.Background()
+	// The table is shared; put back whatever the seeder left in it
+	var saved [][]any
+	rows, err := db.Primary().Query(ctx, `SELECT position, segment, plan, min_spend FROM segment_rules`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, values)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mustExec(t, db, `DELETE FROM segment_rules`)
+		for _, row := range saved {
+			mustExec(t, db, `INSERT INTO segment_rules (position, segment, plan, min_spend) VALUES ($1, $2, $3, $4)`, row...)
+		}
+	})
+	mustExec(t, db, `DELETE FROM segment_rules`)
+	mustExec(t, db, `
+		INSERT INTO segment_rules (position, segment, plan, min_spend) VALUES
+			(1, 'whale', NULL, 50000),
+			(2, 'team', 'enterprise', NULL),
+			(3, 'everyone', NULL, NULL)`)
+
+	rules := newSegmentRules(db, testConfig(t).Segment)
+	if err := rules.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		plan  string
+		spend float64
+		want  string
+	}{
+		{"basic", 60000, "whale"},
+		{"enterprise", 0, "team"},
+		{"basic", 0, "everyone"},
+	} {
+		if got := computeSegment(tt.plan, "us-east", tt.spend, rules.Rules()); got != tt.want {
+			t.Errorf("%s spending %v: segment = %q, want %q", tt.plan, tt.spend, got, tt.want)
+		}
+	}
+
+	// An empty table falls back to the SEGMENT_* thresholds
+	mustExec(t, db, `DELETE FROM segment_rules`)
+	if err := rules.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := computeSegment("enterprise", "us-east", 0, rules.Rules()); got != "vip" {
+		t.Errorf("with no rows: segment = %q, want vip", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// shippingTier prices one shipping method: Base for the first unit and
+// PerItem for each unit after it, so three of one product ship as three
+// different products would. A non-zero FreeOver waives the charge on a
+// subtotal above it.
+type shippingTier struct {
+	Base     Cents
+	PerItem  Cents
+	FreeOver Cents
+}
+
+// shippingTiers are the methods checkout accepts; only standard ships
+// free over a threshold
+var shippingTiers = map[string]shippingTier{
+	"standard":  {Base: 5_99, PerItem: 99, FreeOver: 100_00},
+	"express":   {Base: 14_99, PerItem: 1_99},
+	"overnight": {Base: 29_99, PerItem: 3_99},
+}
+
+// shippingMethods lists shippingTiers' keys for error details
+var shippingMethods = []string{"standard", "express", "overnight"}
+
+// defaultShippingMethod is used when a checkout names none
+const defaultShippingMethod = "standard"
+
+// shippingMethodOrDefault returns method, or defaultShippingMethod when
+// it is empty
+func shippingMethodOrDefault(method string) string {
+	if method == "" {
+		return defaultShippingMethod
+	}
+	return method
+}
+
+// computeShipping prices an order of units items, counting each line's
+// quantity, by method, which must be one of shippingTiers
+func computeShipping(method string, subtotal Cents, units int) Cents {
+	tier := shippingTiers[method]
+	if tier.FreeOver > 0 && subtotal > tier.FreeOver {
+		return 0
+	}
+	return tier.Base + Cents(units-1)*tier.PerItem
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestComputeShipping(t *testing.T) {
+	for _, tt := range []struct {
+		method   string
+		subtotal Cents
+		units    int
+		want     Cents
+	}{
+		{"standard", 20_00, 1, 5_99},
+		{"standard", 20_00, 3, 7_97},
+		{"standard", 100_00, 2, 6_98}, // free only above the threshold
+		{"standard", 100_01, 2, 0},
+		{"express", 20_00, 1, 14_99},
+		{"express", 500_00, 3, 18_97},
+		{"overnight", 20_00, 1, 29_99},
+		{"overnight", 500_00, 2, 33_98},
+	} {
+		if got := computeShipping(tt.method, tt.subtotal, tt.units); got != tt.want {
+			t.Errorf("%s, %d units over %d: shipping = %d, want %d", tt.method, tt.units, tt.subtotal, got, tt.want)
+		}
+	}
+}
+
+func TestShippingCountsUnits(t *testing.T) {
+	three := priceOrder([]CartItemDB{{ProductID: "P1", Qty: 3, UnitPrice: 10_00}}, 0, 0, "express")
+	distinct := priceOrder([]CartItemDB{
+		{ProductID: "P1", Qty: 1, UnitPrice: 10_00},
+		{ProductID: "P2", Qty: 1, UnitPrice: 10_00},
+		{ProductID: "P3", Qty: 1, UnitPrice: 10_00},
+	}, 0, 0, "express")
+	if three.Shipping != 18_97 || distinct.Shipping != three.Shipping {
+		t.Errorf("shipping = %d for three of one, %d for three different, want 1897 for both", three.Shipping, distinct.Shipping)
+	}
+}
+
+func TestCheckoutValidatesTheShippingMethod(t *testing.T) {
+	h := &CheckoutHandler{cfg: testConfig(t).Checkout}
+	app := fiber.New()
+	app.Post("/checkout", func(c *fiber.Ctx) error {
+		req, err := h.decodeRequest(c, true)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.SendString(req.ShippingMethod)
+	})
+	checkout := func(method string) CheckoutRequest {
+		return CheckoutRequest{
+			UserID: testUserID, PaymentRef: "pay-ship", ShippingMethod: method,
+			Items: []CheckoutItem{{ProductID: testUserID, Qty: 1}},
+		}
+	}
+
+	for method, want := range map[string]string{"": "standard", "express": "express", "overnight": "overnight"} {
+		if resp, body := send(t, app, newRequest(http.MethodPost, "/checkout", checkout(method))); resp.StatusCode != fiber.StatusOK || string(body) != want {
+			t.Errorf("%q: got %d %s, want %s", method, resp.StatusCode, body, want)
+		}
+	}
+	resp, body := send(t, app, newRequest(http.MethodPost, "/checkout", checkout("teleport")))
+	e, _ := decode(t, body)["error"].(map[string]any)
+	details, _ := e["details"].(map[string]any)
+	if resp.StatusCode != fiber.StatusBadRequest || e["code"] != "INVALID_SHIPPING_METHOD" ||
+		details["shippingMethod"] != "teleport" || len(details["allowed"].([]any)) != 3 {
+		t.Errorf("got %d %s, want 400 INVALID_SHIPPING_METHOD listing the methods", resp.StatusCode, body)
+	}
+}
+
+func TestOrderRecordsItsShippingMethod(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	checkout, _ := checkoutApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	product := seedProduct(t, db, "SHIPPED", 60, 10)
+
+	for _, tt := range []struct {
+		method   string
+		shipping float64
+	}{
+		{"standard", 0},    // 120.00 ships free
+		{"express", 16.98}, // the second unit adds PerItem
+		{"overnight", 33.98},
+	} {
+		out := postCheckout(t, checkout, CheckoutRequest{
+			UserID: user, PaymentRef: "pay-" + tt.method, ShippingMethod: tt.method,
+			Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+		})
+		resp, body := send(t, app, newRequest(http.MethodGet, "/v1/orders/"+out.OrderID, nil))
+		got := decode(t, body)
+		if resp.StatusCode != fiber.StatusOK || got["shipping_method"] != tt.method || got["shipping"] != tt.shipping {
+			t.Errorf("%s: got %d shipping %v by %v, want %v", tt.method, resp.StatusCode, got["shipping"], got["shipping_method"], tt.shipping)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package startup waits for backing services to come up. In docker-compose
+// the app and the seeder often start before Postgres or Redis accept
+// connections; retrying here avoids container restart loops that would
+// skew startup measurements.
+package startup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"loastest-go/config"
+	"loastest-go/internal/retry"
+)
+
+// Wait calls ping until it succeeds, backing off with jitter between
+// attempts, bounded by cfg.MaxAttempts and cfg.Timeout. Every failed attempt
+// is logged; the returned error summarizes the attempts made and the last
+// failure.
+func Wait(
+	ctx context.Context,
+	cfg config.StartupConfig,
+	name string,
+	ping func(ctx context.Context) error,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	attempts := 0
+	var lastErr error
+	err := retry.DoIdempotent(ctx, retry.Policy{
+		Name:        "startup_" + name,
+		MaxAttempts: cfg.MaxAttempts,
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		MaxElapsed:  cfg.Timeout,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			log.Printf("⏳ %s not ready (attempt %d/%d): %v; retrying in %s",
+				name, attempt, cfg.MaxAttempts, err, delay.Round(time.Millisecond))
+		},
+	}, func(ctx context.Context) error {
+		attempts++
+		lastErr = ping(ctx)
+		return lastErr
+	})
+	if err != nil {
+		if lastErr == nil {
+			lastErr = err
+		}
+		return fmt.Errorf("%s unreachable after %d attempts over %s: %w",
+			name, attempts, time.Since(start).Round(time.Millisecond), lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var summaryRebuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "overview_summary_rebuilds_total",
+	Help: "Summary cache misses, by how they were resolved: built, shared (joined an in-process rebuild) or remote (another instance's rebuild).",
+}, []string{"outcome"})
+
+// releaseMarkerScript deletes a marker only if it still holds our token, so
+// work that outlived the marker's TTL can't drop someone else's. It guards
+// rebuild markers here, and checkout's locks and idempotency placeholders.
+var releaseMarkerScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+const (
+	rebuildPollInterval = 20 * time.Millisecond
+	// rebuildTimeout bounds a rebuild, which isn't tied to any one request:
+	// it serves every caller that joined it, and a stale refresh serves none
+	rebuildTimeout = 5 * time.Second
+
+	// staleSuffix marks the long-lived copy kept in swr mode. It stays under
+	// the summary prefix so checkout's invalidation removes it too.
+	staleSuffix = ":stale"
+)
+
+// SummaryResult is a rendered summary and where it came from
+type SummaryResult struct {
+	Payload []byte
+	// Outcome is hit, stale, miss, or shared (another caller's rebuild)
+	Outcome string
+	// Segment is only known when this caller built the payload
+	Segment string
+}
+
+// BuiltSummary is a freshly rendered summary and its user segment
+type BuiltSummary struct {
+	Payload []byte
+	Segment string
+	// Partial is set when a section was left out because it degraded; the
+	// payload is served but not cached
+	Partial bool
+}
+
+// SummaryBuilder renders a summary. It may run after the request that
+// supplied it has finished, so it must not touch the fiber.Ctx.
+type SummaryBuilder func(ctx context.Context) (BuiltSummary, error)
+
+// Summary serves the summary cached under key, rebuilding it on a miss. In
+// swr mode an expired entry's stale copy is served as is while a
+// background rebuild refreshes it.
+func (s *UserOverviewService) Summary(
+	ctx context.Context,
+	key, userID string,
+	build SummaryBuilder,
+) (SummaryResult, error) {
+	if cached, ok := s.GetSummary(ctx, key); ok {
+		s.recordCache(ctx, "summary", "hit")
+		return SummaryResult{Payload: cached, Outcome: "hit"}, nil
+	}
+	if s.cache.Strategy == "swr" {
+		if stale, ok := s.peekSummary(ctx, key+staleSuffix); ok {
+			s.recordCache(ctx, "summary", "stale")
+			s.refreshStale(ctx, key, userID, build)
+			return SummaryResult{Payload: stale, Outcome: "stale"}, nil
+		}
+	}
+	if isCacheBypassed(ctx) {
+		s.recordCache(ctx, "summary", "bypass")
+	} else {
+		s.recordCache(ctx, "summary", "miss")
+	}
+	return s.rebuildSummary(ctx, key, userID, build)
+}
+
+// refreshStale rebuilds key in the background, at most once per process at
+// a time
+func (s *UserOverviewService) refreshStale(
+	ctx context.Context,
+	key, userID string,
+	build SummaryBuilder,
+) {
+	if _, busy := s.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer s.refreshing.Delete(key)
+		if _, err := s.rebuildSummary(ctx, key, userID, build); err != nil {
+			log.Printf("⚠️  Background refresh of %s failed: %v", key, err)
+		}
+	}()
+}
+
+// rebuildSummary builds the summary for key after a cache miss. Concurrent
+// misses in this process share one call to build; across instances a short
+// Redis marker lets the first rebuild win while the others wait for its
+// result.
+//
+// build runs with the first caller's values but not its cancellation,
+// bounded by rebuildTimeout instead, so a leader that gives up doesn't fail
+// everyone who joined it. Each caller still stops waiting at its own
+// deadline.
+func (s *UserOverviewService) rebuildSummary(
+	ctx context.Context,
+	key, userID string,
+	build SummaryBuilder,
+) (SummaryResult, error) {
+	leader, built := false, false
+	var segment string
+	flight := s.flight.DoChan(key, func() (any, error) {
+		leader = true
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rebuildTimeout)
+		defer cancel()
+		// An earlier flight may have stored it after our GET missed
+		if cached, ok := s.peekSummary(ctx, key); ok {
+			summaryRebuilds.WithLabelValues("remote").Inc()
+			return cached, nil
+		}
+
+		release, ok := s.claimRebuild(ctx, key)
+		if !ok {
+			if cached, ok := s.waitForSummary(ctx, key); ok {
+				summaryRebuilds.WithLabelValues("remote").Inc()
+				return cached, nil
+			}
+		}
+		storing := false
+		defer func() {
+			if !storing {
+				release()
+			}
+		}()
+
+		b, err := build(ctx)
+		if err != nil {
+			return nil, err
+		}
+		built, segment = true, b.Segment
+		summaryRebuilds.WithLabelValues("built").Inc()
+		// The store is off the response path; the marker is held until it
+		// lands so other instances keep waiting for it rather than rebuild
+		if !b.Partial {
+			storing = true
+			afterResponse(ctx, "set_summary", func(ctx context.Context) error {
+				defer release()
+				return s.StoreSummary(ctx, key, userID, b.Payload)
+			})
+		}
+		return b.Payload, nil
+	})
+	var v any
+	select {
+	case res := <-flight:
+		if res.Err != nil {
+			return SummaryResult{}, res.Err
+		}
+		v = res.Val
+	case <-ctx.Done():
+		return SummaryResult{}, ctx.Err()
+	}
+	if !leader {
+		summaryRebuilds.WithLabelValues("shared").Inc()
+	}
+	if !built {
+		return SummaryResult{Payload: v.([]byte), Outcome: "shared"}, nil
+	}
+	return SummaryResult{Payload: v.([]byte), Outcome: "miss", Segment: segment}, nil
+}
+
+// peekSummary reads the cached payload without counting it as a hit
+func (s *UserOverviewService) peekSummary(ctx context.Context, key string) ([]byte, bool) {
+	if isCacheBypassed(ctx) {
+		return nil, false
+	}
+	cached, err := s.cachedGet(ctx, key).Bytes()
+	if err != nil || len(cached) == 0 {
+		return nil, false
+	}
+	payload, err := decodeCached(cached)
+	if err != nil {
+		s.dropCorrupt(ctx, key)
+		return nil, false
+	}
+	return payload, true
+}
+
+// claimRebuild sets the cross-instance rebuild marker. It reports false
+// only when another instance holds it; with the marker disabled or Redis
+// failing the caller just builds.
+func (s *UserOverviewService) claimRebuild(
+	ctx context.Context,
+	key string,
+) (release func(), ok bool) {
+	noop := func() {}
+	if s.cache.RebuildLockTTL <= 0 || isCacheBypassed(ctx) {
+		return noop, true
+	}
+	markerKey := "lock:rebuild:" + key
+	token := uuid.NewString()
+	ok, err := s.rdb.SetNX(ctx, markerKey, token, s.cache.RebuildLockTTL).Result()
+	if err != nil {
+		cacheBypassed(ctx, "claim_rebuild", err)
+		return noop, true
+	}
+	if !ok {
+		return noop, false
+	}
+	return func() {
+		releaseMarkerScript.Run(context.WithoutCancel(ctx), s.rdb, []string{markerKey}, token)
+	}, true
+}
+
+// waitForSummary polls for another instance's rebuild for up to RebuildWait
+func (s *UserOverviewService) waitForSummary(ctx context.Context, key string) ([]byte, bool) {
+	deadline := time.Now().Add(s.cache.RebuildWait)
+	ticker := time.NewTicker(rebuildPollInterval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-ticker.C:
+		}
+		if cached, ok := s.peekSummary(ctx, key); ok {
+			return cached, true
+		}
+	}
+	return nil, false
+}
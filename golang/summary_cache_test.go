@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// summaryService is an overview service with only the summary cache wired
+func summaryService(t *testing.T, rdb *redis.Client) *UserOverviewService {
+	cfg := testConfig(t)
+	return NewUserOverviewService(nil, rdb, cfg.Cache, nil, 0, nil,
+		NewActiveUsers(rdb, cfg.Metrics.ActiveUsers), cfg.Overview.ReservedFrom)
+}
+
+func TestSummaryStampedeBuildsOnce(t *testing.T) {
+	_, rdb := testRedis(t)
+	svc := summaryService(t, rdb)
+	var builds atomic.Int32
+	build := func(ctx context.Context) (BuiltSummary, error) {
+		builds.Add(1)
+		time.Sleep(50 * time.Millisecond) // the three queries
+		return BuiltSummary{Payload: []byte(`{"user":"u"}`)}, nil
+	}
+
+	const callers = 100
+	results := make([]SummaryResult, callers)
+	errs := make([]error, callers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			results[i], errs[i] = svc.Summary(context.Background(), "summary:v1:stampede", testUserID, build)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := builds.Load(); n != 1 {
+		t.Errorf("build ran %d times for %d concurrent misses, want 1", n, callers)
+	}
+	outcomes := map[string]int{}
+	for i := range callers {
+		if errs[i] != nil || string(results[i].Payload) != `{"user":"u"}` {
+			t.Fatalf("caller %d: %q, %v", i, results[i].Payload, errs[i])
+		}
+		outcomes[results[i].Outcome]++
+	}
+	if outcomes["miss"] != 1 {
+		t.Errorf("outcomes = %v, want exactly one miss", outcomes)
+	}
+}
+
+func TestSummaryRebuildOutlivesItsLeader(t *testing.T) {
+	_, rdb := testRedis(t)
+	svc := summaryService(t, rdb)
+	started, finish := make(chan struct{}), make(chan struct{})
+	var builds atomic.Int32
+	var uncancelled atomic.Bool
+	build := func(ctx context.Context) (BuiltSummary, error) {
+		builds.Add(1)
+		close(started)
+		<-finish
+		uncancelled.Store(ctx.Err() == nil)
+		return BuiltSummary{Payload: []byte(`{}`)}, nil
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := svc.Summary(leaderCtx, "summary:v1:leader", testUserID, build)
+		leaderDone <- err
+	}()
+	<-started
+	followerDone := make(chan SummaryResult, 1)
+	go func() {
+		res, _ := svc.Summary(context.Background(), "summary:v1:leader", testUserID, build)
+		followerDone <- res
+	}()
+	time.Sleep(20 * time.Millisecond) // let the follower join the flight
+
+	// The leader's client goes away; it stops waiting, the build doesn't
+	cancelLeader()
+	select {
+	case err := <-leaderDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("leader err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a cancelled leader kept waiting on the build")
+	}
+	close(finish)
+	res := <-followerDone
+	if res.Outcome != "shared" || string(res.Payload) != `{}` {
+		t.Errorf("follower got %q (%s), want the shared build", res.Payload, res.Outcome)
+	}
+	if !uncancelled.Load() {
+		t.Error("the build's context was cancelled with its leader")
+	}
+	if builds.Load() != 1 {
+		t.Errorf("build ran %d times, want 1", builds.Load())
+	}
+}
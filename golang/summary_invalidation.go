@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+)
+
+// invalidateSummariesScript deletes every summary key in the user's
+// registry (KEYS[1]), the registry itself and the rest of KEYS. Running it
+// as one script keeps an overview that stores a summary mid-invalidation
+// from registering a key into a set that is about to be dropped.
+var invalidateSummariesScript = redis.NewScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+for i = 1, #keys, 500 do
+  redis.call('DEL', unpack(keys, i, math.min(i + 499, #keys)))
+end
+return redis.call('DEL', unpack(KEYS))
+`)
+
+// summaryInvalidator drops a user's cached summaries when something they
+// show changes. CACHE_INVALIDATION picks how it finds them: "registry"
+// reads the set StoreSummary adds every key to, "scan" walks the keyspace
+// with SCAN MATCH, CACHE_INVALIDATION_SCAN_COUNT keys per call, and no
+// registry is kept. Both are kept to benchmark one against the other.
+type summaryInvalidator struct {
+	rdb       *redis.Client
+	scan      bool
+	scanCount int64
+}
+
+func newSummaryInvalidator(rdb *redis.Client, cfg config.CacheConfig) *summaryInvalidator {
+	return &summaryInvalidator{
+		rdb:       rdb,
+		scan:      cfg.Invalidation == "scan",
+		scanCount: int64(cfg.InvalidationScanCount),
+	}
+}
+
+// Queue adds the deletion of userID's summaries, and of keys, to pipe. In
+// scan mode the keyspace is scanned first, outside the pipeline, so a
+// summary stored between the scan and the DEL survives until its TTL;
+// the registry's script leaves no such window.
+func (inv *summaryInvalidator) Queue(ctx context.Context, pipe redis.Pipeliner, userID string, keys ...string) error {
+	if !inv.scan {
+		// EVALSHA can't fall back to EVAL inside a pipeline, so this sends
+		// the script
+		invalidateSummariesScript.Eval(ctx, pipe, append([]string{summaryRegistryKey(userID)}, keys...))
+		return nil
+	}
+	found, err := inv.scanSummaries(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(found); i += 500 {
+		pipe.Del(ctx, found[i:min(i+500, len(found))]...)
+	}
+	if len(keys) > 0 {
+		pipe.Del(ctx, keys...)
+	}
+	return nil
+}
+
+// Invalidate deletes userID's summaries and keys now
+func (inv *summaryInvalidator) Invalidate(ctx context.Context, userID string, keys ...string) error {
+	_, err := inv.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		return inv.Queue(ctx, pipe, userID, keys...)
+	})
+	return err
+}
+
+// scanSummaries lists every key under userID's summary prefix. Each SCAN
+// call examines about scanCount keys, so Redis is never blocked for
+// long, however big the keyspace.
+func (inv *summaryInvalidator) scanSummaries(ctx context.Context, userID string) ([]string, error) {
+	match := summaryKeyPrefix(userID) + "*"
+	var found []string
+	var cursor uint64
+	for {
+		keys, next, err := inv.rdb.Scan(ctx, cursor, match, inv.scanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, keys...)
+		if cursor = next; cursor == 0 {
+			return found, nil
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestOverviewLimitRounding(t *testing.T) {
+	for _, tt := range []struct{ limit, max, want int }{
+		{1, 100, 10}, {10, 100, 10}, {11, 100, 25}, {26, 100, 50}, {99, 100, 100},
+		{30, 40, 40}, {120, 200, 200},
+	} {
+		if got := overviewLimit(tt.limit, tt.max); got != tt.want {
+			t.Errorf("overviewLimit(%d, %d) = %d, want %d", tt.limit, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLimitSweepLandsOnAFewSummaryKeys(t *testing.T) {
+	_, rdb := testRedis(t)
+	cfg := testConfig(t)
+	svc := summaryService(t, rdb)
+	h := NewUserOverviewHandler(svc, cfg.Overview)
+	app := fiber.New()
+	app.Get("/users/:userId/overview", func(c *fiber.Ctx) error {
+		q, err := h.parseOverviewQuery(c)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.SendString(svc.SummaryKey("v1", q))
+	})
+
+	keys := map[string]bool{}
+	for limit := 1; limit <= cfg.Overview.MaxLimit; limit++ {
+		target := fmt.Sprintf("/users/%s/overview?limit=%d", testUserID, limit)
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		if resp.StatusCode != 200 {
+			t.Fatalf("limit=%d: status = %d: %s", limit, resp.StatusCode, body)
+		}
+		keys[string(body)] = true
+	}
+	if len(keys) > len(overviewLimitSizes) {
+		t.Errorf("%d limits made %d summary keys, want at most %d", cfg.Overview.MaxLimit, len(keys), len(overviewLimitSizes))
+	}
+}
+
+func TestSummaryInvalidation(t *testing.T) {
+	const other = "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	for _, mode := range []string{"registry", "scan"} {
+		t.Run(mode, func(t *testing.T) {
+			mr, rdb := testRedis(t)
+			cfg := testConfig(t)
+			cfg.Cache.Invalidation, cfg.Cache.Strategy = mode, "swr"
+			svc := NewUserOverviewService(nil, rdb, cfg.Cache, nil, 0, nil,
+				NewActiveUsers(rdb, cfg.Metrics.ActiveUsers), cfg.Overview.ReservedFrom)
+			ctx := context.Background()
+
+			var mine []string
+			for _, v := range []string{"v1", "v2"} {
+				key := svc.SummaryKey(v, OverviewQuery{UserID: testUserID, Page: 1, Limit: 10})
+				mine = append(mine, key, key+staleSuffix)
+				if err := svc.StoreSummary(ctx, key, testUserID, []byte(`{}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			theirs := svc.SummaryKey("v1", OverviewQuery{UserID: other, Page: 1, Limit: 10})
+			svc.StoreSummary(ctx, theirs, other, []byte(`{}`))
+			mr.Set(topProductsKey(testUserID), "x")
+
+			registry := summaryRegistryKey(testUserID)
+			if mode == "registry" {
+				if n, _ := rdb.SCard(ctx, registry).Result(); n != 4 {
+					t.Errorf("registry holds %d keys, want 4", n)
+				}
+				// As long as the stale copies, the longest-lived entries
+				if ttl := mr.TTL(registry); ttl < cfg.Cache.SummaryStaleTTL/2 {
+					t.Errorf("registry TTL = %s, want about SummaryStaleTTL", ttl)
+				}
+			} else if mr.Exists(registry) {
+				t.Error("scan mode keeps a registry")
+			}
+
+			inv := newSummaryInvalidator(rdb, cfg.Cache)
+			if err := inv.Invalidate(ctx, testUserID, topProductsKey(testUserID)); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range append(mine, registry, topProductsKey(testUserID)) {
+				if mr.Exists(key) {
+					t.Errorf("%s survived invalidation", key)
+				}
+			}
+			if !mr.Exists(theirs) {
+				t.Error("another user's summary was invalidated")
+			}
+		})
+	}
+}
+
+func TestInvalidationCoversEveryVariant(t *testing.T) {
+	const other = "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	cats := [][]string{nil, {"aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"}, {"aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa", "cccccccc-cccc-cccc-cccc-cccccccccccc"}}
+	for _, mode := range []string{"registry", "scan"} {
+		t.Run(mode, func(t *testing.T) {
+			mr, rdb := testRedis(t)
+			cfg := testConfig(t)
+			// A small SCAN COUNT so the scan takes many cursor rounds
+			cfg.Cache.Invalidation, cfg.Cache.InvalidationScanCount, cfg.Cache.Strategy = mode, 3, "swr"
+			svc := NewUserOverviewService(nil, rdb, cfg.Cache, nil, 0, nil,
+				NewActiveUsers(rdb, cfg.Metrics.ActiveUsers), cfg.Overview.ReservedFrom)
+			ctx := context.Background()
+
+			var mine, theirs []string
+			for _, user := range []string{testUserID, other} {
+				for page := 1; page <= 3; page++ {
+					for _, limit := range []int{10, 20, 50} {
+						for _, c := range cats {
+							q := OverviewQuery{UserID: user, CategoryIDs: c, Page: page, Limit: limit}
+							key := svc.SummaryKey("v1", q)
+							if err := svc.StoreSummary(ctx, key, user, []byte(`{}`)); err != nil {
+								t.Fatal(err)
+							}
+							if user == testUserID {
+								mine = append(mine, key)
+							} else {
+								theirs = append(theirs, key)
+							}
+						}
+					}
+				}
+			}
+			if len(mine) != 27 {
+				t.Fatalf("stored %d distinct variants, want 27", len(mine))
+			}
+
+			// As checkout does, queued behind its other post-commit writes
+			inv := newSummaryInvalidator(rdb, cfg.Cache)
+			_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, "unrelated", "1", 0)
+				return inv.Queue(ctx, pipe, testUserID)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range mine {
+				if mr.Exists(key) || mr.Exists(key+staleSuffix) {
+					t.Errorf("%s survived invalidation", key)
+				}
+			}
+			for _, key := range theirs {
+				if !mr.Exists(key) {
+					t.Errorf("another user's %s was invalidated", key)
+				}
+			}
+			if mode == "registry" {
+				if n, _ := rdb.SCard(ctx, summaryRegistryKey(other)).Result(); n != int64(2*len(theirs)) {
+					t.Errorf("the other registry holds %d keys, want %d", n, 2*len(theirs))
+				}
+			}
+		})
+	}
+}
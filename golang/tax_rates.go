@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"loastest-go/config"
+)
+
+// taxRates holds the per-region rates checkout charges. They come from
+// the tax_rates table, reloaded every TAX_RATES_REFRESH so a rate can
+// change without a redeploy; a region without a row, and every region
+// before the first load, is charged TAX_DEFAULT_RATE.
+type taxRates struct {
+	db       *DBRouter
+	fallback TaxRate
+	refresh  time.Duration
+	current  atomic.Pointer[map[string]TaxRate]
+}
+
+func newTaxRates(db *DBRouter, cfg config.TaxConfig) *taxRates {
+	r := &taxRates{db: db, fallback: taxRateOf(cfg.DefaultRate), refresh: cfg.Refresh}
+	r.current.Store(&map[string]TaxRate{})
+	return r
+}
+
+// Rate returns the rate for region, or the default when it has none
+func (r *taxRates) Rate(region string) TaxRate {
+	if rate, ok := (*r.current.Load())[region]; ok {
+		return rate
+	}
+	return r.fallback
+}
+
+// Run reloads the rates every interval until ctx is done; a failed reload
+// keeps the previous rates
+func (r *taxRates) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(ctx); err != nil {
+				log.Printf("⚠️  Tax rates reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reload reads tax_rates and swaps it in
+func (r *taxRates) Reload(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.refresh)
+	defer cancel()
+	rows, err := r.db.Read().Query(ctx, `SELECT region, rate FROM tax_rates`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rates := make(map[string]TaxRate)
+	for rows.Next() {
+		var region string
+		var rate TaxRate
+		if err := rows.Scan(&region, &rate); err != nil {
+			return err
+		}
+		rates[region] = rate
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	r.current.Store(&rates)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTaxRateFallsBackToTheDefault(t *testing.T) {
+	cfg := testConfig(t).Tax
+	cfg.DefaultRate = 0.07
+	rates := newTaxRates(unreachableRouter(t), cfg)
+	if r := rates.Rate("us-east"); r != 700 {
+		t.Errorf("before a load: rate = %d, want the 700 default", r)
+	}
+	rates.current.Store(&map[string]TaxRate{"us-east": 825})
+	if err := rates.Reload(context.Background()); err == nil {
+		t.Fatal("reload against an unreachable database succeeded")
+	}
+	if r := rates.Rate("us-east"); r != 825 {
+		t.Errorf("after a failed reload: rate = %d, want the loaded 825", r)
+	}
+	if r := rates.Rate("eu-north"); r != 700 {
+		t.Errorf("unlisted region: rate = %d, want the 700 default", r)
+	}
+}
+
+func TestCheckoutChargesTheRegionsRate(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	app, h := checkoutApp(t, db, rdb)
+	// Regions of the test's own, so the seeded rates are left alone
+	mustExec(t, db, `
+		INSERT INTO tax_rates (region, rate) VALUES ('test-tax-low', 0.0425), ('test-tax-high', 0.1025)
+		ON CONFLICT (region) DO UPDATE SET rate = EXCLUDED.rate`)
+	t.Cleanup(func() {
+		db.Primary().Exec(ctx, `DELETE FROM tax_rates WHERE region LIKE 'test-tax-%'`)
+	})
+	if err := h.taxes.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		region  string
+		tax     float64
+		taxRate float64
+	}{
+		{"test-tax-low", 2.13, 0.0425},  // 50 * 4.25% = 2.125
+		{"test-tax-high", 5.13, 0.1025}, // 5.125
+		{"test-tax-none", 4, 0.08},      // TAX_DEFAULT_RATE
+	} {
+		t.Run(tt.region, func(t *testing.T) {
+			user := seedUser(t, db, "pro", "active")
+			mustExec(t, db, `UPDATE users SET region = $2 WHERE id = $1`, user, tt.region)
+			product := seedProduct(t, db, "TAXED", 25, 10)
+			out := postCheckout(t, app, CheckoutRequest{
+				UserID: user, PaymentRef: "pay-" + tt.region,
+				Items: []CheckoutItem{{ProductID: product, Qty: 2}},
+			})
+			var tax, rate, total float64
+			err := db.Primary().QueryRow(ctx, `
+				SELECT tax::float8, tax_rate::float8, total::float8 FROM orders WHERE id = $1`,
+				out.OrderID).Scan(&tax, &rate, &total)
+			if err != nil || tax != tt.tax || rate != tt.taxRate {
+				t.Errorf("tax = %v at %v, %v, want %v at %v", tax, rate, err, tt.tax, tt.taxRate)
+			}
+			if total != out.Total {
+				t.Errorf("stored total %v, responded %v", total, out.Total)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// timeoutMiddleware gives the request a deadline through the user context.
+// Handlers pass c.UserContext() to pgx and go-redis, so when it fires the
+// in-flight query is cancelled server-side and any open transaction rolls
+// back. Whatever the handler rendered is replaced with a 504.
+func timeoutMiddleware(budget time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), budget)
+		defer cancel()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) &&
+			(err != nil || c.Response().StatusCode() >= 500) {
+			return writeError(c, ErrTimeout.WithDetails(fiber.Map{
+				"timeoutMs": budget.Milliseconds(),
+			}))
+		}
+		return err
+	}
+}
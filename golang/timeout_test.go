@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler fiber.Handler
+		status  int
+		code    string
+	}{
+		{
+			name:    "in budget",
+			handler: okHandler,
+			status:  fiber.StatusOK,
+		},
+		{
+			name: "handler returns the context error",
+			handler: func(c *fiber.Ctx) error {
+				<-c.UserContext().Done()
+				return c.UserContext().Err()
+			},
+			status: fiber.StatusGatewayTimeout,
+			code:   "TIMEOUT",
+		},
+		{
+			name: "handler already rendered a 500",
+			handler: func(c *fiber.Ctx) error {
+				<-c.UserContext().Done()
+				return writeError(c, errors.New("query: canceling statement"))
+			},
+			status: fiber.StatusGatewayTimeout,
+			code:   "TIMEOUT",
+		},
+		{
+			name: "late success is kept",
+			handler: func(c *fiber.Ctx) error {
+				<-c.UserContext().Done()
+				return c.SendString("ok")
+			},
+			status: fiber.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", timeoutMiddleware(20*time.Millisecond), tt.handler)
+			resp, body := send(t, app, newRequest(http.MethodGet, "/", nil))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.code == "" {
+				return
+			}
+			e, _ := decode(t, body)["error"].(map[string]any)
+			if e["code"] != tt.code {
+				t.Errorf("code = %v, want %s", e["code"], tt.code)
+			}
+			if d, _ := e["details"].(map[string]any); d["timeoutMs"] != float64(20) {
+				t.Errorf("details = %v, want timeoutMs 20", e["details"])
+			}
+		})
+	}
+}
+
+func TestTimeoutCancelsTheQueryInPostgres(t *testing.T) {
+	pool := testPool(t)
+	app := fiber.New()
+	app.Get("/", timeoutMiddleware(100*time.Millisecond), func(c *fiber.Ctx) error {
+		_, err := pool.Exec(c.UserContext(), "SELECT pg_sleep(5)")
+		return err
+	})
+
+	start := time.Now()
+	resp, body := send(t, app, newRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != fiber.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request took %s; the deadline did not reach the query", elapsed)
+	}
+
+	// A cancelled statement is gone server-side, not left running
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var running int
+	err := pool.QueryRow(ctx, `
+		SELECT count(*) FROM pg_stat_activity
+		WHERE query = 'SELECT pg_sleep(5)' AND state = 'active'`).Scan(&running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running != 0 {
+		t.Errorf("%d pg_sleep statements still running", running)
+	}
+}
+
+func TestTimeoutRollsBackTheTransaction(t *testing.T) {
+	pool := testPool(t)
+	table := "timeout_rollback_test"
+	if _, err := pool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS "+table+" (id int)"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Exec(context.Background(), "DROP TABLE "+table) })
+
+	app := fiber.New()
+	app.Post("/", timeoutMiddleware(100*time.Millisecond), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(context.Background())
+		if _, err := tx.Exec(ctx, "INSERT INTO "+table+" VALUES (1)"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "SELECT pg_sleep(5)"); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	resp, _ := send(t, app, newRequest(http.MethodPost, "/", nil))
+	if resp.StatusCode != fiber.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", resp.StatusCode)
+	}
+	var rows int
+	if err := pool.QueryRow(context.Background(), "SELECT count(*) FROM "+table).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("%d rows committed after the deadline", rows)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+
+	"loastest-go/config"
+)
+
+// buildTLSConfig loads the server certificate and, when a client CA is
+// configured, asks clients for a certificate. Verification is optional at
+// the handshake so public routes keep working; requireAdmin enforces
+// it on admin routes.
+func buildTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in TLS_CLIENT_CA_FILE")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// listen serves plain HTTP or TLS, on PORT or a unix socket, depending on
+// configuration
+func listen(app *fiber.App, cfg *config.Config) error {
+	addr := ":" + cfg.Port
+	if !cfg.TLS.Enabled() && cfg.Socket.Path == "" {
+		return app.Listen(addr)
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		var err error
+		if tlsConfig, err = buildTLSConfig(cfg.TLS); err != nil {
+			return err
+		}
+		// Custom listeners bypass prefork; config rejects PREFORK with
+		// client CAs and sockets so the certificate is all that's needed
+		if cfg.Prefork {
+			return app.ListenTLSWithCertificate(addr, tlsConfig.Certificates[0])
+		}
+	}
+
+	var ln net.Listener
+	var err error
+	if cfg.Socket.Path != "" {
+		ln, err = listenUnix(cfg.Socket)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return app.Listener(ln)
+}
+
+// listenUnix removes a socket left behind by a previous run, listens and
+// applies the configured permissions. Closing the listener on shutdown
+// unlinks the file.
+func listenUnix(cfg config.SocketConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(cfg.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("LISTEN_SOCKET %s exists and is not a socket", cfg.Path)
+		}
+		if err := os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.Path, cfg.Mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// headerAdminKey carries ADMIN_API_KEY on admin requests
+const headerAdminKey = "X-Admin-Key"
+
+// requireAdmin admits a request with a verified client certificate (when
+// certs is set) or the admin key (when key is set), and rejects the rest
+// with ErrUnauthorized, detailing what would have been accepted
+func requireAdmin(certs bool, key string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if certs {
+			state := c.Context().TLSConnectionState()
+			if state != nil && len(state.VerifiedChains) > 0 {
+				return c.Next()
+			}
+		}
+		if key != "" {
+			got := c.Get(headerAdminKey)
+			if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+				return c.Next()
+			}
+		}
+		var accepted []string
+		if certs {
+			accepted = append(accepted, "client certificate")
+		}
+		if key != "" {
+			accepted = append(accepted, headerAdminKey)
+		}
+		return writeError(c, ErrUnauthorized.WithDetails(fiber.Map{"accepted": accepted}))
+	}
+}
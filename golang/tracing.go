@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingEnabled gates every instrumentation point. When no OTLP endpoint
+// is configured nothing is installed and startSpan returns immediately, so
+// the hot path pays no allocation.
+var (
+	tracingEnabled bool
+	tracer         trace.Tracer
+	noopSpan       = trace.SpanFromContext(context.Background())
+)
+
+// setupTracing configures the OTLP/HTTP exporter from the standard OTEL_*
+// environment variables. The returned shutdown flushes pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" ||
+		(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+			os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "go-fiber")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	tracer = tp.Tracer("loastest-go")
+	tracingEnabled = true
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a child span, or returns ctx untouched when tracing is off
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if !tracingEnabled {
+		return ctx, noopSpan
+	}
+	return tracer.Start(ctx, name)
+}
+
+// endSpan records err (if any) on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// instrumentRedis adds redisotel tracing hooks to the client
+func instrumentRedis(rdb *redis.Client) error {
+	if !tracingEnabled {
+		return nil
+	}
+	return redisotel.InstrumentTracing(rdb)
+}
+
+// tracingMiddleware starts the server span and stores it in the user
+// context, which handlers pass down to pgx and go-redis
+func tracingMiddleware() fiber.Handler {
+	propagator := otel.GetTextMapPropagator()
+	return func(c *fiber.Ctx) error {
+		ctx := propagator.Extract(
+			c.UserContext(),
+			headerCarrier{&c.Request().Header},
+		)
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("url.path", c.Path()),
+			),
+		)
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if fe, ok := err.(*fiber.Error); ok {
+			status = fe.Code
+		}
+		route := c.Route().Path
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", status),
+		)
+		if status >= 500 || (err != nil && status < 400) {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+		return err
+	}
+}
+
+// headerCarrier adapts fasthttp request headers to the propagation API
+type headerCarrier struct {
+	h *fasthttp.RequestHeader
+}
+
+func (hc headerCarrier) Get(key string) string { return string(hc.h.Peek(key)) }
+func (hc headerCarrier) Set(key, value string) { hc.h.Set(key, value) }
+func (hc headerCarrier) Keys() []string {
+	var keys []string
+	hc.h.VisitAll(func(k, _ []byte) { keys = append(keys, string(k)) })
+	return keys
+}
+
+// pgxTracer implements pgx.QueryTracer, producing one span per query
+type pgxTracer struct{}
+
+type pgxSpanKey struct{}
+
+func (pgxTracer) TraceQueryStart(
+	ctx context.Context,
+	_ *pgx.Conn,
+	data pgx.TraceQueryStartData,
+) context.Context {
+	ctx, span := tracer.Start(ctx, "pg.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", data.SQL),
+		),
+	)
+	return context.WithValue(ctx, pgxSpanKey{}, span)
+}
+
+func (pgxTracer) TraceQueryEnd(
+	ctx context.Context,
+	_ *pgx.Conn,
+	data pgx.TraceQueryEndData,
+) {
+	span, ok := ctx.Value(pgxSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	endSpan(span, data.Err)
+}
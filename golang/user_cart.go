@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// CartResponse is the open cart with every line
+type CartResponse struct {
+	Cart
+	// WarehouseID is the fulfillment warehouse checkout will reserve from;
+	// each product's availability is counted there
+	WarehouseID string     `json:"warehouse_id"`
+	Items       []CartLine `json:"items"`
+}
+
+// CartLine is one cart item. UnitPrice is the price the item was added at;
+// Product.Price is the current one.
+type CartLine struct {
+	Product   Product `json:"product"`
+	Qty       int     `json:"qty"`
+	UnitPrice float64 `json:"unit_price"`
+	LineTotal float64 `json:"line_total"`
+}
+
+// cartCacheKey caches the cart page. Checkout closes the cart, so it
+// deletes the entry along with the summaries.
+func cartCacheKey(userID string) string {
+	return "cache:user:" + userID + ":cart"
+}
+
+// CartPayload returns the rendered cart page, from Redis when cached for
+// CACHE_CART_TTL. The bool reports a cache hit.
+func (s *UserOverviewService) CartPayload(ctx context.Context, user *User) ([]byte, bool, error) {
+	key := cartCacheKey(user.ID)
+	if !isCacheBypassed(ctx) {
+		cached, err := s.rdb.Get(ctx, key).Bytes()
+		switch {
+		case err == nil:
+			s.recordCache(ctx, "cart", "hit")
+			return cached, true, nil
+		case err != redis.Nil:
+			cacheBypassed(ctx, "get_cart", err)
+		}
+	}
+	if isCacheBypassed(ctx) {
+		s.recordCache(ctx, "cart", "bypass")
+	} else {
+		s.recordCache(ctx, "cart", "miss")
+	}
+
+	cart, err := s.LoadCart(ctx, user)
+	if err != nil {
+		return nil, false, err
+	}
+	payload, err := jsonMarshal(cart)
+	if err != nil || isCacheBypassed(ctx) {
+		return payload, false, err
+	}
+	if err := s.rdb.SetEx(ctx, key, payload, s.ttl.TTL(s.cache.CartTTL)).Err(); err != nil {
+		cacheBypassed(ctx, "set_cart", err)
+	}
+	return payload, false, nil
+}
+
+// LoadCart reads the user's open cart and its lines, or ErrNoOpenCart
+func (s *UserOverviewService) LoadCart(ctx context.Context, user *User) (*CartResponse, error) {
+	ctx, span := startSpan(ctx, "cart.load")
+	defer span.End()
+
+	cart, err := s.getCurrentCart(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cart == nil {
+		return nil, ErrNoOpenCart
+	}
+
+	warehouseID := warehouseForRegion(user.Region)
+	rows, err := s.db.Read().Query(ctx, `
+		SELECT p.id, p.sku, p.price,
+			COALESCE(i.available_qty - i.reserved_qty, 0)::int AS available,
+			ci.qty, ci.unit_price
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		LEFT JOIN inventory i ON i.product_id = p.id AND i.warehouse_id = $2
+		WHERE ci.cart_id = $1
+		ORDER BY ci.unit_price * ci.qty DESC, p.id`, cart.ID, warehouseID)
+	if err != nil {
+		return nil, dbError("load cart items", err)
+	}
+	defer rows.Close()
+
+	resp := &CartResponse{Cart: *cart, WarehouseID: warehouseID, Items: make([]CartLine, 0, cart.CartItems)}
+	for rows.Next() {
+		var l CartLine
+		err := rows.Scan(&l.Product.ID, &l.Product.SKU, &l.Product.Price, &l.Product.Available,
+			&l.Qty, &l.UnitPrice)
+		if err != nil {
+			return nil, err
+		}
+		l.LineTotal = float64(l.Qty) * l.UnitPrice
+		resp.Items = append(resp.Items, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load cart items", err)
+	}
+	return resp, nil
+}
+
+// GetUserCart serves the open cart with item detail
+func (h *UserOverviewHandler) GetUserCart(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	c.SetUserContext(ctx)
+	defer markBypass(c, bypassed)
+	p := newQueryParams(c)
+	userID := p.PathUUID("userId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+
+	user, err := h.resolveOverviewUser(c, userID)
+	if user == nil {
+		return err
+	}
+	payload, hit, err := h.svc.CartPayload(ctx, user)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if hit {
+		c.Set(headerCache, "HIT")
+	} else {
+		c.Set(headerCache, "MISS")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(payload)
+}
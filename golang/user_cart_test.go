@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUserCart(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "pro", "active")
+	a := seedProduct(t, db, "CART-A", 5, 10)
+	b := seedProduct(t, db, "CART-B", 7.5, 3)
+	// Added when the prices were lower
+	cart := seedCart(t, db, user, "open", 4, a, b)
+
+	target := "/v1/users/" + user + "/cart"
+	resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(headerCache) != "MISS" {
+		t.Fatalf("got %d X-Cache %q: %s", resp.StatusCode, resp.Header.Get(headerCache), body)
+	}
+	got := decode(t, body)
+	if got["id"] != cart || got["status"] != "open" || got["warehouse_id"] != "11111111-1111-1111-1111-111111111111" {
+		t.Errorf("cart = %v, want %s open in the us-east warehouse", got, cart)
+	}
+	want := map[string][2]float64{a: {5, 10}, b: {7.5, 3}}
+	items, _ := got["items"].([]any)
+	if len(items) != 2 {
+		t.Fatalf("items = %v, want 2", got["items"])
+	}
+	for _, it := range items {
+		line := it.(map[string]any)
+		product := line["product"].(map[string]any)
+		w := want[product["id"].(string)]
+		if product["price"] != w[0] || product["available"] != w[1] {
+			t.Errorf("product = %v, want price %v available %v", product, w[0], w[1])
+		}
+		if line["unit_price"] != 4.0 || line["qty"] != 1.0 || line["line_total"] != 4.0 {
+			t.Errorf("line = %v, want 1 at the added price 4", line)
+		}
+	}
+
+	resp, cached := send(t, app, newRequest(http.MethodGet, target, nil))
+	if resp.Header.Get(headerCache) != "HIT" || string(cached) != string(body) {
+		t.Errorf("second request: X-Cache %q, want a HIT with the same body", resp.Header.Get(headerCache))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"loastest-go/events"
+)
+
+// EventsQuery filters and pages a user's activity feed
+type EventsQuery struct {
+	UserID string
+	Type   string
+	Limit  int
+	// Before is the (created_at, id) of the last event already seen; it
+	// uses the order history's cursor encoding
+	Before *orderCursor
+}
+
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Payload is payload_json decoded into its type's shape, or as stored
+	// when it can't be; null when absent
+	Payload any `json:"payload"`
+	// PayloadError says why Payload is as stored, e.g. it predates
+	// schema_version
+	PayloadError string    `json:"payload_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// EventsPage is one page of ListEvents
+type EventsPage struct {
+	Events     []Event
+	HasMore    bool
+	NextBefore string
+}
+
+// ListEvents returns a user's events newest first. It walks
+// idx_events_user_created backwards from Before and stops at LIMIT, so deep
+// pages cost the same as the first.
+func (s *UserOverviewService) ListEvents(ctx context.Context, q EventsQuery) (*EventsPage, error) {
+	ctx, span := startSpan(ctx, "events.list")
+	defer span.End()
+
+	args := []any{q.UserID}
+	where := "user_id = $1"
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.Type != "" {
+		where += " AND type = " + arg(q.Type)
+	}
+	if q.Before != nil {
+		where += fmt.Sprintf(" AND (created_at, id) < (%s::timestamptz, %s::uuid)",
+			arg(q.Before.CreatedAt), arg(q.Before.ID))
+	}
+	limitArg := arg(q.Limit + 1)
+
+	rows, err := s.db.Read().Query(ctx, fmt.Sprintf(`
+		SELECT id, type, payload_json, created_at
+		FROM events
+		WHERE %s
+		ORDER BY created_at DESC, id DESC
+		LIMIT %s`, where, limitArg),
+		args...)
+	if err != nil {
+		return nil, dbError("list events", err)
+	}
+	defer rows.Close()
+
+	page := &EventsPage{Events: make([]Event, 0, q.Limit)}
+	for rows.Next() {
+		var e Event
+		var payload *string
+		if err := rows.Scan(&e.ID, &e.Type, &payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Payload, e.PayloadError = eventPayload(e.Type, payload)
+		page.Events = append(page.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("list events", err)
+	}
+	if len(page.Events) > q.Limit {
+		page.HasMore = true
+		page.Events = page.Events[:q.Limit]
+		last := page.Events[len(page.Events)-1]
+		page.NextBefore = orderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.String()
+	}
+	return page, nil
+}
+
+// eventPayload nests payload_json in the response, decoded by the events
+// registry. A payload the registry rejects (an unknown type or version, or
+// one written before payloads were versioned) doesn't fail the page: it is
+// passed through as stored, with the reason. The column is TEXT, so
+// anything that isn't valid JSON is passed through as a string.
+func eventPayload(eventType string, raw *string) (any, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	payload, err := events.Unmarshal(eventType, []byte(*raw))
+	if err == nil {
+		return payload, ""
+	}
+	if json.Valid([]byte(*raw)) {
+		return json.RawMessage(*raw), err.Error()
+	}
+	return *raw, err.Error()
+}
+
+type EventsResponse struct {
+	Events     []Event          `json:"events"`
+	Pagination EventsPagination `json:"pagination"`
+}
+
+type EventsPagination struct {
+	Limit    int  `json:"limit"`
+	Returned int  `json:"returned"`
+	HasMore  bool `json:"has_more"`
+	// NextBefore is passed as ?before= for the next page; absent on the last
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+func (h *UserOverviewHandler) parseEventsQuery(c *fiber.Ctx) (EventsQuery, error) {
+	p := newQueryParams(c)
+	q := EventsQuery{
+		UserID: p.PathUUID("userId"),
+		Type:   p.OneOf("type", "", events.Types()...),
+		Limit:  p.Int("limit", 20, h.cfg.MaxLimit),
+	}
+	if token := c.Query("before"); token != "" {
+		before, err := parseOrderCursor(token)
+		if err != nil {
+			p.fail("before", err.Error())
+		}
+		q.Before = before
+	}
+	return q, p.Err()
+}
+
+// GetUserEvents pages through a user's activity feed
+func (h *UserOverviewHandler) GetUserEvents(c *fiber.Ctx) error {
+	q, err := h.parseEventsQuery(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	user, err := h.resolveOverviewUser(c, q.UserID)
+	if user == nil {
+		return err
+	}
+
+	page, err := h.svc.ListEvents(c.UserContext(), q)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(EventsResponse{
+		Events: page.Events,
+		Pagination: EventsPagination{
+			Limit:      q.Limit,
+			Returned:   len(page.Events),
+			HasMore:    page.HasMore,
+			NextBefore: page.NextBefore,
+		},
+	})
+}
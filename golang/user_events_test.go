@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"loastest-go/events"
+)
+
+func TestEventPayloadPassesRejectsThrough(t *testing.T) {
+	str := func(s string) *string { return &s }
+	payload, reason := eventPayload(events.OrderShipped, str(`{"schema_version":1,"orderId":"o-1","shippedUnits":2}`))
+	if shipped, ok := payload.(*events.OrderShippedPayload); !ok || shipped.ShippedUnits != 2 || reason != "" {
+		t.Errorf("versioned: %#v, %q, want the typed payload", payload, reason)
+	}
+	payload, reason = eventPayload(events.OrderCreated, str(`{"action":"checkout"}`))
+	if raw, ok := payload.(json.RawMessage); !ok || string(raw) != `{"action":"checkout"}` || reason == "" {
+		t.Errorf("unversioned: %#v, %q, want it as stored with the reason", payload, reason)
+	}
+	payload, reason = eventPayload(events.OrderCreated, str(`not json`))
+	if payload != "not json" || reason == "" {
+		t.Errorf("not JSON: %#v, %q, want the string with the reason", payload, reason)
+	}
+	if payload, reason := eventPayload(events.OrderCreated, nil); payload != nil || reason != "" {
+		t.Errorf("NULL: %#v, %q", payload, reason)
+	}
+}
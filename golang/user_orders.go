@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// OrdersQuery filters and pages a user's order history
+type OrdersQuery struct {
+	UserID string
+	Status string
+	From   *time.Time // inclusive
+	To     *time.Time // exclusive
+	Page   int
+	Limit  int
+	// After, from the cursor param, replaces Page with keyset pagination
+	After *orderCursor
+}
+
+// orderCursor is the (created_at, id) of the last order on a page, in the
+// same descending order the index is scanned in
+type orderCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c orderCursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMicro(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseOrderCursor(token string) (*orderCursor, error) {
+	invalid := errors.New("is not a valid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	micros, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, invalid
+	}
+	n, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil || uuid.Validate(id) != nil {
+		return nil, invalid
+	}
+	return &orderCursor{CreatedAt: time.UnixMicro(n).UTC(), ID: id}, nil
+}
+
+// OrdersPage is one page of ListOrders
+type OrdersPage struct {
+	Orders     []Order
+	HasMore    bool
+	NextCursor string
+}
+
+// ListOrders pages through a user's orders, newest first. The page of
+// orders is picked in a subquery so Postgres walks
+// idx_orders_user_created and stops at LIMIT; item counts are only
+// aggregated for the rows returned.
+func (s *UserOverviewService) ListOrders(ctx context.Context, q OrdersQuery) (*OrdersPage, error) {
+	ctx, span := startSpan(ctx, "orders.list")
+	defer span.End()
+
+	args := []any{q.UserID}
+	where := "o.user_id = $1"
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.Status != "" {
+		where += " AND o.status = " + arg(q.Status)
+	}
+	if q.From != nil {
+		where += " AND o.created_at >= " + arg(*q.From)
+	}
+	if q.To != nil {
+		where += " AND o.created_at < " + arg(*q.To)
+	}
+	offset := (q.Page - 1) * q.Limit
+	if q.After != nil {
+		where += fmt.Sprintf(" AND (o.created_at, o.id) < (%s::timestamptz, %s::uuid)",
+			arg(q.After.CreatedAt), arg(q.After.ID))
+		offset = 0
+	}
+	offsetArg, limitArg := arg(offset), arg(q.Limit+1)
+
+	rows, err := s.db.Read().Query(ctx, fmt.Sprintf(`
+		WITH page AS (
+			SELECT o.id, o.status, o.total, o.created_at
+			FROM orders o
+			WHERE %s
+			ORDER BY o.created_at DESC, o.id DESC
+			OFFSET %s LIMIT %s
+		)
+		SELECT p.id, p.status, p.total, p.created_at,
+			COUNT(oi.id)::int AS items_count,
+			COALESCE(SUM(oi.qty), 0)::int AS items_qty
+		FROM page p
+		LEFT JOIN order_items oi ON oi.order_id = p.id
+		GROUP BY p.id, p.status, p.total, p.created_at
+		ORDER BY p.created_at DESC, p.id DESC`, where, offsetArg, limitArg),
+		args...)
+	if err != nil {
+		return nil, dbError("list orders", err)
+	}
+	defer rows.Close()
+
+	page := &OrdersPage{Orders: make([]Order, 0, q.Limit)}
+	for rows.Next() {
+		var o Order
+		err := rows.Scan(&o.ID, &o.Status, &o.Total, &o.CreatedAt, &o.ItemsCount, &o.ItemsQty)
+		if err != nil {
+			return nil, err
+		}
+		page.Orders = append(page.Orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("list orders", err)
+	}
+	if len(page.Orders) > q.Limit {
+		page.HasMore = true
+		page.Orders = page.Orders[:q.Limit]
+		last := page.Orders[len(page.Orders)-1]
+		page.NextCursor = orderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.String()
+	}
+	return page, nil
+}
+
+type OrdersResponse struct {
+	Orders     []Order          `json:"orders"`
+	Pagination OrdersPagination `json:"pagination"`
+}
+
+type OrdersPagination struct {
+	Page       int    `json:"page"`
+	Limit      int    `json:"limit"`
+	Returned   int    `json:"returned"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// orderStatusPattern keeps status to the short lowercase words the orders
+// table uses, so junk never reaches the query
+var orderStatusPattern = regexp.MustCompile(`^[a-z_]{1,20}$`)
+
+func (h *UserOverviewHandler) parseOrdersQuery(c *fiber.Ctx) (OrdersQuery, error) {
+	p := newQueryParams(c)
+	q := OrdersQuery{
+		UserID: p.PathUUID("userId"),
+		Status: c.Query("status"),
+		From:   p.Time("from"),
+		To:     p.Time("to"),
+		Page:   p.Int("page", 1, h.cfg.MaxPage),
+		Limit:  p.Int("limit", 20, h.cfg.MaxLimit),
+	}
+	if q.Status != "" && !orderStatusPattern.MatchString(q.Status) {
+		p.fail("status", "must be an order status such as pending or completed")
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		p.fail("to", "must be after from")
+	}
+	if token := c.Query("cursor"); token != "" {
+		after, err := parseOrderCursor(token)
+		if err != nil {
+			p.fail("cursor", err.Error())
+		}
+		q.After = after
+	}
+	return q, p.Err()
+}
+
+// GetUserOrders pages through a user's full order history
+func (h *UserOverviewHandler) GetUserOrders(c *fiber.Ctx) error {
+	q, err := h.parseOrdersQuery(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	user, err := h.resolveOverviewUser(c, q.UserID)
+	if user == nil {
+		return err
+	}
+
+	page, err := h.svc.ListOrders(c.UserContext(), q)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return c.JSON(OrdersResponse{
+		Orders: page.Orders,
+		Pagination: OrdersPagination{
+			Page:       q.Page,
+			Limit:      q.Limit,
+			Returned:   len(page.Orders),
+			HasMore:    page.HasMore,
+			NextCursor: page.NextCursor,
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestItemlessOrdersAreListed(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "free", "active")
+	a := seedProduct(t, db, "ITEMS-A", 4, 10)
+	b := seedProduct(t, db, "ITEMS-B", 4, 10)
+	full := seedOrder(t, db, user, "completed", 3, 4, a, b)
+	empty := seedOrder(t, db, user, "cancelled", 0, 0)
+
+	want := map[string][2]float64{full: {2, 6}, empty: {0, 0}}
+	for _, target := range []string{
+		"/v1/users/" + user + "/overview",
+		"/v1/users/" + user + "/orders",
+	} {
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", target, resp.StatusCode, body)
+		}
+		orders, _ := decode(t, body)["orders"].([]any)
+		if len(orders) != len(want) {
+			t.Fatalf("%s: %d orders, want %d: %s", target, len(orders), len(want), body)
+		}
+		for _, o := range orders {
+			o := o.(map[string]any)
+			w, ok := want[o["id"].(string)]
+			if !ok {
+				t.Errorf("%s: unexpected order %v", target, o["id"])
+				continue
+			}
+			if o["items_count"] != w[0] || o["items_qty"] != w[1] {
+				t.Errorf("%s: order %v has items_count %v items_qty %v, want %v and %v",
+					target, o["id"], o["items_count"], o["items_qty"], w[0], w[1])
+			}
+		}
+	}
+}
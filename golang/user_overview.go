@@ -2,19 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
 )
 
 type UserOverviewHandler struct {
-	db  *pgxpool.Pool
-	rdb *redis.Client
+	svc *UserOverviewService
+	cfg config.OverviewConfig
 }
 
 type User struct {
@@ -38,6 +35,7 @@ type Order struct {
 	Total      float64   `json:"total"`
 	CreatedAt  time.Time `json:"created_at"`
 	ItemsCount int       `json:"items_count"`
+	ItemsQty   int       `json:"items_qty"`
 }
 
 type Product struct {
@@ -48,322 +46,173 @@ type Product struct {
 }
 
 type Derived struct {
-	UserSegment    string   `json:"user_segment"`
-	CartAgeSeconds *int     `json:"cart_age_seconds"`
-	TopProducts    []string `json:"top_products"`
+	UserSegment    string `json:"user_segment,omitempty"`
+	CartAgeSeconds *int   `json:"cart_age_seconds"`
+	// TopProducts are the ids of the user's most-purchased products
+	TopProducts []string `json:"top_products"`
 }
 
+// UserOverviewResponse is the frozen v1 body. Pagination metadata (page,
+// limit, returned, hasMore from a limit+1 fetch, nextCursor) is served by
+// /v2/users/:userId/overview rather than added here.
 type UserOverviewResponse struct {
 	User     *User     `json:"user"`
 	Cart     *Cart     `json:"cart"`
 	Orders   []Order   `json:"orders"`
 	Products []Product `json:"products"`
-	Derived  Derived   `json:"derived"`
+	Derived  *Derived  `json:"derived,omitempty"`
+	// ProductsDegraded only appears when the products query timed out and
+	// products is empty instead, so healthy responses are unchanged
+	ProductsDegraded bool `json:"products_degraded,omitempty"`
 }
 
 func NewUserOverviewHandler(
-	db *pgxpool.Pool,
-	rdb *redis.Client,
+	svc *UserOverviewService,
+	cfg config.OverviewConfig,
 ) *UserOverviewHandler {
-	return &UserOverviewHandler{db: db, rdb: rdb}
+	return &UserOverviewHandler{svc: svc, cfg: cfg}
 }
 
-func (h *UserOverviewHandler) GetUserOverview(c *fiber.Ctx) error {
-	ctx := c.Context()
-	userID := c.Params("userId")
-	categoryID := c.Query("categoryId")
-	page, _ := strconv.Atoi(c.Query("page", "1"))
-	limit, _ := strconv.Atoi(c.Query("limit", "10"))
-
-	if page < 1 {
-		page = 1
-	}
-	if limit < 1 {
-		limit = 10
-	}
+// overviewLimitSizes are the page sizes the overview serves. A requested
+// limit is rounded up to one of them so the summary cache holds a handful of
+// variants per user rather than one per distinct ?limit=.
+var overviewLimitSizes = []int{10, 25, 50, 100}
 
-	// 1) Validate user exists (DB light read or cached)
-	user, err := h.getCachedUser(ctx, userID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).
-			JSON(fiber.Map{"error": err.Error()})
-	}
-	if user == nil {
-		user, err = h.getUserFromDB(ctx, userID)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).
-				JSON(fiber.Map{"error": err.Error()})
+// overviewLimit rounds limit up to the nearest page size, or to maxLimit
+// when that is smaller or no page size is large enough
+func overviewLimit(limit, maxLimit int) int {
+	for _, size := range overviewLimitSizes {
+		if size >= limit {
+			return min(size, maxLimit)
 		}
-		if user == nil {
-			return c.Status(fiber.StatusNotFound).
-				JSON(fiber.Map{"error": "User not found"})
-		}
-		h.cacheUser(ctx, userID, user)
 	}
+	return maxLimit
+}
 
-	// 2) Check summary cache (short TTL)
-	summaryKey := "cache:user:" + userID + ":summary:" + categoryID + ":" + strconv.Itoa(
-		page,
-	) + ":" + strconv.Itoa(
-		limit,
-	)
-	if categoryID == "" {
-		summaryKey = "cache:user:" + userID + ":summary:all:" + strconv.Itoa(
-			page,
-		) + ":" + strconv.Itoa(
-			limit,
-		)
-	}
+// parseOverviewQuery validates the path and query parameters before
+// anything touches Redis or Postgres. The returned query is normalized
+// (canonical, sorted UUIDs, re-encoded cursor, limit rounded to a page
+// size), so the summary cache key built from it can't be inflated with
+// equivalent spellings.
+//
+// The cursor is the fast path: it seeks straight to the next page instead
+// of aggregating and discarding every earlier one.
+func (h *UserOverviewHandler) parseOverviewQuery(c *fiber.Ctx) (OverviewQuery, error) {
+	p := newQueryParams(c)
+	q := OverviewQuery{
+		UserID:      p.PathUUID("userId"),
+		CategoryIDs: p.UUIDs("categoryId", h.cfg.MaxCategories),
+		Page:        p.Int("page", 1, h.cfg.MaxPage),
+		Limit:       overviewLimit(p.Int("limit", 10, h.cfg.MaxLimit), h.cfg.MaxLimit),
 
-	cached, err := h.rdb.Get(ctx, summaryKey).Result()
-	if err == nil && cached != "" {
-		h.rdb.Incr(ctx, "metrics:get_overview_hits")
-		var response UserOverviewResponse
-		json.Unmarshal([]byte(cached), &response)
-		return c.JSON(response)
+		Personalized: p.Bool("personalized", h.cfg.Personalized),
 	}
-
-	// 3) Complex DB read (joins + aggregation + pagination)
-	orders, err := h.getRecentOrders(ctx, userID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).
-			JSON(fiber.Map{"error": err.Error()})
+	if h.cfg.Debug {
+		q.Debug = p.Bool("debug", false)
 	}
-
-	cart, err := h.getCurrentCart(ctx, userID)
+	include, err := parseSections(c.Query("include"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).
-			JSON(fiber.Map{"error": err.Error()})
+		p.fail("include", err.Error())
 	}
-
-	products, err := h.getRecommendedProducts(ctx, categoryID, page, limit)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).
-			JSON(fiber.Map{"error": err.Error()})
-	}
-
-	// 4) Compute derived fields (CPU work)
-	var orderTotalSum float64
-	for _, o := range orders {
-		orderTotalSum += o.Total
-	}
-
-	derived := Derived{
-		UserSegment: computeSegment(user.Plan, user.Region, orderTotalSum),
-		TopProducts: make([]string, 0),
-	}
-
-	if cart != nil {
-		age := int(time.Since(cart.UpdatedAt).Seconds())
-		derived.CartAgeSeconds = &age
-	}
-
-	for i, p := range products {
-		if i >= 3 {
-			break
+	q.Include = include
+	if token := c.Query("cursor"); token != "" {
+		after, err := parseProductCursor(token)
+		if err != nil {
+			p.fail("cursor", err.Error())
 		}
-		derived.TopProducts = append(derived.TopProducts, p.ID)
-	}
-
-	response := UserOverviewResponse{
-		User:     user,
-		Cart:     cart,
-		Orders:   orders,
-		Products: products,
-		Derived:  derived,
+		q.After = after
 	}
-
-	// 5) Store summary cache, plus some extra redis ops
-	responseJSON, _ := json.Marshal(response)
-	h.rdb.SetEx(ctx, summaryKey, string(responseJSON), 30*time.Second)
-	h.rdb.SAdd(ctx, "metrics:active_users", userID)
-	h.rdb.Expire(ctx, "metrics:active_users", 3600*time.Second)
-
-	return c.JSON(response)
+	return q, p.Err()
 }
 
-func (h *UserOverviewHandler) getCachedUser(
-	ctx context.Context,
+// resolveOverviewUser writes the error response itself when it returns nil
+func (h *UserOverviewHandler) resolveOverviewUser(
+	c *fiber.Ctx,
 	userID string,
 ) (*User, error) {
-	cached, err := h.rdb.Get(ctx, "cache:user:"+userID).Result()
-	if err == redis.Nil {
-		return nil, nil
-	}
+	// Validate user exists (DB light read or cached)
+	user, err := h.svc.ResolveUser(c.UserContext(), userID)
 	if err != nil {
-		return nil, err
+		return nil, writeError(c, err)
 	}
-	var user User
-	json.Unmarshal([]byte(cached), &user)
-	return &user, nil
-}
-
-func (h *UserOverviewHandler) getUserFromDB(
-	ctx context.Context,
-	userID string,
-) (*User, error) {
-	row := h.db.QueryRow(
-		ctx,
-		`SELECT id, plan, region, status FROM users WHERE id = $1 AND status = 'active'`,
-		userID,
-	)
-
-	var user User
-	err := row.Scan(&user.ID, &user.Plan, &user.Region, &user.Status)
-	if err != nil {
-		if err.Error() == "no rows in result set" {
-			return nil, nil
-		}
-		return nil, err
+	if user == nil {
+		return nil, writeError(c, ErrUserNotFound)
 	}
-	return &user, nil
-}
-
-func (h *UserOverviewHandler) cacheUser(
-	ctx context.Context,
-	userID string,
-	user *User,
-) {
-	data, _ := json.Marshal(user)
-	h.rdb.SetEx(ctx, "cache:user:"+userID, string(data), 120*time.Second)
+	if user.Status != "active" {
+		return nil, writeError(c, ErrUserInactive)
+	}
+	return user, nil
 }
 
-func (h *UserOverviewHandler) getRecentOrders(
-	ctx context.Context,
-	userID string,
-) ([]Order, error) {
-	rows, err := h.db.Query(ctx, `
-		SELECT o.id, o.status, o.total, o.created_at, COUNT(oi.product_id)::int as items_count
-		FROM orders o
-		JOIN order_items oi ON oi.order_id = o.id
-		WHERE o.user_id = $1
-		GROUP BY o.id
-		ORDER BY o.created_at DESC
-		LIMIT 10`, userID)
+// GetUserOverview serves the frozen v1 shape. Its output must stay
+// byte-compatible with existing load scripts; new fields go to v2.
+func (h *UserOverviewHandler) GetUserOverview(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	c.SetUserContext(ctx)
+	defer markBypass(c, bypassed)
+	q, err := h.parseOverviewQuery(c)
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var orders []Order
-	for rows.Next() {
-		var o Order
-		err := rows.Scan(
-			&o.ID,
-			&o.Status,
-			&o.Total,
-			&o.CreatedAt,
-			&o.ItemsCount,
-		)
-		if err != nil {
-			return nil, err
-		}
-		orders = append(orders, o)
+		return writeError(c, err)
 	}
-	return orders, nil
-}
 
-func (h *UserOverviewHandler) getCurrentCart(
-	ctx context.Context,
-	userID string,
-) (*Cart, error) {
-	row := h.db.QueryRow(ctx, `
-		SELECT c.id, c.status, c.updated_at,
-			   COALESCE(SUM(ci.qty * ci.unit_price), 0)::decimal AS cart_total,
-			   COALESCE(SUM(ci.qty), 0)::int AS cart_items
-		FROM carts c
-		LEFT JOIN cart_items ci ON ci.cart_id = c.id
-		WHERE c.user_id = $1 AND c.status = 'open'
-		GROUP BY c.id
-		LIMIT 1`, userID)
+	summaryKey := h.svc.SummaryKey("v1", q)
+	ctx = h.overviewContext(c, ctx, q, summaryKey)
 
-	var cart Cart
-	err := row.Scan(
-		&cart.ID,
-		&cart.Status,
-		&cart.UpdatedAt,
-		&cart.CartTotal,
-		&cart.CartItems,
-	)
+	user, err := h.resolveOverviewUser(c, q.UserID)
+	if user == nil {
+		return err
+	}
+	res, err := h.summary(ctx, q, summaryKey,
+		func(ctx context.Context) (BuiltSummary, error) {
+			ov, err := h.svc.Load(ctx, user, q, OverviewOptions{
+				Regional:       h.cfg.Availability == "regional",
+				SharedProducts: true,
+			})
+			if err != nil {
+				return BuiltSummary{}, err
+			}
+			stop := timeStage(ctx, "marshal")
+			payload, err := jsonMarshal(mapOverviewV1(ov))
+			stop()
+			return ov.built(payload), err
+		})
 	if err != nil {
-		if err.Error() == "no rows in result set" {
-			return nil, nil
-		}
-		return nil, err
+		return writeError(c, err)
 	}
-	return &cart, nil
-}
-
-func (h *UserOverviewHandler) getRecommendedProducts(
-	ctx context.Context,
-	categoryID string,
-	page, limit int,
-) ([]Product, error) {
-	offset := (page - 1) * limit
-
-	var rows pgx.Rows
-	var err error
-
-	if categoryID == "" {
-		rows, err = h.db.Query(ctx, `
-			SELECT p.id, p.sku, p.price,
-				   COALESCE(SUM(i.available_qty - i.reserved_qty), 0)::int as available
-			FROM products p
-			LEFT JOIN inventory i ON i.product_id = p.id
-			WHERE p.status = 'active'
-			GROUP BY p.id
-			ORDER BY available DESC, p.id DESC
-			OFFSET $1 LIMIT $2`, offset, limit)
-	} else {
-		rows, err = h.db.Query(ctx, `
-			SELECT p.id, p.sku, p.price,
-				   COALESCE(SUM(i.available_qty - i.reserved_qty), 0)::int as available
-			FROM products p
-			LEFT JOIN inventory i ON i.product_id = p.id
-			WHERE p.status = 'active' AND p.category_id = $1
-			GROUP BY p.id
-			ORDER BY available DESC, p.id DESC
-			OFFSET $2 LIMIT $3`, categoryID, offset, limit)
+	if res.Segment == "" {
+		// Scanned rather than decoded: a hit should cost no JSON work
+		res.Segment = payloadString(res.Payload, "user_segment")
 	}
+	return writeSummary(c, res)
+}
 
-	if err != nil {
-		return nil, err
+// writeSummary sends a summary payload, tagging the response and access log
+// with where it came from
+func writeSummary(c *fiber.Ctx, res SummaryResult) error {
+	c.Locals(localCacheOutcome, res.Outcome)
+	if res.Segment != "" {
+		c.Locals(localUserSegment, res.Segment)
 	}
-	defer rows.Close()
-
-	var products []Product
-	for rows.Next() {
-		var p Product
-		err := rows.Scan(&p.ID, &p.SKU, &p.Price, &p.Available)
-		if err != nil {
-			return nil, err
-		}
-		products = append(products, p)
+	switch res.Outcome {
+	case "hit":
+		c.Set(headerCache, "HIT")
+	case "stale":
+		c.Set(headerCache, "STALE")
+	default:
+		c.Set(headerCache, "MISS")
 	}
-	return products, nil
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(res.Payload)
 }
 
-func computeSegment(plan, region string, totalSpend float64) string {
-	// Simulate some CPU work
-	str := plan + ":" + region + ":" + strconv.FormatFloat(
-		totalSpend,
-		'f',
-		2,
-		64,
-	)
-	hash := 0
-	for _, c := range str {
-		hash = (hash << 5) - hash + int(c)
-	}
+func mapOverviewV1(ov *Overview) UserOverviewResponse {
+	return UserOverviewResponse{
+		User:     ov.User,
+		Cart:     ov.Cart,
+		Orders:   ov.Orders,
+		Products: ov.Products,
+		Derived:  ov.Derived,
 
-	if plan == "enterprise" || totalSpend > 10000 {
-		return "vip"
-	}
-	if plan == "premium" || totalSpend > 5000 {
-		return "premium"
-	}
-	if plan == "basic" || totalSpend > 1000 {
-		return "standard"
+		ProductsDegraded: ov.ProductsDegraded,
 	}
-	return "basic"
 }
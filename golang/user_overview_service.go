@@ -0,0 +1,999 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+
+	"loastest-go/config"
+)
+
+var productsDegraded = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "overview_products_degraded_total",
+	Help: "Overviews served without products because the products query hit QUERY_TIMEOUT_PRODUCTS.",
+})
+
+// UserOverviewService loads everything the overview endpoints render. It is
+// shared by every API version; the handlers only map an Overview onto their
+// own response DTO.
+type UserOverviewService struct {
+	// db routes every query here to the read replica when one is configured
+	db    *DBRouter
+	rdb   *redis.Client
+	cache config.CacheConfig
+	ttl   ttlPolicy
+	codec cacheCodec
+	// segments caches each user's segment; checkout keeps it current
+	segments *segmentStore
+	// productsTimeout bounds the products query separately from the request
+	productsTimeout time.Duration
+	// availability serves the all-warehouse sums when it is fresh
+	availability *AvailabilityView
+	// activeUsers counts the users whose summaries get built
+	activeUsers *ActiveUsers
+	// reservedFrom is OVERVIEW_RESERVED_FROM
+	reservedFrom string
+	// flight collapses concurrent summary rebuilds per cache key;
+	// refreshing holds the keys with a background swr refresh running
+	flight     singleflight.Group
+	refreshing sync.Map
+}
+
+type OverviewQuery struct {
+	UserID string
+	// CategoryIDs restricts products to any of these categories; they are
+	// canonical, sorted and distinct, so they can go straight into keys
+	CategoryIDs []string
+	Page        int
+	Limit       int
+	// After, from the cursor param, replaces Page with keyset pagination
+	After *productCursor
+	// Include is the ?include= selection; zero means every section
+	Include OverviewSections
+	// Personalized drops products bought in the user's recent orders
+	Personalized bool
+	// Debug adds stage timings and skips the summary cache; never part of
+	// the key since debug responses aren't stored
+	Debug bool
+}
+
+func (q OverviewQuery) sections() OverviewSections {
+	if q.Include == 0 {
+		return allSections
+	}
+	return q.Include
+}
+
+// OverviewOptions turns on the extra sections newer API versions render
+type OverviewOptions struct {
+	Regional bool // availability from the user's regional warehouse only
+	// SharedProducts serves the products page from the cross-user cache
+	SharedProducts bool
+	Pagination     bool // fetch limit+1 products to compute HasMore
+	AccountStats   bool
+	CartPreview    bool
+}
+
+type CartPreviewItem struct {
+	ProductID string
+	SKU       string
+	Qty       int
+	UnitPrice float64
+}
+
+type AccountStats struct {
+	OrderCount    int
+	LifetimeSpend float64
+}
+
+type Overview struct {
+	User        *User
+	Cart        *Cart
+	CartPreview []CartPreviewItem
+	Orders      []Order
+	Products    []Product
+	HasMore     bool
+	// NextCursor resumes after the last product; set only when HasMore
+	NextCursor  string
+	WarehouseID string
+	Stats       AccountStats
+	// ProductsDegraded is set when the products query hit productsTimeout;
+	// Products is then empty
+	ProductsDegraded bool
+	// TopProducts and Segment are loaded with the derived section
+	TopProducts []TopProduct
+	Segment     string
+	// Derived is nil when the derived section was not requested
+	Derived *Derived
+}
+
+// TopProduct is one of the products a user has bought the most units of
+type TopProduct struct {
+	ProductID string `json:"productId"`
+	SKU       string `json:"sku"`
+	TotalQty  int    `json:"totalQty"`
+}
+
+const topProductsSize = 3
+
+const cartPreviewSize = 3
+
+// recentOrdersSize is how many orders the orders section lists, and so how
+// far back personalized recommendations look for purchases
+const recentOrdersSize = 10
+
+// overviewQueryFanout is the most pool connections one Load holds at once
+const overviewQueryFanout = 6
+
+func NewUserOverviewService(
+	db *DBRouter,
+	rdb *redis.Client,
+	cache config.CacheConfig,
+	segments *segmentStore,
+	productsTimeout time.Duration,
+	availability *AvailabilityView,
+	activeUsers *ActiveUsers,
+	reservedFrom string,
+) *UserOverviewService {
+	return &UserOverviewService{
+		db:              db,
+		rdb:             rdb,
+		cache:           cache,
+		ttl:             newTTLPolicy(cache.TTLJitter),
+		codec:           newCacheCodec(cache.CompressThreshold),
+		segments:        segments,
+		productsTimeout: productsTimeout,
+		availability:    availability,
+		activeUsers:     activeUsers,
+		reservedFrom:    reservedFrom,
+	}
+}
+
+// ResolveUser returns the user from cache or DB, or nil if it doesn't
+// exist. Inactive users are returned (and cached) too; callers check Status.
+func (s *UserOverviewService) ResolveUser(
+	ctx context.Context,
+	userID string,
+) (*User, error) {
+	ctx, span := startSpan(ctx, "overview.resolve_user")
+	defer span.End()
+
+	user, err := s.getCachedUser(ctx, userID)
+	if err != nil || user != nil {
+		return user, err
+	}
+	user, err = s.getUserFromDB(ctx, userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	s.cacheUser(ctx, userID, user)
+	return user, nil
+}
+
+// SummaryKey builds the summary cache key. Every version's key lives under
+// summaryKeyPrefix followed by the version, so no query of one version can
+// spell another's key. Unless CACHE_INVALIDATION is scan, StoreSummary
+// records each one it writes in the user's registry so checkout can delete
+// them without scanning for them.
+func (s *UserOverviewService) SummaryKey(version string, q OverviewQuery) string {
+	category := categoryKey(q.CategoryIDs)
+	prefix := summaryKeyPrefix(q.UserID) + version + ":"
+	key := prefix + category + ":" + strconv.Itoa(q.Page) + ":" + strconv.Itoa(q.Limit)
+	if q.After != nil {
+		key = prefix + category + ":c:" + q.After.String() + ":" + strconv.Itoa(q.Limit)
+	}
+	if include := q.sections(); include != allSections {
+		key += ":i:" + include.String()
+	}
+	if q.Personalized {
+		key += ":p"
+	}
+	return key
+}
+
+// summaryKeyPrefix starts every summary key of the user
+func summaryKeyPrefix(userID string) string {
+	return "cache:user:" + userID + ":summary:"
+}
+
+// summaryRegistryKey is the SET of every summary key (stale copies
+// included) written for a user since the last invalidation. It sits
+// outside the summary: prefix so it is never mistaken for an entry.
+func summaryRegistryKey(userID string) string {
+	return "cache:user:" + userID + ":summary_keys"
+}
+
+// GetSummary returns the cached summary payload, if any
+func (s *UserOverviewService) GetSummary(ctx context.Context, key string) ([]byte, bool) {
+	ctx, span := startSpan(ctx, "overview.summary_cache")
+	defer span.End()
+
+	cached, err := s.cachedGet(ctx, key).Bytes()
+	if err != nil && err != redis.Nil {
+		cacheBypassed(ctx, "get_summary", err)
+	}
+	if err != nil || len(cached) == 0 {
+		return nil, false
+	}
+	payload, err := decodeCached(cached)
+	if err != nil {
+		s.dropCorrupt(ctx, key)
+		return nil, false
+	}
+	if err := s.rdb.Incr(ctx, "metrics:get_overview_hits").Err(); err != nil {
+		cacheBypassed(ctx, "incr_hits", err)
+	}
+	return payload, true
+}
+
+// dropCorrupt deletes an entry that failed decodeCached, so the rebuild
+// that follows replaces it rather than racing a TTL
+func (s *UserOverviewService) dropCorrupt(ctx context.Context, key string) {
+	cacheCorrupt.WithLabelValues("summary").Inc()
+	if err := s.rdb.Del(ctx, key).Err(); err != nil {
+		cacheBypassed(ctx, "del_corrupt", err)
+	}
+}
+
+// StoreSummary caches a rendered summary and marks the user active, all in
+// one pipeline
+func (s *UserOverviewService) StoreSummary(
+	ctx context.Context,
+	key, userID string,
+	payload []byte,
+) error {
+	// Redis already failed on the read side of this request; don't pile on
+	if isCacheBypassed(ctx) {
+		return nil
+	}
+	stored := s.codec.Encode(payload)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		ttl, staleTTL := s.ttl.Pair(s.cache.SummaryTTL, s.cache.SummaryStaleTTL)
+		keys := []string{key}
+		pipe.SetEx(ctx, key, stored, ttl)
+		if s.cache.Strategy == "swr" {
+			pipe.SetEx(ctx, key+staleSuffix, stored, staleTTL)
+			keys = append(keys, key+staleSuffix)
+			ttl = staleTTL
+		}
+		if s.cache.Invalidation == "registry" {
+			// The registry lives as long as the longest entry in it: NX sets
+			// the TTL on a new set, GT only ever extends it
+			registry := summaryRegistryKey(userID)
+			pipe.SAdd(ctx, registry, keys)
+			pipe.ExpireNX(ctx, registry, ttl)
+			pipe.ExpireGT(ctx, registry, ttl)
+		}
+		s.activeUsers.Track(ctx, pipe, userID, time.Now())
+		return nil
+	})
+	return err
+}
+
+// warmupUserID never matches a row; querying it prepares statements
+// without touching real data
+const warmupUserID = "00000000-0000-0000-0000-000000000000"
+
+// Warm runs every overview query once so pgx has them prepared on the
+// connection it used. Results are discarded.
+func (s *UserOverviewService) Warm(ctx context.Context) error {
+	if _, err := s.getUserFromDB(ctx, warmupUserID); err != nil {
+		return err
+	}
+	user := &User{ID: warmupUserID, Region: defaultRegion}
+	q := OverviewQuery{UserID: warmupUserID, Page: 1, Limit: 10}
+	for _, opts := range []OverviewOptions{
+		{},
+		{Regional: true, Pagination: true, AccountStats: true, CartPreview: true},
+	} {
+		if _, err := s.Load(ctx, user, q, opts); err != nil {
+			return err
+		}
+	}
+	// Load may have served top products from Redis
+	if _, err := s.loadTopProducts(ctx, warmupUserID); err != nil {
+		return err
+	}
+	// No cart exists for the sentinel, so Load skipped the preview query
+	_, err := s.getCartPreview(ctx, warmupUserID)
+	return err
+}
+
+// Load runs the overview queries and computes the derived fields
+func (s *UserOverviewService) Load(
+	ctx context.Context,
+	user *User,
+	q OverviewQuery,
+	opts OverviewOptions,
+) (*Overview, error) {
+	ctx, span := startSpan(ctx, "overview.load")
+	defer span.End()
+
+	ov := &Overview{User: user}
+	fetch := q.Limit
+	if opts.Pagination {
+		fetch++
+	}
+	if opts.Regional {
+		ov.WarehouseID = overviewWarehouse(user.Region)
+	}
+
+	// The sections are independent, so each runs on its own pool connection
+	// (up to overviewQueryFanout per request); the first error cancels the
+	// rest. Sections left out of ?include= run no query at all.
+	include := q.sections()
+	// Personalized products exclude the recent orders' items, so the
+	// products goroutine loads the orders itself and shares them
+	personalized := q.Personalized && include.Has(SectionProducts)
+	g, gctx := errgroup.WithContext(ctx)
+	if include.Has(SectionOrders) && !personalized {
+		g.Go(func() (err error) {
+			// Complex DB read (joins + aggregation + pagination)
+			defer timeStage(gctx, "orders_query")()
+			ov.Orders, err = s.getRecentOrders(gctx, q.UserID)
+			return err
+		})
+	}
+	if include.Has(SectionCart) {
+		g.Go(func() (err error) {
+			defer timeStage(gctx, "cart_query")()
+			ov.Cart, err = s.getCurrentCart(gctx, q.UserID)
+			return err
+		})
+	}
+	if include.Has(SectionProducts) {
+		g.Go(func() (err error) {
+			var purchased []string
+			if personalized {
+				stop := timeStage(gctx, "orders_query")
+				orders, err := s.getRecentOrders(gctx, q.UserID)
+				stop()
+				if err != nil {
+					return err
+				}
+				if include.Has(SectionOrders) {
+					ov.Orders = orders
+				}
+				purchased = orderIDs(orders)
+			}
+			pctx := gctx
+			if s.productsTimeout > 0 {
+				var cancel context.CancelFunc
+				pctx, cancel = context.WithTimeout(gctx, s.productsTimeout)
+				defer cancel()
+			}
+			stop := timeStage(gctx, "products_query")
+			// The shared cache is keyed by warehouse, not user, so it can
+			// only hold unpersonalized pages
+			if opts.SharedProducts && !personalized {
+				ov.Products, err = s.getSharedRecommendedProducts(
+					pctx, ov.WarehouseID, q.CategoryIDs, q.After, q.Page, q.Limit, fetch,
+				)
+			} else {
+				ov.Products, err = s.getProducts(
+					pctx, ov.WarehouseID, q.CategoryIDs, purchased, q.After, q.Page, q.Limit, fetch,
+				)
+			}
+			stop()
+			// Only our own deadline degrades; the request's still fails
+			if err != nil && pctx.Err() == context.DeadlineExceeded && gctx.Err() == nil {
+				productsDegraded.Inc()
+				ov.Products, ov.ProductsDegraded = []Product{}, true
+				return nil
+			}
+			return err
+		})
+	}
+	if include.Has(SectionDerived) {
+		g.Go(func() (err error) {
+			ov.TopProducts, err = s.getTopProducts(gctx, q.UserID)
+			return err
+		})
+		g.Go(func() (err error) {
+			ov.Segment, err = s.getSegment(gctx, user)
+			return err
+		})
+	}
+	// Account stats summarize the order history, so they go with orders
+	if opts.AccountStats && include.Has(SectionOrders) {
+		g.Go(func() (err error) {
+			ov.Stats, err = s.getAccountStats(gctx, q.UserID)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if len(ov.Products) > q.Limit {
+		ov.HasMore = true
+		ov.Products = ov.Products[:q.Limit]
+		last := ov.Products[len(ov.Products)-1]
+		ov.NextCursor = productCursor{Available: last.Available, ProductID: last.ID}.String()
+	}
+
+	// Needs the cart ID, so it can't join the group above
+	if opts.CartPreview && ov.Cart != nil {
+		var err error
+		ov.CartPreview, err = s.getCartPreview(ctx, ov.Cart.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if include.Has(SectionDerived) {
+		ov.Derived = computeDerived(ov)
+	}
+	return ov, nil
+}
+
+// built wraps a payload rendered from ov for the summary cache
+func (ov *Overview) built(payload []byte) BuiltSummary {
+	return BuiltSummary{Payload: payload, Segment: ov.segment(), Partial: ov.ProductsDegraded}
+}
+
+// segment is the derived user segment, or "" when it wasn't computed
+func (ov *Overview) segment() string {
+	if ov.Derived == nil {
+		return ""
+	}
+	return ov.Derived.UserSegment
+}
+
+// computeDerived assembles the derived section. The segment and top
+// products have their own lookups, which run whenever derived is
+// requested; the cart age is only set when the cart was loaded.
+func computeDerived(ov *Overview) *Derived {
+	d := &Derived{UserSegment: ov.Segment}
+	if ov.Cart != nil {
+		age := int(time.Since(ov.Cart.UpdatedAt).Seconds())
+		d.CartAgeSeconds = &age
+	}
+
+	d.TopProducts = make([]string, 0, len(ov.TopProducts))
+	for _, p := range ov.TopProducts {
+		d.TopProducts = append(d.TopProducts, p.ProductID)
+	}
+	return d
+}
+
+// getSegment returns the user's cached segment, computing it from lifetime
+// spend on a miss. Redis trouble falls back to the aggregate.
+func (s *UserOverviewService) getSegment(ctx context.Context, user *User) (string, error) {
+	if !isCacheBypassed(ctx) {
+		segment, err := s.segments.Get(ctx, user.ID)
+		if err != nil {
+			cacheBypassed(ctx, "get_segment", err)
+		} else if segment != "" {
+			s.recordCache(ctx, "segment", "hit")
+			return segment, nil
+		}
+	}
+	if isCacheBypassed(ctx) {
+		s.recordCache(ctx, "segment", "bypass")
+	} else {
+		s.recordCache(ctx, "segment", "miss")
+	}
+
+	stats, err := s.getAccountStats(ctx, user.ID)
+	if err != nil {
+		return "", dbError("load lifetime spend", err)
+	}
+	if isCacheBypassed(ctx) {
+		return s.segments.compute(user.Plan, user.Region, stats.LifetimeSpend), nil
+	}
+	segment, err := s.segments.Store(ctx, user, stats.LifetimeSpend)
+	if err != nil {
+		cacheBypassed(ctx, "set_segment", err)
+	}
+	return segment, nil
+}
+
+// topProductsKey caches getTopProducts. It sits outside the summary prefix
+// so it can outlive summaries; checkout deletes it explicitly.
+func topProductsKey(userID string) string {
+	return "cache:user:" + userID + ":top_products"
+}
+
+// getTopProducts returns the user's most-bought products by units,
+// cached for CACHE_TOP_PRODUCTS_TTL since purchase history changes rarely
+func (s *UserOverviewService) getTopProducts(
+	ctx context.Context,
+	userID string,
+) ([]TopProduct, error) {
+	key := topProductsKey(userID)
+	if !isCacheBypassed(ctx) {
+		cached, err := s.rdb.Get(ctx, key).Bytes()
+		switch {
+		case err == nil:
+			var top []TopProduct
+			if json.Unmarshal(cached, &top) == nil {
+				return top, nil
+			}
+		case err != redis.Nil:
+			cacheBypassed(ctx, "get_top_products", err)
+		}
+	}
+
+	top, err := s.loadTopProducts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isCacheBypassed(ctx) {
+		payload, _ := json.Marshal(top)
+		if err := s.rdb.SetEx(ctx, key, payload, s.ttl.TTL(s.cache.TopProductsTTL)).Err(); err != nil {
+			cacheBypassed(ctx, "set_top_products", err)
+		}
+	}
+	return top, nil
+}
+
+// loadTopProducts walks the user's orders via idx_orders_user and their
+// lines via idx_order_items_order; it never scans order_items as a whole
+func (s *UserOverviewService) loadTopProducts(
+	ctx context.Context,
+	userID string,
+) ([]TopProduct, error) {
+	rows, err := s.db.Read().Query(ctx, `
+		SELECT oi.product_id, p.sku, SUM(oi.qty)::int AS total_qty
+		FROM orders o
+		JOIN order_items oi ON oi.order_id = o.id
+		JOIN products p ON p.id = oi.product_id
+		WHERE o.user_id = $1
+		GROUP BY oi.product_id, p.sku
+		ORDER BY total_qty DESC, oi.product_id
+		LIMIT $2`, userID, topProductsSize)
+	if err != nil {
+		return nil, dbError("load top products", err)
+	}
+	defer rows.Close()
+
+	top := make([]TopProduct, 0, topProductsSize)
+	for rows.Next() {
+		var p TopProduct
+		if err := rows.Scan(&p.ProductID, &p.SKU, &p.TotalQty); err != nil {
+			return nil, err
+		}
+		top = append(top, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("load top products", err)
+	}
+	return top, nil
+}
+
+func userCacheKey(userID string) string {
+	return "cache:user:" + userID
+}
+
+func (s *UserOverviewService) getCachedUser(
+	ctx context.Context,
+	userID string,
+) (*User, error) {
+	stop := timeStage(ctx, "redis_user_cache")
+	cached, err := s.cachedGet(ctx, userCacheKey(userID)).Result()
+	stop()
+	if err == redis.Nil {
+		s.recordCache(ctx, "user", "miss")
+		return nil, nil
+	}
+	if err != nil {
+		// The user row is in Postgres; treat Redis trouble as a miss
+		cacheBypassed(ctx, "get_user", err)
+		s.recordCache(ctx, "user", "bypass")
+		return nil, nil
+	}
+	s.recordCache(ctx, "user", "hit")
+	var user User
+	json.Unmarshal([]byte(cached), &user)
+	return &user, nil
+}
+
+func (s *UserOverviewService) getUserFromDB(
+	ctx context.Context,
+	userID string,
+) (*User, error) {
+	row := s.db.Read().QueryRow(
+		ctx,
+		`SELECT id, plan, region, status FROM users WHERE id = $1`,
+		userID,
+	)
+
+	var user User
+	err := row.Scan(&user.ID, &user.Plan, &user.Region, &user.Status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, dbError("load user", err)
+	}
+	return &user, nil
+}
+
+func (s *UserOverviewService) cacheUser(
+	ctx context.Context,
+	userID string,
+	user *User,
+) {
+	if isCacheBypassed(ctx) {
+		return
+	}
+	data, _ := json.Marshal(user)
+	if err := s.rdb.SetEx(ctx, userCacheKey(userID), string(data), s.ttl.TTL(s.cache.UserTTL)).Err(); err != nil {
+		cacheBypassed(ctx, "set_user", err)
+	}
+}
+
+func (s *UserOverviewService) getRecentOrders(
+	ctx context.Context,
+	userID string,
+) ([]Order, error) {
+	// LEFT JOIN so orders without items still show up. items_count is the
+	// number of lines, items_qty the units across them.
+	rows, err := s.db.Read().Query(ctx, `
+		SELECT o.id, o.status, o.total, o.created_at,
+			COUNT(oi.id)::int AS items_count,
+			COALESCE(SUM(oi.qty), 0)::int AS items_qty
+		FROM orders o
+		LEFT JOIN order_items oi ON oi.order_id = o.id
+		WHERE o.user_id = $1
+		GROUP BY o.id
+		ORDER BY o.created_at DESC
+		LIMIT $2`, userID, recentOrdersSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		err := rows.Scan(
+			&o.ID,
+			&o.Status,
+			&o.Total,
+			&o.CreatedAt,
+			&o.ItemsCount,
+			&o.ItemsQty,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+func orderIDs(orders []Order) []string {
+	ids := make([]string, len(orders))
+	for i, o := range orders {
+		ids[i] = o.ID
+	}
+	return ids
+}
+
+func (s *UserOverviewService) getCurrentCart(
+	ctx context.Context,
+	userID string,
+) (*Cart, error) {
+	row := s.db.Read().QueryRow(ctx, `
+		SELECT c.id, c.status, c.updated_at,
+			   COALESCE(SUM(ci.qty * ci.unit_price), 0)::decimal AS cart_total,
+			   COALESCE(SUM(ci.qty), 0)::int AS cart_items
+		FROM carts c
+		LEFT JOIN cart_items ci ON ci.cart_id = c.id
+		WHERE c.user_id = $1 AND c.status = 'open'
+		GROUP BY c.id
+		LIMIT 1`, userID)
+
+	var cart Cart
+	err := row.Scan(
+		&cart.ID,
+		&cart.Status,
+		&cart.UpdatedAt,
+		&cart.CartTotal,
+		&cart.CartItems,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, dbError("load cart", err)
+	}
+	return &cart, nil
+}
+
+// getSharedRecommendedProducts caches getProducts across users under
+// cache:products:reco:, since the page only depends on the warehouse, not
+// on who asks. It lives outside the user prefix, so checkout leaves it
+// alone and it simply expires after CACHE_RECO_TTL.
+func (s *UserOverviewService) getSharedRecommendedProducts(
+	ctx context.Context,
+	warehouseID string,
+	categoryIDs []string,
+	after *productCursor,
+	page, limit, fetch int,
+) ([]Product, error) {
+	warehouse := warehouseID
+	if warehouse == "" {
+		warehouse = "all"
+	}
+	category := categoryKey(categoryIDs)
+	position := strconv.Itoa(page)
+	if after != nil {
+		position = "c:" + after.String()
+	}
+	key := "cache:products:reco:" + warehouse + ":" + category + ":" + position + ":" + strconv.Itoa(fetch)
+
+	if !isCacheBypassed(ctx) {
+		cached, err := s.rdb.Get(ctx, key).Bytes()
+		switch {
+		case err == nil:
+			var products []Product
+			if json.Unmarshal(cached, &products) == nil {
+				s.recordCache(ctx, "reco", "hit")
+				return products, nil
+			}
+		case err != redis.Nil:
+			cacheBypassed(ctx, "get_reco", err)
+		}
+	}
+	if isCacheBypassed(ctx) {
+		s.recordCache(ctx, "reco", "bypass")
+	} else {
+		s.recordCache(ctx, "reco", "miss")
+	}
+
+	products, err := s.getProducts(ctx, warehouseID, categoryIDs, nil, after, page, limit, fetch)
+	if err != nil || isCacheBypassed(ctx) {
+		return products, err
+	}
+	payload, _ := json.Marshal(products)
+	if err := s.rdb.SetEx(ctx, key, payload, s.ttl.TTL(s.cache.RecoTTL)).Err(); err != nil {
+		cacheBypassed(ctx, "set_reco", err)
+	}
+	return products, nil
+}
+
+// getProducts ranks products by availability in warehouseID, or across
+// every warehouse when it is "". Products bought in purchasedOrders are
+// left out.
+func (s *UserOverviewService) getProducts(
+	ctx context.Context,
+	warehouseID string,
+	categoryIDs []string,
+	purchasedOrders []string,
+	after *productCursor,
+	page, limit, fetch int,
+) ([]Product, error) {
+	if warehouseID == "" {
+		return s.getRecommendedProducts(ctx, categoryIDs, purchasedOrders, after, page, limit, fetch)
+	}
+	return s.getRegionalProducts(ctx, warehouseID, categoryIDs, purchasedOrders, after, page, limit, fetch)
+}
+
+// getRecommendedProducts ranks products by availability over every
+// warehouse, read from product_availability while it is fresh
+func (s *UserOverviewService) getRecommendedProducts(
+	ctx context.Context,
+	categoryIDs []string,
+	purchasedOrders []string,
+	after *productCursor,
+	page, limit, fetch int,
+) ([]Product, error) {
+	if s.availability.Fresh() {
+		return s.getMaterializedProducts(ctx, categoryIDs, purchasedOrders, after, page, limit, fetch)
+	}
+	available := "COALESCE(SUM(i.available_qty - i.reserved_qty), 0)::int"
+	if s.reservedFrom == "reservations" {
+		available = `(COALESCE(SUM(i.available_qty), 0) - (
+			SELECT COALESCE(SUM(r.qty), 0) FROM inventory_reservations r
+			WHERE r.product_id = p.id AND r.expires_at > NOW()))::int`
+	}
+	var args []any
+	where := "p.status = 'active'"
+	if len(categoryIDs) > 0 {
+		where += " AND " + categoryCondition(categoryIDs, &args)
+	}
+	if len(purchasedOrders) > 0 {
+		where += " AND " + notPurchasedCondition(purchasedOrders, &args)
+	}
+	// The cursor compares the aggregate, so it goes in HAVING
+	having := ""
+	offset := (page - 1) * limit
+	if after != nil {
+		having = "HAVING " + keysetCondition(available, after, &args)
+		offset = 0
+	}
+	args = append(args, offset, fetch)
+
+	rows, err := s.db.Read().Query(ctx, fmt.Sprintf(`
+		SELECT p.id, p.sku, p.price, %s as available
+		FROM products p
+		LEFT JOIN inventory i ON i.product_id = p.id
+		WHERE %s
+		GROUP BY p.id
+		%s
+		ORDER BY available DESC, p.id DESC
+		OFFSET $%d LIMIT $%d`, available, where, having, len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// getMaterializedProducts is getRecommendedProducts over the view: one row
+// per product, so no GROUP BY over inventory
+func (s *UserOverviewService) getMaterializedProducts(
+	ctx context.Context,
+	categoryIDs []string,
+	purchasedOrders []string,
+	after *productCursor,
+	page, limit, fetch int,
+) ([]Product, error) {
+	const available = "COALESCE(pa.available, 0)"
+	var args []any
+	where := "p.status = 'active'"
+	if len(categoryIDs) > 0 {
+		where += " AND " + categoryCondition(categoryIDs, &args)
+	}
+	if len(purchasedOrders) > 0 {
+		where += " AND " + notPurchasedCondition(purchasedOrders, &args)
+	}
+	offset := (page - 1) * limit
+	if after != nil {
+		where += " AND " + keysetCondition(available, after, &args)
+		offset = 0
+	}
+	args = append(args, offset, fetch)
+
+	rows, err := s.db.Read().Query(ctx, fmt.Sprintf(`
+		SELECT p.id, p.sku, p.price, %s as available
+		FROM products p
+		LEFT JOIN product_availability pa ON pa.product_id = p.id
+		WHERE %s
+		ORDER BY available DESC, p.id DESC
+		OFFSET $%d LIMIT $%d`, available, where, len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// getRegionalProducts ranks products by what the given warehouse can
+// actually ship, which is what checkout reserves against
+func (s *UserOverviewService) getRegionalProducts(
+	ctx context.Context,
+	warehouseID string,
+	categoryIDs []string,
+	purchasedOrders []string,
+	after *productCursor,
+	page, limit, fetch int,
+) ([]Product, error) {
+	available := "COALESCE(i.available_qty - i.reserved_qty, 0)::int"
+	if s.reservedFrom == "reservations" {
+		available = `COALESCE(i.available_qty - (
+			SELECT COALESCE(SUM(r.qty), 0) FROM inventory_reservations r
+			WHERE r.product_id = i.product_id AND r.warehouse_id = i.warehouse_id
+				AND r.expires_at > NOW()), 0)::int`
+	}
+	args := []any{warehouseID}
+	where := "p.status = 'active'"
+	if len(categoryIDs) > 0 {
+		where += " AND " + categoryCondition(categoryIDs, &args)
+	}
+	if len(purchasedOrders) > 0 {
+		where += " AND " + notPurchasedCondition(purchasedOrders, &args)
+	}
+	offset := (page - 1) * limit
+	if after != nil {
+		where += " AND " + keysetCondition(available, after, &args)
+		offset = 0
+	}
+	args = append(args, offset, fetch)
+
+	rows, err := s.db.Read().Query(ctx, fmt.Sprintf(`
+		SELECT p.id, p.sku, p.price, %s as available
+		FROM products p
+		LEFT JOIN inventory i ON i.product_id = p.id AND i.warehouse_id = $1
+		WHERE %s
+		ORDER BY available DESC, p.id DESC
+		OFFSET $%d LIMIT $%d`, available, where, len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// categoryKey renders canonical category ids for a cache key
+func categoryKey(categoryIDs []string) string {
+	if len(categoryIDs) == 0 {
+		return "all"
+	}
+	return strings.Join(categoryIDs, ",")
+}
+
+// categoryCondition keeps products in any of categoryIDs. Like the order
+// ids below, they go over as text[].
+func categoryCondition(categoryIDs []string, args *[]any) string {
+	*args = append(*args, categoryIDs)
+	return fmt.Sprintf("p.category_id = ANY($%d::text[]::uuid[])", len(*args))
+}
+
+// notPurchasedCondition anti-joins order_items, via idx_order_items_order,
+// to drop products with a line in any of orderIDs. The ids go over as
+// text[] since pgx has no binary uuid[] encoding for []string.
+func notPurchasedCondition(orderIDs []string, args *[]any) string {
+	*args = append(*args, orderIDs)
+	return fmt.Sprintf(`NOT EXISTS (
+			SELECT 1 FROM order_items oi
+			WHERE oi.order_id = ANY($%d::text[]::uuid[]) AND oi.product_id = p.id)`, len(*args))
+}
+
+func scanProducts(rows pgx.Rows) ([]Product, error) {
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		var p Product
+		err := rows.Scan(&p.ID, &p.SKU, &p.Price, &p.Available)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+func (s *UserOverviewService) getAccountStats(
+	ctx context.Context,
+	userID string,
+) (AccountStats, error) {
+	var stats AccountStats
+	err := s.db.Read().QueryRow(ctx, `
+		SELECT COUNT(*)::int, COALESCE(SUM(total), 0)::float8
+		FROM orders WHERE user_id = $1`, userID).
+		Scan(&stats.OrderCount, &stats.LifetimeSpend)
+	return stats, err
+}
+
+func (s *UserOverviewService) getCartPreview(
+	ctx context.Context,
+	cartID string,
+) ([]CartPreviewItem, error) {
+	rows, err := s.db.Read().Query(ctx, `
+		SELECT ci.product_id, p.sku, ci.qty, ci.unit_price
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.unit_price * ci.qty DESC
+		LIMIT $2`, cartID, cartPreviewSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []CartPreviewItem
+	for rows.Next() {
+		var it CartPreviewItem
+		if err := rows.Scan(&it.ProductID, &it.SKU, &it.Qty, &it.UnitPrice); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
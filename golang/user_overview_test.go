@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// overviewFixture is a fully loaded overview with fixed values, so each
+// version's rendering of it can be pinned byte for byte
+func overviewFixture() *Overview {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cartAge := 90
+	return &Overview{
+		User: &User{ID: "7f0c9a52-1d1e-4c55-9d5e-3a1f6f0b2c11", Plan: "pro", Region: "us-east", Status: "active"},
+		Cart: &Cart{ID: "c3b2a1d0-5e6f-4a7b-8c9d-0e1f2a3b4c5d", Status: "open", UpdatedAt: updated, CartTotal: 59.97, CartItems: 3},
+		CartPreview: []CartPreviewItem{
+			{ProductID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", SKU: "SKU-000001", Qty: 2, UnitPrice: 19.99},
+			{ProductID: "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e", SKU: "SKU-000002", Qty: 1, UnitPrice: 19.99},
+		},
+		Orders: []Order{
+			{ID: "9d8c7b6a-5f4e-4d3c-8b2a-1f0e9d8c7b6a", Status: "completed", Total: 120.5, CreatedAt: updated.Add(-48 * time.Hour), ItemsCount: 2, ItemsQty: 5},
+			{ID: "8c7b6a5f-4e3d-4c2b-9a1f-0e9d8c7b6a5f", Status: "pending", Total: 0, CreatedAt: updated.Add(-72 * time.Hour), ItemsCount: 0, ItemsQty: 0},
+		},
+		Products: []Product{
+			{ID: "2c3d4e5f-6a7b-4c8d-9e0f-1a2b3c4d5e6f", SKU: "SKU-000003", Price: 5.25, Available: 40},
+			{ID: "3d4e5f6a-7b8c-4d9e-8f1a-2b3c4d5e6f7a", SKU: "SKU-000004", Price: 99, Available: 7},
+		},
+		HasMore:     true,
+		NextCursor:  productCursor{Available: 7, ProductID: "3d4e5f6a-7b8c-4d9e-8f1a-2b3c4d5e6f7a"}.String(),
+		WarehouseID: "5e6f7a8b-9c0d-4e1f-8a2b-3c4d5e6f7a8b",
+		Stats:       AccountStats{OrderCount: 2, LifetimeSpend: 120.5},
+		TopProducts: []TopProduct{{ProductID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", SKU: "SKU-000001", TotalQty: 4}},
+		Segment:     "basic",
+		Derived: &Derived{
+			UserSegment:    "basic",
+			CartAgeSeconds: &cartAge,
+			TopProducts:    []string{"0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"},
+		},
+	}
+}
+
+// withEncoders runs fn under each JSON_ENCODER; both must render the same
+// bytes, or switching encoders would change the contract
+func withEncoders(t *testing.T, fn func(t *testing.T)) {
+	for _, name := range []string{"stdlib", "goccy"} {
+		t.Run(name, func(t *testing.T) {
+			useJSONEncoder(name)
+			t.Cleanup(func() { useJSONEncoder("stdlib") })
+			fn(t)
+		})
+	}
+}
+
+func TestOverviewV1Contract(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		edit   func(ov *Overview)
+	}{
+		{name: "full", golden: "overview_v1.json"},
+		{name: "no cart, products degraded", golden: "overview_v1_degraded.json", edit: func(ov *Overview) {
+			ov.Cart, ov.CartPreview, ov.Derived.CartAgeSeconds = nil, nil, nil
+			ov.Products, ov.ProductsDegraded = []Product{}, true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncoders(t, func(t *testing.T) {
+				ov := overviewFixture()
+				if tt.edit != nil {
+					tt.edit(ov)
+				}
+				payload, err := jsonMarshal(mapOverviewV1(ov))
+				if err != nil {
+					t.Fatal(err)
+				}
+				golden(t, tt.golden, payload)
+			})
+		})
+	}
+}
+
+func TestOverviewV2Contract(t *testing.T) {
+	tests := []struct {
+		name    string
+		golden  string
+		include OverviewSections
+		edit    func(ov *Overview)
+	}{
+		{name: "full", golden: "overview_v2.json"},
+		{name: "last page", golden: "overview_v2_last_page.json", edit: func(ov *Overview) {
+			ov.HasMore, ov.NextCursor = false, ""
+		}},
+		{name: "orders and cart only", golden: "overview_v2_orders_cart.json", include: SectionOrders | SectionCart, edit: func(ov *Overview) {
+			ov.Products, ov.Derived = nil, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncoders(t, func(t *testing.T) {
+				ov := overviewFixture()
+				if tt.edit != nil {
+					tt.edit(ov)
+				}
+				q := OverviewQuery{UserID: ov.User.ID, Page: 1, Limit: 10, Include: tt.include}
+				payload, err := jsonMarshal(mapOverviewV2(ov, q))
+				if err != nil {
+					t.Fatal(err)
+				}
+				golden(t, tt.golden, payload)
+			})
+		})
+	}
+}
+
+func TestSummaryKeysDifferByVersion(t *testing.T) {
+	s := &UserOverviewService{}
+	const user = "7f0c9a52-1d1e-4c55-9d5e-3a1f6f0b2c11"
+	queries := []OverviewQuery{
+		{UserID: user, Page: 1, Limit: 10},
+		{UserID: user, Page: 2, Limit: 25, CategoryIDs: []string{"0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"}},
+		{UserID: user, Page: 1, Limit: 10, Include: SectionOrders},
+		{UserID: user, Limit: 10, After: &productCursor{Available: 3, ProductID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"}},
+	}
+	seen := map[string]string{}
+	for _, version := range []string{"v1", "v2"} {
+		for _, q := range queries {
+			key := s.SummaryKey(version, q)
+			if prev, ok := seen[key]; ok {
+				t.Errorf("%s and %s %+v share the key %s", prev, version, q, key)
+			}
+			seen[key] = version
+			if want := summaryKeyPrefix(user) + version + ":"; key[:len(want)] != want {
+				t.Errorf("%s key %s does not start with %s", version, key, want)
+			}
+		}
+	}
+}
+
+func TestOverviewV2Pages(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	app := overviewApp(t, db, rdb)
+	user := seedUser(t, db, "free", "active")
+	category := seedCategory(t, db)
+	for i := range 25 {
+		seedProductIn(t, db, category, fmt.Sprintf("PAGE-%02d", i), 3, 5)
+	}
+
+	seen := map[string]bool{}
+	for _, tt := range []struct {
+		page     int
+		returned float64
+		hasMore  bool
+	}{{1, 10, true}, {2, 10, true}, {3, 5, false}} {
+		target := fmt.Sprintf("/v2/users/%s/overview?categoryId=%s&limit=10&page=%d", user, category, tt.page)
+		resp, body := send(t, app, newRequest(http.MethodGet, target, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: status = %d: %s", tt.page, resp.StatusCode, body)
+		}
+		got := decode(t, body)
+		p, _ := got["pagination"].(map[string]any)
+		if _, ok := p["nextCursor"].(string); ok != tt.hasMore {
+			t.Errorf("page %d: nextCursor = %v, want one only before the last page", tt.page, p["nextCursor"])
+		}
+		delete(p, "nextCursor")
+		want := map[string]any{"page": float64(tt.page), "limit": 10.0, "returned": tt.returned, "hasMore": tt.hasMore}
+		if fmt.Sprint(p) != fmt.Sprint(want) {
+			t.Errorf("page %d: pagination = %v, want %v", tt.page, p, want)
+		}
+		products, _ := got["products"].([]any)
+		if float64(len(products)) != tt.returned {
+			t.Errorf("page %d: %d products, want %v", tt.page, len(products), tt.returned)
+		}
+		for _, p := range products {
+			id := p.(map[string]any)["id"].(string)
+			if seen[id] {
+				t.Errorf("page %d repeats product %s", tt.page, id)
+			}
+			seen[id] = true
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// v2 overview DTO: camelCase names, pagination metadata, account stats, a
+// cart item preview and availability scoped to the user's warehouse
+
+type UserOverviewV2Response struct {
+	User     UserV2      `json:"user"`
+	Cart     *CartV2     `json:"cart"`
+	Orders   []OrderV2   `json:"orders"`
+	Products []ProductV2 `json:"products"`
+	// Sections left out of ?include= are null (orders, cart, products) or
+	// omitted (pagination and accountStats follow products and orders)
+	Pagination   *PaginationV2   `json:"pagination,omitempty"`
+	AccountStats *AccountStatsV2 `json:"accountStats,omitempty"`
+	Derived      *DerivedV2      `json:"derived,omitempty"`
+	// Degraded is set when Redis failed and everything came from Postgres
+	Degraded bool `json:"degraded,omitempty"`
+	// ProductsDegraded is set when the products query timed out and
+	// products is empty instead
+	ProductsDegraded bool `json:"productsDegraded,omitempty"`
+}
+
+type UserV2 struct {
+	ID     string `json:"id"`
+	Plan   string `json:"plan"`
+	Region string `json:"region"`
+	Status string `json:"status"`
+}
+
+type CartV2 struct {
+	ID        string       `json:"id"`
+	Status    string       `json:"status"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	Total     float64      `json:"total"`
+	ItemCount int          `json:"itemCount"`
+	Preview   []CartItemV2 `json:"preview"`
+}
+
+type CartItemV2 struct {
+	ProductID string  `json:"productId"`
+	SKU       string  `json:"sku"`
+	Qty       int     `json:"qty"`
+	UnitPrice float64 `json:"unitPrice"`
+}
+
+type OrderV2 struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Total      float64   `json:"total"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ItemsCount int       `json:"itemsCount"`
+	ItemsQty   int       `json:"itemsQty"`
+}
+
+type ProductV2 struct {
+	ID        string  `json:"id"`
+	SKU       string  `json:"sku"`
+	Price     float64 `json:"price"`
+	Available int     `json:"available"`
+}
+
+type PaginationV2 struct {
+	Page     int  `json:"page"`
+	Limit    int  `json:"limit"`
+	Returned int  `json:"returned"`
+	HasMore  bool `json:"hasMore"`
+	// NextCursor fetches the following page via ?cursor=; absent on the last
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type AccountStatsV2 struct {
+	OrderCount    int     `json:"orderCount"`
+	LifetimeSpend float64 `json:"lifetimeSpend"`
+}
+
+// DerivedV2.TopProducts carries SKU and units; v1 keeps bare product ids
+type DerivedV2 struct {
+	UserSegment    string       `json:"userSegment,omitempty"`
+	CartAgeSeconds *int         `json:"cartAgeSeconds"`
+	TopProducts    []TopProduct `json:"topProducts"`
+	WarehouseID    string       `json:"warehouseId"`
+}
+
+func (h *UserOverviewHandler) GetUserOverviewV2(c *fiber.Ctx) error {
+	ctx, bypassed := withCacheBypass(c.UserContext())
+	c.SetUserContext(ctx)
+	defer markBypass(c, bypassed)
+	q, err := h.parseOverviewQuery(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	summaryKey := h.svc.SummaryKey("v2", q)
+	ctx = h.overviewContext(c, ctx, q, summaryKey)
+
+	user, err := h.resolveOverviewUser(c, q.UserID)
+	if user == nil {
+		return err
+	}
+	res, err := h.summary(ctx, q, summaryKey,
+		func(ctx context.Context) (BuiltSummary, error) {
+			ov, err := h.svc.Load(ctx, user, q, OverviewOptions{
+				Regional:     true,
+				Pagination:   true,
+				AccountStats: true,
+				CartPreview:  true,
+			})
+			if err != nil {
+				return BuiltSummary{}, err
+			}
+			response := mapOverviewV2(ov, q)
+			response.Degraded = bypassed.Load()
+			stop := timeStage(ctx, "marshal")
+			payload, err := jsonMarshal(response)
+			stop()
+			return ov.built(payload), err
+		})
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeSummary(c, res)
+}
+
+func mapOverviewV2(ov *Overview, q OverviewQuery) UserOverviewV2Response {
+	include := q.sections()
+	resp := UserOverviewV2Response{
+		User: UserV2{
+			ID:     ov.User.ID,
+			Plan:   ov.User.Plan,
+			Region: ov.User.Region,
+			Status: ov.User.Status,
+		},
+	}
+
+	if ov.Cart != nil {
+		resp.Cart = &CartV2{
+			ID:        ov.Cart.ID,
+			Status:    ov.Cart.Status,
+			UpdatedAt: ov.Cart.UpdatedAt,
+			Total:     ov.Cart.CartTotal,
+			ItemCount: ov.Cart.CartItems,
+			Preview:   make([]CartItemV2, 0, len(ov.CartPreview)),
+		}
+		for _, it := range ov.CartPreview {
+			resp.Cart.Preview = append(resp.Cart.Preview, CartItemV2(it))
+		}
+	}
+	if include.Has(SectionOrders) {
+		resp.Orders = make([]OrderV2, 0, len(ov.Orders))
+		for _, o := range ov.Orders {
+			resp.Orders = append(resp.Orders, OrderV2(o))
+		}
+		resp.AccountStats = &AccountStatsV2{
+			OrderCount:    ov.Stats.OrderCount,
+			LifetimeSpend: ov.Stats.LifetimeSpend,
+		}
+	}
+	if include.Has(SectionProducts) {
+		resp.ProductsDegraded = ov.ProductsDegraded
+		resp.Products = make([]ProductV2, 0, len(ov.Products))
+		for _, p := range ov.Products {
+			resp.Products = append(resp.Products, ProductV2(p))
+		}
+		resp.Pagination = &PaginationV2{
+			Page:       q.Page,
+			Limit:      q.Limit,
+			Returned:   len(ov.Products),
+			HasMore:    ov.HasMore,
+			NextCursor: ov.NextCursor,
+		}
+	}
+	if ov.Derived != nil {
+		resp.Derived = &DerivedV2{
+			UserSegment:    ov.Derived.UserSegment,
+			CartAgeSeconds: ov.Derived.CartAgeSeconds,
+			TopProducts:    ov.TopProducts,
+			WarehouseID:    ov.WarehouseID,
+		}
+	}
+	return resp
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Set at build time:
+//
+//	go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// When unset they fall back to the VCS stamp Go embeds in module builds.
+var (
+	gitCommit string
+	buildTime string
+)
+
+// VersionInfo identifies the running binary and the features it was
+// started with, so benchmark results can be tied to what produced them
+type VersionInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+	Prefork   bool   `json:"prefork"`
+	Pprof     bool   `json:"pprof"`
+	Tracing   bool   `json:"tracing"`
+}
+
+func newVersionInfo(prefork, pprof, tracing bool) VersionInfo {
+	v := VersionInfo{
+		Commit:    gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		Prefork:   prefork,
+		Pprof:     pprof,
+		Tracing:   tracing,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && v.Commit == "" {
+		dirty := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v.Commit = s.Value
+			case "vcs.time":
+				if v.BuildTime == "" {
+					v.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && v.Commit != "" {
+			v.Commit += "-dirty"
+		}
+	}
+	if v.Commit == "" {
+		v.Commit = "unknown"
+	}
+	if v.BuildTime == "" {
+		v.BuildTime = "unknown"
+	}
+	return v
+}
+
+func versionHandler(v VersionInfo) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(v)
+	}
+}
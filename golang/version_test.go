@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+func TestVersionHandlerShape(t *testing.T) {
+	app := fiber.New()
+	app.Get("/version", versionHandler(newVersionInfo(true, true, false)))
+	resp, body := send(t, app, newRequest(http.MethodGet, "/version", nil))
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	got := decode(t, body)
+
+	want := map[string]any{
+		"goVersion": runtime.Version(),
+		"prefork":   true,
+		"pprof":     true,
+		"tracing":   false,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	// Unstamped test binaries still report something
+	for _, k := range []string{"commit", "buildTime"} {
+		if s, _ := got[k].(string); s == "" {
+			t.Errorf("%s = %v, want a non-empty string", k, got[k])
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("body has %d fields, want 6: %s", len(got), body)
+	}
+}
+
+func TestVersionPrefersLinkerStamps(t *testing.T) {
+	gitCommit, buildTime = "abc123", "2024-03-01T12:00:00Z"
+	t.Cleanup(func() { gitCommit, buildTime = "", "" })
+	v := newVersionInfo(false, false, false)
+	if v.Commit != "abc123" || v.BuildTime != "2024-03-01T12:00:00Z" {
+		t.Errorf("version = %+v, want the -ldflags values", v)
+	}
+}
+
+func TestPprofIsAnAdminRoute(t *testing.T) {
+	routes := NewRouteRegistry("", requireAdmin(false, "secret"))
+	routes.Add(Route{Method: fiber.MethodGet, Path: "/debug/pprof/*", Admin: true, Handler: pprof.New()})
+	app := fiber.New(fiber.Config{StrictRouting: true})
+	routes.Mount(app)
+
+	if resp, _ := send(t, app, newRequest(http.MethodGet, "/debug/pprof/cmdline", nil)); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("without the key: status = %d, want 401", resp.StatusCode)
+	}
+	req := newRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set(headerAdminKey, "secret")
+	resp, body := send(t, app, req)
+	if resp.StatusCode != fiber.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("index: got %d, want 200 listing the profiles", resp.StatusCode)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+// Region -> fulfillment warehouse. Checkout reserves stock from this
+// warehouse and the overview reports regional availability against it.
+var warehouseByRegion = map[string]string{
+	"us-east":      "11111111-1111-1111-1111-111111111111",
+	"us-west":      "22222222-2222-2222-2222-222222222222",
+	"eu-west":      "33333333-3333-3333-3333-333333333333",
+	"ap-southeast": "44444444-4444-4444-4444-444444444444",
+}
+
+const defaultRegion = "us-east"
+
+func warehouseForRegion(region string) string {
+	if wh, ok := warehouseByRegion[region]; ok {
+		return wh
+	}
+	return warehouseByRegion[defaultRegion]
+}
+
+// overviewWarehouse is the warehouse the overview counts availability in:
+// the user's fulfillment warehouse, or "" (every warehouse) when the user
+// has no region
+func overviewWarehouse(region string) string {
+	if region == "" {
+		return ""
+	}
+	return warehouseForRegion(region)
+}
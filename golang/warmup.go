@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// startWarmup runs warm in the background with readiness held at 503,
+// releasing it when warm returns or timeout expires, whichever is first.
+// warm gets a context with that deadline; a step that ignores it is left
+// to finish on its own rather than holding readiness back.
+func startWarmup(health *Health, timeout time.Duration, warm func(context.Context) error) {
+	health.SetWarming()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() { done <- warm(ctx) }()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out after %s: %w", timeout, err)
+			}
+			log.Printf("⚠️  Warmup incomplete: %v", err)
+		}
+		health.WarmupDone(err)
+	}()
+}
+
+// warmup establishes the connections the first requests would otherwise pay
+// for: MinConns per Postgres pool (held together so they are distinct
+// connections), PoolSize Redis connections, and optionally the prepared
+// statements for the overview queries.
+func warmup(
+	ctx context.Context,
+	db *DBRouter,
+	rdb *redis.Client,
+	svc *UserOverviewService,
+	primeStatements bool,
+) error {
+	start := time.Now()
+
+	pools := []*pgxpool.Pool{db.Primary()}
+	if replica := db.Replica(); replica != nil {
+		pools = append(pools, replica)
+	}
+	for _, pool := range pools {
+		if err := warmPool(ctx, pool); err != nil {
+			return err
+		}
+	}
+
+	if err := warmRedis(ctx, rdb); err != nil {
+		return err
+	}
+
+	if primeStatements {
+		// One Warm per minimum connection, concurrently, so the pool spreads
+		// them across connections instead of reusing one
+		n := max(int(db.Primary().Config().MinConns), 1)
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() { errs <- svc.Warm(ctx) }()
+		}
+		var err error
+		for i := 0; i < n; i++ {
+			err = errors.Join(err, <-errs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("🔥 Warmup done in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func warmPool(ctx context.Context, pool *pgxpool.Pool) error {
+	n := int(pool.Config().MinConns)
+	conns := make([]*pgxpool.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	return nil
+}
+
+func warmRedis(ctx context.Context, rdb *redis.Client) error {
+	n := rdb.Options().PoolSize
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rdb.Ping(ctx).Err()
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// readyApp serves health.Ready over db and rdb with no breaker, view or
+// outbox to report on
+func readyApp(db *DBRouter, rdb *redis.Client) (*fiber.App, *Health) {
+	health := NewHealth(db, rdb, nil, &AvailabilityView{}, &OutboxRelay{}, time.Second)
+	app := fiber.New()
+	app.Get("/ready", health.Ready)
+	return app, health
+}
+
+// unreachableRouter is a DBRouter whose pool never connects
+func unreachableRouter(t *testing.T) *DBRouter {
+	pool, err := pgxpool.New(context.Background(), "postgres://nobody@127.0.0.1:1/none?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return NewDBRouter(pool, nil)
+}
+
+// awaitWarmupDone polls until health stops reporting warming
+func awaitWarmupDone(t *testing.T, health *Health, within time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for health.warming.Load() {
+		if time.Since(start) > within {
+			t.Fatalf("still warming after %s", within)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return time.Since(start)
+}
+
+func TestWarmupTimeoutReleasesReadiness(t *testing.T) {
+	_, rdb := testRedis(t)
+	app, health := readyApp(unreachableRouter(t), rdb)
+
+	// A step that never honours its context must not pin readiness
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	startWarmup(health, 50*time.Millisecond, func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	resp, body := send(t, app, newRequest(http.MethodGet, "/ready", nil))
+	if resp.StatusCode != fiber.StatusServiceUnavailable || decode(t, body)["status"] != "warming" {
+		t.Fatalf("during warmup: got %d %s, want 503 warming", resp.StatusCode, body)
+	}
+
+	if took := awaitWarmupDone(t, health, time.Second); took < 40*time.Millisecond {
+		t.Errorf("readiness released after %s, before the timeout", took)
+	}
+	_, body = send(t, app, newRequest(http.MethodGet, "/ready", nil))
+	components, _ := decode(t, body)["components"].(map[string]any)
+	warm, _ := components["warmup"].(map[string]any)
+	if warm["status"] != "down" || warm["critical"] != false ||
+		!strings.Contains(warm["error"].(string), "timed out after 50ms") {
+		t.Errorf("warmup component = %v, want a non-critical timeout", warm)
+	}
+}
+
+func TestWarmupHonoursItsDeadline(t *testing.T) {
+	_, rdb := testRedis(t)
+	_, health := readyApp(unreachableRouter(t), rdb)
+	var deadline time.Time
+	startWarmup(health, time.Minute, func(ctx context.Context) error {
+		deadline, _ = ctx.Deadline()
+		return nil
+	})
+	awaitWarmupDone(t, health, time.Second)
+	if until := time.Until(deadline); until < 50*time.Second {
+		t.Errorf("warm ran with %s left, want the configured minute", until)
+	}
+	if health.warmupErr.Load() != nil {
+		t.Errorf("a successful warmup was recorded as %q", *health.warmupErr.Load())
+	}
+}
+
+func TestReadinessAfterWarmup(t *testing.T) {
+	db := testRouter(t)
+	_, rdb := testRedis(t)
+	for _, tt := range []struct {
+		name   string
+		err    error
+		status string
+	}{
+		{"completed", nil, "ok"},
+		{"failed", errors.New("redis: connection refused"), "degraded"},
+		{"timed out", context.DeadlineExceeded, "degraded"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			app, health := readyApp(db, rdb)
+			startWarmup(health, time.Second, func(context.Context) error { return tt.err })
+			awaitWarmupDone(t, health, time.Second)
+			resp, body := send(t, app, newRequest(http.MethodGet, "/ready", nil))
+			if resp.StatusCode != fiber.StatusOK || decode(t, body)["status"] != tt.status {
+				t.Errorf("got %d %s, want 200 %s", resp.StatusCode, body, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+
+	"loastest-go/config"
+	"loastest-go/events"
+)
+
+// The headers a webhook is signed with, both the ones this service sends
+// and the payment provider's it receives
+const (
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+var (
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook deliveries handled by this instance, by outcome (queued, delivered, retried, dead, held while the subscriber's breaker was open).",
+	}, []string{"outcome"})
+	webhookDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_delivery_duration_seconds",
+		Help:    "Time from sending a webhook POST to its response, or to the error when there was none.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// orderEventTypes are the types published to stream:order_events, which
+// are the ones a subscription can ask for
+var orderEventTypes = []string{
+	events.OrderCreated,
+	events.OrderCancelled,
+	events.OrderShipped,
+	events.PaymentConfirmed,
+}
+
+// WebhookEvent is the JSON body POSTed to subscribers. ID is the same on
+// every delivery of the event, including one the outbox published twice,
+// so a subscriber can drop the repeats at-least-once delivery brings.
+type WebhookEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// PublishedAt is when the event reached the stream
+	PublishedAt time.Time         `json:"publishedAt"`
+	Data        map[string]string `json:"data"`
+}
+
+// WebhookDispatcher delivers stream:order_events to webhook subscribers,
+// at least once. Every instance runs one. The consumer group hands each
+// entry to one instance, which queues a webhook_deliveries row per
+// matching subscription before acknowledging it. Delivery passes lease due
+// rows with SKIP LOCKED, so no two instances send one at the same time; a
+// lease that runs out, say when an instance dies mid-POST, makes the row
+// due again. Entries the order stream consumer trims away before the group
+// reads them are never delivered, as with its stats.
+type WebhookDispatcher struct {
+	db       *DBRouter
+	rdb      *redis.Client
+	cfg      config.WebhookConfig
+	client   *http.Client
+	consumer string
+	breakers *webhookBreakers
+}
+
+func NewWebhookDispatcher(db *DBRouter, rdb *redis.Client, cfg config.WebhookConfig) *WebhookDispatcher {
+	host, _ := os.Hostname()
+	return &WebhookDispatcher{
+		db:  db,
+		rdb: rdb,
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: webhookTransport(cfg.AllowPrivateIPs),
+			// A redirect fails the delivery; the subscription's URL should
+			// be fixed rather than followed on every event
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		consumer: fmt.Sprintf("%s-%d", host, os.Getpid()),
+		breakers: newWebhookBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+}
+
+// errWebhookAddress is a subscriber address deliveries don't connect to
+var errWebhookAddress = errors.New("webhook address is not public")
+
+// webhookMetadataAddrs are the cloud metadata services outside link-local
+// space, which WEBHOOK_ALLOW_PRIVATE_IPS doesn't open up
+var webhookMetadataAddrs = []netip.Addr{
+	netip.MustParseAddr("fd00:ec2::254"),
+	netip.MustParseAddr("100.100.100.200"),
+}
+
+// webhookSharedAddrs is the carrier-grade NAT range (RFC 6598), which
+// netip's IsPrivate leaves out but sits inside a provider's network all
+// the same
+var webhookSharedAddrs = netip.MustParsePrefix("100.64.0.0/10")
+
+// webhookTransport connects to subscribers directly, never through a
+// proxy, so the address checked is the one the POST goes to
+func webhookTransport(allowPrivate bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   webhookDialControl(allowPrivate),
+	}).DialContext
+	return t
+}
+
+// webhookDialControl refuses to connect to an address inside this
+// network unless allowPrivate lets loopback, private and shared ones
+// through. It runs on the resolved address of every connection, so a
+// subscription URL whose host resolves to one, now or after it was saved,
+// is refused too.
+func webhookDialControl(allowPrivate bool) func(network, address string, _ syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errWebhookAddress, address)
+		}
+		ip := addrPort.Addr().Unmap()
+		// Link-local holds 169.254.169.254, most clouds' metadata service
+		blocked := ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalUnicast()
+		if !allowPrivate {
+			blocked = blocked || ip.IsLoopback() || ip.IsPrivate() || webhookSharedAddrs.Contains(ip)
+		}
+		for _, metadata := range webhookMetadataAddrs {
+			blocked = blocked || ip == metadata
+		}
+		if blocked {
+			return fmt.Errorf("%w: %s", errWebhookAddress, ip)
+		}
+		return nil
+	}
+}
+
+// Enabled reports whether WEBHOOK_DELIVERY turns delivery on
+func (d *WebhookDispatcher) Enabled() bool {
+	return d.cfg.Enabled
+}
+
+// Start queues deliveries from the stream and sends them until ctx is done
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	log.Printf("🪝 Delivering %s to webhook subscribers as %s/%s", orderEventsStream, d.cfg.Group, d.consumer)
+	go d.consume(ctx)
+	go d.deliver(ctx)
+}
+
+// consume queues the stream's entries until ctx is done. Failures are
+// logged and retried after a second; entries left unacknowledged are
+// claimed again after ClaimIdle.
+func (d *WebhookDispatcher) consume(ctx context.Context) {
+	grouped := false
+	var nextClaim time.Time
+	for ctx.Err() == nil {
+		err := func() error {
+			if !grouped {
+				// From "$": subscribers get the events from when delivery
+				// was first turned on, not the stream's whole backlog
+				err := d.rdb.XGroupCreateMkStream(ctx, orderEventsStream, d.cfg.Group, "$").Err()
+				if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+					return err
+				}
+				grouped = true
+			}
+			if now := time.Now(); now.After(nextClaim) {
+				if err := d.claim(ctx); err != nil {
+					return err
+				}
+				nextClaim = now.Add(d.cfg.ClaimIdle)
+			}
+			return d.read(ctx)
+		}()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		// The stream or group is gone, e.g. after a FLUSHALL
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			grouped = false
+		}
+		log.Printf("⚠️  Webhook stream consumer failed: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// claim takes over entries another instance has held unacknowledged for
+// ClaimIdle, and queues them
+func (d *WebhookDispatcher) claim(ctx context.Context) error {
+	start := "0-0"
+	for {
+		msgs, next, err := d.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   orderEventsStream,
+			Group:    d.cfg.Group,
+			Consumer: d.consumer,
+			MinIdle:  d.cfg.ClaimIdle,
+			Start:    start,
+			Count:    int64(d.cfg.BatchSize),
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if err := d.queue(ctx, msgs); err != nil {
+			return err
+		}
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// read queues the next batch of new entries, waiting up to PollInterval
+// for one to arrive
+func (d *WebhookDispatcher) read(ctx context.Context) error {
+	streams, err := d.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    d.cfg.Group,
+		Consumer: d.consumer,
+		Streams:  []string{orderEventsStream, ">"},
+		Count:    int64(d.cfg.BatchSize),
+		Block:    d.cfg.PollInterval,
+	}).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		if err := d.queue(ctx, stream.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue writes a delivery of each entry for every active subscription
+// that wants its type, then acknowledges the entries. An entry queued
+// again, because it wasn't acknowledged or the outbox published it twice,
+// is absorbed by the (subscription_id, event_id) key.
+func (d *WebhookDispatcher) queue(ctx context.Context, msgs []redis.XMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(msgs))
+	var eventIDs, types, bodies []string
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+		event, ok := newWebhookEvent(msg)
+		if !ok {
+			continue
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		eventIDs = append(eventIDs, event.ID)
+		types = append(types, event.Type)
+		bodies = append(bodies, string(body))
+	}
+	if len(eventIDs) > 0 {
+		tag, err := d.db.Primary().Exec(ctx, `
+			INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, body)
+			SELECT s.id, e.event_id, e.event_type, e.body
+			FROM unnest($1::text[], $2::text[], $3::text[]) AS e(event_id, event_type, body)
+			JOIN webhook_subscriptions s ON s.active AND e.event_type = ANY(s.event_types)
+			ON CONFLICT (subscription_id, event_id) DO NOTHING`, eventIDs, types, bodies)
+		if err != nil {
+			return dbError("queue webhook deliveries", err)
+		}
+		webhookDeliveries.WithLabelValues("queued").Add(float64(tag.RowsAffected()))
+	}
+	return d.rdb.XAck(ctx, orderEventsStream, d.cfg.Group, ids...).Err()
+}
+
+// newWebhookEvent makes the body of an entry's deliveries. Its id is the
+// outboxId the relay adds to each entry, or the entry's own id for one
+// that didn't come through the outbox.
+func newWebhookEvent(msg redis.XMessage) (WebhookEvent, bool) {
+	ms, _, _ := strings.Cut(msg.ID, "-")
+	at, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return WebhookEvent{}, false
+	}
+	event := WebhookEvent{
+		ID:          msg.ID,
+		Type:        events.OrderCreated,
+		PublishedAt: time.UnixMilli(at).UTC(),
+		Data:        make(map[string]string, len(msg.Values)),
+	}
+	for k, v := range msg.Values {
+		s, _ := v.(string)
+		switch {
+		case k == "outboxId" && s != "":
+			event.ID = s
+		case k == "type" && s != "":
+			event.Type = s
+		case k != "outboxId" && k != "type":
+			event.Data[k] = s
+		}
+	}
+	return event, true
+}
+
+// deliver sends due deliveries every PollInterval until ctx is done
+func (d *WebhookDispatcher) deliver(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				n, err := d.deliverBatch(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("⚠️  Webhook delivery failed: %v", err)
+					}
+					break
+				}
+				if n < d.cfg.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+type leasedDelivery struct {
+	id             int64
+	subscriptionID string
+	url            string
+	secret         string
+	eventID        string
+	body           []byte
+	attempts       int
+}
+
+type webhookResult struct {
+	statusCode int
+	err        error
+	duration   time.Duration
+	// heldUntil is set, instead of the rest, on a delivery that wasn't
+	// sent because its subscriber's breaker held it back
+	heldUntil time.Time
+}
+
+// deliverBatch leases up to BatchSize due deliveries of subscribers whose
+// breaker isn't open, sends them Concurrency at a time and records the
+// outcomes. It returns how many deliveries it leased.
+func (d *WebhookDispatcher) deliverBatch(ctx context.Context) (int, error) {
+	// The lease covers the whole batch going out Concurrency at a time
+	rounds := (d.cfg.BatchSize + d.cfg.Concurrency - 1) / d.cfg.Concurrency
+	lease := d.cfg.Timeout * time.Duration(rounds+1)
+
+	rows, err := d.db.Primary().Query(ctx, `
+		WITH due AS (
+			SELECT w.id FROM webhook_deliveries w
+			JOIN webhook_subscriptions s ON s.id = w.subscription_id
+			WHERE w.status = 'pending' AND w.next_attempt_at <= NOW() AND s.active
+				AND w.subscription_id <> ALL($2::text[]::uuid[])
+			ORDER BY w.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF w SKIP LOCKED
+		)
+		UPDATE webhook_deliveries w
+		SET next_attempt_at = NOW() + make_interval(secs => $3)
+		FROM due, webhook_subscriptions s
+		WHERE w.id = due.id AND s.id = w.subscription_id
+		RETURNING w.id, s.id::text, s.url, s.secret, w.event_id, w.body, w.attempts`,
+		d.cfg.BatchSize, d.breakers.open(time.Now()), lease.Seconds())
+	if err != nil {
+		return 0, dbError("lease webhook deliveries", err)
+	}
+	var batch []leasedDelivery
+	for rows.Next() {
+		var del leasedDelivery
+		var body string
+		if err := rows.Scan(&del.id, &del.subscriptionID, &del.url, &del.secret,
+			&del.eventID, &body, &del.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		del.body = []byte(body)
+		batch = append(batch, del)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, dbError("lease webhook deliveries", err)
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	results := make([]webhookResult, len(batch))
+	slots := make(chan struct{}, d.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := range batch {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = d.send(ctx, batch[i])
+		}()
+	}
+	wg.Wait()
+
+	// Recorded even when shutting down, so what went out isn't sent again
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := d.record(recordCtx, batch, results); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// send POSTs one delivery, unless its subscriber's breaker holds it back
+func (d *WebhookDispatcher) send(ctx context.Context, del leasedDelivery) webhookResult {
+	if ok, until := d.breakers.allow(del.subscriptionID, time.Now()); !ok {
+		return webhookResult{heldUntil: until}
+	}
+	start := time.Now()
+	status, err := d.post(ctx, del)
+	res := webhookResult{statusCode: status, err: err, duration: time.Since(start)}
+	webhookDuration.Observe(res.duration.Seconds())
+	if !errors.Is(err, context.Canceled) {
+		d.breakers.record(del.subscriptionID, err == nil, time.Now())
+	}
+	return res
+}
+
+// post sends the delivery's body with its signature. Only a 2xx counts as
+// delivered.
+func (d *WebhookDispatcher) post(ctx context.Context, del leasedDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.url, bytes.NewReader(del.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", del.eventID)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(del.attempts+1))
+	req.Header.Set(headerWebhookTimestamp, timestamp)
+	req.Header.Set(headerWebhookSignature, "sha256="+webhookSignature(del.secret, timestamp, del.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drained so the connection goes back to the pool
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "<timestamp>.<body>" keyed
+// with the subscription's secret. Signing the timestamp lets a subscriber
+// turn away an old request replayed at it.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	return hex.EncodeToString(webhookMAC(secret, timestamp, body))
+}
+
+// webhookMAC is the HMAC webhookSignature encodes
+func webhookMAC(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// record marks deliveries delivered, reschedules failed ones with
+// exponential backoff (dead after MaxAttempts), moves held ones to when
+// their breaker allows another try, and logs every POST. One cut short by
+// shutdown is left to its lease.
+func (d *WebhookDispatcher) record(ctx context.Context, batch []leasedDelivery, results []webhookResult) error {
+	var delivered, failedIDs, heldIDs []int64
+	var failedErrs []string
+	var heldUntil []time.Time
+	var logIDs []int64
+	var logAttempts, logCodes []int
+	var logErrs []string
+	var logDurations []float64
+	dead := 0
+	for i, del := range batch {
+		res := results[i]
+		switch {
+		case !res.heldUntil.IsZero():
+			heldIDs = append(heldIDs, del.id)
+			heldUntil = append(heldUntil, res.heldUntil)
+			continue
+		case errors.Is(res.err, context.Canceled):
+			continue
+		case res.err == nil:
+			delivered = append(delivered, del.id)
+		default:
+			failedIDs = append(failedIDs, del.id)
+			failedErrs = append(failedErrs, res.err.Error())
+			if del.attempts+1 >= d.cfg.MaxAttempts {
+				dead++
+			}
+		}
+		logIDs = append(logIDs, del.id)
+		logAttempts = append(logAttempts, del.attempts+1)
+		logCodes = append(logCodes, res.statusCode)
+		logErrs = append(logErrs, "")
+		if res.err != nil {
+			logErrs[len(logErrs)-1] = res.err.Error()
+		}
+		logDurations = append(logDurations, float64(res.duration.Microseconds())/1000)
+	}
+
+	tx, err := d.db.Primary().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+	err = execBatch(ctx, tx,
+		batchStmt{"mark webhooks delivered", `
+			UPDATE webhook_deliveries
+			SET status = 'delivered', attempts = attempts + 1, last_error = NULL, delivered_at = NOW()
+			WHERE id = ANY($1)`,
+			[]any{delivered}},
+		batchStmt{"reschedule webhooks", `
+			UPDATE webhook_deliveries w
+			SET attempts = w.attempts + 1,
+				last_error = f.err,
+				status = CASE WHEN w.attempts + 1 >= $3 THEN 'dead' ELSE 'pending' END,
+				next_attempt_at = NOW() + make_interval(secs => LEAST($4 * 2 ^ LEAST(w.attempts, 16), $5))
+			FROM unnest($1::bigint[], $2::text[]) AS f(id, err)
+			WHERE w.id = f.id`,
+			[]any{failedIDs, failedErrs, d.cfg.MaxAttempts, d.cfg.RetryBackoff.Seconds(), d.cfg.MaxBackoff.Seconds()}},
+		batchStmt{"hold webhooks", `
+			UPDATE webhook_deliveries w
+			SET next_attempt_at = f.at
+			FROM unnest($1::bigint[], $2::timestamptz[]) AS f(id, at)
+			WHERE w.id = f.id`,
+			[]any{heldIDs, heldUntil}},
+		batchStmt{"log webhook attempts", `
+			INSERT INTO webhook_attempts(delivery_id, attempt, status_code, error, duration_ms, created_at)
+			SELECT f.id, f.attempt, NULLIF(f.code, 0), NULLIF(f.err, ''), f.ms, NOW()
+			FROM unnest($1::bigint[], $2::int[], $3::int[], $4::text[], $5::float8[])
+				AS f(id, attempt, code, err, ms)
+			-- Not for a delivery whose subscription was deleted meanwhile
+			JOIN webhook_deliveries w ON w.id = f.id`,
+			[]any{logIDs, logAttempts, logCodes, logErrs, logDurations}},
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	webhookDeliveries.WithLabelValues("delivered").Add(float64(len(delivered)))
+	webhookDeliveries.WithLabelValues("retried").Add(float64(len(failedIDs) - dead))
+	webhookDeliveries.WithLabelValues("dead").Add(float64(dead))
+	webhookDeliveries.WithLabelValues("held").Add(float64(len(heldIDs)))
+	return nil
+}
+
+// webhookBreakers is a circuit breaker per subscription, kept by each
+// instance for itself. Threshold consecutive failures open a subscriber's
+// breaker for the cooldown, during which its deliveries aren't leased.
+// Then one delivery is let through as a probe: success closes the
+// breaker, failure opens it for another cooldown.
+type webhookBreakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	state map[string]*webhookBreaker
+}
+
+type webhookBreaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newWebhookBreakers(threshold int, cooldown time.Duration) *webhookBreakers {
+	return &webhookBreakers{threshold: threshold, cooldown: cooldown, state: map[string]*webhookBreaker{}}
+}
+
+// open lists the subscriptions whose breaker is open at now. It is never
+// nil, since ALL over a NULL array matches nothing.
+func (b *webhookBreakers) open(now time.Time) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := []string{}
+	for id, s := range b.state {
+		if s.failures >= b.threshold && now.Before(s.openUntil) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// allow reports whether a delivery to subscription id may be sent at now,
+// claiming the probe once the cooldown is over. A delivery held back is
+// due again at the time returned.
+func (b *webhookBreakers) allow(id string, now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.state[id]
+	switch {
+	case s == nil || s.failures < b.threshold:
+		return true, time.Time{}
+	case now.Before(s.openUntil):
+		return false, s.openUntil
+	case s.probing:
+		// The probe in flight decides; the next pass will know
+		return false, now
+	}
+	s.probing = true
+	return true, time.Time{}
+}
+
+func (b *webhookBreakers) record(id string, ok bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		delete(b.state, id)
+		return
+	}
+	s := b.state[id]
+	if s == nil {
+		s = &webhookBreaker{}
+		b.state[id] = s
+	}
+	s.failures++
+	s.probing = false
+	if s.failures >= b.threshold {
+		s.openUntil = now.Add(b.cooldown)
+		if s.failures == b.threshold {
+			log.Printf("⚠️  Webhook subscription %s failed %d times running; holding its deliveries for %s",
+				id, s.failures, b.cooldown)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loastest-go/config"
+)
+
+func TestWebhookDialControl(t *testing.T) {
+	for _, tt := range []struct {
+		address       string
+		public, local bool // allowed by default, allowed with private IPs
+	}{
+		{"93.184.216.34:443", true, true},
+		{"[2606:2800:220:1::]:443", true, true},
+		{"127.0.0.1:8080", false, true},
+		{"[::1]:8080", false, true},
+		{"10.0.4.2:80", false, true},
+		{"172.16.0.1:80", false, true},
+		{"192.168.1.10:80", false, true},
+		{"[fd12:3456::1]:80", false, true},
+		{"100.64.0.1:80", false, true},
+		{"100.127.255.254:80", false, true},
+		{"[::ffff:100.64.0.1]:80", false, true},
+		{"100.128.0.1:80", true, true},
+		{"[::ffff:127.0.0.1]:80", false, true},
+		{"169.254.169.254:80", false, false},
+		{"[fe80::1]:80", false, false},
+		{"[fd00:ec2::254]:80", false, false},
+		{"100.100.100.200:80", false, false},
+		{"0.0.0.0:80", false, false},
+		{"224.0.0.1:80", false, false},
+		{"localhost:80", false, false},
+	} {
+		for allowPrivate, want := range map[bool]bool{false: tt.public, true: tt.local} {
+			err := webhookDialControl(allowPrivate)("tcp", tt.address, nil)
+			if (err == nil) != want || (err != nil && !errors.Is(err, errWebhookAddress)) {
+				t.Errorf("%s with private IPs allowed %t: err = %v, want allowed %t", tt.address, allowPrivate, err, want)
+			}
+		}
+	}
+}
+
+// webhookCfg is a dispatcher config for posting straight to a test server
+func webhookCfg(allowPrivate bool) config.WebhookConfig {
+	return config.WebhookConfig{
+		Timeout:          time.Second,
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+		AllowPrivateIPs:  allowPrivate,
+	}
+}
+
+func TestWebhookRefusesPrivateSubscribers(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+
+	d := NewWebhookDispatcher(nil, nil, webhookCfg(false))
+	res := d.send(context.Background(), leasedDelivery{subscriptionID: "sub-1", url: srv.URL, body: []byte(`{}`)})
+	if !errors.Is(res.err, errWebhookAddress) || res.statusCode != 0 {
+		t.Errorf("result = %+v, want the loopback address refused", res)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the subscriber was reached %d times", hits.Load())
+	}
+	// A redirect isn't followed anywhere, public or not
+	if d.client.CheckRedirect(nil, nil) != http.ErrUseLastResponse {
+		t.Error("redirects are followed")
+	}
+}
+
+func TestWebhookFlakySubscriber(t *testing.T) {
+	const secret = "sub-secret"
+	body := []byte(`{"type":"ORDER_CREATED","orderId":"o-1"}`)
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		got, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(headerWebhookTimestamp)
+		if r.Header.Get(headerWebhookSignature) != "sha256="+webhookSignature(secret, timestamp, got) {
+			t.Errorf("attempt %s is not signed", r.Header.Get("X-Webhook-Attempt"))
+		}
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	// httptest listens on loopback, which only the opt-in reaches
+	d := NewWebhookDispatcher(nil, nil, webhookCfg(true))
+	ctx := context.Background()
+	del := leasedDelivery{subscriptionID: "sub-1", url: srv.URL, secret: secret, eventID: "1-0", body: body}
+
+	for attempt := range 2 {
+		del.attempts = attempt
+		if res := d.send(ctx, del); res.err == nil || res.statusCode != http.StatusBadGateway {
+			t.Fatalf("attempt %d: result = %+v, want a failed 502", attempt+1, res)
+		}
+	}
+	// Two failures open the breaker, which holds the third back unsent
+	if res := d.send(ctx, del); res.heldUntil.IsZero() || hits.Load() != 2 {
+		t.Fatalf("with the breaker open: result = %+v after %d hits, want it held", res, hits.Load())
+	}
+	if open := d.breakers.open(time.Now()); len(open) != 1 || open[0] != "sub-1" {
+		t.Errorf("open breakers = %v, want sub-1", open)
+	}
+
+	// Once the subscriber recovers, the probe after the cooldown closes it
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	del.attempts = 2
+	if res := d.send(ctx, del); res.err != nil || res.statusCode != http.StatusOK {
+		t.Fatalf("probe: result = %+v, want a 200", res)
+	}
+	if res := d.send(ctx, del); res.err != nil || hits.Load() != 4 {
+		t.Errorf("after the probe: result = %+v after %d hits, want it sent", res, hits.Load())
+	}
+	if open := d.breakers.open(time.Now()); len(open) != 0 {
+		t.Errorf("open breakers = %v, want none", open)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// WebhookAdmin manages webhook subscriptions. A change applies to events
+// queued after it; deliveries already queued keep their body but go to
+// the subscription's current URL, signed with its current secret.
+type WebhookAdmin struct {
+	db *DBRouter
+}
+
+func NewWebhookAdmin(db *DBRouter) *WebhookAdmin {
+	return &WebhookAdmin{db: db}
+}
+
+type WebhookSubscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the deliveries; it is only sent back by the create
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"eventTypes"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// WebhookSubscriptionRequest creates a subscription, or updates the
+// fields it sets. One created without a secret is given a random one.
+type WebhookSubscriptionRequest struct {
+	URL        *string  `json:"url"`
+	Secret     *string  `json:"secret"`
+	EventTypes []string `json:"eventTypes"`
+	Active     *bool    `json:"active"`
+}
+
+func (r WebhookSubscriptionRequest) validate(create bool) error {
+	var errs fieldErrors
+	if r.URL == nil {
+		if create {
+			errs.add("url", "is required")
+		}
+	} else if u, err := url.Parse(*r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add("url", "must be an http or https URL")
+	}
+	if r.Secret != nil && len(*r.Secret) < 16 {
+		errs.add("secret", "must be at least 16 characters")
+	}
+	switch {
+	case r.EventTypes == nil:
+		if create {
+			errs.add("eventTypes", "is required")
+		}
+	case len(r.EventTypes) == 0:
+		errs.add("eventTypes", "must not be empty")
+	default:
+		for _, t := range r.EventTypes {
+			if !slices.Contains(orderEventTypes, t) {
+				errs.add("eventTypes", "must be some of "+strings.Join(orderEventTypes, ", "))
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return ErrValidation.WithDetails(errs)
+	}
+	return nil
+}
+
+const webhookColumns = `id::text, url, event_types, active, created_at, updated_at`
+
+func scanWebhook(row pgx.Row) (WebhookSubscription, error) {
+	var s WebhookSubscription
+	err := row.Scan(&s.ID, &s.URL, &s.EventTypes, &s.Active, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+// List serves GET /v1/admin/webhooks, oldest first
+func (a *WebhookAdmin) List(c *fiber.Ctx) error {
+	rows, err := a.db.Primary().Query(c.UserContext(), `
+		SELECT `+webhookColumns+` FROM webhook_subscriptions ORDER BY created_at, id`)
+	if err != nil {
+		return writeError(c, dbError("load webhooks", err))
+	}
+	defer rows.Close()
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		s, err := scanWebhook(rows)
+		if err != nil {
+			return writeError(c, err)
+		}
+		subs = append(subs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return writeError(c, dbError("load webhooks", err))
+	}
+	return c.JSON(fiber.Map{"webhooks": subs})
+}
+
+// Get serves GET /v1/admin/webhooks/:webhookId
+func (a *WebhookAdmin) Get(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	id := p.PathUUID("webhookId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	s, err := scanWebhook(a.db.Primary().QueryRow(c.UserContext(), `
+		SELECT `+webhookColumns+` FROM webhook_subscriptions WHERE id = $1`, id))
+	if err != nil {
+		return writeError(c, webhookError("load webhook", err))
+	}
+	return c.JSON(s)
+}
+
+// Create serves POST /v1/admin/webhooks
+func (a *WebhookAdmin) Create(c *fiber.Ctx) error {
+	var req WebhookSubscriptionRequest
+	if err := decodeStrict(c.Body(), &req); err != nil {
+		return writeError(c, err)
+	}
+	if err := req.validate(true); err != nil {
+		return writeError(c, err)
+	}
+	secret := ""
+	if req.Secret != nil {
+		secret = *req.Secret
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return writeError(c, err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+	active := req.Active == nil || *req.Active
+
+	s, err := scanWebhook(a.db.Primary().QueryRow(c.UserContext(), `
+		INSERT INTO webhook_subscriptions(url, secret, event_types, active)
+		VALUES($1, $2, $3, $4)
+		RETURNING `+webhookColumns, *req.URL, secret, req.EventTypes, active))
+	if err != nil {
+		return writeError(c, dbError("create webhook", err))
+	}
+	s.Secret = secret
+	return c.Status(fiber.StatusCreated).JSON(s)
+}
+
+// Update serves PATCH /v1/admin/webhooks/:webhookId
+func (a *WebhookAdmin) Update(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	id := p.PathUUID("webhookId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	var req WebhookSubscriptionRequest
+	if err := decodeStrict(c.Body(), &req); err != nil {
+		return writeError(c, err)
+	}
+	if err := req.validate(false); err != nil {
+		return writeError(c, err)
+	}
+
+	s, err := scanWebhook(a.db.Primary().QueryRow(c.UserContext(), `
+		UPDATE webhook_subscriptions
+		SET url = COALESCE($2, url),
+			secret = COALESCE($3, secret),
+			event_types = COALESCE($4, event_types),
+			active = COALESCE($5, active),
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+webhookColumns, id, req.URL, req.Secret, req.EventTypes, req.Active))
+	if err != nil {
+		return writeError(c, webhookError("update webhook", err))
+	}
+	return c.JSON(s)
+}
+
+// Delete serves DELETE /v1/admin/webhooks/:webhookId. Its deliveries go
+// with it, including those not yet sent.
+func (a *WebhookAdmin) Delete(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	id := p.PathUUID("webhookId")
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	tag, err := a.db.Primary().Exec(c.UserContext(), `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return writeError(c, dbError("delete webhook", err))
+	}
+	if tag.RowsAffected() == 0 {
+		return writeError(c, ErrWebhookNotFound)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// webhookError reports a missing subscription as such
+func webhookError(op string, err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrWebhookNotFound
+	}
+	return dbError(op, err)
+}
+
+// WebhookDelivery is one event owed to a subscriber, with every POST of it
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	EventID       string           `json:"eventId"`
+	EventType     string           `json:"eventType"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	LastError     *string          `json:"lastError"`
+	NextAttemptAt time.Time        `json:"nextAttemptAt"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	DeliveredAt   *time.Time       `json:"deliveredAt"`
+	Log           []WebhookAttempt `json:"log"`
+}
+
+// WebhookAttempt is one POST. StatusCode is nil when there was no
+// response; Error says what went wrong, if anything did.
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode *int      `json:"statusCode"`
+	Error      *string   `json:"error"`
+	DurationMs float64   `json:"durationMs"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Deliveries serves GET /v1/admin/webhooks/:webhookId/deliveries: the
+// newest first, optionally only those of one ?status=
+func (a *WebhookAdmin) Deliveries(c *fiber.Ctx) error {
+	p := newQueryParams(c)
+	id := p.PathUUID("webhookId")
+	status := p.OneOf("status", "", "pending", "delivered", "dead")
+	limit := p.Int("limit", 50, 500)
+	if err := p.Err(); err != nil {
+		return writeError(c, err)
+	}
+	ctx := c.UserContext()
+
+	var exists bool
+	err := a.db.Primary().QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM webhook_subscriptions WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return writeError(c, dbError("load webhook", err))
+	}
+	if !exists {
+		return writeError(c, ErrWebhookNotFound)
+	}
+
+	rows, err := a.db.Primary().Query(ctx, `
+		SELECT id, event_id, event_type, status, attempts, last_error, next_attempt_at,
+			created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3`, id, status, limit)
+	if err != nil {
+		return writeError(c, dbError("load webhook deliveries", err))
+	}
+	deliveries := []WebhookDelivery{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.LastError,
+			&d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			rows.Close()
+			return writeError(c, err)
+		}
+		d.Log = []WebhookAttempt{}
+		index[d.ID] = len(deliveries)
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return writeError(c, dbError("load webhook deliveries", err))
+	}
+
+	ids := make([]int64, len(deliveries))
+	for i, d := range deliveries {
+		ids[i] = d.ID
+	}
+	rows, err = a.db.Primary().Query(ctx, `
+		SELECT delivery_id, attempt, status_code, error, duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = ANY($1)
+		ORDER BY id`, ids)
+	if err != nil {
+		return writeError(c, dbError("load webhook attempts", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deliveryID int64
+		var at WebhookAttempt
+		if err := rows.Scan(&deliveryID, &at.Attempt, &at.StatusCode, &at.Error, &at.DurationMs, &at.CreatedAt); err != nil {
+			return writeError(c, err)
+		}
+		d := &deliveries[index[deliveryID]]
+		d.Log = append(d.Log, at)
+	}
+	if err := rows.Err(); err != nil {
+		return writeError(c, dbError("load webhook attempts", err))
+	}
+	return c.JSON(fiber.Map{"deliveries": deliveries})
+}
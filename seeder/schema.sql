@@ -81,18 +81,53 @@ CREATE TABLE IF NOT EXISTS cart_items (
     UNIQUE(cart_id, product_id)
 );
 
+-- Numbers orders ORD-{year}-{nnnnnnnnn}; checkout draws from it in its
+-- transaction, the seeder reserves a block for its orders
+CREATE SEQUENCE IF NOT EXISTS order_number_seq;
+
 -- Orders table
 CREATE TABLE IF NOT EXISTS orders (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    -- Human-readable and sortable, e.g. ORD-2024-000123456; NULL on orders
+    -- placed before numbers were assigned
+    order_number VARCHAR(32),
     user_id UUID NOT NULL REFERENCES users(id),
     status VARCHAR(20) NOT NULL DEFAULT 'pending',
     subtotal DECIMAL(10, 2) NOT NULL DEFAULT 0,
     discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
     tax DECIMAL(10, 2) NOT NULL DEFAULT 0,
     shipping DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    -- standard, express or overnight; existing orders count as standard
+    shipping_method VARCHAR(20) NOT NULL DEFAULT 'standard',
     total DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    -- The rate tax was charged at, from tax_rates; NULL on orders placed
+    -- before rates were recorded
+    tax_rate DECIMAL(5, 4),
+    -- The coupon applied at checkout, so a cancellation can give it back
+    coupon_code VARCHAR(50),
+    -- The checkout's paymentRef, which payment webhooks name the order by;
+    -- NULL on orders placed before it was recorded
+    payment_ref TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(50);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_rate DECIMAL(5, 4);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_method VARCHAR(20) NOT NULL DEFAULT 'standard';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS order_number VARCHAR(32);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_ref TEXT;
+-- The stored parts must add up: no discount beyond the subtotal, no
+-- negative tax, and total = subtotal - discount + tax + shipping. NOT VALID
+-- so an existing database only has new rows checked.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'orders_total_composition') THEN
+        ALTER TABLE orders ADD CONSTRAINT orders_total_composition CHECK (
+            discount >= 0 AND discount <= subtotal AND tax >= 0
+            AND total = subtotal - discount + tax + shipping
+        ) NOT VALID;
+    END IF;
+END
+$$;
 
 -- Order items table
 CREATE TABLE IF NOT EXISTS order_items (
@@ -103,6 +138,116 @@ CREATE TABLE IF NOT EXISTS order_items (
     unit_price DECIMAL(10, 2) NOT NULL
 );
 
+-- Inventory reserved by a pending order, one row per product. The API's
+-- reservation sweeper expires orders whose reservations are past
+-- expires_at and gives back exactly these quantities; fulfilling or
+-- cancelling the order deletes them.
+CREATE TABLE IF NOT EXISTS inventory_reservations (
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id),
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    qty INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (order_id, product_id)
+);
+-- Reservations from before expires_at hold for the sweeper's old default
+-- of 15 minutes
+ALTER TABLE inventory_reservations ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+UPDATE inventory_reservations SET expires_at = created_at + INTERVAL '15 minutes' WHERE expires_at IS NULL;
+ALTER TABLE inventory_reservations ALTER COLUMN expires_at SET NOT NULL;
+
+-- One row per checkout idempotency key (the Idempotency-Key header, or
+-- the paymentRef), written in the checkout's transaction. Replays outlive
+-- the Redis entry through it; request_hash tells a retry from reuse of the
+-- key for a different request.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id),
+    request_hash CHAR(64) NOT NULL,
+    response_json TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Stream entries waiting for the outbox relay, written in the same
+-- transaction as the change they announce. Rows that Redis keeps rejecting
+-- end up 'dead' after OUTBOX_MAX_ATTEMPTS; published rows are not pruned.
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    stream VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    published_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Checkouts answered with an error, recorded by the API when
+-- AUDIT_FAILED_CHECKOUTS is on so failures can be replayed. body is the
+-- request with its paymentRef replaced by payment_ref_hash (SHA-256), cut
+-- at AUDIT_MAX_BODY_BYTES; it is NULL when the body wasn't JSON. Old rows
+-- are deleted by the API after AUDIT_RETENTION.
+CREATE TABLE IF NOT EXISTS checkout_audit (
+    id BIGSERIAL PRIMARY KEY,
+    request_id VARCHAR(64),
+    user_id UUID,
+    status INTEGER NOT NULL,
+    code VARCHAR(50) NOT NULL,
+    message TEXT,
+    payment_ref_hash CHAR(64),
+    body TEXT,
+    body_bytes INTEGER NOT NULL,
+    body_truncated BOOLEAN NOT NULL DEFAULT FALSE,
+    duration_ms DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Subscribers to order events, managed through the admin API. Each gets a
+-- signed POST of every stream:order_events entry whose type is in
+-- event_types, while active.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT[] NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- One event owed to one subscriber. body is the signed JSON, the same on
+-- every attempt. The unique key absorbs an event the outbox published
+-- twice. Rows end up 'delivered', or 'dead' after WEBHOOK_MAX_ATTEMPTS;
+-- neither is pruned.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id UUID NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_id VARCHAR(64) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    body TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (subscription_id, event_id)
+);
+
+-- Every POST of a delivery: the subscriber's status code, or the error
+-- when there was no response
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    error TEXT,
+    duration_ms DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Coupons table
 CREATE TABLE IF NOT EXISTS coupons (
     id SERIAL PRIMARY KEY,
@@ -112,8 +257,15 @@ CREATE TABLE IF NOT EXISTS coupons (
     max_uses INTEGER NOT NULL DEFAULT 0,
     used_count INTEGER NOT NULL DEFAULT 0,
     starts_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    ends_at TIMESTAMP WITH TIME ZONE DEFAULT (NOW() + INTERVAL '1 year')
+    ends_at TIMESTAMP WITH TIME ZONE DEFAULT (NOW() + INTERVAL '1 year'),
+    -- Optional eligibility rules: the order subtotal must reach
+    -- min_order_amount, and a percentage discount only covers products in
+    -- applicable_category_id
+    min_order_amount DECIMAL(10, 2),
+    applicable_category_id UUID REFERENCES categories(id)
 );
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS min_order_amount DECIMAL(10, 2);
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS applicable_category_id UUID REFERENCES categories(id);
 
 -- User coupon usage table
 CREATE TABLE IF NOT EXISTS user_coupon_usage (
@@ -124,6 +276,23 @@ CREATE TABLE IF NOT EXISTS user_coupon_usage (
     UNIQUE(user_id, coupon_id)
 );
 
+-- Segment rules, tried by the API in position order: the first rule whose
+-- plan is the user's, or whose min_spend their lifetime spend exceeds,
+-- names the segment. A rule with neither matches everyone.
+CREATE TABLE IF NOT EXISTS segment_rules (
+    position INTEGER PRIMARY KEY,
+    segment VARCHAR(20) NOT NULL,
+    plan VARCHAR(20),
+    min_spend DECIMAL(12, 2)
+);
+
+-- Tax rate per user region (0.0825 is 8.25%). Checkout charges
+-- TAX_DEFAULT_RATE in a region without a row.
+CREATE TABLE IF NOT EXISTS tax_rates (
+    region VARCHAR(20) PRIMARY KEY,
+    rate DECIMAL(5, 4) NOT NULL CHECK (rate >= 0 AND rate < 1)
+);
+
 -- Events table (audit log)
 CREATE TABLE IF NOT EXISTS events (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -153,15 +322,54 @@ CREATE INDEX IF NOT EXISTS idx_cart_items_product ON cart_items(product_id);
 CREATE INDEX IF NOT EXISTS idx_orders_user ON orders(user_id);
 CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
 CREATE INDEX IF NOT EXISTS idx_orders_created ON orders(created_at);
+-- Order history pages walk this newest-first per user
+CREATE INDEX IF NOT EXISTS idx_orders_user_created ON orders(user_id, created_at DESC, id DESC);
+-- GET /v1/orders/ORD-... looks orders up by number
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_order_number ON orders(order_number);
+-- Payment webhooks find the order by paymentRef. Not unique: once its
+-- idempotency record expires a paymentRef can be checked out again, and a
+-- webhook for a paymentRef on two orders is refused.
+CREATE INDEX IF NOT EXISTS idx_orders_payment_ref ON orders(payment_ref, created_at DESC)
+    WHERE payment_ref IS NOT NULL;
 
 CREATE INDEX IF NOT EXISTS idx_order_items_order ON order_items(order_id);
 CREATE INDEX IF NOT EXISTS idx_order_items_product ON order_items(product_id);
 
+CREATE INDEX IF NOT EXISTS idx_inventory_reservations_created ON inventory_reservations(created_at);
+-- The sweeper looks for expired reservations; the overview can sum the
+-- active ones per product and warehouse
+CREATE INDEX IF NOT EXISTS idx_inventory_reservations_expires ON inventory_reservations(expires_at);
+CREATE INDEX IF NOT EXISTS idx_inventory_reservations_stock ON inventory_reservations(product_id, warehouse_id);
+
+-- The outbox relay only ever looks at pending rows, oldest first
+CREATE INDEX IF NOT EXISTS idx_event_outbox_pending ON event_outbox(id) WHERE status = 'pending';
+
+-- Recent failures, optionally of one code, and the retention cleanup
+CREATE INDEX IF NOT EXISTS idx_checkout_audit_created ON checkout_audit(created_at);
+CREATE INDEX IF NOT EXISTS idx_checkout_audit_code ON checkout_audit(code, id DESC);
+
+-- The delivery worker only ever looks at pending rows that are due; the
+-- admin API lists a subscription's newest deliveries and their attempts
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription ON webhook_deliveries(subscription_id, id DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts(delivery_id);
+
 CREATE INDEX IF NOT EXISTS idx_coupons_code ON coupons(code);
 
 CREATE INDEX IF NOT EXISTS idx_events_user ON events(user_id);
 CREATE INDEX IF NOT EXISTS idx_events_type ON events(type);
 CREATE INDEX IF NOT EXISTS idx_events_created ON events(created_at);
+-- Activity feed pages walk this newest-first per user
+CREATE INDEX IF NOT EXISTS idx_events_user_created ON events(user_id, created_at DESC, id DESC);
+
+-- All-warehouse availability per product, refreshed by the API when
+-- AVAILABILITY_SOURCE=materialized. The unique index is what allows
+-- REFRESH MATERIALIZED VIEW CONCURRENTLY.
+CREATE MATERIALIZED VIEW IF NOT EXISTS product_availability AS
+SELECT product_id, SUM(available_qty - reserved_qty)::int AS available
+FROM inventory
+GROUP BY product_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_availability_product ON product_availability(product_id);
 
 -- Done
 SELECT 'Schema created successfully!' as status;
@@ -4,8 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
-	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"loastest-go/config"
+	"loastest-go/events"
+	"loastest-go/startup"
 )
 
 // Configuration - 1M+ ORDERS, 3M+ ORDER ITEMS
@@ -33,12 +38,14 @@ var (
 	statuses   = []string{"active", "active", "active", "active", "inactive"}
 	orderStats = []string{"pending", "completed", "shipped", "delivered"}
 	eventTypes = []string{
-		"ORDER_CREATED",
-		"ORDER_SHIPPED",
-		"ORDER_DELIVERED",
-		"CART_UPDATED",
-		"COUPON_USED",
+		events.OrderCreated,
+		events.OrderShipped,
+		events.OrderDelivered,
+		events.CartUpdated,
+		events.CouponUsed,
 	}
+	// couponCodes are the codes seedCoupons creates, for COUPON_USED events
+	couponCodes = []string{"WELCOME10", "SAVE20", "FLAT50"}
 
 	categoryIDs = []string{
 		"aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa",
@@ -53,6 +60,14 @@ var (
 		"33333333-3333-3333-3333-333333333333",
 		"44444444-4444-4444-4444-444444444444",
 	}
+
+	// taxRates is what each region is charged at checkout
+	taxRates = map[string]float64{
+		"us-east":      0.0800,
+		"us-west":      0.0725,
+		"eu-west":      0.2000,
+		"ap-southeast": 0.0700,
+	}
 )
 
 var totalInserted int64
@@ -60,8 +75,11 @@ var totalInserted int64
 func main() {
 	start := time.Now()
 
-	dbURL := buildDBURL()
-	pool := connectDB(dbURL)
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration:\n%v", err)
+	}
+	pool := connectDB(cfg)
 	defer pool.Close()
 
 	log.Println("🚀 Starting data population...")
@@ -77,11 +95,14 @@ func main() {
 	productIDs := seedProducts(pool)
 	seedInventory(pool, productIDs)
 	seedCoupons(pool)
+	seedSegmentRules(pool, cfg.Segment.Rules())
+	seedTaxRates(pool)
 	cartIDs := seedCarts(pool, userIDs)
 	seedCartItems(pool, cartIDs, productIDs)
 	orderIDs := seedOrders(pool, userIDs)
 	seedOrderItems(pool, orderIDs, productIDs)
-	seedEvents(pool, userIDs)
+	seedReservations(pool)
+	seedEvents(pool, userIDs, orderIDs, cartIDs, productIDs)
 
 	cancel()
 
@@ -89,26 +110,20 @@ func main() {
 	printSummary(pool, elapsed)
 }
 
-func buildDBURL() string {
-	if url := os.Getenv("DATABASE_URL"); url != "" {
-		return url
+func connectDB(cfg *config.Config) *pgxpool.Pool {
+	poolConfig, err := cfg.PoolConfig()
+	if err != nil {
+		log.Fatalf("❌ Invalid database configuration: %v", err)
 	}
-	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?pool_max_conns=30",
-		getEnvKey("DB_USER", "postgres"),
-		getEnvKey("DB_PASSWORD", "postgres"),
-		getEnvKey("DB_HOST", "localhost"),
-		getEnvKey("DB_PORT", "5434"),
-		getEnvKey("DB_NAME", "loadtest"))
-}
-
-func connectDB(dbURL string) *pgxpool.Pool {
-	config, _ := pgxpool.ParseConfig(dbURL)
-	config.MaxConns = 30
-	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		log.Fatalf("❌ DB connection failed: %v", err)
 	}
+	if err := startup.Wait(context.Background(), cfg.Startup, "PostgreSQL", pool.Ping); err != nil {
+		log.Fatalf("❌ DB connection failed: %v", err)
+	}
 	log.Println("✅ Database connected")
+	log.Printf("   pool: %s", config.DescribePool(poolConfig))
 	return pool
 }
 
@@ -130,7 +145,7 @@ func progressReporter(ctx context.Context) {
 }
 
 func seedUsers(pool *pgxpool.Pool) []string {
-	log.Println("📦 [1/9] Creating users...")
+	log.Println("📦 [1/12] Creating users...")
 	userIDs := make([]string, TOTAL_USERS)
 	for i := range userIDs {
 		userIDs[i] = uuid.New().String()
@@ -160,7 +175,7 @@ func seedUsers(pool *pgxpool.Pool) []string {
 }
 
 func seedProducts(pool *pgxpool.Pool) []string {
-	log.Println("📦 [2/9] Creating products...")
+	log.Println("📦 [2/12] Creating products...")
 	productIDs := make([]string, TOTAL_PRODUCTS)
 	rows := make([][]interface{}, 0, TOTAL_PRODUCTS)
 
@@ -187,7 +202,7 @@ func seedProducts(pool *pgxpool.Pool) []string {
 }
 
 func seedInventory(pool *pgxpool.Pool, productIDs []string) {
-	log.Println("📦 [3/9] Creating inventory...")
+	log.Println("📦 [3/12] Creating inventory...")
 	rows := make([][]interface{}, 0, len(productIDs)*4)
 
 	for _, pid := range productIDs {
@@ -218,7 +233,9 @@ func seedInventory(pool *pgxpool.Pool, productIDs []string) {
 }
 
 func seedCoupons(pool *pgxpool.Pool) {
-	log.Println("📦 [4/9] Creating coupons...")
+	log.Println("📦 [4/12] Creating coupons...")
+	// The last two columns are min_order_amount and applicable_category_id;
+	// nil leaves a coupon unrestricted
 	rows := [][]interface{}{
 		{
 			"WELCOME10",
@@ -228,6 +245,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 			0,
 			time.Now(),
 			time.Now().AddDate(1, 0, 0),
+			nil,
+			nil,
 		},
 		{
 			"SAVE20",
@@ -237,6 +256,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 			0,
 			time.Now(),
 			time.Now().AddDate(0, 6, 0),
+			100.0,
+			nil,
 		},
 		{
 			"FLAT50",
@@ -246,6 +267,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 			0,
 			time.Now(),
 			time.Now().AddDate(0, 3, 0),
+			200.0,
+			nil,
 		},
 		{
 			"SUMMER25",
@@ -255,6 +278,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 			0,
 			time.Now(),
 			time.Now().AddDate(0, 2, 0),
+			nil,
+			categoryIDs[0],
 		},
 		{
 			"VIP30",
@@ -264,6 +289,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 			0,
 			time.Now(),
 			time.Now().AddDate(1, 0, 0),
+			150.0,
+			categoryIDs[1],
 		},
 	}
 
@@ -272,6 +299,14 @@ func seedCoupons(pool *pgxpool.Pool) {
 		if rand.Intn(3) == 0 {
 			t, v = "fixed", 10.0+rand.Float64()*90.0
 		}
+		// About a third need a minimum order, a quarter one category
+		var minOrder, category interface{}
+		if rand.Intn(3) == 0 {
+			minOrder = float64(25 * (1 + rand.Intn(8)))
+		}
+		if rand.Intn(4) == 0 {
+			category = categoryIDs[rand.Intn(len(categoryIDs))]
+		}
 		rows = append(
 			rows,
 			[]interface{}{
@@ -282,6 +317,8 @@ func seedCoupons(pool *pgxpool.Pool) {
 				0,
 				time.Now(),
 				time.Now().AddDate(1, 0, 0),
+				minOrder,
+				category,
 			},
 		)
 	}
@@ -297,15 +334,52 @@ func seedCoupons(pool *pgxpool.Pool) {
 			"used_count",
 			"starts_at",
 			"ends_at",
+			"min_order_amount",
+			"applicable_category_id",
 		},
 		rows,
 	)
 	atomic.AddInt64(&totalInserted, count)
-	log.Println("✅ Created coupons\n")
+	log.Print("✅ Created coupons\n\n")
+}
+
+// seedSegmentRules writes the SEGMENT_* thresholds as rules, so the table
+// starts out matching what the API falls back to
+func seedSegmentRules(pool *pgxpool.Pool, rules []config.SegmentRule) {
+	log.Println("📦 [5/12] Creating segment rules...")
+	rows := make([][]interface{}, 0, len(rules))
+	for i, rule := range rules {
+		var plan interface{}
+		if rule.Plan != "" {
+			plan = rule.Plan
+		}
+		rows = append(rows, []interface{}{i + 1, rule.Segment, plan, rule.MinSpend})
+	}
+
+	count := copyRows(
+		pool,
+		"segment_rules",
+		[]string{"position", "segment", "plan", "min_spend"},
+		rows,
+	)
+	atomic.AddInt64(&totalInserted, count)
+	log.Print("✅ Created segment rules\n\n")
+}
+
+func seedTaxRates(pool *pgxpool.Pool) {
+	log.Println("📦 [6/12] Creating tax rates...")
+	rows := make([][]interface{}, 0, len(taxRates))
+	for _, region := range regions {
+		rows = append(rows, []interface{}{region, taxRates[region]})
+	}
+
+	count := copyRows(pool, "tax_rates", []string{"region", "rate"}, rows)
+	atomic.AddInt64(&totalInserted, count)
+	log.Print("✅ Created tax rates\n\n")
 }
 
 func seedCarts(pool *pgxpool.Pool, userIDs []string) []string {
-	log.Println("📦 [5/9] Creating carts...")
+	log.Println("📦 [7/12] Creating carts...")
 	cartIDs := make([]string, TOTAL_CARTS)
 	rows := make([][]interface{}, 0, TOTAL_CARTS)
 
@@ -331,7 +405,7 @@ func seedCarts(pool *pgxpool.Pool, userIDs []string) []string {
 }
 
 func seedCartItems(pool *pgxpool.Pool, cartIDs []string, productIDs []string) {
-	log.Println("📦 [6/9] Creating cart items...")
+	log.Println("📦 [8/12] Creating cart items...")
 	var totalItems int64
 
 	parallelInsert(pool, len(cartIDs), func(start, end int) int64 {
@@ -372,29 +446,38 @@ func seedCartItems(pool *pgxpool.Pool, cartIDs []string, productIDs []string) {
 }
 
 func seedOrders(pool *pgxpool.Pool, userIDs []string) []string {
-	log.Println("📦 [7/9] Creating 1M orders...")
+	log.Println("📦 [9/12] Creating 1M orders...")
 	orderIDs := make([]string, TOTAL_ORDERS)
+	placedAt := make([]time.Time, TOTAL_ORDERS)
 	for i := range orderIDs {
 		orderIDs[i] = uuid.New().String()
+		placedAt[i] = randomTime(365)
 	}
+	// Numbered oldest first, like orders placed through checkout, from a
+	// block of order_number_seq reserved for them
+	slices.SortFunc(placedAt, time.Time.Compare)
+	firstNumber := reserveOrderNumbers(pool, TOTAL_ORDERS)
 
 	parallelInsert(pool, TOTAL_ORDERS, func(start, end int) int64 {
 		rows := make([][]interface{}, 0, end-start)
 		for i := start; i < end; i++ {
-			subtotal := 50.0 + rand.Float64()*1000.0
-			discount := rand.Float64() * 50.0
-			tax := subtotal * 0.08
+			// Rounded to the cent so the stored parts add up to the total
+			// (orders_total_composition)
+			subtotal := cents(50.0 + rand.Float64()*1000.0)
+			discount := cents(rand.Float64() * 50.0)
+			tax := cents(subtotal * 0.08)
 			shipping := 0.0
 			if subtotal < 100 {
 				shipping = 9.99
 			}
 			rows = append(rows, []interface{}{
 				orderIDs[i],
+				orderNumber(placedAt[i], firstNumber+int64(i)),
 				userIDs[rand.Intn(len(userIDs))],
 				orderStats[rand.Intn(4)],
 				subtotal, discount, tax, shipping,
-				subtotal - discount + tax + shipping,
-				randomTime(365),
+				cents(subtotal - discount + tax + shipping),
+				placedAt[i],
 			})
 		}
 		return copyRows(
@@ -402,6 +485,7 @@ func seedOrders(pool *pgxpool.Pool, userIDs []string) []string {
 			"orders",
 			[]string{
 				"id",
+				"order_number",
 				"user_id",
 				"status",
 				"subtotal",
@@ -419,12 +503,31 @@ func seedOrders(pool *pgxpool.Pool, userIDs []string) []string {
 	return orderIDs
 }
 
+// reserveOrderNumbers takes n numbers from order_number_seq and returns
+// the first, so seeded orders never collide with checkout's or an earlier
+// run's
+func reserveOrderNumbers(pool *pgxpool.Pool, n int) int64 {
+	var first int64
+	err := pool.QueryRow(context.Background(),
+		`SELECT setval('order_number_seq', nextval('order_number_seq') + $1 - 1) - $1 + 1`,
+		n).Scan(&first)
+	if err != nil {
+		log.Fatalf("❌ Reserving order numbers failed: %v", err)
+	}
+	return first
+}
+
+// orderNumber matches the API's ORD-{year}-{nnnnnnnnn} numbers
+func orderNumber(placed time.Time, seq int64) string {
+	return fmt.Sprintf("ORD-%d-%09d", placed.UTC().Year(), seq)
+}
+
 func seedOrderItems(
 	pool *pgxpool.Pool,
 	orderIDs []string,
 	productIDs []string,
 ) {
-	log.Println("📦 [8/9] Creating 3M+ order items...")
+	log.Println("📦 [10/12] Creating 3M+ order items...")
 
 	parallelInsert(pool, len(orderIDs), func(start, end int) int64 {
 		rows := make([][]interface{}, 0, (end-start)*4)
@@ -448,24 +551,62 @@ func seedOrderItems(
 		)
 	})
 
-	log.Println("✅ Created order items\n")
+	log.Print("✅ Created order items\n\n")
 }
 
-func seedEvents(pool *pgxpool.Pool, userIDs []string) {
-	log.Println("📦 [9/9] Creating events...")
+// seedReservations reserves stock for the pending orders placed in the
+// last day, from the warehouse serving each user's region as checkout
+// does, and adds it to reserved_qty. They expire over the next 15 minutes,
+// so a fresh database gives the API's reservation sweeper work.
+func seedReservations(pool *pgxpool.Pool) {
+	log.Println("📦 [11/12] Creating inventory reservations...")
+	var count int64
+	err := pool.QueryRow(context.Background(), `
+		WITH reserved AS (
+			INSERT INTO inventory_reservations(order_id, product_id, warehouse_id, qty, created_at, expires_at)
+			SELECT o.id, oi.product_id, w.id, SUM(oi.qty), o.created_at,
+				NOW() + random() * INTERVAL '15 minutes'
+			FROM orders o
+			JOIN users u ON u.id = o.user_id
+			JOIN warehouses w ON w.region = u.region
+			JOIN order_items oi ON oi.order_id = o.id
+			WHERE o.status = 'pending' AND o.created_at > NOW() - INTERVAL '1 day'
+			GROUP BY o.id, oi.product_id, w.id
+			ON CONFLICT DO NOTHING
+			RETURNING product_id, warehouse_id, qty
+		), bumped AS (
+			UPDATE inventory i
+			SET reserved_qty = i.reserved_qty + t.qty, updated_at = NOW()
+			FROM (
+				SELECT product_id, warehouse_id, SUM(qty)::int AS qty
+				FROM reserved GROUP BY product_id, warehouse_id
+			) t
+			WHERE i.product_id = t.product_id AND i.warehouse_id = t.warehouse_id
+		)
+		SELECT COUNT(*) FROM reserved`).Scan(&count)
+	if err != nil {
+		log.Fatalf("❌ Creating inventory reservations failed: %v", err)
+	}
+	atomic.AddInt64(&totalInserted, count)
+	log.Printf("✅ Created %d inventory reservations\n\n", count)
+}
+
+func seedEvents(pool *pgxpool.Pool, userIDs, orderIDs, cartIDs, productIDs []string) {
+	log.Println("📦 [12/12] Creating events...")
 
 	parallelInsert(pool, TOTAL_EVENTS, func(start, end int) int64 {
 		rows := make([][]interface{}, 0, end-start)
 		for i := start; i < end; i++ {
+			eventType := eventTypes[rand.Intn(len(eventTypes))]
+			payload, err := events.Marshal(eventPayload(eventType, orderIDs, cartIDs, productIDs))
+			if err != nil {
+				log.Fatalf("❌ Building %s payload failed: %v", eventType, err)
+			}
 			rows = append(rows, []interface{}{
 				uuid.New().String(),
 				userIDs[rand.Intn(len(userIDs))],
-				eventTypes[rand.Intn(5)],
-				fmt.Sprintf(
-					`{"action":"event_%d","value":%d}`,
-					i,
-					rand.Intn(1000),
-				),
+				eventType,
+				payload,
 				randomTime(90),
 			})
 		}
@@ -480,6 +621,31 @@ func seedEvents(pool *pgxpool.Pool, userIDs []string) {
 	log.Printf("✅ Created %d events\n\n", TOTAL_EVENTS)
 }
 
+// eventPayload makes a plausible payload for eventType, pointing at seeded
+// orders, carts and products
+func eventPayload(eventType string, orderIDs, cartIDs, productIDs []string) events.Payload {
+	orderID := orderIDs[rand.Intn(len(orderIDs))]
+	switch eventType {
+	case events.OrderCreated:
+		return &events.OrderCreatedPayload{OrderID: orderID, Total: cents(50.0 + rand.Float64()*1000.0)}
+	case events.OrderShipped:
+		return &events.OrderShippedPayload{OrderID: orderID, ShippedUnits: 1 + rand.Intn(5)}
+	case events.OrderDelivered:
+		return &events.OrderDeliveredPayload{OrderID: orderID}
+	case events.CartUpdated:
+		return &events.CartUpdatedPayload{
+			CartID:    cartIDs[rand.Intn(len(cartIDs))],
+			ProductID: productIDs[rand.Intn(len(productIDs))],
+			Qty:       1 + rand.Intn(5),
+		}
+	default:
+		return &events.CouponUsedPayload{
+			Code:     couponCodes[rand.Intn(len(couponCodes))],
+			Discount: cents(rand.Float64() * 50.0),
+		}
+	}
+}
+
 // ============ HELPERS ============
 
 func parallelInsert(
@@ -546,27 +712,33 @@ func printSummary(pool *pgxpool.Pool, elapsed time.Duration) {
 		"cart_items",
 		"orders",
 		"order_items",
+		"inventory_reservations",
+		"idempotency_keys",
+		"event_outbox",
+		"checkout_audit",
+		"webhook_subscriptions",
+		"webhook_deliveries",
+		"webhook_attempts",
 		"coupons",
+		"segment_rules",
+		"tax_rates",
 		"events",
 	}
 	var sum int64
 	for _, t := range tables {
 		var c int64
 		pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+t).Scan(&c)
-		log.Printf("  %-15s %12d", t, c)
+		log.Printf("  %-22s %12d", t, c)
 		sum += c
 	}
 	log.Println("----------------------------------------")
-	log.Printf("  %-15s %12d (%.2fM)\n", "TOTAL", sum, float64(sum)/1_000_000)
+	log.Printf("  %-22s %12d (%.2fM)\n", "TOTAL", sum, float64(sum)/1_000_000)
 }
 
-func randomTime(maxDays int) time.Time {
-	return time.Now().Add(-time.Duration(rand.Intn(maxDays)) * 24 * time.Hour)
+func cents(v float64) float64 {
+	return math.Round(v*100) / 100
 }
 
-func getEnvKey(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
-	}
-	return d
+func randomTime(maxDays int) time.Time {
+	return time.Now().Add(-time.Duration(rand.Intn(maxDays)) * 24 * time.Hour)
 }
@@ -4,7 +4,9 @@ import {
   Body,
   HttpException,
   HttpStatus,
+  Res,
 } from '@nestjs/common';
+import { Response } from 'express';
 import { CheckoutService } from './checkout.service';
 import { CheckoutDto } from './checkout.dto';
 
@@ -13,13 +15,18 @@ export class CheckoutController {
   constructor(private readonly service: CheckoutService) {}
 
   @Post('checkout')
-  async checkout(@Body() dto: CheckoutDto) {
+  async checkout(
+    @Body() dto: CheckoutDto,
+    @Res({ passthrough: true }) res: Response,
+  ) {
+    const headers: Record<string, string> = {};
     try {
-      return await this.service.checkout(dto);
+      return await this.service.checkout(dto, headers);
     } catch (error) {
       const statusMap: Record<string, HttpStatus> = {
         'Rate limit exceeded': HttpStatus.TOO_MANY_REQUESTS,
-        'Checkout in progress': HttpStatus.CONFLICT,
+        'Cart checkout in progress': HttpStatus.CONFLICT,
+        'User checkout in progress': HttpStatus.CONFLICT,
         'Cart not found or not open': HttpStatus.BAD_REQUEST,
         'Cart is empty': HttpStatus.BAD_REQUEST,
         'Invalid or expired coupon': HttpStatus.BAD_REQUEST,
@@ -30,6 +37,9 @@ export class CheckoutController {
       const status =
         statusMap[error.message] || HttpStatus.INTERNAL_SERVER_ERROR;
       throw new HttpException(error.message, status);
+    } finally {
+      // Set before the exception filter writes an error response too
+      res.set(headers);
     }
   }
 }
@@ -4,6 +4,7 @@ import {
   IsOptional,
   ValidateNested,
   IsInt,
+  IsIn,
   Min,
 } from 'class-validator';
 import { Type } from 'class-transformer';
@@ -35,4 +36,8 @@ export class CheckoutDto {
 
   @IsString()
   paymentRef: string;
+
+  @IsOptional()
+  @IsIn(['standard', 'express', 'overnight'])
+  shippingMethod?: 'standard' | 'express' | 'overnight';
 }
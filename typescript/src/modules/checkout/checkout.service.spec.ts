@@ -0,0 +1,110 @@
+import { CheckoutService } from './checkout.service';
+import { CheckoutDto } from './checkout.dto';
+
+// fakeRedis keeps just enough of ioredis in a Map for the checkout's
+// idempotency, rate-limit and lock calls
+function fakeRedis() {
+  const data = new Map<string, string>();
+  return {
+    data,
+    get: async (key: string) => data.get(key) ?? null,
+    incr: async (key: string) => {
+      const n = Number(data.get(key) ?? 0) + 1;
+      data.set(key, String(n));
+      return n;
+    },
+    expire: async () => 1,
+    set: async (key: string, value: string, ...args: unknown[]) => {
+      if (args.includes('NX') && data.has(key)) {
+        return null;
+      }
+      data.set(key, value);
+      return 'OK';
+    },
+    setex: async (key: string, _ttl: number, value: string) => {
+      data.set(key, value);
+      return 'OK';
+    },
+    del: async (...keys: string[]) => {
+      keys.forEach((key) => data.delete(key));
+      return keys.length;
+    },
+  };
+}
+
+describe('CheckoutService rate-limit headers', () => {
+  // 12:00:00 UTC, the start of a minute's window
+  const minute = Date.UTC(2024, 0, 1, 12, 0, 0);
+  let service: CheckoutService;
+  let now: number;
+
+  beforeEach(() => {
+    service = new CheckoutService(null, fakeRedis() as any);
+    // The transaction is not what's under test
+    jest
+      .spyOn(service as any, 'executeCheckoutTransaction')
+      .mockResolvedValue({ orderId: 'order-1' });
+    now = minute;
+    jest.spyOn(Date, 'now').mockImplementation(() => now);
+  });
+
+  afterEach(() => jest.restoreAllMocks());
+
+  let attempt = 0;
+  const checkout = async () => {
+    const headers: Record<string, string> = {};
+    const dto = {
+      userId: 'user-1',
+      cartId: 'cart-1',
+      paymentRef: `pay-${++attempt}`,
+      items: [],
+    } as CheckoutDto;
+    try {
+      await service.checkout(dto, headers);
+      return { ok: true, headers };
+    } catch (error) {
+      return { ok: false, error: error.message, headers };
+    }
+  };
+
+  it('counts down the remaining quota on allowed checkouts', async () => {
+    now = minute + 15_000;
+    const first = await checkout();
+    expect(first.ok).toBe(true);
+    expect(first.headers).toEqual({
+      'X-RateLimit-Limit': '10',
+      'X-RateLimit-Remaining': '9',
+      'X-RateLimit-Reset': '45',
+    });
+    for (let i = 0; i < 8; i++) {
+      await checkout();
+    }
+    const last = await checkout();
+    expect(last.ok).toBe(true);
+    expect(last.headers['X-RateLimit-Remaining']).toBe('0');
+    expect(last.headers['Retry-After']).toBeUndefined();
+  });
+
+  it('sends Retry-After on a 429 until the window resets', async () => {
+    now = minute + 59_500;
+    for (let i = 0; i < 10; i++) {
+      await checkout();
+    }
+    const limited = await checkout();
+    expect(limited.ok).toBe(false);
+    expect(limited.error).toBe('Rate limit exceeded');
+    expect(limited.headers).toEqual({
+      'X-RateLimit-Limit': '10',
+      'X-RateLimit-Remaining': '0',
+      'X-RateLimit-Reset': '1',
+      'Retry-After': '1',
+    });
+
+    // Across the boundary the new window starts a new count
+    now = minute + 60_000;
+    const next = await checkout();
+    expect(next.ok).toBe(true);
+    expect(next.headers['X-RateLimit-Remaining']).toBe('9');
+    expect(next.headers['X-RateLimit-Reset']).toBe('60');
+  });
+});
@@ -23,6 +23,17 @@ interface Coupon {
 
 @Injectable()
 export class CheckoutService {
+  // Base covers the first unit, perItem each unit after it, whichever
+  // lines they're on; only standard ships free, on a subtotal over freeOver
+  private readonly shippingTiers: Record<
+    string,
+    { base: number; perItem: number; freeOver?: number }
+  > = {
+    standard: { base: 599, perItem: 99, freeOver: 10000 },
+    express: { base: 1499, perItem: 199 },
+    overnight: { base: 2999, perItem: 399 },
+  };
+
   private readonly warehouseByRegion: Record<string, string> = {
     'us-east': '11111111-1111-1111-1111-111111111111',
     'us-west': '22222222-2222-2222-2222-222222222222',
@@ -35,8 +46,16 @@ export class CheckoutService {
     @Inject('REDIS') private readonly redis: Redis,
   ) {}
 
-  async checkout(dto: CheckoutDto) {
-    const { userId, cartId, coupon: couponCode, paymentRef } = dto;
+  // headers collects the rate-limit headers for the response, whether the
+  // checkout succeeds or not
+  async checkout(dto: CheckoutDto, headers: Record<string, string> = {}) {
+    const {
+      userId,
+      cartId,
+      coupon: couponCode,
+      paymentRef,
+      shippingMethod = 'standard',
+    } = dto;
     const idempotencyKey = `idem:checkout:${paymentRef}`;
 
     // 0) Idempotency check (Redis)
@@ -45,30 +64,60 @@ export class CheckoutService {
       return JSON.parse(existing);
     }
 
-    // 1) Rate limit (Redis)
-    const currentMinute = Math.floor(Date.now() / 60000);
+    // 1) Rate limit (Redis): 10 per minute, in a fixed window that
+    // resets on the minute. The headers match the Go service's.
+    const now = Date.now();
+    const currentMinute = Math.floor(now / 60000);
     const rlKey = `rl:user:${userId}:checkout:${currentMinute}`;
     const count = await this.redis.incr(rlKey);
     if (count === 1) {
       await this.redis.expire(rlKey, 90);
     }
+    const resetSeconds = Math.ceil(((currentMinute + 1) * 60000 - now) / 1000);
+    headers['X-RateLimit-Limit'] = '10';
+    headers['X-RateLimit-Remaining'] = String(Math.max(10 - count, 0));
+    headers['X-RateLimit-Reset'] = String(resetSeconds);
     if (count > 10) {
+      headers['Retry-After'] = String(Math.max(resetSeconds, 1));
       throw new Error('Rate limit exceeded');
     }
 
-    // 2) Distributed lock (Redis)
-    const lockKey = `lock:checkout:${userId}`;
-
-    const locked = await this.redis.set(lockKey, '1', 'PX', 5000, 'NX');
-
-    if (!locked) {
-      throw new Error('Checkout in progress');
+    // 2) Distributed locks (Redis): the cart's, and the user's too with
+    // CHECKOUT_LOCK_PER_USER, on the same keys as the Go service. The cart
+    // row lock in the transaction is what guarantees a cart is ordered once.
+    const lockKeys = [`lock:checkout:cart:${cartId}`];
+    const cartLocked = await this.redis.set(
+      lockKeys[0],
+      '1',
+      'PX',
+      5000,
+      'NX',
+    );
+    if (!cartLocked) {
+      throw new Error('Cart checkout in progress');
+    }
+    if (process.env.CHECKOUT_LOCK_PER_USER === 'true') {
+      const userLockKey = `lock:checkout:${userId}`;
+      const userLocked = await this.redis.set(
+        userLockKey,
+        '1',
+        'PX',
+        5000,
+        'NX',
+      );
+      if (!userLocked) {
+        await this.redis.del(...lockKeys);
+        throw new Error('User checkout in progress');
+      }
+      lockKeys.push(userLockKey);
     }
 
     try {
       const result = await this.executeCheckoutTransaction(
         userId,
         cartId,
+        paymentRef,
+        shippingMethod,
         couponCode,
       );
 
@@ -77,13 +126,15 @@ export class CheckoutService {
 
       return result;
     } finally {
-      await this.redis.del(lockKey);
+      await this.redis.del(...lockKeys);
     }
   }
 
   private async executeCheckoutTransaction(
     userId: string,
     cartId: string,
+    paymentRef: string,
+    shippingMethod: string,
     couponCode?: string,
   ) {
     const client = await this.db.connect();
@@ -117,9 +168,9 @@ export class CheckoutService {
       const cartItems = itemsResult.rows;
 
       // 3.3) Coupon validation + usage lock
-      let discount = 0;
+      let couponDiscount = 0;
       if (couponCode) {
-        discount = await this.processCoupon(
+        couponDiscount = await this.processCoupon(
           client,
           userId,
           couponCode,
@@ -128,17 +179,35 @@ export class CheckoutService {
       }
 
       // 3.4) Inventory reservation (lock rows)
-      const warehouseId = await this.getWarehouseForUser(client, userId);
+      const { warehouseId, taxRate } = await this.getUserRegion(
+        client,
+        userId,
+      );
       await this.reserveInventory(client, cartItems, warehouseId);
 
-      // 3.5) Compute totals
-      const subtotal = cartItems.reduce(
-        (sum, item) => sum + item.qty * Number(item.unit_price),
-        0,
+      // 3.5) Compute totals in integer cents, so the row satisfies
+      // orders_total_composition and matches the Go service to the cent
+      const subtotalCents = this.subtotalCents(cartItems);
+      const discountCents = Math.min(
+        Math.max(couponDiscount, 0),
+        subtotalCents,
+      );
+      const taxCents = this.computeTax(
+        subtotalCents - discountCents,
+        taxRate,
+      );
+      const shippingCents = this.computeShipping(
+        shippingMethod,
+        subtotalCents,
+        cartItems.reduce((units, item) => units + item.qty, 0),
       );
-      const tax = this.computeTax(subtotal - discount);
-      const shipping = this.computeShipping(subtotal, cartItems.length);
-      const total = Math.max(0, subtotal - discount + tax + shipping);
+      const totalCents =
+        subtotalCents - discountCents + taxCents + shippingCents;
+      const subtotal = subtotalCents / 100;
+      const discount = discountCents / 100;
+      const tax = taxCents / 100;
+      const shipping = shippingCents / 100;
+      const total = totalCents / 100;
 
       // 3.6) Create order + items
       const orderId = await this.createOrder(
@@ -147,10 +216,14 @@ export class CheckoutService {
         subtotal,
         discount,
         tax,
+        taxRate / 10000,
         shipping,
+        shippingMethod,
         total,
+        paymentRef,
       );
       await this.createOrderItems(client, orderId, cartItems);
+      await this.recordReservations(client, orderId, cartItems, warehouseId);
 
       // 3.7) Mark cart closed
       await client.query(
@@ -158,11 +231,16 @@ export class CheckoutService {
         [cartId],
       );
 
-      // 3.8) Event log
+      // 3.8) Event log, in the shape of the Go service's
+      // events.OrderCreatedPayload
       await client.query(
-        `INSERT INTO events(user_id, type, payload_json, created_at)
-         VALUES($1, 'ORDER_CREATED', $2, NOW())`,
-        [userId, JSON.stringify({ orderId, total, cartId })],
+        `INSERT INTO events(id, user_id, type, payload_json, created_at)
+         VALUES($1, $2, 'ORDER_CREATED', $3, NOW())`,
+        [
+          uuidv4(),
+          userId,
+          JSON.stringify({ schema_version: 1, orderId, total, cartId }),
+        ],
       );
 
       await client.query('COMMIT');
@@ -196,8 +274,10 @@ export class CheckoutService {
     }
 
     const coupon = couponResult.rows[0];
-    const now = new Date();
-    if (now < coupon.starts_at || now > coupon.ends_at) {
+    // ends_at is inclusive to the second, as in the Go service
+    const now = Date.now();
+    const endsAfter = Math.floor(coupon.ends_at.getTime() / 1000) * 1000 + 1000;
+    if (now < coupon.starts_at.getTime() || now >= endsAfter) {
       throw new Error('Invalid or expired coupon');
     }
     if (coupon.max_uses && coupon.used_count >= coupon.max_uses) {
@@ -228,27 +308,40 @@ export class CheckoutService {
       [couponCode],
     );
 
-    // Compute discount
-    const subtotal = cartItems.reduce(
-      (sum, item) => sum + item.qty * Number(item.unit_price),
-      0,
-    );
+    // Compute discount, in cents. A percentage value is in hundredths of
+    // a percent once scaled, so 15.00 becomes 1500 out of 10000.
+    const subtotal = this.subtotalCents(cartItems);
     if (coupon.type === 'percentage') {
-      return subtotal * (Number(coupon.value) / 100);
+      return Math.round((subtotal * this.toCents(coupon.value)) / 10000);
     }
-    return Number(coupon.value);
+    // A fixed amount never takes the order below zero
+    return Math.min(this.toCents(coupon.value), subtotal);
   }
 
-  private async getWarehouseForUser(
+  // The user's region picks the warehouse and the tax rate, in
+  // ten-thousandths (800 is 8%); a region without a tax_rates row is
+  // charged TAX_DEFAULT_RATE, 0.08 unless set
+  private async getUserRegion(
     client: PoolClient,
     userId: string,
-  ): Promise<string> {
-    const result = await client.query<{ region: string }>(
-      `SELECT region FROM users WHERE id = $1`,
-      [userId],
+  ): Promise<{ warehouseId: string; taxRate: number }> {
+    const region =
+      (
+        await client.query<{ region: string }>(
+          `SELECT region FROM users WHERE id = $1`,
+          [userId],
+        )
+      ).rows[0]?.region || 'us-east';
+    const rateResult = await client.query<{ rate: string }>(
+      `SELECT rate FROM tax_rates WHERE region = $1`,
+      [region],
     );
-    const region = result.rows[0]?.region || 'us-east';
-    return this.warehouseByRegion[region] || this.warehouseByRegion['us-east'];
+    const rate = rateResult.rows[0]?.rate ?? process.env.TAX_DEFAULT_RATE;
+    return {
+      warehouseId:
+        this.warehouseByRegion[region] || this.warehouseByRegion['us-east'],
+      taxRate: Math.round(Number(rate ?? 0.08) * 10000),
+    };
   }
 
   private async reserveInventory(
@@ -287,13 +380,32 @@ export class CheckoutService {
     }
   }
 
-  private computeTax(amount: number): number {
-    return Math.round(amount * 0.08 * 100) / 100;
+  // Money below is in integer cents; only createOrder and the response
+  // see dollars
+  private toCents(amount: string | number): number {
+    return Math.round(Number(amount) * 100);
+  }
+
+  private subtotalCents(cartItems: CartItem[]): number {
+    return cartItems.reduce(
+      (sum, item) => sum + item.qty * this.toCents(item.unit_price),
+      0,
+    );
+  }
+
+  // Rounded half up to the cent
+  private computeTax(amountCents: number, rate: number): number {
+    return Math.round((amountCents * rate) / 10000);
   }
 
-  private computeShipping(subtotal: number, itemCount: number): number {
-    if (subtotal > 100) return 0;
-    return 5.99 + (itemCount - 1) * 0.99;
+  private computeShipping(
+    method: string,
+    subtotalCents: number,
+    units: number,
+  ): number {
+    const tier = this.shippingTiers[method];
+    if (tier.freeOver && subtotalCents > tier.freeOver) return 0;
+    return tier.base + (units - 1) * tier.perItem;
   }
 
   private async createOrder(
@@ -302,14 +414,29 @@ export class CheckoutService {
     subtotal: number,
     discount: number,
     tax: number,
+    taxRate: number,
     shipping: number,
+    shippingMethod: string,
     total: number,
+    paymentRef: string,
   ): Promise<string> {
     const result = await client.query<{ id: string }>(
-      `INSERT INTO orders(id, user_id, status, subtotal, discount, tax, shipping, total, created_at)
-       VALUES($1, $2, 'pending', $3, $4, $5, $6, $7, NOW())
+      `INSERT INTO orders(id, order_number, user_id, status, subtotal, discount, tax, tax_rate, shipping, shipping_method, total, payment_ref, created_at)
+       VALUES($1, 'ORD-' || to_char(NOW() AT TIME ZONE 'UTC', 'YYYY') || '-' || lpad(nextval('order_number_seq')::text, 9, '0'),
+         $2, 'pending', $3, $4, $5, $6, $7, $8, $9, $10, NOW())
        RETURNING id`,
-      [uuidv4(), userId, subtotal, discount, tax, shipping, total],
+      [
+        uuidv4(),
+        userId,
+        subtotal,
+        discount,
+        tax,
+        taxRate,
+        shipping,
+        shippingMethod,
+        total,
+        paymentRef,
+      ],
     );
     return result.rows[0].id;
   }
@@ -342,6 +469,27 @@ export class CheckoutService {
     );
   }
 
+  // What the Go service's reservation sweeper gives back if the order is
+  // still pending once they expire, after its default RESERVATION_TTL
+  private async recordReservations(
+    client: PoolClient,
+    orderId: string,
+    cartItems: CartItem[],
+    warehouseId: string,
+  ): Promise<void> {
+    await client.query(
+      `INSERT INTO inventory_reservations(order_id, product_id, warehouse_id, qty, created_at, expires_at)
+       SELECT $1, t.product_id, $2, t.qty, NOW(), NOW() + INTERVAL '15 minutes'
+       FROM unnest($3::uuid[], $4::int[]) AS t(product_id, qty)`,
+      [
+        orderId,
+        warehouseId,
+        cartItems.map((item) => item.product_id),
+        cartItems.map((item) => item.qty),
+      ],
+    );
+  }
+
   private async postCommitRedisOps(
     userId: string,
     orderId: string,
@@ -349,16 +497,35 @@ export class CheckoutService {
   ): Promise<void> {
     const pipeline = this.redis.pipeline();
 
-    // Scan and delete user summary cache keys (simplified - in production use SCAN)
-    const keys = await this.redis.keys(`cache:user:${userId}:summary:*`);
-    if (keys.length > 0) {
-      pipeline.del(...keys);
-    }
+    // Delete user summary cache keys. SCAN walks the keyspace 500 keys
+    // per call instead of blocking Redis the way KEYS does.
+    let cursor = '0';
+    do {
+      const [next, keys] = await this.redis.scan(
+        cursor,
+        'MATCH',
+        `cache:user:${userId}:summary:*`,
+        'COUNT',
+        500,
+      );
+      if (keys.length > 0) {
+        pipeline.del(...keys);
+      }
+      cursor = next;
+    } while (cursor !== '0');
 
+    // Daily leaderboards back the Go service's ?window= views
+    const dayStart = new Date();
+    dayStart.setUTCHours(0, 0, 0, 0);
+    const dayKey = `leaderboard:top_buyers:${dayStart.toISOString().slice(0, 10)}`;
     pipeline.zincrby('leaderboard:top_buyers', total, userId);
+    pipeline.zincrby(dayKey, total, userId);
+    pipeline.expireat(dayKey, Math.floor(dayStart.getTime() / 1000) + 41 * 86400);
     pipeline.xadd(
       'stream:order_events',
       '*',
+      'type',
+      'ORDER_CREATED',
       'userId',
       userId,
       'orderId',